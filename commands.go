@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+)
+
+// newPoolSizingCommand - reports whether the configured pools could hold a target number of services
+func newPoolSizingCommand() *cobra.Command {
+	var kubeconfig, namespace, configMap, keyPrefix string
+	var target int
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "pool-sizing",
+		Short: "Report whether the configured pools have the capacity for a target number of services",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := provider.NewKubeClient(kubeconfig)
+			if err != nil {
+				return err
+			}
+			sizing, err := provider.PoolSizingReport(context.Background(), client, namespace, configMap, keyPrefix, target)
+			if err != nil {
+				return err
+			}
+			return provider.WritePoolSizing(os.Stdout, sizing, asJSON)
+		},
+	}
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig, the in-cluster configuration is used if empty")
+	cmd.Flags().StringVar(&namespace, "namespace", "kube-system", "Namespace of the kube-vip config map")
+	cmd.Flags().StringVar(&configMap, "config-map", provider.KubeVipCloudConfig, "Name of the kube-vip config map")
+	cmd.Flags().StringVar(&keyPrefix, "key-prefix", "", "Prefix of the cidr and range keys in the config map")
+	cmd.Flags().IntVar(&target, "target", 0, "Projected number of services allocated from each pool")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Output the report as JSON instead of a table")
+	return cmd
+}
+
+// newMigrateLoadBalancerIPsCommand - copies the spec.loadBalancerIP of every load balancer service into the annotation
+func newMigrateLoadBalancerIPsCommand() *cobra.Command {
+	var kubeconfig string
+	var dryRun, confirm, asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "migrate-loadbalancer-ips",
+		Short: "Record the spec.loadBalancerIP of every load balancer service in the " + provider.LoadBalancerIPsAnnotation + " annotation",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Updating every service in the cluster has to be asked for
+			if !dryRun && !confirm {
+				return errors.New("services are only updated with --confirm, use --dry-run to list them")
+			}
+			client, err := provider.NewKubeClient(kubeconfig)
+			if err != nil {
+				return err
+			}
+			migrations, err := provider.MigrateLoadBalancerIPs(context.Background(), client, dryRun)
+			if writeErr := provider.WriteMigrations(os.Stdout, migrations, asJSON); writeErr != nil && err == nil {
+				err = writeErr
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig, the in-cluster configuration is used if empty")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List the services that would be migrated without updating them")
+	cmd.Flags().BoolVar(&confirm, "confirm", false, "Update the services")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Output the migrated services as JSON instead of a table")
+	return cmd
+}
@@ -20,8 +20,10 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/component-base/logs"
 	"k8s.io/kubernetes/cmd/cloud-controller-manager/app"
@@ -32,6 +34,7 @@ import (
 	_ "k8s.io/component-base/metrics/prometheus/clientgo" // load all the prometheus client-go plugins
 	_ "k8s.io/kubernetes/pkg/cloudprovider/providers"
 
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
 )
 
@@ -39,8 +42,65 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	command := app.NewCloudControllerManagerCommand()
+	command.AddCommand(newPoolSizingCommand())
+	command.AddCommand(newMigrateLoadBalancerIPsCommand())
 
 	command.Flags().BoolVar(&provider.OutSideCluster, "OutSideCluster", false, "Start Controller outside of cluster")
+	command.Flags().BoolVar(&provider.Paused, "paused", false, "Pause allocation and release, services that have an address are left untouched")
+	command.Flags().BoolVar(&provider.ObserveOnly, "observe-only", false, "Report the addresses of services without allocating or modifying them")
+	command.Flags().StringVar(&provider.DebugAddress, "debug-address", "", "Address to serve the debug endpoint on, i.e. :8081 (disabled if empty)")
+	command.Flags().StringVar(&provider.TextfilePath, "textfile-path", "", "File the pool usage and allocations are written to for the node-exporter textfile collector, i.e. /var/lib/node_exporter/kube-vip.prom (disabled if empty)")
+	command.Flags().DurationVar(&provider.TextfileInterval, "textfile-interval", provider.TextfileInterval, "How often the textfile is written")
+	command.Flags().StringVar(&provider.ReservationsURL, "reservations-url", "", "An endpoint returning the addresses, cidrs and ranges reserved by an external IPAM, they are never allocated")
+	command.Flags().DurationVar(&provider.ReservationsInterval, "reservations-interval", time.Minute, "How often the external reservations are fetched")
+	command.Flags().DurationVar(&provider.TerminatingGracePeriod, "reclaim-terminating-after", 0, "Reclaim the address of a service that has been terminating for longer than this, i.e. its finalizer is never removed (disabled if 0)")
+	command.Flags().DurationVar(&provider.SummaryInterval, "summary-interval", 0, "How often a summary of the allocations, pool capacity and pending services is logged (disabled if 0)")
+	command.Flags().StringVar(&provider.KeyPrefix, "key-prefix", "", "Prefix of the cidr and range keys in the config map, i.e. kv- to use kv-cidr-<namespace>")
+	command.Flags().StringVar(&provider.APIAddress, "api-address", "", "Address to serve the allocation API on, i.e. :8443 (disabled if empty)")
+	command.Flags().StringVar(&provider.APITokenFile, "api-token-file", "", "File containing the bearer token that allocation API clients must present")
+	command.Flags().StringVar(&provider.APITLSCert, "api-tls-cert", "", "Certificate to serve the allocation API with (required, the API is only served over TLS)")
+	command.Flags().StringVar(&provider.APITLSKey, "api-tls-key", "", "Key of the allocation API certificate")
+	command.Flags().StringVar(&provider.APIClientCA, "api-client-ca", "", "CA that allocation API client certificates must be signed by")
+	command.Flags().StringVar(&provider.WebhookAddress, "webhook-address", "", "Address to serve the configmap validating webhook on, i.e. :9443 (disabled if empty)")
+	command.Flags().StringVar(&provider.WebhookTLSCert, "webhook-tls-cert", "", "Certificate to serve the validating webhook with")
+	command.Flags().StringVar(&provider.WebhookTLSKey, "webhook-tls-key", "", "Key of the validating webhook certificate")
+	command.Flags().StringVar(&provider.CompatAnnotation, "compat-annotation", "", "Annotation of another load balancer that also records the allocated address, i.e. metallb.universe.tf/loadBalancerIPs (disabled if empty)")
+	command.Flags().StringSliceVar(&provider.WatchedNamespaces, "watched-namespaces", nil, "Comma separated list of namespaces whose services are reconciled, all namespaces if empty")
+	command.Flags().BoolVar(&provider.RequireManagedAnnotation, "require-managed-annotation", false, "Only manage services with the kube-vip.io/managed: \"true\" annotation")
+	command.Flags().BoolVar(&provider.AvoidExternalIPs, "avoid-external-ips", false, "Never allocate the spec.externalIPs of services in the watched namespaces")
+	command.Flags().BoolVar(&provider.AvoidClusterIPs, "avoid-cluster-ips", false, "Never allocate the spec.clusterIP of services in the watched namespaces")
+	command.Flags().StringVar(&provider.ServiceCidr, "service-cidr", "", "Service network of the cluster (the --service-cluster-ip-range of the kube-apiserver), the cidr-from-service-offset pool is derived from it")
+	command.Flags().StringVar(&provider.InstanceID, "instance-id", "", "Instance of the provider stamped on the services it allocates (kube-vip.io/owned-by), the hostname if empty")
+	command.Flags().BoolVar(&provider.EnforceOwnership, "enforce-ownership", false, "Leave services owned by another instance of the provider untouched")
+	command.Flags().DurationVar(&provider.ResyncInterval, "resync-interval", 0, "How often every service is reconciled by the provider, services reconciled within the interval are skipped (0 disables the resync)")
+	command.Flags().BoolVar(&provider.ReserveStaticAddresses, "reserve-static-addresses", provider.ReserveStaticAddresses, "Never allocate the spec.loadBalancerIP requested by a service to another service, even before the request has been reconciled")
+	command.Flags().IntVar(&ipam.MaxPoolSize, "max-pool-size", ipam.MaxPoolSize, "Largest number of addresses in a pool, larger pools are refused rather than scanned (0 disables the limit)")
+	command.Flags().BoolVar(&provider.WarmPools, "warm-pools", false, "Cache the free addresses of every pool at startup, instead of scanning a pool for each allocation")
+	command.Flags().DurationVar(&provider.ScanTimeout, "scan-timeout", 0, "Maximum time a scan of a cidr pool for a free address can take, the service is requeued and the scan resumed (0 disables the timeout)")
+	command.Flags().DurationVar(&provider.ReconcileTimeout, "reconcile-timeout", provider.ReconcileTimeout, "Maximum time a single service sync can take, 0 disables the timeout")
+	command.Flags().DurationVar(&provider.SnapshotInterval, "snapshot-interval", 0, "How often the allocations are written to the kubevip-allocation-snapshot configmap, services are given their snapshotted address when it is free (0 disables snapshots)")
+	command.Flags().DurationVar(&provider.SnapshotRetention, "snapshot-retention", provider.SnapshotRetention, "How long the snapshot keeps the address of a service that has none, i.e. one not recreated yet after a restore")
+	command.Flags().IntVar(&provider.AllocationHistoryLength, "allocation-history-length", 0, "Number of allocation events kept in the kube-vip.io/allocation-history annotation, 0 disables the annotation")
+	command.Flags().BoolVar(&provider.AllocationAudit, "allocation-audit", false, "Record every allocation as an IPAllocation object (requires manifest/ipallocation-crd.yaml)")
+	command.Flags().StringVar(&provider.AuditChannelDir, "audit-channel-dir", "", "A directory that the allocations and releases of each audit channel (audit-channel-<pool> in the configmap) are appended to, as <channel>.log")
+	command.Flags().BoolVar(&provider.VerifyAllocation, "verify-allocation", false, "Re-read a service after allocating, and retry if the allocation was not applied (i.e. removed by a webhook)")
+	command.Flags().StringVar(&provider.ForeignIngressPolicy, "foreign-ingress-policy", provider.ForeignIngressPolicy, "How a service with an ingress address from another controller is handled, one of allocate, adopt or skip")
+	command.Flags().StringVar(&provider.StaticConflictPolicy, "static-conflict-policy", provider.StaticConflictPolicy, "How a service requesting an address allocated to another service is handled, one of protect-dynamic or yield-dynamic")
+	command.Flags().StringVar(&provider.NodeSubnetPolicy, "node-subnet-policy", provider.NodeSubnetPolicy, "How a spec.loadBalancerIP that isn't in a subnet of the nodes is handled, one of ignore, warn or strict")
+	command.Flags().IntVar(&provider.NodeSubnetPrefix, "node-subnet-prefix", provider.NodeSubnetPrefix, "Prefix length of the subnet inferred from each IPv4 node address, IPv6 node subnets are /64")
+	command.Flags().StringVar(&provider.NodeAddressPolicy, "node-address-policy", provider.NodeAddressPolicy, "How an allocated address that is the internal or external address of a node is handled, one of ignore, warn or avoid")
+	command.Flags().StringVar(&provider.DriftPolicy, "drift-policy", provider.DriftPolicy, "How a service whose spec.loadBalancerIP no longer matches its allocated address is handled, one of restore or adopt")
+	command.Flags().BoolVar(&provider.WaitForAdvertisement, "wait-for-advertisement", false, "Only set the ingress of a service once kube-vip has advertised its address (the kube-vip.io/vipHost annotation)")
+	command.Flags().BoolVar(&provider.ReserveIngress, "reserve-ingress", false, "Set the ingress of a service as soon as its address is allocated, with the kube-vip.io/advertisement-status annotation until kube-vip has advertised it")
+	command.Flags().DurationVar(&provider.AdvertisementTimeout, "advertisement-timeout", provider.AdvertisementTimeout, "How long the ingress is held back waiting for the address to be advertised, it is set anyway once the timeout has passed")
+	command.Flags().StringVar(&provider.OnAllocateURL, "on-allocate-url", "", "URL that is POSTed to after an address is allocated to a service")
+	command.Flags().StringVar(&provider.OnReleaseURL, "on-release-url", "", "URL that is POSTed to after the address of a service is released")
+	command.Flags().StringVar(&provider.HookSecret, "hook-secret", "", "Secret (<namespace>/<name>, kube-system if there is no namespace) with the token and headers the allocate/release hooks are sent with")
+	command.Flags().BoolVar(&provider.HookBlocking, "hook-blocking", false, "Fail the reconcile when an allocate/release hook can't be delivered")
+	command.Flags().IntVar(&provider.Concurrency, "concurrency", provider.Concurrency, "Number of services reconciled at once, sets --concurrent-service-syncs unless it is also set")
+	command.Flags().BoolVar(&provider.EventDeduplication, "event-deduplication", provider.EventDeduplication, "Only emit an IPAM event for a service when its reason changes, rather than on every reconcile")
+	command.Flags().DurationVar(&provider.EventRepeatInterval, "event-repeat-interval", 0, "How long until an unchanged IPAM event is emitted again, 0 never repeats it")
+	command.Flags().IntVar(&provider.HookRetries, "hook-retries", provider.HookRetries, "Number of attempts made to deliver an allocate/release hook")
 
 	// Set static flags for which we know the values.
 	command.Flags().VisitAll(func(fl *pflag.Flag) {
@@ -69,6 +129,14 @@ func main() {
 		}
 	})
 
+	// The service controller syncs --concurrency services at once, unless its own flag is set
+	command.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("concurrency") && !cmd.Flags().Changed("concurrent-service-syncs") {
+			return cmd.Flags().Set("concurrent-service-syncs", strconv.Itoa(provider.Concurrency))
+		}
+		return nil
+	}
+
 	// TODO: once we switch everything over to Cobra commands, we can go back to calling
 	// utilflag.InitFlags() (by removing its pflag.Parse() call). For now, we have to set the
 	// normalize func and add the go flag set by hand.
@@ -0,0 +1,162 @@
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// MaxPoolSize - is the largest number of addresses that a pool is built from, as every address may be scanned, i.e.
+// a /8 typed instead of a /28 is refused rather than scanned. Zero disables the limit
+var MaxPoolSize = 1 << 16
+
+// ErrInvalidCidr is returned when a cidr in a pool can't be parsed
+var ErrInvalidCidr = errors.New("invalid cidr")
+
+// ErrInvalidRange is returned when a range in a pool can't be parsed
+var ErrInvalidRange = errors.New("invalid range")
+
+// ErrRangeReversed is returned when the start of a range is after its end, it is also an ErrInvalidRange
+var ErrRangeReversed = fmt.Errorf("%w, its start is after its end", ErrInvalidRange)
+
+// ErrPoolTooLarge is returned when a pool has more addresses than the MaxPoolSize
+var ErrPoolTooLarge = errors.New("pool is larger than the size limit")
+
+// Bounds - is the first and last address of a cidr or range
+type Bounds struct {
+	First net.IP
+	Last  net.IP
+}
+
+// Overlaps - returns true if any address is in both bounds
+func (b Bounds) Overlaps(o Bounds) bool {
+	return bytes.Compare(b.First.To16(), o.Last.To16()) <= 0 && bytes.Compare(o.First.To16(), b.Last.To16()) <= 0
+}
+
+// Contains - returns true if the address is within the bounds
+func (b Bounds) Contains(ip net.IP) bool {
+	return bytes.Compare(b.First.To16(), ip.To16()) <= 0 && bytes.Compare(ip.To16(), b.Last.To16()) <= 0
+}
+
+func (b Bounds) String() string {
+	return fmt.Sprintf("%s-%s", b.First, b.Last)
+}
+
+// CidrBounds - returns the bounds of each of the comma separated cidrs, the bounds of a cidr with a window are the
+// bounds of its window
+func CidrBounds(cidr string) ([]Bounds, error) {
+	var bounds []Bounds
+	for _, c := range splitDefinition(cidr) {
+		_, ipnet, window, err := parseBoundedCidr(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w [%s]: %v", ErrInvalidCidr, c, err)
+		}
+		if window != nil {
+			bounds = append(bounds, *window)
+			continue
+		}
+		bounds = append(bounds, networkBounds(ipnet))
+	}
+	return bounds, nil
+}
+
+// networkBounds - returns the bounds of the whole network, from its network address to its broadcast address
+func networkBounds(ipnet *net.IPNet) Bounds {
+	last := make(net.IP, len(ipnet.IP))
+	for x := range ipnet.IP {
+		last[x] = ipnet.IP[x] | ^ipnet.Mask[x]
+	}
+	return Bounds{First: ipnet.IP, Last: last}
+}
+
+// RangeBounds - returns the bounds of each of the comma separated (IPv4) ranges
+func RangeBounds(ipRange string) ([]Bounds, error) {
+	var bounds []Bounds
+	for _, r := range splitDefinition(ipRange) {
+		ends := strings.Split(r, "-")
+		if len(ends) != 2 {
+			return nil, fmt.Errorf("%w [%s], it must be first-last", ErrInvalidRange, r)
+		}
+		first := net.ParseIP(ends[0]).To4()
+		last := net.ParseIP(ends[1]).To4()
+		if first == nil || last == nil {
+			return nil, fmt.Errorf("%w [%s], both ends must be IPv4 addresses", ErrInvalidRange, r)
+		}
+		if bytes.Compare(first, last) > 0 {
+			return nil, fmt.Errorf("%w [%s]", ErrRangeReversed, r)
+		}
+		bounds = append(bounds, Bounds{First: first, Last: last})
+	}
+	return bounds, nil
+}
+
+// IsNetworkOrBroadcast - returns true if the address is the network or broadcast address of one of the (IPv4) cidrs,
+// a /31 or /32 has neither
+func IsNetworkOrBroadcast(cidr, address string) bool {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return false
+	}
+	// The network of a cidr with a window is still the whole cidr
+	for _, c := range splitDefinition(cidr) {
+		_, ipnet, err := parseCidr(c)
+		if err != nil {
+			return false
+		}
+		b := networkBounds(ipnet)
+		first, last := b.First.To4(), b.Last.To4()
+		if first == nil || IPStr2Int(last.String())-IPStr2Int(first.String()) < 2 {
+			continue
+		}
+		if ip.Equal(first) || ip.Equal(last) {
+			return true
+		}
+	}
+	return false
+}
+
+// GatewayAddresses - returns the conventional gateway (the first host, i.e. .1) of each of the comma separated
+// cidrs, a cidr with fewer than two host bits (i.e. a /31 or /32) has no gateway
+func GatewayAddresses(cidr string) ([]string, error) {
+	var gateways []string
+	for _, c := range splitDefinition(cidr) {
+		_, ipnet, err := parseCidr(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w [%s]: %v", ErrInvalidCidr, c, err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones < 2 {
+			continue
+		}
+		gateway, err := NextAddress(ipnet.IP.String())
+		if err != nil {
+			return nil, err
+		}
+		gateways = append(gateways, gateway)
+	}
+	return gateways, nil
+}
+
+// Size - returns the number of addresses in the bounds
+func (b Bounds) Size() *big.Int {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(b.Last.To16()), new(big.Int).SetBytes(b.First.To16()))
+	return size.Add(size, big.NewInt(1))
+}
+
+// CheckPoolSize - returns an error if there are more addresses in the bounds than the MaxPoolSize
+func CheckPoolSize(bounds []Bounds) error {
+	if MaxPoolSize <= 0 {
+		return nil
+	}
+	total := new(big.Int)
+	for _, b := range bounds {
+		total.Add(total, b.Size())
+	}
+	if total.Cmp(big.NewInt(int64(MaxPoolSize))) > 0 {
+		return fmt.Errorf("%w, it has [%s] addresses and the limit is [%d]", ErrPoolTooLarge, total, MaxPoolSize)
+	}
+	return nil
+}
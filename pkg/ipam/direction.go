@@ -0,0 +1,10 @@
+package ipam
+
+// descendingAddresses - returns the addresses of the pool from the highest to the lowest
+func descendingAddresses(addresses []string) []string {
+	descending := make([]string, len(addresses))
+	for x := range addresses {
+		descending[len(addresses)-1-x] = addresses[x]
+	}
+	return descending
+}
@@ -0,0 +1,31 @@
+package ipam
+
+import "strings"
+
+const (
+	//FamilyIPv4 is the family of IPv4 cidrs, ranges and addresses
+	FamilyIPv4 = "IPv4"
+
+	//FamilyIPv6 is the family of IPv6 cidrs, ranges and addresses
+	FamilyIPv6 = "IPv6"
+)
+
+// entryFamily - returns the family of a cidr, range or address entry of a pool, only IPv6 entries contain a colon
+func entryFamily(entry string) string {
+	if strings.Contains(entry, ":") {
+		return FamilyIPv6
+	}
+	return FamilyIPv4
+}
+
+// FilterFamily - returns the comma separated cidrs, ranges or addresses of the definition that are of the family,
+// ok is false if none are
+func FilterFamily(definition, family string) (filtered string, ok bool) {
+	var entries []string
+	for _, entry := range splitDefinition(definition) {
+		if entryFamily(entry) == family {
+			entries = append(entries, entry)
+		}
+	}
+	return strings.Join(entries, ","), len(entries) != 0
+}
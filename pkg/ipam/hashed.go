@@ -0,0 +1,77 @@
+package ipam
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// HashProbes is the number of addresses after the hashed address that are tried when it is already in use
+var HashProbes = 64
+
+// ipv6Cidrs returns the networks of the comma separated cidrs, ok is false unless every cidr is IPv6 (without a window)
+func ipv6Cidrs(cidr string) (networks []*net.IPNet, ok bool) {
+	for _, c := range splitDefinition(cidr) {
+		_, ipnet, window, err := parseBoundedCidr(c)
+		if err != nil || ipnet.IP.To4() != nil || window != nil {
+			return nil, false
+		}
+		networks = append(networks, ipnet)
+	}
+	return networks, len(networks) != 0
+}
+
+// hashedHost - derives the address from a hash of the key in the host portion of the first network that has one
+// free, an address that is in use is followed by probing the next HashProbes addresses
+func hashedHost(networks []*net.IPNet, key string, existingServiceIPS []string) (string, bool) {
+	inUse := make(map[string]bool, len(existingServiceIPS))
+	for x := range existingServiceIPS {
+		inUse[existingServiceIPS[x]] = true
+	}
+	sum := sha256.Sum256([]byte(key))
+
+	for _, network := range networks {
+		ones, bits := network.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		base := new(big.Int).SetBytes(network.IP.To16())
+		host := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), size)
+
+		probes := big.NewInt(int64(HashProbes))
+		if size.Cmp(probes) < 0 {
+			probes = size
+		}
+		for i := int64(0); i < probes.Int64(); i++ {
+			// The all zeros host is the subnet-router anycast address
+			if host.Sign() != 0 {
+				address := net.IP(new(big.Int).Add(base, host).FillBytes(make([]byte, net.IPv6len))).String()
+				if !inUse[address] {
+					return address, true
+				}
+			}
+			host.Add(host, big.NewInt(1))
+			host.Mod(host, size)
+		}
+	}
+	return "", false
+}
+
+// Hashable - returns true if the comma separated cidrs have hashed addresses, every cidr must be IPv6 without a window
+func Hashable(cidr string) bool {
+	_, ok := ipv6Cidrs(cidr)
+	return ok
+}
+
+// FindHashedHostFromCidr - derives the address for the key (i.e. namespace/name of the service) from a hash, so the
+// same key is always given the same address unless it is in use. Only IPv6 cidrs have a hashed address, ok is
+// false for a cidr that isn't entirely IPv6
+func FindHashedHostFromCidr(cidr, key string, existingServiceIPS []string) (address string, ok bool, err error) {
+	networks, ok := ipv6Cidrs(cidr)
+	if !ok {
+		return "", false, nil
+	}
+	if address, found := hashedHost(networks, key, existingServiceIPS); found {
+		return address, true, nil
+	}
+	return "", true, fmt.Errorf("%w for [%s] in cidr [%s] after [%d] probes", ErrNoAddressesAvailable, key, cidr, HashProbes)
+}
@@ -1,16 +1,42 @@
 package ipam
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/klog"
 )
 
+// Log levels follow the provider, V(2) for allocation decisions and V(4) for building pools and scanning candidates
+
+// ErrNoAddressesAvailable is returned when every address in a pool is in use
+var ErrNoAddressesAvailable = errors.New("no addresses available")
+
+// ErrScanTimeout is returned when a pool couldn't be scanned for a free address within the deadline, the scan is
+// resumed from where it stopped by the next allocation from the pool
+var ErrScanTimeout = errors.New("scan timed out")
+
+// scanDeadlineInterval is the number of candidates examined between checks of the deadline
+const scanDeadlineInterval = 1024
+
+// scanResume is the index in each pool that a scan stopped at by its deadline will resume from
+var scanResume = make(map[string]int)
+
+// ScanObserver - is called with the number of addresses examined by every scan of a pool, found is false if the pool
+// was exhausted, i.e. to export the scan count as a metric
+var ScanObserver func(scanned int, found bool)
+
 // Manager - handles the addresses for each namespace/vip
 var Manager []ipManager
 
+// managerLock protects the Manager, as allocations in different namespaces can happen concurrently
+var managerLock sync.Mutex
+
 // ipManager defines the mapping to a namespace and address pool
 type ipManager struct {
 	// Identifies the manager
@@ -24,15 +50,50 @@ type ipManager struct {
 	addresses []string
 }
 
+// Options - changes how a free address is chosen from a pool
+type Options struct {
+	// StartOffset is the index of the first address that is tried, the search wraps around to the start of the pool
+	StartOffset int
+
+	// HashKey derives the address from a hash of the key instead of scanning the pool, this only applies to a
+	// pool of IPv6 cidrs as they are too large to scan
+	HashKey string
+
+	// Deadline stops the scan of the pool with ErrScanTimeout once it has passed, the zero time never stops it
+	Deadline time.Time
+
+	// Parity prefers the addresses whose last octet is even or odd (ParityEven or ParityOdd), any address is
+	// allocated once none of them are free. A warm pool isn't used when a parity is set
+	Parity string
+
+	// Descending scans the pool from its highest address down, the start offset is counted from the highest
+	// address. A warm pool isn't used when the scan is descending
+	Descending bool
+}
+
 // FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
 func FindAvailableHostFromRange(namespace, ipRange string, existingServiceIPS []string) (string, error) {
+	return FindAvailableHostFromRangeWithOptions(namespace, ipRange, existingServiceIPS, Options{})
+}
+
+// FindAvailableHostFromRangeWithOptions - is FindAvailableHostFromRange choosing the address with the options, the
+// HashKey only applies to a cidr
+func FindAvailableHostFromRangeWithOptions(namespace, ipRange string, existingServiceIPS []string, options Options) (string, error) {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	if options.Parity == "" && !options.Descending {
+		if address, warm, err := warmTake("range", ipRange, existingServiceIPS, options.StartOffset); warm {
+			return address, err
+		}
+	}
 
 	// Look through namespaces and update one if it exists
 	for x := range Manager {
 		if Manager[x].namespace == namespace {
 			// Check that the address range is the same
 			if Manager[x].ipRange != ipRange {
-				klog.Infof("Updating IP address range from [%s] to [%s]", Manager[x].ipRange, ipRange)
+				klog.V(2).Infof("Updating IP address range from [%s] to [%s]", Manager[x].ipRange, ipRange)
 
 				// If not rebuild the available hosts
 				ah, err := buildAddressesFromRange(ipRange)
@@ -43,21 +104,15 @@ func FindAvailableHostFromRange(namespace, ipRange string, existingServiceIPS []
 				Manager[x].ipRange = ipRange
 			}
 
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].addresses {
-				found := false
-				for z := range existingServiceIPS {
-					if Manager[x].addresses[y] == existingServiceIPS[z] {
-						found = true
-					}
-				}
-				if !found {
-					return Manager[x].addresses[y], nil
-
-				}
+			address, ok, err := scanPool(ipRange, Manager[x].addresses, existingServiceIPS, options)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return address, nil
 			}
 			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("no addresses available in [%s] range [%s]", namespace, ipRange)
+			return "", fmt.Errorf("%w in [%s] range [%s]", ErrNoAddressesAvailable, namespace, ipRange)
 
 		}
 	}
@@ -72,26 +127,41 @@ func FindAvailableHostFromRange(namespace, ipRange string, existingServiceIPS []
 		ipRange:   ipRange,
 	}
 	Manager = append(Manager, newManager)
-	// TODO - currently we search (incrementally) through the list of hosts
-	for y := range newManager.addresses {
-		found := false
-		for z := range existingServiceIPS {
-			if newManager.addresses[y] == existingServiceIPS[z] {
-				found = true
-			}
-		}
-		if !found {
-			return newManager.addresses[y], nil
-
-		}
+	address, ok, err := scanPool(ipRange, newManager.addresses, existingServiceIPS, options)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return address, nil
 	}
 
-	return "", fmt.Errorf("no addresses available in [%s] range [%s]", namespace, ipRange)
+	return "", fmt.Errorf("%w in [%s] range [%s]", ErrNoAddressesAvailable, namespace, ipRange)
 
 }
 
 // FindAvailableHostFromCidr - will look through the cidr and the address Manager and find a free address (if possible)
 func FindAvailableHostFromCidr(namespace, cidr string, existingServiceIPS []string) (string, error) {
+	return FindAvailableHostFromCidrWithOptions(namespace, cidr, existingServiceIPS, Options{})
+}
+
+// FindAvailableHostFromCidrWithOptions - is FindAvailableHostFromCidr choosing the address with the options
+func FindAvailableHostFromCidrWithOptions(namespace, cidr string, existingServiceIPS []string, options Options) (string, error) {
+	if options.HashKey != "" {
+		if address, hashed, err := FindHashedHostFromCidr(cidr, options.HashKey, existingServiceIPS); hashed {
+			return address, err
+		}
+		// The config map validation reports the pool, it isn't logged for every allocation
+		klog.V(2).Infof("cidr [%s] isn't IPv6 (or has a window), scanning it instead of hashing", cidr)
+	}
+
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	if options.Parity == "" && !options.Descending {
+		if address, warm, err := warmTake("cidr", cidr, existingServiceIPS, options.StartOffset); warm {
+			return address, err
+		}
+	}
 
 	// Look through namespaces and update one if it exists
 	for x := range Manager {
@@ -107,21 +177,15 @@ func FindAvailableHostFromCidr(namespace, cidr string, existingServiceIPS []stri
 				Manager[x].cidr = cidr
 
 			}
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].addresses {
-				found := false
-				for z := range existingServiceIPS {
-					if Manager[x].addresses[y] == existingServiceIPS[z] {
-						found = true
-					}
-				}
-				if !found {
-					return Manager[x].addresses[y], nil
-
-				}
+			address, ok, err := scanPool(cidr, Manager[x].addresses, existingServiceIPS, options)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return address, nil
 			}
 			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("no addresses available in [%s] range [%s]", namespace, cidr)
+			return "", fmt.Errorf("%w in [%s] range [%s]", ErrNoAddressesAvailable, namespace, cidr)
 
 		}
 	}
@@ -137,21 +201,79 @@ func FindAvailableHostFromCidr(namespace, cidr string, existingServiceIPS []stri
 	}
 	Manager = append(Manager, newManager)
 
+	address, ok, err := scanPool(cidr, newManager.addresses, existingServiceIPS, options)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return address, nil
+	}
+	return "", fmt.Errorf("%w in [%s] range [%s]", ErrNoAddressesAvailable, namespace, cidr)
+
+}
+
+// firstAvailable - returns the first address of the pool that isn't in use, starting from the offset and wrapping around
+func firstAvailable(pool string, addresses, existingServiceIPS []string, offset int) (string, bool) {
+	address, ok, _ := firstAvailableBefore(pool, addresses, existingServiceIPS, offset, time.Time{})
+	return address, ok
+}
+
+// firstAvailableBefore - is firstAvailable stopped with ErrScanTimeout once the deadline (if set) has passed, a scan
+// that was stopped resumes from the address it stopped at. With a deadline the caller must hold the managerLock
+func firstAvailableBefore(pool string, addresses, existingServiceIPS []string, offset int, deadline time.Time) (string, bool, error) {
+	if len(addresses) == 0 {
+		reportScan(pool, 0, "")
+		return "", false, nil
+	}
+	inUse := make(map[string]bool, len(existingServiceIPS))
+	for x := range existingServiceIPS {
+		inUse[existingServiceIPS[x]] = true
+	}
+	start := offset % len(addresses)
+	if start < 0 {
+		start += len(addresses)
+	}
+	// The addresses before a stopped scan were in use, so the scan carries on from there
+	if !deadline.IsZero() {
+		if resume, ok := scanResume[pool]; ok && resume < len(addresses) {
+			start = resume
+		}
+		delete(scanResume, pool)
+	}
 	// TODO - currently we search (incrementally) through the list of hosts
-	for y := range newManager.addresses {
-		found := false
-		for z := range existingServiceIPS {
-			if newManager.addresses[y] == existingServiceIPS[z] {
-				found = true
-			}
+	for y := range addresses {
+		if !deadline.IsZero() && y > 0 && y%scanDeadlineInterval == 0 && time.Now().After(deadline) {
+			scanResume[pool] = (start + y) % len(addresses)
+			reportScan(pool, y, "")
+			return "", false, fmt.Errorf("%w after [%d] of [%d] addresses in pool [%s]", ErrScanTimeout, y, len(addresses), pool)
 		}
-		if !found {
-			return newManager.addresses[y], nil
-
+		address := addresses[(start+y)%len(addresses)]
+		if !inUse[address] {
+			reportScan(pool, y+1, address)
+			return address, true, nil
+		}
+		// Only build the message when it will be logged, this is called for every candidate
+		if klog.V(4) {
+			klog.Infof("address [%s] is in use", address)
 		}
 	}
-	return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, cidr)
+	reportScan(pool, len(addresses), "")
+	return "", false, nil
+}
 
+// reportScan - logs the number of addresses examined in the pool, address is empty if the pool was exhausted
+func reportScan(pool string, scanned int, address string) {
+	if ScanObserver != nil {
+		ScanObserver(scanned, address != "")
+	}
+	if !klog.V(4) {
+		return
+	}
+	if address == "" {
+		klog.Infof("scanned [%d] addresses in pool [%s], none are free", scanned, pool)
+		return
+	}
+	klog.Infof("scanned [%d] addresses in pool [%s] to find [%s]", scanned, pool, address)
 }
 
 // // RenewAddress - removes the mark on an address
@@ -180,36 +302,259 @@ func buildHostsFromCidr(cidr string) ([]string, error) {
 	var ips []string
 
 	// Split the ipranges (comma separated)
-	cidrs := strings.Split(cidr, ",")
+	cidrs := splitDefinition(cidr)
 	if len(cidrs) == 0 {
 		return nil, fmt.Errorf("Unable to parse IP cidrs [%s]", cidr)
 	}
 
+	// Refuse to build a pool that is too large to scan
+	if bounds, err := CidrBounds(cidr); err == nil {
+		if err := CheckPoolSize(bounds); err != nil {
+			return nil, fmt.Errorf("cidr [%s]: %w", cidr, err)
+		}
+	}
+
 	for x := range cidrs {
 
-		ip, ipnet, err := net.ParseCIDR(cidrs[x])
+		ip, ipnet, window, err := parseBoundedCidr(cidrs[x])
 		if err != nil {
 			return nil, err
 		}
 
+		// Only the addresses within the window are allocated, the network and broadcast are still removed
+		if window != nil {
+			ips = append(ips, windowHosts(ipnet, *window)...)
+			continue
+		}
+
 		var cidrips []string
 		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
 			cidrips = append(cidrips, ip.String())
 		}
 
-		// remove network address and broadcast address
-		lenIPs := len(cidrips)
-		switch {
-		case lenIPs < 2:
+		// remove the network and broadcast address of the cidr, whatever their last octet, i.e. the .255 in the
+		// lower half of a /23 is a host. A /31 or /32 has neither
+		if ones, bits := ipnet.Mask.Size(); bits-ones < 2 {
 			ips = append(ips, cidrips...)
-
-		default:
-			ips = append(ips, cidrips[1:len(cidrips)-1]...)
+			continue
 		}
+		ips = append(ips, cidrips[1:len(cidrips)-1]...)
 	}
 	return removeDuplicateAddresses(ips), nil
 }
 
+// splitDefinition - splits the comma separated cidrs or ranges of a pool, whitespace (i.e. "192.168.0.10 - 192.168.0.20")
+// and empty entries are dropped and an entry that is repeated is only returned once
+func splitDefinition(definition string) []string {
+	var entries []string
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(definition, ",") {
+		entry = strings.Join(strings.Fields(entry), "")
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parseCidr - parses a cidr in prefix form (192.168.0.0/24) or with a dotted-decimal mask (192.168.0.0/255.255.255.0),
+// the window of a bounded cidr (192.168.0.0/24[192.168.0.50-192.168.0.100]) is ignored
+func parseCidr(cidr string) (net.IP, *net.IPNet, error) {
+	if i := strings.Index(cidr, "["); i != -1 {
+		cidr = cidr[:i]
+	}
+	address := strings.Split(cidr, "/")
+	if len(address) == 2 && strings.Contains(address[1], ".") {
+		mask := net.ParseIP(address[1]).To4()
+		if mask == nil {
+			return nil, nil, fmt.Errorf("unable to parse netmask [%s] in cidr [%s]", address[1], cidr)
+		}
+		// Size returns 0, 0 for a non-contiguous mask
+		ones, bits := net.IPMask(mask).Size()
+		if bits == 0 {
+			return nil, nil, fmt.Errorf("netmask [%s] in cidr [%s] is not contiguous", address[1], cidr)
+		}
+		cidr = fmt.Sprintf("%s/%d", address[0], ones)
+	}
+	return net.ParseCIDR(cidr)
+}
+
+// parseBoundedCidr - parses a cidr with an optional window of first-last addresses in brackets, i.e.
+// 192.168.0.0/24[192.168.0.50-192.168.0.100], window is nil unless the cidr has one. The window must lie within the cidr
+func parseBoundedCidr(cidr string) (net.IP, *net.IPNet, *Bounds, error) {
+	ip, ipnet, err := parseCidr(cidr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	i := strings.Index(cidr, "[")
+	if i == -1 {
+		return ip, ipnet, nil, nil
+	}
+	if !strings.HasSuffix(cidr, "]") {
+		return nil, nil, nil, fmt.Errorf("window of cidr [%s] must end with ]", cidr)
+	}
+	ends := strings.Split(cidr[i+1:len(cidr)-1], "-")
+	if len(ends) != 2 {
+		return nil, nil, nil, fmt.Errorf("window of cidr [%s] must be first-last", cidr)
+	}
+	first, last := net.ParseIP(ends[0]), net.ParseIP(ends[1])
+	if first == nil || last == nil {
+		return nil, nil, nil, fmt.Errorf("unable to parse the window of cidr [%s]", cidr)
+	}
+	if !ipnet.Contains(first) || !ipnet.Contains(last) {
+		return nil, nil, nil, fmt.Errorf("window of cidr [%s] isn't within [%s]", cidr, ipnet)
+	}
+	// The window is in the same form as the network, so that the addresses can be compared
+	if ipnet.IP.To4() != nil {
+		first, last = first.To4(), last.To4()
+	}
+	if bytes.Compare(first, last) > 0 {
+		return nil, nil, nil, fmt.Errorf("window of cidr [%s] starts after its end", cidr)
+	}
+	return ip, ipnet, &Bounds{First: first, Last: last}, nil
+}
+
+// windowHosts - returns the addresses of the window, without the network and broadcast addresses of the cidr
+func windowHosts(ipnet *net.IPNet, window Bounds) []string {
+	network := ipnet.IP.Mask(ipnet.Mask)
+	broadcast := make(net.IP, len(network))
+	for x := range network {
+		broadcast[x] = network[x] | ^ipnet.Mask[x]
+	}
+	ones, bits := ipnet.Mask.Size()
+
+	var hosts []string
+	ip := make(net.IP, len(window.First))
+	copy(ip, window.First)
+	for {
+		if bits-ones < 2 || (!ip.Equal(network) && !ip.Equal(broadcast)) {
+			hosts = append(hosts, ip.String())
+		}
+		if ip.Equal(window.Last) {
+			return hosts
+		}
+		inc(ip)
+	}
+}
+
+// PreferCidr - reorders the comma separated cidrs so that the preferred cidr is first, an error is
+// returned if the preferred cidr isn't one of the cidrs
+func PreferCidr(cidr, preferred string) (string, error) {
+	_, preferredNet, err := parseCidr(strings.TrimSpace(preferred))
+	if err != nil {
+		return "", err
+	}
+	cidrs := splitDefinition(cidr)
+	for x := range cidrs {
+		_, ipnet, err := parseCidr(cidrs[x])
+		if err != nil {
+			return "", err
+		}
+		if ipnet.String() == preferredNet.String() {
+			ordered := append([]string{cidrs[x]}, cidrs[:x]...)
+			ordered = append(ordered, cidrs[x+1:]...)
+			return strings.Join(ordered, ","), nil
+		}
+	}
+	return "", fmt.Errorf("subnet [%s] is not part of the pool [%s]", preferred, cidr)
+}
+
+// PrefixFromCidr - returns the network of the cidr that contains the address
+func PrefixFromCidr(cidr, address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("unable to parse IP address [%s]", address)
+	}
+	for _, c := range splitDefinition(cidr) {
+		_, ipnet, err := parseCidr(c)
+		if err != nil {
+			return "", err
+		}
+		if ipnet.Contains(ip) {
+			return ipnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("address [%s] is not in cidr [%s]", address, cidr)
+}
+
+// PrefixFromRange - returns the smallest prefix that encloses the range containing the address
+func PrefixFromRange(ipRangeString, address string) (string, error) {
+	ip := IPStr2Int(address)
+	if ip == 0 {
+		return "", fmt.Errorf("unable to parse IP address [%s]", address)
+	}
+	for _, r := range splitDefinition(ipRangeString) {
+		ipRange := strings.Split(r, "-")
+		if len(ipRange) != 2 {
+			return "", fmt.Errorf("unable to parse IP range [%s]", r)
+		}
+		firstIP := IPStr2Int(ipRange[0])
+		lastIP := IPStr2Int(ipRange[1])
+		if firstIP > lastIP {
+			firstIP, lastIP = lastIP, firstIP
+		}
+		if ip < firstIP || ip > lastIP {
+			continue
+		}
+		return enclosingPrefix(firstIP, lastIP), nil
+	}
+	return "", fmt.Errorf("address [%s] is not in range [%s]", address, ipRangeString)
+}
+
+// EnclosingCidr - returns the smallest cidr that contains all of the (IPv4) addresses
+func EnclosingCidr(addresses []string) (string, error) {
+	var firstIP, lastIP uint
+	for x := range addresses {
+		ip := IPStr2Int(addresses[x])
+		if ip == 0 {
+			return "", fmt.Errorf("unable to parse IP address [%s]", addresses[x])
+		}
+		if x == 0 || ip < firstIP {
+			firstIP = ip
+		}
+		if ip > lastIP {
+			lastIP = ip
+		}
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("no addresses to enclose")
+	}
+	return enclosingPrefix(firstIP, lastIP), nil
+}
+
+// enclosingPrefix - returns the smallest prefix containing both addresses
+func enclosingPrefix(firstIP, lastIP uint) string {
+	// Shorten the prefix until the first and last address share the same network
+	ones := 32
+	for ones > 0 && firstIP>>(32-ones) != lastIP>>(32-ones) {
+		ones--
+	}
+	network := firstIP >> (32 - ones) << (32 - ones)
+	return fmt.Sprintf("%s/%d", IPInt2Str(network), ones)
+}
+
+// NormalizeAddress - Returns the canonical form of an address (i.e. fd00:0:0::1 is fd00::1) so that addresses
+// can be compared as strings, anything that isn't an address is returned trimmed but otherwise unchanged
+func NormalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	return ip.String()
+}
+
+// NormalizeAddresses - Returns the canonical form of every address
+func NormalizeAddresses(addresses []string) []string {
+	normalized := make([]string, 0, len(addresses))
+	for x := range addresses {
+		normalized = append(normalized, NormalizeAddress(addresses[x]))
+	}
+	return normalized
+}
+
 // IPStr2Int - Converts the IP address in string format to an integer
 func IPStr2Int(ip string) uint {
 	b := net.ParseIP(ip).To4()
@@ -234,11 +579,18 @@ func buildAddressesFromRange(ipRangeString string) ([]string, error) {
 	var ips []string
 	// Split the ipranges (comma seperated)
 
-	ranges := strings.Split(ipRangeString, ",")
+	ranges := splitDefinition(ipRangeString)
 	if len(ranges) == 0 {
 		return nil, fmt.Errorf("unable to parse IP ranges [%s]", ipRangeString)
 	}
 
+	// Refuse to build a pool that is too large to scan
+	if bounds, err := RangeBounds(ipRangeString); err == nil {
+		if err := CheckPoolSize(bounds); err != nil {
+			return nil, fmt.Errorf("range [%s]: %w", ipRangeString, err)
+		}
+	}
+
 	for x := range ranges {
 		ipRange := strings.Split(ranges[x], "-")
 		// Make sure we have x.x.x.x-x.x.x.x
@@ -249,16 +601,21 @@ func buildAddressesFromRange(ipRangeString string) ([]string, error) {
 
 		firstIP := IPStr2Int(ipRange[0])
 		lastIP := IPStr2Int(ipRange[1])
+		// A reversed range is refused rather than swapped, it is more likely a typo than intended
 		if firstIP > lastIP {
-			// swap
-			firstIP, lastIP = lastIP, firstIP
+			return nil, fmt.Errorf("%w [%s]", ErrRangeReversed, ranges[x])
 		}
 
 		for ip := firstIP; ip <= lastIP; ip++ {
+			// A range crossing an octet boundary skips the .255 and .0 in between, they are the broadcast and network
+			// address of a /24. The ends of the range are always allocated
+			if ip != firstIP && ip != lastIP && (ip&0xff == 0 || ip&0xff == 0xff) {
+				continue
+			}
 			ips = append(ips, IPInt2Str(ip))
 		}
 
-		klog.Infof("Rebuilding addresse cache, [%d] addresses exist", len(ips))
+		klog.V(4).Infof("Rebuilding addresse cache, [%d] addresses exist", len(ips))
 	}
 	return removeDuplicateAddresses(ips), nil
 	//return ips, nil
@@ -288,3 +645,21 @@ func inc(ip net.IP) {
 		}
 	}
 }
+
+// NextAddress - returns the address immediately following the address
+func NextAddress(address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("unable to parse IP address [%s]", address)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	inc(next)
+	if next.IsUnspecified() {
+		return "", fmt.Errorf("address [%s] is the last address", address)
+	}
+	return next.String(), nil
+}
@@ -1,7 +1,11 @@
 package ipam
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -97,6 +101,36 @@ func Test_buildHostsFromCidr(t *testing.T) {
 			want:    []string{"192.168.0.201", "192.168.0.202", "192.168.0.203", "192.168.0.204", "192.168.0.205", "192.168.0.206"},
 			wantErr: false,
 		},
+		{
+			name: "single entry, dotted netmask",
+			args: args{
+				"192.168.0.200/255.255.255.252",
+			},
+			want:    []string{"192.168.0.201", "192.168.0.202"},
+			wantErr: false,
+		},
+		{
+			name: "dual entry, dotted netmask and prefix",
+			args: args{
+				"192.168.0.200/255.255.255.252,192.168.0.200/29",
+			},
+			want:    []string{"192.168.0.201", "192.168.0.202", "192.168.0.203", "192.168.0.204", "192.168.0.205", "192.168.0.206"},
+			wantErr: false,
+		},
+		{
+			name: "non-contiguous netmask",
+			args: args{
+				"192.168.0.0/255.0.255.0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid netmask",
+			args: args{
+				"192.168.0.0/255.255.255.a",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -112,6 +146,60 @@ func Test_buildHostsFromCidr(t *testing.T) {
 	}
 }
 
+func Test_buildHostsFromCidrBoundaries(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		wantHosts   int
+		wantSkipped []string
+		wantHost    []string
+	}{
+		{
+			cidr:        "192.168.0.0/23",
+			wantHosts:   510,
+			wantSkipped: []string{"192.168.0.0", "192.168.1.255"},
+			wantHost:    []string{"192.168.0.255", "192.168.1.0"},
+		},
+		{
+			cidr:        "192.168.0.0/24",
+			wantHosts:   254,
+			wantSkipped: []string{"192.168.0.0", "192.168.0.255"},
+			wantHost:    []string{"192.168.0.1", "192.168.0.254"},
+		},
+		{
+			cidr:        "192.168.0.128/25",
+			wantHosts:   126,
+			wantSkipped: []string{"192.168.0.128", "192.168.0.255"},
+			wantHost:    []string{"192.168.0.129", "192.168.0.254"},
+		},
+		{
+			cidr:        "192.168.0.0/25",
+			wantHosts:   126,
+			wantSkipped: []string{"192.168.0.0", "192.168.0.127"},
+			wantHost:    []string{"192.168.0.1", "192.168.0.126"},
+		},
+		{
+			cidr:      "192.168.0.254/31",
+			wantHosts: 2,
+			wantHost:  []string{"192.168.0.254", "192.168.0.255"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			got, err := buildHostsFromCidr(tt.cidr)
+			if err != nil {
+				t.Fatalf("buildHostsFromCidr() error = %v", err)
+			}
+			assert.Len(t, got, tt.wantHosts)
+			for _, address := range tt.wantSkipped {
+				assert.NotContains(t, got, address)
+			}
+			for _, address := range tt.wantHost {
+				assert.Contains(t, got, address)
+			}
+		})
+	}
+}
+
 func TestFindAvailableHostFromRange(t *testing.T) {
 	type args struct {
 		namespace        string
@@ -160,3 +248,845 @@ func TestFindAvailableHostFromRange(t *testing.T) {
 		})
 	}
 }
+
+func TestFindAvailableHostFromRangeDirection(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipRange string
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "reversed",
+			ipRange: "192.168.0.200-192.168.0.10",
+			wantErr: ErrRangeReversed,
+		},
+		{
+			name:    "reversed second range",
+			ipRange: "192.168.0.10-192.168.0.20,192.168.1.20-192.168.1.10",
+			wantErr: ErrRangeReversed,
+		},
+		{
+			name:    "equal",
+			ipRange: "192.168.0.10-192.168.0.10",
+			want:    "192.168.0.10",
+		},
+		{
+			name:    "valid",
+			ipRange: "192.168.0.10-192.168.0.200",
+			want:    "192.168.0.10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Manager = nil
+			got, err := FindAvailableHostFromRange("dev", tt.ipRange, nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !errors.Is(err, ErrInvalidRange) {
+					t.Errorf("FindAvailableHostFromRange() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("FindAvailableHostFromRange() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    string
+	}{
+		{
+			name:    "ipv4",
+			address: "192.168.0.10",
+			want:    "192.168.0.10",
+		},
+		{
+			name:    "whitespace",
+			address: " 192.168.0.10\n",
+			want:    "192.168.0.10",
+		},
+		{
+			name:    "ipv6 zeros are compressed",
+			address: "fd00:0:0::1",
+			want:    "fd00::1",
+		},
+		{
+			name:    "ipv6 leading zeros",
+			address: "fd00:0000:0000:0000:0000:0000:0000:0001",
+			want:    "fd00::1",
+		},
+		{
+			name:    "ipv6 upper case",
+			address: "FD00::ABCD",
+			want:    "fd00::abcd",
+		},
+		{
+			name:    "ipv4 mapped ipv6",
+			address: "::ffff:192.168.0.10",
+			want:    "192.168.0.10",
+		},
+		{
+			name:    "not an address",
+			address: " pending ",
+			want:    "pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeAddress(tt.address); got != tt.want {
+				t.Errorf("NormalizeAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddressesEquivalent(t *testing.T) {
+	got := NormalizeAddresses([]string{"fd00:0:0::1", "fd00::0:1", "fd00::1"})
+	for x := range got {
+		if got[x] != "fd00::1" {
+			t.Errorf("NormalizeAddresses()[%d] = %v, want fd00::1", x, got[x])
+		}
+	}
+}
+
+func TestEnclosingCidr(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "single address",
+			addresses: []string{"192.168.0.10"},
+			want:      "192.168.0.10/32",
+		},
+		{
+			name:      "same /24",
+			addresses: []string{"192.168.0.10", "192.168.0.200", "192.168.0.20"},
+			want:      "192.168.0.0/24",
+		},
+		{
+			name:      "across third octet",
+			addresses: []string{"192.168.1.2", "192.168.0.253"},
+			want:      "192.168.0.0/23",
+		},
+		{
+			name:    "no addresses",
+			wantErr: true,
+		},
+		{
+			name:      "invalid address",
+			addresses: []string{"192.168.0.10", "node-1"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EnclosingCidr(tt.addresses)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnclosingCidr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EnclosingCidr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostFromCidrStartOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		offset   int
+		existing []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "no offset",
+			cidr: "192.168.0.0/28",
+			want: "192.168.0.1",
+		},
+		{
+			name:   "starts at the offset",
+			cidr:   "192.168.0.0/28",
+			offset: 5,
+			want:   "192.168.0.6",
+		},
+		{
+			name:     "skips used addresses after the offset",
+			cidr:     "192.168.0.0/28",
+			offset:   5,
+			existing: []string{"192.168.0.6", "192.168.0.7"},
+			want:     "192.168.0.8",
+		},
+		{
+			name:     "wraps around when the top is full",
+			cidr:     "192.168.0.0/29",
+			offset:   4,
+			existing: []string{"192.168.0.5", "192.168.0.6"},
+			want:     "192.168.0.1",
+		},
+		{
+			name:   "offset larger than the pool wraps",
+			cidr:   "192.168.0.0/29",
+			offset: 8,
+			want:   "192.168.0.3",
+		},
+		{
+			name:     "exhausted",
+			cidr:     "192.168.0.0/30",
+			offset:   1,
+			existing: []string{"192.168.0.1", "192.168.0.2"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Manager = nil
+			got, err := FindAvailableHostFromCidrWithOptions("dev", tt.cidr, tt.existing, Options{StartOffset: tt.offset})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindAvailableHostFromCidrWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FindAvailableHostFromCidrWithOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarmCidr(t *testing.T) {
+	Manager = nil
+	defer ResetWarm()
+
+	if err := WarmCidr("192.168.0.0/29", []string{"192.168.0.1", "192.168.0.3"}); err != nil {
+		t.Fatalf("WarmCidr() error = %v", err)
+	}
+	take := func(existing []string, offset int) string {
+		got, err := FindAvailableHostFromCidrWithOptions("dev", "192.168.0.0/29", existing, Options{StartOffset: offset})
+		if err != nil {
+			return err.Error()
+		}
+		return got
+	}
+
+	// Addresses in use at warm time, or since, are skipped
+	if got := take(nil, 0); got != "192.168.0.2" {
+		t.Errorf("first take = %v, want 192.168.0.2", got)
+	}
+	if got := take([]string{"192.168.0.4"}, 0); got != "192.168.0.5" {
+		t.Errorf("second take = %v, want 192.168.0.5", got)
+	}
+	// A released address is handed out again in pool order
+	ReleaseWarm("192.168.0.2")
+	if got := take(nil, 0); got != "192.168.0.2" {
+		t.Errorf("take after release = %v, want 192.168.0.2", got)
+	}
+	// The offset is honoured and wraps around
+	ReleaseWarm("192.168.0.5")
+	if got := take(nil, 5); got != "192.168.0.6" {
+		t.Errorf("take from offset = %v, want 192.168.0.6", got)
+	}
+	if got := take(nil, 5); got != "192.168.0.5" {
+		t.Errorf("take wrapped around = %v, want 192.168.0.5", got)
+	}
+	if _, err := FindAvailableHostFromCidr("dev", "192.168.0.0/29", nil); err == nil {
+		t.Errorf("take from an exhausted warm pool didn't fail")
+	}
+}
+
+// benchmarkPool is a /16 with the first half in use
+func benchmarkPool(b *testing.B) (string, []string) {
+	cidr := "10.0.0.0/16"
+	hosts, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return cidr, hosts[:len(hosts)/2]
+}
+
+func BenchmarkFindAvailableHostFromCidrScan(b *testing.B) {
+	Manager = nil
+	cidr, inUse := benchmarkPool(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindAvailableHostFromCidr("bench", cidr, inUse); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindAvailableHostFromCidrWarm(b *testing.B) {
+	Manager = nil
+	defer ResetWarm()
+	cidr, inUse := benchmarkPool(b)
+	if err := WarmCidr(cidr, inUse); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		address, err := FindAvailableHostFromCidr("bench", cidr, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Release it so that every iteration allocates from the same pool
+		ReleaseWarm(address)
+	}
+}
+
+func TestFindHashedHostFromCidr(t *testing.T) {
+	address, hashed, err := FindHashedHostFromCidr("fd00:1::/64", "dev/web", nil)
+	if err != nil || !hashed {
+		t.Fatalf("FindHashedHostFromCidr() = %v, %v, %v", address, hashed, err)
+	}
+	// The same service always maps to the same address
+	for i := 0; i < 3; i++ {
+		if again, _, _ := FindHashedHostFromCidr("fd00:1::/64", "dev/web", nil); again != address {
+			t.Errorf("FindHashedHostFromCidr() = %v, want %v", again, address)
+		}
+	}
+	if other, _, _ := FindHashedHostFromCidr("fd00:1::/64", "dev/api", nil); other == address {
+		t.Errorf("FindHashedHostFromCidr() gave two services the same address %v", other)
+	}
+
+	// A collision falls back to probing the following addresses
+	next := net.ParseIP(address)
+	next[len(next)-1]++
+	probed, _, err := FindHashedHostFromCidr("fd00:1::/64", "dev/web", []string{address})
+	if err != nil || probed != next.String() {
+		t.Errorf("FindHashedHostFromCidr() with a collision = %v, %v, want %v", probed, err, next.String())
+	}
+
+	// Only IPv6 cidrs are hashed
+	if _, hashed, _ := FindHashedHostFromCidr("192.168.0.0/24", "dev/web", nil); hashed {
+		t.Errorf("FindHashedHostFromCidr() hashed an IPv4 cidr")
+	}
+}
+
+func TestFindHashedHostFromCidrExhausted(t *testing.T) {
+	// A /126 has three addresses once the subnet-router anycast address is skipped
+	cidr := "fd00:1::/126"
+	var existing []string
+	for i := 0; i < 3; i++ {
+		address, _, err := FindHashedHostFromCidr(cidr, "dev/web", existing)
+		if err != nil {
+			t.Fatalf("FindHashedHostFromCidr() error = %v", err)
+		}
+		if address == "fd00:1::" {
+			t.Errorf("FindHashedHostFromCidr() allocated the subnet-router anycast address")
+		}
+		existing = append(existing, address)
+	}
+	if _, _, err := FindHashedHostFromCidr(cidr, "dev/web", existing); !errors.Is(err, ErrNoAddressesAvailable) {
+		t.Errorf("FindHashedHostFromCidr() error = %v, want %v", err, ErrNoAddressesAvailable)
+	}
+}
+
+func TestFindAvailableHostFromCidrHashed(t *testing.T) {
+	Manager = nil
+	got, err := FindAvailableHostFromCidrWithOptions("dev", "fd00:1::/64", nil, Options{HashKey: "dev/web"})
+	if err != nil {
+		t.Fatalf("FindAvailableHostFromCidrWithOptions() error = %v", err)
+	}
+	if want, _, _ := FindHashedHostFromCidr("fd00:1::/64", "dev/web", nil); got != want {
+		t.Errorf("FindAvailableHostFromCidrWithOptions() = %v, want %v", got, want)
+	}
+	// An IPv4 cidr is scanned instead
+	if got, _ := FindAvailableHostFromCidrWithOptions("dev", "192.168.0.0/29", nil, Options{HashKey: "dev/web"}); got != "192.168.0.1" {
+		t.Errorf("FindAvailableHostFromCidrWithOptions() = %v, want 192.168.0.1", got)
+	}
+}
+
+func TestSpreadCidr(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidr  string
+		inUse []string
+		want  string
+	}{
+		{
+			name: "equally utilized keep their order",
+			cidr: "192.168.0.0/29,192.168.1.0/29",
+			want: "192.168.0.0/29,192.168.1.0/29",
+		},
+		{
+			name:  "least utilized first",
+			cidr:  "192.168.0.0/29,192.168.1.0/29",
+			inUse: []string{"192.168.0.1"},
+			want:  "192.168.1.0/29,192.168.0.0/29",
+		},
+		{
+			name:  "utilization not count",
+			cidr:  "192.168.0.0/30,192.168.1.0/28",
+			inUse: []string{"192.168.0.1", "192.168.1.1", "192.168.1.2"},
+			want:  "192.168.1.0/28,192.168.0.0/30",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SpreadCidr(tt.cidr, tt.inUse)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBestFit(t *testing.T) {
+	tests := []struct {
+		name  string
+		pool  string
+		inUse []string
+		want  string
+	}{
+		{
+			name: "smallest cidr first",
+			pool: "192.168.0.0/28,192.168.1.0/30,192.168.2.0/29",
+			want: "192.168.1.0/30,192.168.2.0/29,192.168.0.0/28",
+		},
+		{
+			name: "same size keep their order",
+			pool: "192.168.1.0/29,192.168.0.0/29",
+			want: "192.168.1.0/29,192.168.0.0/29",
+		},
+		{
+			name:  "full cidr last",
+			pool:  "192.168.0.0/28,192.168.1.0/30",
+			inUse: []string{"192.168.1.1", "192.168.1.2"},
+			want:  "192.168.0.0/28,192.168.1.0/30",
+		},
+		{
+			name: "smallest range first",
+			pool: "192.168.0.10-192.168.0.20,192.168.1.10-192.168.1.11",
+			want: "192.168.1.10-192.168.1.11,192.168.0.10-192.168.0.20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bestFit := BestFitCidr
+			if strings.Contains(tt.pool, "-") {
+				bestFit = BestFitRange
+			}
+			got, err := bestFit(tt.pool, tt.inUse)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNextAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{address: "192.168.0.1", want: "192.168.0.2"},
+		{address: "192.168.0.255", want: "192.168.1.0"},
+		{address: "fd00::ff", want: "fd00::100"},
+		{address: "255.255.255.255", wantErr: true},
+		{address: "invalid", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := NextAddress(tt.address)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGatewayAddresses(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{cidr: "192.168.0.0/24", want: []string{"192.168.0.1"}},
+		{cidr: "192.168.0.64/26,10.0.0.0/8", want: []string{"192.168.0.65", "10.0.0.1"}},
+		{cidr: "192.168.0.0/31,192.168.0.4/32"},
+		{cidr: "fd00::/64", want: []string{"fd00::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			got, err := GatewayAddresses(tt.cidr)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFindAvailableHostFromCidrTooLarge(t *testing.T) {
+	Manager = nil
+	if _, err := FindAvailableHostFromCidr("dev", "10.0.0.0/8", nil); !errors.Is(err, ErrPoolTooLarge) {
+		t.Errorf("FindAvailableHostFromCidr() error = %v, want %v", err, ErrPoolTooLarge)
+	}
+	// The limit is for the whole pool, not each cidr
+	if _, err := FindAvailableHostFromCidr("dev", "10.0.0.0/16,10.1.0.0/30", nil); !errors.Is(err, ErrPoolTooLarge) {
+		t.Errorf("FindAvailableHostFromCidr() error = %v, want %v", err, ErrPoolTooLarge)
+	}
+	if _, err := FindAvailableHostFromRange("dev", "10.0.0.0-10.2.0.0", nil); !errors.Is(err, ErrPoolTooLarge) {
+		t.Errorf("FindAvailableHostFromRange() error = %v, want %v", err, ErrPoolTooLarge)
+	}
+	if got, err := FindAvailableHostFromCidr("dev", "10.0.0.0/16", nil); err != nil || got != "10.0.0.1" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, %v, want 10.0.0.1", got, err)
+	}
+
+	// The limit can be raised, or disabled with zero
+	defer func(size int) { MaxPoolSize = size }(MaxPoolSize)
+	MaxPoolSize = 0
+	if got, err := FindAvailableHostFromCidr("dev", "10.0.0.0/15", nil); err != nil || got != "10.0.0.1" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, %v, want 10.0.0.1", got, err)
+	}
+}
+
+func Test_splitDefinition(t *testing.T) {
+	tests := []struct {
+		definition string
+		want       []string
+	}{
+		{definition: "192.168.0.10-192.168.0.20", want: []string{"192.168.0.10-192.168.0.20"}},
+		{definition: " 192.168.0.10 - 192.168.0.20 , 192.168.0.30-192.168.0.40 ", want: []string{"192.168.0.10-192.168.0.20", "192.168.0.30-192.168.0.40"}},
+		{definition: "192.168.0.0/29,,192.168.1.0/29,", want: []string{"192.168.0.0/29", "192.168.1.0/29"}},
+		{definition: "192.168.0.0/29, 192.168.0.0/29 ,192.168.1.0 / 29", want: []string{"192.168.0.0/29", "192.168.1.0/29"}},
+		{definition: " , ,"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.definition, func(t *testing.T) {
+			assert.Equal(t, tt.want, splitDefinition(tt.definition))
+		})
+	}
+}
+
+func TestFindAvailableHostMessyDefinition(t *testing.T) {
+	Manager = nil
+	got, err := FindAvailableHostFromRange("dev", "192.168.0.10 - 192.168.0.11 ,, 192.168.0.10-192.168.0.11, 192.168.0.30-192.168.0.31", []string{"192.168.0.10", "192.168.0.11"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.30", got)
+
+	got, err = FindAvailableHostFromCidr("staging", " 192.168.1.0/30 , , 192.168.2.0/30 ,", []string{"192.168.1.1", "192.168.1.2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.2.1", got)
+
+	bounds, err := RangeBounds("192.168.0.10 - 192.168.0.20 , 192.168.0.30-192.168.0.40")
+	assert.NoError(t, err)
+	assert.Len(t, bounds, 2)
+}
+
+func TestScanObserver(t *testing.T) {
+	Manager = nil
+	var scanned []int
+	var found []bool
+	defer func(observer func(int, bool)) { ScanObserver = observer }(ScanObserver)
+	ScanObserver = func(n int, ok bool) {
+		scanned = append(scanned, n)
+		found = append(found, ok)
+	}
+
+	// Three of the six hosts are in use, so the fourth is found
+	existing := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}
+	got, err := FindAvailableHostFromCidr("dev", "192.168.0.0/29", existing)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.4", got)
+
+	_, err = FindAvailableHostFromRange("staging", "192.168.1.10-192.168.1.12", []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"})
+	assert.True(t, errors.Is(err, ErrNoAddressesAvailable))
+
+	assert.Equal(t, []int{4, 3}, scanned)
+	assert.Equal(t, []bool{true, false}, found)
+}
+
+func TestFindAvailableHostFromBoundedCidr(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		existing []string
+		want     string
+		wantErr  error
+	}{
+		{name: "unbounded", cidr: "192.168.0.0/24", want: "192.168.0.1"},
+		{name: "bounded", cidr: "192.168.0.0/24[192.168.0.50-192.168.0.100]", want: "192.168.0.50"},
+		{name: "bounded in use", cidr: "192.168.0.0/24[192.168.0.50-192.168.0.51]", existing: []string{"192.168.0.50"}, want: "192.168.0.51"},
+		{name: "bounded exhausted", cidr: "192.168.0.0/24[192.168.0.50-192.168.0.51]", existing: []string{"192.168.0.50", "192.168.0.51"}, wantErr: ErrNoAddressesAvailable},
+		// The network address is never allocated, even at the start of the window
+		{name: "window from the network address", cidr: "192.168.0.0/24[192.168.0.0-192.168.0.1]", want: "192.168.0.1"},
+		{name: "bounded and unbounded", cidr: "192.168.0.0/24[192.168.0.50-192.168.0.50],192.168.1.0/30", existing: []string{"192.168.0.50"}, want: "192.168.1.1"},
+		// A large network is fine as only the window is scanned
+		{name: "window of a large network", cidr: "10.0.0.0/8[10.1.0.10-10.1.0.20]", want: "10.1.0.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Manager = nil
+			got, err := FindAvailableHostFromCidr("dev", tt.cidr, tt.existing)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parseBoundedCidr(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "192.168.0.0/24", want: ""},
+		{cidr: "192.168.0.0/24[192.168.0.50-192.168.0.100]", want: "192.168.0.50-192.168.0.100"},
+		{cidr: "192.168.0.0/255.255.255.0[192.168.0.50-192.168.0.100]", want: "192.168.0.50-192.168.0.100"},
+		{cidr: "fd00::/64[fd00::10-fd00::20]", want: "fd00::10-fd00::20"},
+		{cidr: "192.168.0.0/24[192.168.0.50-192.168.1.10]", wantErr: true},
+		{cidr: "192.168.0.0/24[192.168.0.100-192.168.0.50]", wantErr: true},
+		{cidr: "192.168.0.0/24[192.168.0.50]", wantErr: true},
+		{cidr: "192.168.0.0/24[192.168.0.50-192.168.0.100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, ipnet, window, err := parseBoundedCidr(tt.cidr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, ipnet)
+			if tt.want == "" {
+				assert.Nil(t, window)
+				return
+			}
+			assert.Equal(t, tt.want, window.String())
+		})
+	}
+
+	// The network of a bounded cidr is still the whole cidr
+	prefix, err := PrefixFromCidr("192.168.0.0/24[192.168.0.50-192.168.0.100]", "192.168.0.60")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.0/24", prefix)
+	assert.True(t, IsNetworkOrBroadcast("192.168.0.0/24[192.168.0.50-192.168.0.100]", "192.168.0.255"))
+	assert.False(t, IsNetworkOrBroadcast("192.168.0.0/24[192.168.0.50-192.168.0.100]", "192.168.0.100"))
+}
+
+func TestFindAvailableHostFromList(t *testing.T) {
+	// The addresses are taken in the order of the list, not the numeric order
+	got, err := FindAvailableHostFromList("192.168.0.20, 192.168.0.10,fd00::10", []string{"192.168.0.20"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.10", got)
+
+	got, err = FindAvailableHostFromList("192.168.0.20,192.168.0.10,fd00::10", []string{"192.168.0.20", "192.168.0.10"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00::10", got)
+
+	_, err = FindAvailableHostFromList("192.168.0.20", []string{"192.168.0.20"})
+	assert.True(t, errors.Is(err, ErrNoAddressesAvailable))
+
+	_, err = FindAvailableHostFromList("192.168.0.20,192.168.0.0/24", nil)
+	assert.True(t, errors.Is(err, ErrInvalidList))
+}
+
+func TestListStats(t *testing.T) {
+	bounds, err := ListBounds("192.168.0.20,192.168.0.10,192.168.0.20")
+	assert.NoError(t, err)
+	assert.Len(t, bounds, 2)
+	assert.True(t, bounds[0].Contains(net.ParseIP("192.168.0.20")))
+	assert.False(t, bounds[0].Contains(net.ParseIP("192.168.0.21")))
+
+	stats, err := ListStats("list-dev", "192.168.0.20,192.168.0.10", []string{"192.168.0.10", "192.168.1.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Size)
+	assert.Equal(t, 1, stats.Used)
+}
+
+func TestOffsetCidr(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       string
+		definition string
+		want       string
+		wantErr    bool
+	}{
+		{name: "adjacent block", base: "10.96.0.0/12", definition: "/24@0", want: "10.112.0.0/24"},
+		{name: "third block", base: "10.96.0.0/12", definition: "/24@2", want: "10.112.2.0/24"},
+		{name: "larger than base", base: "10.96.0.0/24", definition: "/16@0", want: "10.97.0.0/16"},
+		{name: "address offset", base: "10.96.0.0/12", definition: "/24@0.16.100.0", want: "10.112.100.0/24"},
+		{name: "ipv6", base: "fd00::/112", definition: "/120@1", want: "fd00::1:100/120"},
+		{name: "address offset overlaps", base: "10.96.0.0/12", definition: "/24@0.0.100.0", wantErr: true},
+		{name: "address offset not aligned", base: "10.96.0.0/12", definition: "/24@0.16.100.10", wantErr: true},
+		{name: "wrong family", base: "10.96.0.0/12", definition: "/24@fd00::", wantErr: true},
+		{name: "beyond the last address", base: "255.255.255.0/24", definition: "/24@0", wantErr: true},
+		{name: "invalid prefix", base: "10.96.0.0/12", definition: "24@0", wantErr: true},
+		{name: "prefix too long", base: "10.96.0.0/12", definition: "/33@0", wantErr: true},
+		{name: "invalid base", base: "10.96.0.0", definition: "/24@0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OffsetCidr(tt.base, tt.definition)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFindAvailableHostFromCidrScanTimeout(t *testing.T) {
+	Manager = nil
+	cidr := "10.0.0.0/16"
+	hosts, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the last host is free
+	inUse := hosts[:len(hosts)-1]
+	expired := Options{Deadline: time.Now().Add(-time.Second)}
+
+	var attempts int
+	for {
+		attempts++
+		address, err := FindAvailableHostFromCidrWithOptions("dev", cidr, inUse, expired)
+		if errors.Is(err, ErrScanTimeout) {
+			if attempts > len(hosts)/scanDeadlineInterval+1 {
+				t.Fatalf("FindAvailableHostFromCidrWithOptions() timed out %d times, the scan isn't resumed", attempts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("FindAvailableHostFromCidrWithOptions() error = %v", err)
+		}
+		if address != hosts[len(hosts)-1] {
+			t.Errorf("FindAvailableHostFromCidrWithOptions() = %v, want %v", address, hosts[len(hosts)-1])
+		}
+		break
+	}
+	if attempts == 1 {
+		t.Errorf("FindAvailableHostFromCidrWithOptions() didn't time out")
+	}
+
+	// Without a deadline the scan isn't stopped
+	if _, err := FindAvailableHostFromCidr("dev", cidr, inUse); err != nil {
+		t.Errorf("FindAvailableHostFromCidr() error = %v", err)
+	}
+}
+
+func TestFindAvailableHostParity(t *testing.T) {
+	tests := []struct {
+		name     string
+		parity   string
+		offset   int
+		existing []string
+		want     string
+	}{
+		{name: "even", parity: ParityEven, want: "192.168.0.2"},
+		{name: "odd", parity: ParityOdd, want: "192.168.0.1"},
+		{name: "even after the allocated even address", parity: ParityEven, existing: []string{"192.168.0.2"}, want: "192.168.0.4"},
+		{name: "even from the offset", parity: ParityEven, offset: 2, want: "192.168.0.4"},
+		{name: "odd from the offset", parity: ParityOdd, offset: 2, want: "192.168.0.3"},
+		{name: "falls back to odd", parity: ParityEven, existing: []string{"192.168.0.2", "192.168.0.4", "192.168.0.6"}, want: "192.168.0.1"},
+		{name: "falls back to even", parity: ParityOdd, existing: []string{"192.168.0.1", "192.168.0.3", "192.168.0.5"}, want: "192.168.0.2"},
+		{name: "without parity", existing: []string{"192.168.0.1"}, want: "192.168.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Manager = nil
+			// 192.168.0.1 - 192.168.0.6
+			got, err := FindAvailableHostFromCidrWithOptions("dev", "192.168.0.0/29", tt.existing, Options{Parity: tt.parity, StartOffset: tt.offset})
+			if err != nil || got != tt.want {
+				t.Errorf("FindAvailableHostFromCidrWithOptions() = %v, %v, want %v", got, err, tt.want)
+			}
+
+			Manager = nil
+			got, err = FindAvailableHostFromRangeWithOptions("dev", "192.168.0.1-192.168.0.6", tt.existing, Options{Parity: tt.parity, StartOffset: tt.offset})
+			if err != nil || got != tt.want {
+				t.Errorf("FindAvailableHostFromRangeWithOptions() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	// Every address is in use, whatever its parity
+	Manager = nil
+	all := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6"}
+	if _, err := FindAvailableHostFromCidrWithOptions("dev", "192.168.0.0/29", all, Options{Parity: ParityEven}); !errors.Is(err, ErrNoAddressesAvailable) {
+		t.Errorf("FindAvailableHostFromCidrWithOptions() error = %v, want %v", err, ErrNoAddressesAvailable)
+	}
+}
+
+func TestFilterFamily(t *testing.T) {
+	tests := []struct {
+		definition, family, want string
+		wantOk                   bool
+	}{
+		{"192.168.0.0/24, fd00::/120", FamilyIPv4, "192.168.0.0/24", true},
+		{"192.168.0.0/24,fd00::/120,fd01::/120", FamilyIPv6, "fd00::/120,fd01::/120", true},
+		{"192.168.0.10-192.168.0.20", FamilyIPv6, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := FilterFamily(tt.definition, tt.family)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("FilterFamily(%q, %s) = %q, %v, want %q, %v", tt.definition, tt.family, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestReservedAddresses(t *testing.T) {
+	got, err := ReservedAddresses([]string{"192.168.0.10 - 192.168.0.11", "192.168.1.0/31", "fd00::5", ""})
+	if err != nil {
+		t.Fatalf("ReservedAddresses() error = %v", err)
+	}
+	want := []string{"192.168.0.10", "192.168.0.11", "192.168.1.0", "192.168.1.1", "fd00::5"}
+	assert.Equal(t, want, got)
+	if _, err := ReservedAddresses([]string{"10.0.0.0/8"}); !errors.Is(err, ErrPoolTooLarge) {
+		t.Errorf("ReservedAddresses() error = %v, want %v", err, ErrPoolTooLarge)
+	}
+	if _, err := ReservedAddresses([]string{"192.168.0.20-192.168.0.10"}); !errors.Is(err, ErrRangeReversed) {
+		t.Errorf("ReservedAddresses() error = %v, want %v", err, ErrRangeReversed)
+	}
+}
+
+func TestFindAvailableHostDescending(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		ipRange  string
+		existing []string
+		options  Options
+		want     string
+	}{
+		{name: "range", ipRange: "192.168.0.10-192.168.0.20", want: "192.168.0.20"},
+		{name: "range with the highest in use", ipRange: "192.168.0.10-192.168.0.20", existing: []string{"192.168.0.20", "192.168.0.19"}, want: "192.168.0.18"},
+		{name: "range with an offset from the top", ipRange: "192.168.0.10-192.168.0.20", options: Options{StartOffset: 2}, want: "192.168.0.18"},
+		{name: "several ranges", ipRange: "192.168.0.10-192.168.0.12,192.168.1.10-192.168.1.12", want: "192.168.1.12"},
+		{name: "cidr", cidr: "192.168.0.0/29", want: "192.168.0.6"},
+		{name: "cidr with an odd parity", cidr: "192.168.0.0/29", options: Options{Parity: ParityOdd}, want: "192.168.0.5"},
+		{name: "cidr wraps around", cidr: "192.168.0.0/29", existing: []string{"192.168.0.1", "192.168.0.4", "192.168.0.5", "192.168.0.6"}, options: Options{StartOffset: 3}, want: "192.168.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Manager = nil
+			options := tt.options
+			options.Descending = true
+			var got string
+			var err error
+			if tt.cidr != "" {
+				got, err = FindAvailableHostFromCidrWithOptions("dev", tt.cidr, tt.existing, options)
+			} else {
+				got, err = FindAvailableHostFromRangeWithOptions("dev", tt.ipRange, tt.existing, options)
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
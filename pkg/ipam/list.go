@@ -0,0 +1,52 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrInvalidList is returned when an address of a list pool can't be parsed
+var ErrInvalidList = errors.New("invalid address list")
+
+// listAddresses - returns the comma separated addresses of a list pool, i.e. 192.168.0.10,192.168.0.20,fd00::10
+func listAddresses(list string) ([]string, error) {
+	entries := splitDefinition(list)
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("%w [%s], it must be comma separated addresses", ErrInvalidList, entry)
+		}
+		addresses = append(addresses, NormalizeAddress(entry))
+	}
+	return removeDuplicateAddresses(addresses), nil
+}
+
+// FindAvailableHostFromList - returns the first address of the list that isn't in use, in the order of the list
+func FindAvailableHostFromList(list string, existingServiceIPS []string) (string, error) {
+	addresses, err := listAddresses(list)
+	if err != nil {
+		return "", err
+	}
+	if address, ok := firstAvailable(list, addresses, existingServiceIPS, 0); ok {
+		return address, nil
+	}
+	return "", fmt.Errorf("%w in list [%s]", ErrNoAddressesAvailable, list)
+}
+
+// ListBounds - returns a bounds of a single address for each address of the list
+func ListBounds(list string) ([]Bounds, error) {
+	addresses, err := listAddresses(list)
+	if err != nil {
+		return nil, err
+	}
+	bounds := make([]Bounds, 0, len(addresses))
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		bounds = append(bounds, Bounds{First: ip, Last: ip})
+	}
+	return bounds, nil
+}
@@ -0,0 +1,73 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidOffsetCidr is returned when a cidr relative to another network can't be parsed or derived
+var ErrInvalidOffsetCidr = errors.New("invalid offset cidr")
+
+// OffsetCidr - derives a cidr from the network base and a definition /<bits>@<offset>. The offset is either the number
+// of /<bits> blocks after the end of base (0 is the block adjacent to it), i.e. /24@0, or an address that is added to
+// the network address of base, i.e. /24@0.0.100.0. The derived cidr must be aligned and mustn't overlap base
+func OffsetCidr(base, definition string) (string, error) {
+	_, baseNet, err := net.ParseCIDR(strings.TrimSpace(base))
+	if err != nil {
+		return "", fmt.Errorf("%w [%s]: %v", ErrInvalidCidr, base, err)
+	}
+	size := net.IPv6len
+	if ip4 := baseNet.IP.To4(); ip4 != nil {
+		baseNet.IP, size = ip4, net.IPv4len
+	}
+	familyBits := size * 8
+
+	parts := strings.Split(strings.TrimSpace(definition), "@")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return "", fmt.Errorf("%w [%s], it must be /<bits>@<offset>", ErrInvalidOffsetCidr, definition)
+	}
+	bits, err := strconv.Atoi(strings.TrimPrefix(parts[0], "/"))
+	if err != nil || bits < 0 || bits > familyBits {
+		return "", fmt.Errorf("%w [%s], [%s] isn't a prefix length", ErrInvalidOffsetCidr, definition, parts[0])
+	}
+	block := new(big.Int).Lsh(big.NewInt(1), uint(familyBits-bits))
+
+	start := new(big.Int).SetBytes(baseNet.IP)
+	if blocks, err := strconv.Atoi(parts[1]); err == nil && blocks >= 0 {
+		// The first aligned block after the end of base
+		ones, _ := baseNet.Mask.Size()
+		start.Add(start, new(big.Int).Lsh(big.NewInt(1), uint(familyBits-ones)))
+		if rem := new(big.Int).Mod(start, block); rem.Sign() != 0 {
+			start.Add(start, new(big.Int).Sub(block, rem))
+		}
+		start.Add(start, new(big.Int).Mul(block, big.NewInt(int64(blocks))))
+	} else {
+		offset := net.ParseIP(parts[1])
+		if offset == nil || (offset.To4() != nil) != (size == net.IPv4len) {
+			return "", fmt.Errorf("%w [%s], [%s] isn't a number of blocks or an address of the family of [%s]", ErrInvalidOffsetCidr, definition, parts[1], base)
+		}
+		if size == net.IPv4len {
+			offset = offset.To4()
+		}
+		start.Add(start, new(big.Int).SetBytes(offset))
+		if new(big.Int).Mod(start, block).Sign() != 0 {
+			return "", fmt.Errorf("%w [%s], the offset from [%s] isn't aligned to [/%d]", ErrInvalidOffsetCidr, definition, base, bits)
+		}
+	}
+
+	last := new(big.Int).Add(start, block)
+	if last.Sub(last, big.NewInt(1)).BitLen() > familyBits {
+		return "", fmt.Errorf("%w [%s], it is beyond the last address from [%s]", ErrInvalidOffsetCidr, definition, base)
+	}
+	ip := make(net.IP, size)
+	start.FillBytes(ip)
+	_, derived, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ip, bits))
+	if networkBounds(derived).Overlaps(networkBounds(baseNet)) {
+		return "", fmt.Errorf("%w [%s], [%s] overlaps [%s]", ErrInvalidOffsetCidr, definition, derived, base)
+	}
+	return derived.String(), nil
+}
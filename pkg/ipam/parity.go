@@ -0,0 +1,60 @@
+package ipam
+
+import (
+	"net"
+
+	"k8s.io/klog"
+)
+
+const (
+	// ParityEven - prefers addresses whose last octet is even, i.e. 192.168.0.10
+	ParityEven = "even"
+	// ParityOdd - prefers addresses whose last octet is odd, i.e. 192.168.0.11
+	ParityOdd = "odd"
+)
+
+// hasParity - returns true if the last octet of the address has the parity
+func hasParity(address, parity string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	even := ip[len(ip)-1]%2 == 0
+	return even == (parity == ParityEven)
+}
+
+// parityAddresses - returns the addresses of the parity, in the order of the pool
+func parityAddresses(addresses []string, parity string) []string {
+	var matching []string
+	for _, address := range addresses {
+		if hasParity(address, parity) {
+			matching = append(matching, address)
+		}
+	}
+	return matching
+}
+
+// scanPool - returns the first free address from the offset as firstAvailableBefore, preferring the addresses of the
+// parity of the options (if set) and falling back to any address when none of them are free. A descending scan is of
+// the addresses from the highest down
+func scanPool(pool string, addresses, existingServiceIPS []string, options Options) (string, bool, error) {
+	if options.Descending {
+		// A stopped descending scan resumes separately from an ascending one
+		addresses, pool = descendingAddresses(addresses), pool+"/descending"
+	}
+	if options.Parity != "" && len(addresses) != 0 {
+		// The offset is of the whole pool, the preferred addresses start from the first at or after it
+		start := options.StartOffset % len(addresses)
+		if start < 0 {
+			start += len(addresses)
+		}
+		preferred := parityAddresses(addresses, options.Parity)
+		offset := len(parityAddresses(addresses[:start], options.Parity))
+		address, ok, err := firstAvailableBefore(pool+"/"+options.Parity, preferred, existingServiceIPS, offset, options.Deadline)
+		if err != nil || ok {
+			return address, ok, err
+		}
+		klog.V(2).Infof("no %s address is free in pool [%s], allocating any free address", options.Parity, pool)
+	}
+	return firstAvailableBefore(pool, addresses, existingServiceIPS, options.StartOffset, options.Deadline)
+}
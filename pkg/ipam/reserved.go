@@ -0,0 +1,57 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ReservedAddresses - returns every address of the reserved entries, each is an address, a cidr (including its
+// network and broadcast address) or an (IPv4) first-last range. The entries are refused if they have more addresses
+// than the MaxPoolSize, as every address is added to the addresses in use
+func ReservedAddresses(entries []string) ([]string, error) {
+	var bounds []Bounds
+	for _, entry := range entries {
+		entry = strings.Join(strings.Fields(entry), "")
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, ipnet, err := parseCidr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%w [%s]: %v", ErrInvalidCidr, entry, err)
+			}
+			bounds = append(bounds, networkBounds(ipnet))
+		case strings.Contains(entry, "-"):
+			b, err := RangeBounds(entry)
+			if err != nil {
+				return nil, err
+			}
+			bounds = append(bounds, b...)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("unable to parse reserved address [%s]", entry)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bounds = append(bounds, Bounds{First: ip, Last: ip})
+		}
+	}
+	if err := CheckPoolSize(bounds); err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, b := range bounds {
+		ip := append(net.IP{}, b.First...)
+		for ; b.Contains(ip); inc(ip) {
+			addresses = append(addresses, ip.String())
+			if ip.Equal(b.Last) {
+				break
+			}
+		}
+	}
+	return addresses, nil
+}
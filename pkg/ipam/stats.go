@@ -0,0 +1,132 @@
+package ipam
+
+import (
+	"sort"
+	"strings"
+)
+
+// PoolStats - describes the usage of a pool of addresses
+type PoolStats struct {
+	// Pool is the configmap key of the pool, e.g. cidr-global
+	Pool string `json:"pool"`
+	// Definition is the cidr, range or list the pool is built from
+	Definition string `json:"definition"`
+
+	Size int `json:"size"`
+	Used int `json:"used"`
+	Free int `json:"free"`
+}
+
+// CidrStats - returns the usage of a cidr pool given the addresses that are in use
+func CidrStats(pool, cidr string, inUse []string) (PoolStats, error) {
+	hosts, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		return PoolStats{}, err
+	}
+	return newPoolStats(pool, cidr, hosts, inUse), nil
+}
+
+// RangeStats - returns the usage of a range pool given the addresses that are in use
+func RangeStats(pool, ipRange string, inUse []string) (PoolStats, error) {
+	hosts, err := buildAddressesFromRange(ipRange)
+	if err != nil {
+		return PoolStats{}, err
+	}
+	return newPoolStats(pool, ipRange, hosts, inUse), nil
+}
+
+// ListStats - returns the usage of a list pool given the addresses that are in use
+func ListStats(pool, list string, inUse []string) (PoolStats, error) {
+	addresses, err := listAddresses(list)
+	if err != nil {
+		return PoolStats{}, err
+	}
+	return newPoolStats(pool, list, addresses, inUse), nil
+}
+
+func newPoolStats(pool, definition string, hosts, inUse []string) PoolStats {
+	used := make(map[string]bool, len(inUse))
+	for x := range inUse {
+		used[inUse[x]] = true
+	}
+
+	stats := PoolStats{
+		Pool:       pool,
+		Definition: definition,
+		Size:       len(hosts),
+	}
+	for x := range hosts {
+		if used[hosts[x]] {
+			stats.Used++
+		}
+	}
+	stats.Free = stats.Size - stats.Used
+	return stats
+}
+
+// SpreadCidr - orders the cidrs of a pool from the least to the most utilized, so that the next address is taken
+// from the cidr with the most room
+func SpreadCidr(cidr string, inUse []string) (string, error) {
+	return spread(cidr, inUse, CidrStats)
+}
+
+// SpreadRange - orders the ranges of a pool from the least to the most utilized
+func SpreadRange(ipRange string, inUse []string) (string, error) {
+	return spread(ipRange, inUse, RangeStats)
+}
+
+// BestFitCidr - orders the cidrs of a pool from the smallest to the largest, those without a free address last, so
+// that the next address is taken from the smallest cidr with room and the larger cidrs are kept for later
+func BestFitCidr(cidr string, inUse []string) (string, error) {
+	return bestFit(cidr, inUse, CidrStats)
+}
+
+// BestFitRange - orders the ranges of a pool from the smallest to the largest, those without a free address last
+func BestFitRange(ipRange string, inUse []string) (string, error) {
+	return bestFit(ipRange, inUse, RangeStats)
+}
+
+func spread(definition string, inUse []string, poolStats func(pool, definition string, inUse []string) (PoolStats, error)) (string, error) {
+	// Equally utilized pools keep their configured order
+	return orderDefinitions(definition, inUse, poolStats, func(a, b PoolStats) bool {
+		return utilization(a) < utilization(b)
+	})
+}
+
+func bestFit(definition string, inUse []string, poolStats func(pool, definition string, inUse []string) (PoolStats, error)) (string, error) {
+	// Pools of the same size keep their configured order
+	return orderDefinitions(definition, inUse, poolStats, func(a, b PoolStats) bool {
+		if (a.Free == 0) != (b.Free == 0) {
+			return a.Free != 0
+		}
+		return a.Size < b.Size
+	})
+}
+
+// orderDefinitions - sorts the cidrs or ranges of the definition by their stats, stably
+func orderDefinitions(definition string, inUse []string, poolStats func(pool, definition string, inUse []string) (PoolStats, error), less func(a, b PoolStats) bool) (string, error) {
+	definitions := splitDefinition(definition)
+	stats := make([]PoolStats, 0, len(definitions))
+	for x := range definitions {
+		s, err := poolStats(definitions[x], definitions[x], inUse)
+		if err != nil {
+			return "", err
+		}
+		stats = append(stats, s)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return less(stats[i], stats[j])
+	})
+	for x := range stats {
+		definitions[x] = stats[x].Definition
+	}
+	return strings.Join(definitions, ","), nil
+}
+
+// utilization is the fraction of the pool in use, a pool without addresses is treated as full
+func utilization(s PoolStats) float64 {
+	if s.Size == 0 {
+		return 1
+	}
+	return float64(s.Used) / float64(s.Size)
+}
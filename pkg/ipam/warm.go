@@ -0,0 +1,131 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+)
+
+// freeLists are the warm pools, keyed by the kind and definition of the pool. They are protected by the managerLock
+var freeLists = map[string]*freeList{}
+
+// freeList caches the free addresses of a pool so that an allocation doesn't have to scan the whole pool
+type freeList struct {
+	// positions is the index of every address in the pool
+	positions map[string]int
+	// free is the free addresses, in the order of the pool
+	free []string
+}
+
+func freeListKey(kind, definition string) string {
+	return kind + ":" + definition
+}
+
+// WarmCidr - caches the free addresses of the cidr, FindAvailableHostFromCidr then takes from the cache
+func WarmCidr(cidr string, inUse []string) error {
+	addresses, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		return err
+	}
+	warm(freeListKey("cidr", cidr), addresses, inUse)
+	return nil
+}
+
+// WarmRange - caches the free addresses of the range, FindAvailableHostFromRange then takes from the cache
+func WarmRange(ipRange string, inUse []string) error {
+	addresses, err := buildAddressesFromRange(ipRange)
+	if err != nil {
+		return err
+	}
+	warm(freeListKey("range", ipRange), addresses, inUse)
+	return nil
+}
+
+func warm(key string, addresses, inUse []string) {
+	used := make(map[string]bool, len(inUse))
+	for x := range inUse {
+		used[inUse[x]] = true
+	}
+	l := &freeList{positions: make(map[string]int, len(addresses))}
+	for x := range addresses {
+		l.positions[addresses[x]] = x
+		if !used[addresses[x]] {
+			l.free = append(l.free, addresses[x])
+		}
+	}
+
+	managerLock.Lock()
+	defer managerLock.Unlock()
+	freeLists[key] = l
+}
+
+// ResetWarm - drops every warm pool, i.e. when the pools have changed
+func ResetWarm() {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+	freeLists = map[string]*freeList{}
+}
+
+// ReleaseWarm - returns the address to the warm pools that contain it
+func ReleaseWarm(address string) {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+	for _, l := range freeLists {
+		l.release(address)
+	}
+}
+
+// warmTake - takes an address from the warm pool, ok is false if the pool isn't warm
+func warmTake(kind, definition string, existingServiceIPS []string, offset int) (address string, ok bool, err error) {
+	l, ok := freeLists[freeListKey(kind, definition)]
+	if !ok {
+		return "", false, nil
+	}
+	if address, found := l.take(existingServiceIPS, offset); found {
+		return address, true, nil
+	}
+	return "", true, fmt.Errorf("%w in warm %s [%s]", ErrNoAddressesAvailable, kind, definition)
+}
+
+// take removes and returns the first free address at or after the offset (wrapping around), addresses that are
+// found to be in use are dropped from the free list
+func (l *freeList) take(existingServiceIPS []string, offset int) (string, bool) {
+	if len(l.free) == 0 {
+		return "", false
+	}
+	inUse := make(map[string]bool, len(existingServiceIPS))
+	for x := range existingServiceIPS {
+		inUse[existingServiceIPS[x]] = true
+	}
+
+	start := 0
+	if offset > 0 && len(l.positions) > 0 {
+		offset %= len(l.positions)
+		start = sort.Search(len(l.free), func(i int) bool { return l.positions[l.free[i]] >= offset })
+	}
+	for len(l.free) > 0 {
+		i := start % len(l.free)
+		address := l.free[i]
+		l.free = append(l.free[:i], l.free[i+1:]...)
+		if !inUse[address] {
+			return address, true
+		}
+		// The next candidate has moved into the same index, unless the search has wrapped around
+		start = i
+	}
+	return "", false
+}
+
+// release returns the address to the free list, in the order of the pool
+func (l *freeList) release(address string) {
+	position, ok := l.positions[address]
+	if !ok {
+		return
+	}
+	i := sort.Search(len(l.free), func(i int) bool { return l.positions[l.free[i]] >= position })
+	if i < len(l.free) && l.free[i] == address {
+		return
+	}
+	l.free = append(l.free, "")
+	copy(l.free[i+1:], l.free[i:])
+	l.free[i] = address
+}
@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+//AfterServiceAnnotation is the name of a service in the same namespace, the address following its address is
+//allocated if it is free
+const AfterServiceAnnotation = "kube-vip.io/after-service"
+
+// preferAdjacent returns the address following the address of the sibling service instead of the discovered
+// address, if it is free and in the same pool
+func (k *kubevipLoadBalancerManager) preferAdjacent(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation, existingServiceIPS []string) *allocation {
+	sibling := service.Annotations[AfterServiceAnnotation]
+	if sibling == "" {
+		return discovered
+	}
+	siblingService, err := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, sibling, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("unable to find service [%s] from [%s] of service [%s]: %v", sibling, AfterServiceAnnotation, service.Name, err)
+		return discovered
+	}
+	siblingAddress := siblingService.Labels["ipam-address"]
+	if siblingAddress == "" {
+		klog.V(2).Infof("service [%s] from [%s] of service [%s] has no address", sibling, AfterServiceAnnotation, service.Name)
+		return discovered
+	}
+	next, err := ipam.NextAddress(siblingAddress)
+	if err != nil {
+		klog.Warningf("unable to find the address after service [%s]: %v", sibling, err)
+		return discovered
+	}
+	if next == discovered.address {
+		return discovered
+	}
+	adjacent, ok := k.preferAddress(ctx, cm, service, discovered, existingServiceIPS, next)
+	if ok {
+		klog.Infof("allocating address [%s] after service [%s] to service [%s]", next, sibling, service.Name)
+	}
+	return adjacent
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func Test_syncLoadBalancerAfterService(t *testing.T) {
+	tests := []struct {
+		name    string
+		sibling string
+		taken   string
+		want    string
+	}{
+		{
+			name:    "next address",
+			sibling: "192.168.0.203",
+			want:    "192.168.0.204",
+		},
+		{
+			name:    "next address taken",
+			sibling: "192.168.0.203",
+			taken:   "192.168.0.204",
+			want:    "192.168.0.201",
+		},
+		{
+			name:    "next address is the broadcast address",
+			sibling: "192.168.0.206",
+			want:    "192.168.0.201",
+		},
+		{
+			name: "sibling without an address",
+			want: "192.168.0.201",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			sibling := newTestService("dev", "sibling")
+			if tt.sibling != "" {
+				sibling.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": tt.sibling}
+				sibling.Spec.LoadBalancerIP = tt.sibling
+			}
+			svc := newTestService("dev", "lb")
+			svc.Annotations = map[string]string{AfterServiceAnnotation: "sibling"}
+			objects := []runtime.Object{sibling, svc}
+			if tt.taken != "" {
+				other := newTestService("staging", "other")
+				other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": tt.taken}
+				other.Spec.LoadBalancerIP = tt.taken
+				objects = append(objects, other)
+			}
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, objects...)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+		})
+	}
+}
+
+func Test_preferAdjacentMissingSibling(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "lb")
+	svc.Annotations = map[string]string{AfterServiceAnnotation: "missing"}
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc)
+
+	discovered := &allocation{address: "192.168.0.201", pool: "cidr-global"}
+	got := k.preferAdjacent(context.TODO(), &v1.ConfigMap{Data: map[string]string{"cidr-global": "192.168.0.200/29"}}, svc, discovered, nil)
+	if got.address != "192.168.0.201" {
+		t.Errorf("preferAdjacent() = %v, want 192.168.0.201", got.address)
+	}
+}
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// WaitForAdvertisement holds back the ingress of a service until kube-vip has advertised its address
+var WaitForAdvertisement bool
+
+// ReserveIngress sets the ingress of a service as soon as its address is allocated, marked as reserved until kube-vip
+// has advertised the address, rather than holding the ingress back
+var ReserveIngress bool
+
+// AdvertisementTimeout is how long the ingress is held back for, once it has passed the ingress is set anyway
+var AdvertisementTimeout = 5 * time.Minute
+
+// ErrNotAdvertised is returned while the address of a service hasn't been advertised by kube-vip, the service is
+// requeued until it is
+var ErrNotAdvertised = errors.New("address not advertised")
+
+const (
+	//AdvertisedAnnotation is set by kube-vip to the host advertising the address of the service
+	AdvertisedAnnotation = "kube-vip.io/vipHost"
+
+	//AdvertisementStatusAnnotation marks an ingress that was set before kube-vip advertised the address, it is removed
+	//once the address is advertised
+	AdvertisementStatusAnnotation = "kube-vip.io/advertisement-status"
+
+	//AdvertisementReserved is the advertisement status of an ingress that is waiting to be advertised
+	AdvertisementReserved = "reserved"
+
+	//AdvertisementTimedOut is the advertisement status of an ingress that wasn't advertised within the timeout
+	AdvertisementTimedOut = "timed-out"
+
+	//ReasonAdvertisementDelayed is the event reason when the address hasn't been advertised within the timeout
+	ReasonAdvertisementDelayed = "AdvertisementDelayed"
+)
+
+// advertisementWaits tracks when the provider started waiting for the address of each service to be advertised
+type advertisementWaits struct {
+	mu      sync.Mutex
+	since   map[types.UID]time.Time
+	delayed map[types.UID]bool
+}
+
+func newAdvertisementWaits() *advertisementWaits {
+	return &advertisementWaits{since: make(map[types.UID]time.Time), delayed: make(map[types.UID]bool)}
+}
+
+// started returns when the wait for the service started, first is true if it started now
+func (a *advertisementWaits) started(uid types.UID, now time.Time) (since time.Time, first bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	since, ok := a.since[uid]
+	if !ok {
+		a.since[uid] = now
+		return now, true
+	}
+	return since, false
+}
+
+// delay marks the wait for the service as timed out, first is true if it wasn't already
+func (a *advertisementWaits) delay(uid types.UID) (first bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	first = !a.delayed[uid]
+	a.delayed[uid] = true
+	return first
+}
+
+// forget stops waiting for the service
+func (a *advertisementWaits) forget(uid types.UID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.since, uid)
+	delete(a.delayed, uid)
+}
+
+// awaitAdvertisement returns the status with the ingress of the allocated address once kube-vip has advertised it,
+// until then an error is returned so that the service is requeued. After the timeout the ingress is set anyway. With
+// reserveIngress the ingress is set at once and marked as reserved until it is advertised (or the timeout passes)
+func (k *kubevipLoadBalancerManager) awaitAdvertisement(ctx context.Context, service *v1.Service, status *v1.LoadBalancerStatus) (*v1.LoadBalancerStatus, error) {
+	recentService, err := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	address := recentService.Labels["ipam-address"]
+	if address == "" {
+		address = recentService.Spec.LoadBalancerIP
+	}
+	// There is nothing to advertise
+	if address == "" {
+		return status, nil
+	}
+	advertised := withIngress(status, address)
+
+	if host := recentService.Annotations[AdvertisedAnnotation]; host != "" {
+		klog.V(2).Infof("address [%s] of service [%s] is advertised by [%s]", address, service.Name, host)
+		k.advertising.forget(service.UID)
+		// The reserved ingress is now advertised
+		if recentService.Annotations[AdvertisementStatusAnnotation] != "" {
+			if err := k.setAdvertisementStatus(ctx, service, ""); err != nil {
+				return nil, err
+			}
+		}
+		return advertised, nil
+	}
+
+	since, first := k.advertising.started(service.UID, k.clock.Now())
+	waited := k.clock.Since(since)
+	if first {
+		klog.V(2).Infof("waiting for address [%s] of service [%s] to be advertised", address, service.Name)
+	}
+	if waited < k.advertisementTimeout {
+		if !k.reserveIngress {
+			return nil, fmt.Errorf("%w, [%s] of service [%s] has been waiting for [%s]", ErrNotAdvertised, address, service.Name, waited.Round(time.Second))
+		}
+		// The ingress is set straight away, the marker tells clients that it isn't reachable yet
+		if recentService.Annotations[AdvertisementStatusAnnotation] != AdvertisementReserved {
+			if err := k.setAdvertisementStatus(ctx, service, AdvertisementReserved); err != nil {
+				return nil, err
+			}
+		}
+		return advertised, nil
+	}
+	// The event is only emitted once, the ingress stays set while the service is still waiting
+	if k.advertising.delay(service.UID) {
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonAdvertisementDelayed, "address [%s] wasn't advertised within [%s], setting the ingress anyway", address, k.advertisementTimeout)
+	}
+	if k.reserveIngress && recentService.Annotations[AdvertisementStatusAnnotation] != AdvertisementTimedOut {
+		if err := k.setAdvertisementStatus(ctx, service, AdvertisementTimedOut); err != nil {
+			return nil, err
+		}
+	}
+	return advertised, nil
+}
+
+// setAdvertisementStatus sets the advertisement status annotation of the service, it is removed if status is empty
+func (k *kubevipLoadBalancerManager) setAdvertisementStatus(ctx context.Context, service *v1.Service, status string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		before := recentService.DeepCopy()
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		if status == "" {
+			delete(recentService.Annotations, AdvertisementStatusAnnotation)
+		} else {
+			recentService.Annotations[AdvertisementStatusAnnotation] = status
+		}
+		if serviceUnchanged(before, recentService) {
+			return nil
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set [%s] on service [%s]: %w", AdvertisementStatusAnnotation, service.Name, err)
+	}
+	return nil
+}
+
+// withIngress returns the status with the address as its ingress, unless it already has ingress (i.e. a hostname)
+func withIngress(status *v1.LoadBalancerStatus, address string) *v1.LoadBalancerStatus {
+	if status != nil && len(status.Ingress) != 0 {
+		return status
+	}
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: address}}}
+}
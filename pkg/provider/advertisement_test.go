@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_waitForAdvertisement(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, svc)
+	k.waitForAdvertisement = true
+	k.clock = clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// The address is allocated, but the ingress is held back until kube-vip advertises it
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); !errors.Is(err, ErrNotAdvertised) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrNotAdvertised)
+	}
+	recent, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if recent.Labels["ipam-address"] != "192.168.0.1" {
+		t.Fatalf("service address = %v, want 192.168.0.1", recent.Labels["ipam-address"])
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), recent); !errors.Is(err, ErrNotAdvertised) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrNotAdvertised)
+	}
+
+	// kube-vip annotates the service once the address is advertised
+	recent.Annotations[AdvertisedAnnotation] = "node-1"
+	if _, err := k.kubeClient.CoreV1().Services("dev").Update(context.TODO(), recent, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := k.syncLoadBalancer(context.TODO(), recent)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != "192.168.0.1" {
+		t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.1", status)
+	}
+}
+
+func Test_waitForAdvertisementTimeout(t *testing.T) {
+	svc := newTestService("dev", "static")
+	svc.Spec.LoadBalancerIP = "192.168.0.10"
+	k := newTestLoadBalancer(nil, svc)
+	k.waitForAdvertisement = true
+	k.advertisementTimeout = time.Minute
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); !errors.Is(err, ErrNotAdvertised) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrNotAdvertised)
+	}
+
+	// Once the timeout has passed the ingress is set anyway, the delay is only reported once
+	fakeClock.Step(time.Minute)
+	for i := 0; i < 2; i++ {
+		status, err := k.syncLoadBalancer(context.TODO(), svc)
+		if err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+		if len(status.Ingress) != 1 || status.Ingress[0].IP != "192.168.0.10" {
+			t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.10", status)
+		}
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if got := strings.Count(strings.Join(events, "\n"), ReasonAdvertisementDelayed); got != 1 {
+		t.Errorf("events = %v, want a single %v", events, ReasonAdvertisementDelayed)
+	}
+}
+
+func Test_reserveIngress(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, svc)
+	k.reserveIngress = true
+	k.clock = clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// The ingress is set as soon as the address is allocated, marked as reserved
+	status, err := k.syncLoadBalancer(context.TODO(), svc)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != "192.168.0.1" {
+		t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.1", status)
+	}
+	recent, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got := recent.Annotations[AdvertisementStatusAnnotation]; got != AdvertisementReserved {
+		t.Errorf("annotation [%s] = %q, want %q", AdvertisementStatusAnnotation, got, AdvertisementReserved)
+	}
+
+	// The marker is removed once kube-vip advertises the address
+	recent.Annotations[AdvertisedAnnotation] = "node-1"
+	if _, err := k.kubeClient.CoreV1().Services("dev").Update(context.TODO(), recent, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if status, err = k.syncLoadBalancer(context.TODO(), recent); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != "192.168.0.1" {
+		t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.1", status)
+	}
+	advertised, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got, ok := advertised.Annotations[AdvertisementStatusAnnotation]; ok {
+		t.Errorf("annotation [%s] = %q once advertised, want it removed", AdvertisementStatusAnnotation, got)
+	}
+}
+
+func Test_reserveIngressTimeout(t *testing.T) {
+	svc := newTestService("dev", "static")
+	svc.Spec.LoadBalancerIP = "192.168.0.10"
+	k := newTestLoadBalancer(nil, svc)
+	k.reserveIngress = true
+	k.advertisementTimeout = time.Minute
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	// The address is never advertised, the reserved ingress is marked as timed out and the delay reported once
+	fakeClock.Step(time.Minute)
+	for i := 0; i < 2; i++ {
+		status, err := k.syncLoadBalancer(context.TODO(), svc)
+		if err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+		if len(status.Ingress) != 1 || status.Ingress[0].IP != "192.168.0.10" {
+			t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.10", status)
+		}
+	}
+	recent, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got := recent.Annotations[AdvertisementStatusAnnotation]; got != AdvertisementTimedOut {
+		t.Errorf("annotation [%s] = %q, want %q", AdvertisementStatusAnnotation, got, AdvertisementTimedOut)
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if got := strings.Count(strings.Join(events, "\n"), ReasonAdvertisementDelayed); got != 1 {
+		t.Errorf("events = %v, want a single %v", events, ReasonAdvertisementDelayed)
+	}
+}
+
+func Test_withIngress(t *testing.T) {
+	hostname := &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{Hostname: "web.example.com"}}}
+	if got := withIngress(hostname, "192.168.0.1"); got != hostname {
+		t.Errorf("withIngress() = %+v, want the hostname ingress kept", got)
+	}
+	if got := withIngress(&v1.LoadBalancerStatus{}, "192.168.0.1"); len(got.Ingress) != 1 || got.Ingress[0].IP != "192.168.0.1" {
+		t.Errorf("withIngress() = %+v, want ingress 192.168.0.1", got)
+	}
+}
@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// allocationStore keeps the addresses observed on services, it backs the metrics and the debug endpoint
+type allocationStore struct {
+	mu          sync.RWMutex
+	allocations map[types.UID]serviceAllocation
+	// sources is where the address of each service came from, static, dynamic or reserved
+	sources map[types.UID]string
+	// addresses is every address of each service, a dual-stack service holds an address of each family
+	addresses map[types.UID][]string
+}
+
+func newAllocationStore() *allocationStore {
+	return &allocationStore{
+		allocations: make(map[types.UID]serviceAllocation),
+		sources:     make(map[types.UID]string),
+		addresses:   make(map[types.UID][]string),
+	}
+}
+
+// set records the address of the service and where it came from, a changed address is counted as an allocation
+func (a *allocationStore) set(service *v1.Service, address, source string) {
+	a.setAddresses(service, []string{address}, source)
+}
+
+// setAddresses records every address of the service, the first is the address it is listed with (the IPv4 address
+// of a dual-stack service)
+func (a *allocationStore) setAddresses(service *v1.Service, addresses []string, source string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	allocation := serviceAllocation{
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		Address:   addresses[0],
+	}
+	if a.allocations[service.UID] != allocation || a.sources[service.UID] != source || !reflect.DeepEqual(a.addresses[service.UID], addresses) {
+		allocationsCounter.WithLabelValues(source).Inc()
+	}
+	a.allocations[service.UID] = allocation
+	a.sources[service.UID] = source
+	a.addresses[service.UID] = addresses
+	a.updateMetrics()
+}
+
+// remove forgets the address of the service
+func (a *allocationStore) remove(uid types.UID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allocations, uid)
+	delete(a.sources, uid)
+	delete(a.addresses, uid)
+	a.updateMetrics()
+}
+
+// list returns the allocations sorted by namespace and name
+func (a *allocationStore) list() []serviceAllocation {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	allocations := make([]serviceAllocation, 0, len(a.allocations))
+	for _, allocation := range a.allocations {
+		allocations = append(allocations, allocation)
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Namespace != allocations[j].Namespace {
+			return allocations[i].Namespace < allocations[j].Namespace
+		}
+		return allocations[i].Name < allocations[j].Name
+	})
+	return allocations
+}
+
+// sourceCount is the number of services in a namespace whose address came from the source
+type sourceCount struct {
+	namespace string
+	source    string
+	count     int
+}
+
+// countBySource returns the number of allocations per namespace and source, sorted, the lock must be held
+func (a *allocationStore) countBySource() []sourceCount {
+	type key struct{ namespace, source string }
+	counts := make(map[key]int)
+	for uid, allocation := range a.allocations {
+		counts[key{allocation.Namespace, a.sources[uid]}]++
+	}
+	bySource := make([]sourceCount, 0, len(counts))
+	for k, count := range counts {
+		bySource = append(bySource, sourceCount{namespace: k.namespace, source: k.source, count: count})
+	}
+	sort.Slice(bySource, func(i, j int) bool {
+		if bySource[i].namespace != bySource[j].namespace {
+			return bySource[i].namespace < bySource[j].namespace
+		}
+		return bySource[i].source < bySource[j].source
+	})
+	return bySource
+}
+
+// counts returns the number of allocations per namespace and source
+func (a *allocationStore) counts() []sourceCount {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.countBySource()
+}
+
+// updateMetrics sets the allocated address gauges per namespace and source, and per service, the lock must be held
+func (a *allocationStore) updateMetrics() {
+	allocationsGauge.Reset()
+	for _, c := range a.countBySource() {
+		allocationsGauge.WithLabelValues(c.namespace, c.source).Set(float64(c.count))
+	}
+
+	serviceAddressesGauge.Reset()
+	for uid, allocation := range a.allocations {
+		serviceAddressesGauge.WithLabelValues(allocation.Namespace, allocation.Name).Set(float64(len(a.addresses[uid])))
+	}
+}
+
+// observedAddress returns the address a service has, whether or not it was allocated by this provider
+func observedAddress(service *v1.Service) string {
+	if service.Spec.LoadBalancerIP != "" {
+		return service.Spec.LoadBalancerIP
+	}
+	return service.Labels["ipam-address"]
+}
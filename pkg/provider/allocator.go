@@ -0,0 +1,198 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Allocator - is a backend that addresses are allocated from, the pools of a backend are the config map keys
+// <kind>-<pool>, i.e. cidr-global. A new backend (i.e. a webhook or a CRD) is added to the allocators
+type Allocator interface {
+	// Kind is the prefix of the config map keys of the pools, i.e. cidr
+	Kind() string
+	// Allocate returns a free address of the pool for the service
+	Allocate(request *AllocationRequest) (*allocation, error)
+	// Bounds returns the addresses of the pool definition, to validate it and find the pool of an address
+	Bounds(definition string) ([]ipam.Bounds, error)
+	// Stats returns the usage of the pool given the addresses that are in use
+	Stats(pool, definition string, inUse []string) (ipam.PoolStats, error)
+	// Prefix returns the network of the address in the pool definition, empty if the pool has no network
+	Prefix(definition, address string) (string, error)
+}
+
+// AllocationRequest - is a request for an address of a pool
+type AllocationRequest struct {
+	// ConfigMap is the kubevip config map
+	ConfigMap *v1.ConfigMap
+	// Service is allocated the address
+	Service *v1.Service
+	// Pool is the name of the pool (i.e. global), Key the config map key (i.e. cidr-global) and Definition its value
+	Pool       string
+	Key        string
+	Definition string
+	// KeyPrefix is prepended to every pool key
+	KeyPrefix string
+	// Existing are the addresses in use
+	Existing []string
+}
+
+// allocators are tried in order for each pool, the first with a key for the pool allocates the address
+var allocators = []Allocator{cidrAllocator{}, rangeAllocator{}, listAllocator{}}
+
+// allocatorFor returns the allocator of the kind of pool, nil if there is none
+func allocatorFor(kind string) Allocator {
+	for _, a := range allocators {
+		if a.Kind() == kind {
+			return a
+		}
+	}
+	return nil
+}
+
+// exhaustedError adds the usage of the pool to an error that it has no free addresses, i.e.
+// pool [cidr-dev] (192.168.0.0/24) is exhausted: 254/254 used. Any other error is returned as it is
+func exhaustedError(allocator Allocator, key, definition string, inUse []string, err error) error {
+	if !errors.Is(err, ipam.ErrNoAddressesAvailable) {
+		return err
+	}
+	stats, statsErr := allocator.Stats(key, definition, ipam.NormalizeAddresses(inUse))
+	if statsErr != nil {
+		klog.Warningf("unable to determine the usage of [%s]: %v", key, statsErr)
+		return err
+	}
+	return fmt.Errorf("%w, pool [%s] (%s) is exhausted: %d/%d used", ipam.ErrNoAddressesAvailable, key, definition, stats.Used, stats.Size)
+}
+
+// cidrAllocator allocates from the hosts of the comma separated cidrs
+type cidrAllocator struct{}
+
+func (cidrAllocator) Kind() string { return "cidr" }
+
+func (c cidrAllocator) Allocate(request *AllocationRequest) (*allocation, error) {
+	cm, service, cidr := request.ConfigMap, request.Service, request.Definition
+	var warnings []string
+	switch {
+	case bestFit(cm):
+		if ordered, err := ipam.BestFitCidr(cidr, request.Existing); err != nil {
+			klog.Warningf("unable to order [%s] [%s] by size: %v", request.Key, cidr, err)
+		} else {
+			cidr = ordered
+		}
+	case roundRobin(cm):
+		if spread, err := ipam.SpreadCidr(cidr, request.Existing); err != nil {
+			klog.Warningf("unable to spread [%s] [%s]: %v", request.Key, cidr, err)
+		} else {
+			cidr = spread
+		}
+	}
+	// Try the preferred subnet of the service first, the rest of the pool is still used if it is full
+	if preferred := service.Annotations[PreferredSubnetAnnotation]; preferred != "" {
+		ordered, err := ipam.PreferCidr(cidr, preferred)
+		if err != nil {
+			warning := fmt.Sprintf("ignoring [%s] for service [%s]: %v", PreferredSubnetAnnotation, service.Name, err)
+			klog.Warning(warning)
+			warnings = append(warnings, warning)
+		} else {
+			cidr = ordered
+		}
+	}
+	vip, err := ipam.FindAvailableHostFromCidrWithOptions(service.Namespace, cidr, withGateways(cm, cidr, request.Existing), cidrOptions(cm, request.KeyPrefix, request.Pool, service))
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := c.Prefix(cidr, vip)
+	if err != nil {
+		klog.Warningf("unable to determine prefix of [%s] in [%s]: %v", vip, request.Key, err)
+	}
+	return &allocation{address: vip, pool: request.Key, prefix: prefix, warnings: warnings}, nil
+}
+
+func (cidrAllocator) Bounds(definition string) ([]ipam.Bounds, error) {
+	return ipam.CidrBounds(definition)
+}
+
+func (cidrAllocator) Stats(pool, definition string, inUse []string) (ipam.PoolStats, error) {
+	return ipam.CidrStats(pool, definition, inUse)
+}
+
+func (cidrAllocator) Prefix(definition, address string) (string, error) {
+	return ipam.PrefixFromCidr(definition, address)
+}
+
+// rangeAllocator allocates from the comma separated first-last ranges
+type rangeAllocator struct{}
+
+func (rangeAllocator) Kind() string { return "range" }
+
+func (r rangeAllocator) Allocate(request *AllocationRequest) (*allocation, error) {
+	ipRange := request.Definition
+	switch {
+	case bestFit(request.ConfigMap):
+		if ordered, err := ipam.BestFitRange(ipRange, request.Existing); err != nil {
+			klog.Warningf("unable to order [%s] [%s] by size: %v", request.Key, ipRange, err)
+		} else {
+			ipRange = ordered
+		}
+	case roundRobin(request.ConfigMap):
+		if spread, err := ipam.SpreadRange(ipRange, request.Existing); err != nil {
+			klog.Warningf("unable to spread [%s] [%s]: %v", request.Key, ipRange, err)
+		} else {
+			ipRange = spread
+		}
+	}
+	vip, err := ipam.FindAvailableHostFromRangeWithOptions(request.Service.Namespace, ipRange, request.Existing, ipam.Options{Parity: octetParity(request.ConfigMap), Descending: descending(request.ConfigMap)})
+	// The range is only parsed once it is allocated from, so name the key that needs fixing
+	if errors.Is(err, ipam.ErrInvalidRange) {
+		return nil, fmt.Errorf("%w in [%s]", err, request.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := r.Prefix(ipRange, vip)
+	if err != nil {
+		klog.Warningf("unable to determine prefix of [%s] in [%s]: %v", vip, request.Key, err)
+	}
+	return &allocation{address: vip, pool: request.Key, prefix: prefix}, nil
+}
+
+func (rangeAllocator) Bounds(definition string) ([]ipam.Bounds, error) {
+	return ipam.RangeBounds(definition)
+}
+
+func (rangeAllocator) Stats(pool, definition string, inUse []string) (ipam.PoolStats, error) {
+	return ipam.RangeStats(pool, definition, inUse)
+}
+
+func (rangeAllocator) Prefix(definition, address string) (string, error) {
+	return ipam.PrefixFromRange(definition, address)
+}
+
+// listAllocator allocates from the comma separated addresses, in the order they are listed
+type listAllocator struct{}
+
+func (listAllocator) Kind() string { return "list" }
+
+func (listAllocator) Allocate(request *AllocationRequest) (*allocation, error) {
+	vip, err := ipam.FindAvailableHostFromList(request.Definition, request.Existing)
+	if err != nil {
+		return nil, err
+	}
+	return &allocation{address: vip, pool: request.Key}, nil
+}
+
+func (listAllocator) Bounds(definition string) ([]ipam.Bounds, error) {
+	return ipam.ListBounds(definition)
+}
+
+func (listAllocator) Stats(pool, definition string, inUse []string) (ipam.PoolStats, error) {
+	return ipam.ListStats(pool, definition, inUse)
+}
+
+// Prefix is always empty, the addresses of a list needn't share a network
+func (listAllocator) Prefix(definition, address string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,187 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_discoverPoolAddressDispatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantPool  string
+		wantAddr  string
+		wantFound bool
+	}{
+		{
+			name:      "cidr before range and list",
+			data:      map[string]string{"cidr-dev": "192.168.0.0/29", "range-dev": "192.168.1.10-192.168.1.20", "list-dev": "192.168.2.10"},
+			wantPool:  "cidr-dev",
+			wantAddr:  "192.168.0.1",
+			wantFound: true,
+		},
+		{
+			name:      "range before list",
+			data:      map[string]string{"range-dev": "192.168.1.10-192.168.1.20", "list-dev": "192.168.2.10"},
+			wantPool:  "range-dev",
+			wantAddr:  "192.168.1.10",
+			wantFound: true,
+		},
+		{
+			name:      "list",
+			data:      map[string]string{"list-dev": "192.168.2.20,192.168.2.10"},
+			wantPool:  "list-dev",
+			wantAddr:  "192.168.2.20",
+			wantFound: true,
+		},
+		{
+			name:      "cordoned cidr falls through to the list",
+			data:      map[string]string{"cidr-dev": "192.168.0.0/29", "list-dev": "192.168.2.10", CordonedPoolsKey: "cidr-dev"},
+			wantPool:  "list-dev",
+			wantAddr:  "192.168.2.10",
+			wantFound: true,
+		},
+		{
+			name: "no pool",
+			data: map[string]string{"list-staging": "192.168.2.10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			cm := &v1.ConfigMap{Data: tt.data}
+			a, found, err := discoverPoolAddress(cm, newTestService("dev", "web"), "dev", KubeVipClientConfig, "", nil)
+			if err != nil {
+				t.Fatalf("discoverPoolAddress() error = %v", err)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("discoverPoolAddress() found = %v, want %v", found, tt.wantFound)
+			}
+			if !found {
+				return
+			}
+			if a.pool != tt.wantPool || a.address != tt.wantAddr {
+				t.Errorf("discoverPoolAddress() = [%s] from [%s], want [%s] from [%s]", a.address, a.pool, tt.wantAddr, tt.wantPool)
+			}
+		})
+	}
+}
+
+func Test_allocators(t *testing.T) {
+	tests := []struct {
+		kind       string
+		definition string
+		existing   []string
+		want       string
+		wantPrefix string
+		wantSize   int
+	}{
+		{kind: "cidr", definition: "192.168.0.0/29", existing: []string{"192.168.0.1"}, want: "192.168.0.2", wantPrefix: "192.168.0.0/29", wantSize: 6},
+		{kind: "range", definition: "192.168.1.10-192.168.1.12", existing: []string{"192.168.1.10"}, want: "192.168.1.11", wantPrefix: "192.168.1.8/29", wantSize: 3},
+		{kind: "list", definition: "192.168.2.20,192.168.2.10", existing: []string{"192.168.2.20"}, want: "192.168.2.10", wantSize: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			ipam.Manager = nil
+			allocator := allocatorFor(tt.kind)
+			if allocator == nil {
+				t.Fatalf("allocatorFor(%v) = nil", tt.kind)
+			}
+			key := tt.kind + "-dev"
+			a, err := allocator.Allocate(&AllocationRequest{
+				ConfigMap:  &v1.ConfigMap{Data: map[string]string{key: tt.definition}},
+				Service:    newTestService("dev", "web"),
+				Pool:       "dev",
+				Key:        key,
+				Definition: tt.definition,
+				Existing:   tt.existing,
+			})
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if a.address != tt.want || a.pool != key || a.prefix != tt.wantPrefix {
+				t.Errorf("Allocate() = %+v, want [%s] from [%s] with prefix [%s]", a, tt.want, key, tt.wantPrefix)
+			}
+
+			bounds, err := allocator.Bounds(tt.definition)
+			if err != nil || len(bounds) == 0 {
+				t.Fatalf("Bounds() = %v, %v", bounds, err)
+			}
+			stats, err := allocator.Stats(key, tt.definition, tt.existing)
+			if err != nil {
+				t.Fatalf("Stats() error = %v", err)
+			}
+			if stats.Size != tt.wantSize || stats.Used != 1 {
+				t.Errorf("Stats() = %+v, want size %d with 1 used", stats, tt.wantSize)
+			}
+		})
+	}
+	if allocatorFor("webhook") != nil {
+		t.Errorf("allocatorFor(webhook) is set, want nil")
+	}
+}
+
+func Test_syncLoadBalancerFromList(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("dev", "first")
+	second := newTestService("dev", "second")
+	k := newTestLoadBalancer(map[string]string{"list-dev": "192.168.2.20,192.168.2.10"}, first, second)
+
+	for _, tt := range []struct {
+		svc  *v1.Service
+		want string
+	}{{first, "192.168.2.20"}, {second, "192.168.2.10"}} {
+		if _, err := k.syncLoadBalancer(context.TODO(), tt.svc); err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+		got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), tt.svc.Name, metav1.GetOptions{})
+		if got.Spec.LoadBalancerIP != tt.want {
+			t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+		}
+	}
+}
+
+func Test_exhaustedError(t *testing.T) {
+	ipam.Manager = nil
+	cidr := "192.168.0.0/30"
+	existing := []string{"192.168.0.1", "192.168.0.2", "192.168.1.1"}
+	_, err := ipam.FindAvailableHostFromCidr("dev", cidr, existing)
+
+	got := exhaustedError(cidrAllocator{}, "cidr-dev", cidr, existing, err)
+	if !errors.Is(got, ipam.ErrNoAddressesAvailable) {
+		t.Errorf("exhaustedError() = %v, want %v", got, ipam.ErrNoAddressesAvailable)
+	}
+	if want := "pool [cidr-dev] (192.168.0.0/30) is exhausted: 2/2 used"; !strings.Contains(got.Error(), want) {
+		t.Errorf("exhaustedError() = %v, want it to contain %q", got, want)
+	}
+
+	// Other errors are returned as they are
+	other := errors.New("unable to parse")
+	if got := exhaustedError(cidrAllocator{}, "cidr-dev", cidr, existing, other); got != other {
+		t.Errorf("exhaustedError() = %v, want %v", got, other)
+	}
+}
+
+func Test_syncLoadBalancerReversedRange(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.200-192.168.0.10"}, svc)
+
+	_, err := k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ipam.ErrRangeReversed) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ipam.ErrRangeReversed)
+	}
+	if !strings.Contains(err.Error(), "[range-dev]") {
+		t.Errorf("syncLoadBalancer() error = %v, want it to name the key [range-dev]", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Annotations[IPAMStatusAnnotation] != IPAMStatusInvalidPool {
+		t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], IPAMStatusInvalidPool)
+	}
+}
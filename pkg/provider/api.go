@@ -0,0 +1,336 @@
+package provider
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// APIAddress is the address that the allocation API listens on, the API is disabled if empty
+var APIAddress string
+
+// APITokenFile contains the bearer token that clients of the allocation API must present
+var APITokenFile string
+
+// APITLSCert and APITLSKey serve the allocation API over TLS
+var APITLSCert, APITLSKey string
+
+// APIClientCA is the CA that client certificates of the allocation API must be signed by (mTLS)
+var APIClientCA string
+
+// KubeVipAPIAllocations is the config map (in kube-system) that records the addresses allocated through the API
+const KubeVipAPIAllocations = "kubevip-api-allocations"
+
+// ErrNotAllocated is returned when releasing an address that wasn't allocated through the API
+var ErrNotAllocated = errors.New("address not allocated")
+
+// ErrInvalidRequest is returned when an API request has an invalid namespace or key
+var ErrInvalidRequest = errors.New("invalid request")
+
+// apiAllocateRequest asks for an address for the key, allocating the same key again returns the same address
+type apiAllocateRequest struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+// apiReleaseRequest releases an address allocated through the API
+type apiReleaseRequest struct {
+	Namespace string `json:"namespace"`
+	Address   string `json:"address"`
+}
+
+// apiAllocation is the response of an allocation
+type apiAllocation struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Address   string `json:"address"`
+}
+
+// apiAllocationKey is the config map key of an allocation, namespaces can't contain a "."
+func apiAllocationKey(namespace, key string) string {
+	return namespace + "." + key
+}
+
+// apiService stands in for a service so that API allocations share the allocation logic and state of services
+func apiService(namespace, key string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      key,
+			UID:       types.UID("api/" + apiAllocationKey(namespace, key)),
+		},
+	}
+}
+
+// apiAddresses returns the addresses allocated through the API in the namespace, or every namespace if it is empty
+func (k *kubevipLoadBalancerManager) apiAddresses(ctx context.Context, namespace string) ([]string, error) {
+	cm, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipAPIAllocations, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for key, address := range cm.Data {
+		if namespace == v1.NamespaceAll || strings.HasPrefix(key, namespace+".") {
+			addresses = append(addresses, ipam.NormalizeAddress(address))
+		}
+	}
+	return addresses, nil
+}
+
+// apiAllocate allocates an address for the key from the pools of the namespace
+func (k *kubevipLoadBalancerManager) apiAllocate(ctx context.Context, namespace, key string) (string, error) {
+	if k.observeOnly {
+		return "", fmt.Errorf("addresses aren't allocated in observe only mode")
+	}
+	if errs := validation.IsDNS1123Label(namespace); len(errs) != 0 {
+		return "", fmt.Errorf("%w, namespace [%s]: %s", ErrInvalidRequest, namespace, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) != 0 {
+		return "", fmt.Errorf("%w, key [%s]: %s", ErrInvalidRequest, key, strings.Join(errs, ", "))
+	}
+
+	unlock := k.allocationLock.lock()
+	defer unlock()
+
+	allocationsCM, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipAPIAllocations, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		allocationsCM, err = k.kubeClient.CoreV1().ConfigMaps("kube-system").Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: KubeVipAPIAllocations, Namespace: "kube-system"},
+		}, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return "", err
+	}
+	if address, ok := allocationsCM.Data[apiAllocationKey(namespace, key)]; ok {
+		return address, nil
+	}
+
+	controllerCM, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return "", err
+	}
+	if k.isPaused(controllerCM) {
+		return "", fmt.Errorf("%w, [%s] is allocated once unpaused", ErrPaused, apiAllocationKey(namespace, key))
+	}
+	if namespaceDisabled(controllerCM, namespace) {
+		return "", fmt.Errorf("allocation is disabled for namespace [%s] by [%s]", namespace, DisabledNamespacesKey)
+	}
+	existingServiceIPS, err := k.existingAddresses(ctx)
+	if err != nil {
+		return "", err
+	}
+	environment, err := k.namespaceEnvironment(ctx, controllerCM, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	service := apiService(namespace, key)
+	discovered, err := discoverAddress(controllerCM, service, environment, k.cloudConfigMap, k.keyPrefix, existingServiceIPS)
+	if err != nil {
+		return "", err
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentCM, getErr := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipAPIAllocations, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentCM.Data == nil {
+			recentCM.Data = make(map[string]string)
+		}
+		recentCM.Data[apiAllocationKey(namespace, key)] = discovered.address
+		_, updateErr := k.kubeClient.CoreV1().ConfigMaps("kube-system").Update(ctx, recentCM, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to record allocation of [%s] to [%s]: %w", discovered.address, apiAllocationKey(namespace, key), err)
+	}
+	klog.Infof("allocated address [%s] from [%s] to API key [%s]", discovered.address, discovered.pool, apiAllocationKey(namespace, key))
+	k.allocations.set(service, discovered.address, SourceDynamic)
+	k.quotaAllocated(ctx, controllerCM, service, true)
+	return discovered.address, nil
+}
+
+// apiRelease releases an address allocated through the API
+func (k *kubevipLoadBalancerManager) apiRelease(ctx context.Context, namespace, address string) error {
+	if k.releasePaused(ctx) {
+		return fmt.Errorf("%w, [%s] in namespace [%s] is released once unpaused", ErrPaused, address, namespace)
+	}
+	unlock := k.allocationLock.lock()
+	defer unlock()
+
+	address = ipam.NormalizeAddress(address)
+	var released string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentCM, getErr := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipAPIAllocations, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		released = ""
+		for key, allocated := range recentCM.Data {
+			if strings.HasPrefix(key, namespace+".") && ipam.NormalizeAddress(allocated) == address {
+				released = key
+				delete(recentCM.Data, key)
+				break
+			}
+		}
+		if released == "" {
+			return nil
+		}
+		_, updateErr := k.kubeClient.CoreV1().ConfigMaps("kube-system").Update(ctx, recentCM, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if apierrors.IsNotFound(err) || (err == nil && released == "") {
+		return fmt.Errorf("%w, [%s] in namespace [%s]", ErrNotAllocated, address, namespace)
+	}
+	if err != nil {
+		return err
+	}
+	klog.Infof("released address [%s] from API key [%s]", address, released)
+	k.releaseWarm(address)
+	k.allocations.remove(apiService(namespace, strings.TrimPrefix(released, namespace+".")).UID)
+	return nil
+}
+
+// apiHandler serves the allocation API, every request must present the token (if set)
+func (k *kubevipLoadBalancerManager) apiHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/allocate", func(w http.ResponseWriter, r *http.Request) {
+		var req apiAllocateRequest
+		if !decodeAPIRequest(w, r, &req) {
+			return
+		}
+		address, err := k.apiAllocate(r.Context(), req.Namespace, req.Key)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResponse(w, apiAllocation{Namespace: req.Namespace, Key: req.Key, Address: address})
+	})
+	mux.HandleFunc("/v1/release", func(w http.ResponseWriter, r *http.Request) {
+		var req apiReleaseRequest
+		if !decodeAPIRequest(w, r, &req) {
+			return
+		}
+		if err := k.apiRelease(r.Context(), req.Namespace, req.Address); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAPIResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		klog.Errorf("unable to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrInvalidRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrNotAllocated):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNoPoolConfigured), errors.Is(err, ipam.ErrNoAddressesAvailable):
+		status = http.StatusConflict
+	case errors.Is(err, ErrPaused):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// serveAPI serves the allocation API on the address until stop is closed, the API isn't served without a token
+// or client CA to authenticate clients with, or without TLS as the token would be sent in the clear
+func (k *kubevipLoadBalancerManager) serveAPI(stop <-chan struct{}) {
+	var token string
+	if APITokenFile != "" {
+		b, err := ioutil.ReadFile(APITokenFile)
+		if err != nil {
+			klog.Errorf("unable to read allocation API token: %v", err)
+			return
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" && APIClientCA == "" {
+		klog.Errorf("not serving the allocation API on [%s], a token file or client CA is required", APIAddress)
+		return
+	}
+	if APITLSCert == "" || APITLSKey == "" {
+		klog.Errorf("not serving the allocation API on [%s], --api-tls-cert and --api-tls-key are required", APIAddress)
+		return
+	}
+
+	server := &http.Server{
+		Addr:              APIAddress,
+		Handler:           k.apiHandler(token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if APIClientCA != "" {
+		b, err := ioutil.ReadFile(APIClientCA)
+		if err != nil {
+			klog.Errorf("unable to read allocation API client CA: %v", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			klog.Errorf("no certificates found in allocation API client CA [%s]", APIClientCA)
+			return
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}
+	}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	klog.Infof("serving allocation API on [%s]", APIAddress)
+	if err := server.ListenAndServeTLS(APITLSCert, APITLSKey); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("allocation API failed: %v", err)
+	}
+}
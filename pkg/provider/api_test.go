@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func apiRequest(handler http.Handler, token, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_apiHandler(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30", QuotaKeyPrefix + "dev": "2"}, svc)
+	k.api = true
+	handler := k.apiHandler("secret")
+
+	if rec := apiRequest(handler, "wrong", "/v1/allocate", `{"namespace":"dev","key":"gateway"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("allocate with the wrong token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec := apiRequest(handler, "secret", "/v1/allocate", `{"namespace":"dev","key":"gateway"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("allocate = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+	var allocated apiAllocation
+	if err := json.Unmarshal(rec.Body.Bytes(), &allocated); err != nil || allocated.Address != "192.168.0.201" {
+		t.Fatalf("allocate = %s, want 192.168.0.201", rec.Body.String())
+	}
+	// The allocation counts towards the quota of the namespace
+	if got, _ := testutil.GetGaugeMetricValue(quotaUsedGauge.WithLabelValues("dev")); got != 1 {
+		t.Errorf("quota used metric = %v, want 1", got)
+	}
+
+	// The same key is given the same address
+	rec = apiRequest(handler, "secret", "/v1/allocate", `{"namespace":"dev","key":"gateway"}`)
+	if err := json.Unmarshal(rec.Body.Bytes(), &allocated); err != nil || allocated.Address != "192.168.0.201" {
+		t.Errorf("allocate again = %s, want 192.168.0.201", rec.Body.String())
+	}
+
+	// Services don't receive an address allocated through the API
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.202" {
+		t.Errorf("syncLoadBalancer() allocated %v, want 192.168.0.202", got.Spec.LoadBalancerIP)
+	}
+
+	// The API doesn't hand out addresses used by services either, and the pool is now exhausted
+	if rec := apiRequest(handler, "secret", "/v1/allocate", `{"namespace":"dev","key":"other"}`); rec.Code != http.StatusConflict {
+		t.Errorf("allocate from an exhausted pool = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusConflict)
+	}
+
+	// Nothing is allocated or released while paused
+	k.paused = true
+	if rec := apiRequest(handler, "secret", "/v1/allocate", `{"namespace":"dev","key":"paused"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("allocate while paused = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusServiceUnavailable)
+	}
+	if rec := apiRequest(handler, "secret", "/v1/release", `{"namespace":"dev","address":"192.168.0.201"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("release while paused = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusServiceUnavailable)
+	}
+	k.paused = false
+
+	if rec := apiRequest(handler, "secret", "/v1/release", `{"namespace":"dev","address":"192.168.0.201"}`); rec.Code != http.StatusNoContent {
+		t.Errorf("release = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusNoContent)
+	}
+	if rec := apiRequest(handler, "secret", "/v1/release", `{"namespace":"dev","address":"192.168.0.201"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("release again = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := apiRequest(handler, "secret", "/v1/allocate", `{"namespace":"dev","key":"bad/key"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("allocate with an invalid key = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+// AllocationAudit records every allocation as an IPAllocation object, these outlive the events of a service
+var AllocationAudit bool
+
+// auditActor is recorded as the actor of every IPAllocation
+const auditActor = "kube-vip-cloud-provider"
+
+// ipAllocationResource is the IPAllocation custom resource (manifest/ipallocation-crd.yaml)
+var ipAllocationResource = schema.GroupVersionResource{Group: "kube-vip.io", Version: "v1alpha1", Resource: "ipallocations"}
+
+// allocationAudit writes an IPAllocation for each allocated service, named after the service. The IPAllocation
+// is owned by the service so it is also removed by the garbage collector if the release is missed
+type allocationAudit struct {
+	client dynamic.Interface
+}
+
+func newAllocationAudit(client dynamic.Interface) *allocationAudit {
+	return &allocationAudit{client: client}
+}
+
+// allocated creates or updates the IPAllocation of the service, auditing is best effort so failures are only logged
+func (a *allocationAudit) allocated(ctx context.Context, service *v1.Service, address, pool string) {
+	if a == nil {
+		return
+	}
+	spec := map[string]interface{}{
+		"service": map[string]interface{}{
+			"namespace": service.Namespace,
+			"name":      service.Name,
+			"uid":       string(service.UID),
+		},
+		"address":     address,
+		"pool":        pool,
+		"allocatedAt": time.Now().UTC().Format(time.RFC3339),
+		"actor":       auditActor,
+	}
+
+	ipAllocations := a.client.Resource(ipAllocationResource).Namespace(service.Namespace)
+	existing, err := ipAllocations.Get(ctx, service.Name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		obj.SetAPIVersion(ipAllocationResource.GroupVersion().String())
+		obj.SetKind("IPAllocation")
+		obj.SetNamespace(service.Namespace)
+		obj.SetName(service.Name)
+		obj.SetOwnerReferences([]metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       service.Name,
+			UID:        service.UID,
+		}})
+		_, err = ipAllocations.Create(ctx, obj, metav1.CreateOptions{})
+	case err == nil:
+		existing.Object["spec"] = spec
+		_, err = ipAllocations.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		klog.Warningf("unable to record IPAllocation for service [%s/%s]: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// released deletes the IPAllocation of the service
+func (a *allocationAudit) released(ctx context.Context, service *v1.Service) {
+	if a == nil {
+		return
+	}
+	err := a.client.Resource(ipAllocationResource).Namespace(service.Namespace).Delete(ctx, service.Name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Warningf("unable to delete IPAllocation for service [%s/%s]: %v", service.Namespace, service.Name, err)
+	}
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+)
+
+// AuditChannelDir is a directory that the allocations and releases of each audit channel are appended to, as
+// <channel>.log. They are only logged if it isn't set
+var AuditChannelDir string
+
+const (
+	//AuditChannelKeyPrefix is followed by the pool, i.e. audit-channel-prod: security, the allocations and releases
+	//of the cidr-prod, range-prod or list-prod pool are logged to the channel
+	AuditChannelKeyPrefix = "audit-channel-"
+
+	//DefaultAuditChannel is the audit channel of a pool without one
+	DefaultAuditChannel = "default"
+)
+
+// poolName returns the name of the pool of the config map key, i.e. prod for cidr-prod
+func poolName(key, keyPrefix string) string {
+	kind := poolKind(key, keyPrefix)
+	if kind == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, keyPrefix+kind+"-")
+}
+
+// auditChannel returns the audit channel of the pool key, a channel must be a DNS label as it names a file
+func auditChannel(cm *v1.ConfigMap, keyPrefix, key string) string {
+	if cm == nil || key == "" {
+		return DefaultAuditChannel
+	}
+	channelKey := keyPrefix + AuditChannelKeyPrefix + poolName(key, keyPrefix)
+	channel, ok := cm.Data[channelKey]
+	if !ok {
+		return DefaultAuditChannel
+	}
+	if errs := validation.IsDNS1123Label(channel); len(errs) != 0 {
+		klog.Warningf("ignoring [%s] [%s], it isn't a DNS label: %s", channelKey, channel, strings.Join(errs, ", "))
+		return DefaultAuditChannel
+	}
+	return channel
+}
+
+// auditChannels writes the allocation and release lines of each channel, tagged with the channel and appended to
+// the file of the channel if there is a directory
+type auditChannels struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newAuditChannels() *auditChannels {
+	return &auditChannels{dir: AuditChannelDir}
+}
+
+// log writes the line to the channel, auditing is best effort so failures are only logged
+func (a *auditChannels) log(channel, line string) {
+	klog.Infof("audit channel [%s]: %s", channel, line)
+	if a.dir == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(a.dir, channel+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		klog.Warningf("unable to open audit channel [%s]: %v", channel, err)
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		klog.Warningf("unable to write to audit channel [%s]: %v", channel, err)
+	}
+}
+
+// auditAllocated logs the allocation to the audit channel of its pool
+func (k *kubevipLoadBalancerManager) auditAllocated(cm *v1.ConfigMap, service *v1.Service, address, pool, source string) {
+	k.auditChannels.log(auditChannel(cm, k.keyPrefix, pool), fmt.Sprintf("allocated address [%s] from pool [%s] to service [%s/%s] source [%s]", address, pool, service.Namespace, service.Name, source))
+}
+
+// auditReleased logs the release to the audit channel of the pool that contains the address
+func (k *kubevipLoadBalancerManager) auditReleased(ctx context.Context, service *v1.Service, address string) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		klog.V(2).Infof("unable to find the pool of released address [%s]: %v", address, err)
+	}
+	var pool string
+	if cm != nil {
+		keys, bounds, _ := poolBounds(cm, k.keyPrefix)
+		pool, _ = poolContaining(keys, bounds, address)
+	}
+	k.auditChannels.log(auditChannel(cm, k.keyPrefix, pool), fmt.Sprintf("released address [%s] of pool [%s] from service [%s/%s]", address, pool, service.Namespace, service.Name))
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_auditChannel(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		AuditChannelKeyPrefix + "prod":    "security",
+		AuditChannelKeyPrefix + "staging": "Not A Label",
+	}}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"cidr-prod", "security"},
+		{"range-prod", "security"},
+		{"list-prod", "security"},
+		{"cidr-dev", DefaultAuditChannel},
+		{"cidr-staging", DefaultAuditChannel},
+		{"", DefaultAuditChannel},
+	}
+	for _, tt := range tests {
+		if got := auditChannel(cm, "", tt.key); got != tt.want {
+			t.Errorf("auditChannel(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func Test_auditChannelRouting(t *testing.T) {
+	ipam.Manager = nil
+	prod := newTestService("prod", "lb")
+	dev := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-prod":                    "192.168.0.0/29",
+		"range-dev":                    "192.168.1.10-192.168.1.20",
+		AuditChannelKeyPrefix + "prod": "security",
+	}, prod, dev)
+	dir := t.TempDir()
+	k.auditChannels = &auditChannels{dir: dir}
+
+	for _, svc := range []*v1.Service{prod, dev} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s/%s) error = %v", svc.Namespace, svc.Name, err)
+		}
+	}
+	deleted, _ := k.kubeClient.CoreV1().Services("prod").Get(context.TODO(), prod.Name, metav1.GetOptions{})
+	if err := k.deleteLoadBalancer(context.TODO(), deleted); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+
+	read := func(channel string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, channel+".log"))
+		if err != nil {
+			t.Fatalf("unable to read channel [%s]: %v", channel, err)
+		}
+		return string(b)
+	}
+	security := read("security")
+	for _, want := range []string{
+		"allocated address [192.168.0.1] from pool [cidr-prod] to service [prod/lb] source [dynamic]",
+		"released address [192.168.0.1] of pool [cidr-prod] from service [prod/lb]",
+	} {
+		if !strings.Contains(security, want) {
+			t.Errorf("channel [security] = %q, want it to contain %q", security, want)
+		}
+	}
+	if strings.Contains(security, "dev/lb") {
+		t.Errorf("channel [security] = %q, want no lines of pool range-dev", security)
+	}
+	if got := read(DefaultAuditChannel); !strings.Contains(got, "allocated address [192.168.1.10] from pool [range-dev] to service [dev/lb]") || strings.Contains(got, "prod/lb") {
+		t.Errorf("channel [%s] = %q, want only the allocation of pool range-dev", DefaultAuditChannel, got)
+	}
+}
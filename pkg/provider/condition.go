@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	//IPAMConditionAnnotation is a condition (as JSON) with the machine-readable reason an address could not be
+	//allocated, the service status of this api version has no conditions field
+	IPAMConditionAnnotation = "kube-vip.io/ipam-condition"
+
+	//ConditionAddressAllocated is the type of the condition, it is only set while its status is False
+	ConditionAddressAllocated = "AddressAllocated"
+)
+
+// ipamCondition returns the condition of the service, or nil if it has none or it can't be parsed
+func ipamCondition(annotations map[string]string) *metav1.Condition {
+	value := annotations[IPAMConditionAnnotation]
+	if value == "" {
+		return nil
+	}
+	condition := &metav1.Condition{}
+	if err := json.Unmarshal([]byte(value), condition); err != nil {
+		return nil
+	}
+	return condition
+}
+
+// setIPAMCondition sets the condition of a failed allocation, changed is false if the condition already has the
+// reason. The message and transition time of an unchanged reason are kept, so that a reconcile doesn't update the service
+func setIPAMCondition(annotations map[string]string, reason, message string, now metav1.Time) (changed bool) {
+	if existing := ipamCondition(annotations); existing != nil && existing.Reason == reason {
+		return false
+	}
+	value, _ := json.Marshal(metav1.Condition{
+		Type:               ConditionAddressAllocated,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: now,
+	})
+	annotations[IPAMConditionAnnotation] = string(value)
+	return true
+}
+
+// clearIPAMStatus removes the status and condition of a failed allocation
+func clearIPAMStatus(annotations map[string]string) {
+	delete(annotations, IPAMStatusAnnotation)
+	delete(annotations, IPAMConditionAnnotation)
+}
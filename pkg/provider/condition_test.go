@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func Test_ipamCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]string
+		requested  string
+		wantReason string
+	}{
+		{"no pool configured", map[string]string{"cidr-prod": "192.168.0.0/24"}, "", ReasonNoPoolConfigured},
+		{"pool exhausted", map[string]string{"range-dev": "192.168.0.201-192.168.0.201"}, "", ReasonPoolExhausted},
+		{"invalid static address", map[string]string{"cidr-dev": "192.168.0.0/24"}, "192.168.0.0", ReasonInvalidAddress},
+		{"reversed range", map[string]string{"range-dev": "192.168.0.200-192.168.0.10"}, "", ReasonInvalidPool},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			used := newTestService("dev", "used")
+			used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+			svc := newTestService("dev", "failed")
+			svc.Spec.LoadBalancerIP = tt.requested
+			k := newTestLoadBalancer(tt.data, used, svc)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err == nil {
+				t.Fatal("syncLoadBalancer() error = nil, want an allocation failure")
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			condition := ipamCondition(got.Annotations)
+			if condition == nil {
+				t.Fatalf("annotation [%s] = %q, want a condition", IPAMConditionAnnotation, got.Annotations[IPAMConditionAnnotation])
+			}
+			if condition.Type != ConditionAddressAllocated || condition.Status != metav1.ConditionFalse || condition.Reason != tt.wantReason {
+				t.Errorf("condition = %s %s %s, want %s False %s", condition.Type, condition.Status, condition.Reason, ConditionAddressAllocated, tt.wantReason)
+			}
+			if condition.Message == "" {
+				t.Errorf("condition has no message")
+			}
+		})
+	}
+}
+
+func Test_ipamConditionTransition(t *testing.T) {
+	ipam.Manager = nil
+	used := newTestService("dev", "used")
+	used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc := newTestService("dev", "exhausted")
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.201-192.168.0.201"}, used, svc)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+
+	_, _ = k.syncLoadBalancer(context.TODO(), svc)
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	first := ipamCondition(got.Annotations)
+	if first == nil {
+		t.Fatalf("annotation [%s] isn't set", IPAMConditionAnnotation)
+	}
+
+	// An unchanged reason keeps its transition time
+	fakeClock.Step(time.Minute)
+	_, _ = k.syncLoadBalancer(context.TODO(), svc)
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if again := ipamCondition(got.Annotations); again == nil || !again.LastTransitionTime.Equal(&first.LastTransitionTime) {
+		t.Errorf("condition = %+v, want the transition time of %+v", again, first)
+	}
+
+	// An allocation clears the condition
+	if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), used.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if _, ok := got.Annotations[IPAMConditionAnnotation]; ok {
+		t.Errorf("annotation [%s] = %q, want it removed", IPAMConditionAnnotation, got.Annotations[IPAMConditionAnnotation])
+	}
+	if _, ok := got.Annotations[IPAMStatusAnnotation]; ok {
+		t.Errorf("annotation [%s] = %q, want it removed", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation])
+	}
+}
@@ -2,6 +2,11 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -46,9 +51,87 @@ import (
 // 	return
 // }
 
+// configList returns the comma separated values of a key in the configMap, empty values are ignored
+func configList(cm *v1.ConfigMap, key string) []string {
+	var values []string
+	for _, value := range strings.Split(cm.Data[key], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// ErrUndefinedVariable is returned when a config map value references an environment variable that isn't set
+var ErrUndefinedVariable = errors.New("undefined environment variable")
+
+// ConfigVariablePrefix is the prefix of the environment variables that a config map value can reference, the rest
+// of the environment (i.e. credentials) can't be read through the config map
+const ConfigVariablePrefix = "KUBEVIP_"
+
+// configVariable is a ${VAR} reference in a config map value, $VAR is left as it is
+var configVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandValue replaces the ${KUBEVIP_*} references in the value with the environment of the provider, any other
+// reference is left as it is
+func expandValue(value string) (string, error) {
+	var undefined []string
+	expanded := configVariable.ReplaceAllStringFunc(value, func(reference string) string {
+		name := configVariable.FindStringSubmatch(reference)[1]
+		if !strings.HasPrefix(name, ConfigVariablePrefix) {
+			return reference
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return env
+	})
+	if len(undefined) != 0 {
+		return "", fmt.Errorf("%w [%s]", ErrUndefinedVariable, strings.Join(undefined, ", "))
+	}
+	return expanded, nil
+}
+
+// unexpandedErrors reports the values of the keys as they are written in the config map rather than as they were
+// expanded, so the environment of the provider isn't echoed back in webhook denials and logs
+func unexpandedErrors(errs []error, raw *v1.ConfigMap) []error {
+	for _, err := range errs {
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			continue
+		}
+		if value, ok := raw.Data[configErr.Key]; ok {
+			configErr.Value = value
+		}
+	}
+	return errs
+}
+
+// expandConfigMap returns a copy of the config map with the ${KUBEVIP_*} references in its values expanded, i.e.
+// cidr-global: ${KUBEVIP_LB_CIDR}, an error is returned if a variable isn't set
+func expandConfigMap(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	expanded := cm.DeepCopy()
+	for key, value := range cm.Data {
+		if !strings.Contains(value, "${") {
+			continue
+		}
+		v, err := expandValue(value)
+		if err != nil {
+			return nil, &ConfigError{Key: key, Value: value, Err: err}
+		}
+		expanded.Data[key] = v
+	}
+	return expanded, nil
+}
+
 func (k *kubevipLoadBalancerManager) GetConfigMap(ctx context.Context, cm, nm string) (*v1.ConfigMap, error) {
 	// Attempt to retrieve the config map
-	return k.kubeClient.CoreV1().ConfigMaps(nm).Get(ctx, k.cloudConfigMap, metav1.GetOptions{})
+	configMap, err := k.kubeClient.CoreV1().ConfigMaps(nm).Get(ctx, k.cloudConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return expandConfigMap(configMap)
 }
 
 func (k *kubevipLoadBalancerManager) CreateConfigMap(ctx context.Context, cm, nm string) (*v1.ConfigMap, error) {
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_expandConfigMap(t *testing.T) {
+	os.Setenv("KUBEVIP_TEST_CIDR", "192.168.0.200/29")
+	os.Setenv("KUBEVIP_TEST_EMPTY", "")
+	os.Setenv("KUBE_VIP_TEST_SECRET", "secret")
+	defer os.Unsetenv("KUBEVIP_TEST_CIDR")
+	defer os.Unsetenv("KUBEVIP_TEST_EMPTY")
+	defer os.Unsetenv("KUBE_VIP_TEST_SECRET")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no variables", value: "192.168.0.200/29", want: "192.168.0.200/29"},
+		{name: "defined", value: "${KUBEVIP_TEST_CIDR}", want: "192.168.0.200/29"},
+		{name: "within a value", value: "192.168.1.0/29,${KUBEVIP_TEST_CIDR}", want: "192.168.1.0/29,192.168.0.200/29"},
+		{name: "defined but empty", value: "192.168.1.0/29${KUBEVIP_TEST_EMPTY}", want: "192.168.1.0/29"},
+		{name: "only braced references", value: "$KUBEVIP_TEST_CIDR", want: "$KUBEVIP_TEST_CIDR"},
+		{name: "undefined", value: "${KUBEVIP_TEST_CIDR},${KUBEVIP_TEST_UNDEFINED}", wantErr: true},
+		{name: "without the prefix", value: "${KUBE_VIP_TEST_SECRET}", want: "${KUBE_VIP_TEST_SECRET}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &v1.ConfigMap{Data: map[string]string{"cidr-global": tt.value}}
+			got, err := expandConfigMap(cm)
+			if tt.wantErr {
+				var configErr *ConfigError
+				if !errors.Is(err, ErrUndefinedVariable) || !errors.As(err, &configErr) || configErr.Key != "cidr-global" {
+					t.Errorf("expandConfigMap() error = %v, want %v for cidr-global", err, ErrUndefinedVariable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandConfigMap() error = %v", err)
+			}
+			if got.Data["cidr-global"] != tt.want {
+				t.Errorf("expandConfigMap() = %v, want %v", got.Data["cidr-global"], tt.want)
+			}
+			if cm.Data["cidr-global"] != tt.value {
+				t.Errorf("expandConfigMap() modified the config map")
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerExpandsVariables(t *testing.T) {
+	os.Setenv("KUBEVIP_TEST_CIDR", "192.168.0.200/29")
+	defer os.Unsetenv("KUBEVIP_TEST_CIDR")
+
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "${KUBEVIP_TEST_CIDR}"}, svc)
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.201" {
+		t.Errorf("syncLoadBalancer() address = %v, want 192.168.0.201", got.Spec.LoadBalancerIP)
+	}
+
+	// A config map with an undefined variable isn't replaced, and nothing is allocated
+	ipam.Manager = nil
+	pending := newTestService("dev", "pending")
+	k = newTestLoadBalancer(map[string]string{"cidr-dev": "${KUBEVIP_TEST_UNDEFINED}"}, pending)
+	if _, err := k.syncLoadBalancer(context.TODO(), pending); !errors.Is(err, ErrUndefinedVariable) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrUndefinedVariable)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), pending.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "" {
+		t.Errorf("syncLoadBalancer() address = %v, want none", got.Spec.LoadBalancerIP)
+	}
+}
@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// StaticConflictPolicy is how a service requesting an address that is allocated to another service is handled
+var StaticConflictPolicy = StaticConflictProtectDynamic
+
+// ErrAddressConflict is returned when a service requests an address that is allocated to another service
+var ErrAddressConflict = errors.New("address conflict")
+
+// ErrDuplicateStaticIP is returned when a service requests an address that another service requested first
+var ErrDuplicateStaticIP = errors.New("duplicate static address")
+
+const (
+	//StaticConflictProtectDynamic rejects the request, the allocated service keeps its address
+	StaticConflictProtectDynamic = "protect-dynamic"
+
+	//StaticConflictYieldDynamic reallocates the allocated service, the requesting service is given the address
+	StaticConflictYieldDynamic = "yield-dynamic"
+
+	//IPAMStatusAddressConflict is set when the service requests an address that is allocated to another service
+	IPAMStatusAddressConflict = "address-conflict"
+
+	//ReasonAddressConflict is the event reason when a service requests an address allocated to another service
+	ReasonAddressConflict = "AddressConflict"
+
+	//IPAMStatusDuplicateStaticIP is set when the service requests an address that another service requested first
+	IPAMStatusDuplicateStaticIP = "duplicate-static-ip"
+
+	//ReasonDuplicateStaticIP is the event reason when a service requests an address another service requested first
+	ReasonDuplicateStaticIP = "DuplicateStaticIP"
+
+	//ReasonAddressYielded is the event reason when a service is reallocated so its address can be requested
+	ReasonAddressYielded = "AddressYielded"
+)
+
+// conflictingAllocation returns the other kube-vip service that the address requested by the service is allocated
+// to, ok is false if it isn't allocated
+func (k *kubevipLoadBalancerManager) conflictingAllocation(ctx context.Context, service *v1.Service) (conflict serviceAllocation, ok bool, err error) {
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return serviceAllocation{}, false, err
+	}
+	for _, a := range allocations {
+		if a.Address == service.Spec.LoadBalancerIP && (a.Namespace != service.Namespace || a.Name != service.Name) {
+			return a, true, nil
+		}
+	}
+	return serviceAllocation{}, false, nil
+}
+
+// claimsFirst returns true if service a holds a requested address before service b, a service that already has the
+// address as its ingress holds it, otherwise the oldest service (then by namespace and name) does
+func claimsFirst(a, b *v1.Service, address string) bool {
+	if hasIngress(a, address) != hasIngress(b, address) {
+		return hasIngress(a, address)
+	}
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return snapshotKey(a.Namespace, a.Name) < snapshotKey(b.Namespace, b.Name)
+}
+
+// hasIngress returns true if the address is an ingress of the service
+func hasIngress(service *v1.Service, address string) bool {
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP == address {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicateStatic returns an error if another service in the cluster requested the same address in its
+// spec.loadBalancerIP first, only one of the services is given the address and the others are left pending
+func (k *kubevipLoadBalancerManager) duplicateStatic(ctx context.Context, service *v1.Service) error {
+	address := service.Spec.LoadBalancerIP
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for x := range svcs.Items {
+		other := &svcs.Items[x]
+		if other.Spec.Type != v1.ServiceTypeLoadBalancer || other.Spec.LoadBalancerIP != address || other.UID == service.UID {
+			continue
+		}
+		// A service that the address is allocated to is handled by the static conflict policy
+		if other.Labels["ipam-address"] == address {
+			continue
+		}
+		if claimsFirst(other, service, address) {
+			return k.allocationFailed(ctx, service, fmt.Errorf("%w, [%s] requested by service [%s] was requested first by service [%s/%s]", ErrDuplicateStaticIP, address, service.Name, other.Namespace, other.Name))
+		}
+	}
+	return nil
+}
+
+// resolveConflict applies the static conflict policy when the address requested by the service is allocated to
+// another service, an error is returned if the request is rejected
+func (k *kubevipLoadBalancerManager) resolveConflict(ctx context.Context, service *v1.Service) error {
+	conflict, ok, err := k.conflictingAllocation(ctx, service)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	address := service.Spec.LoadBalancerIP
+
+	if k.staticConflictPolicy != StaticConflictYieldDynamic {
+		return k.allocationFailed(ctx, service, fmt.Errorf("%w, [%s] requested by service [%s] is allocated to service [%s/%s]", ErrAddressConflict, address, service.Name, conflict.Namespace, conflict.Name))
+	}
+
+	yielding, err := k.kubeClient.CoreV1().Services(conflict.Namespace).Get(ctx, conflict.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to reallocate service [%s/%s]: %w", conflict.Namespace, conflict.Name, err)
+	}
+	// A service owned by another instance isn't reallocated by this one
+	if k.foreignOwned(yielding) {
+		return k.allocationFailed(ctx, service, fmt.Errorf("%w, [%s] requested by service [%s] is allocated to service [%s/%s] owned by [%s]", ErrAddressConflict, address, service.Name, conflict.Namespace, conflict.Name, yielding.Annotations[OwnedByAnnotation]))
+	}
+	klog.Infof("service [%s/%s] yields address [%s] to service [%s/%s]", conflict.Namespace, conflict.Name, address, service.Namespace, service.Name)
+	k.recorder.Eventf(yielding, v1.EventTypeWarning, ReasonAddressYielded, "address [%s] was requested by service [%s/%s], reallocating", address, service.Namespace, service.Name)
+	// Without its address the service is allocated a new one, its label still holds the yielded address so that
+	// isn't allocated again. If the reallocation fails neither service is changed
+	yielding.Spec.LoadBalancerIP = ""
+	delete(yielding.Annotations, PoolGenerationAnnotation)
+	if _, err := k.reconcileLoadBalancer(ctx, yielding); err != nil {
+		return fmt.Errorf("unable to reallocate service [%s/%s]: %w", conflict.Namespace, conflict.Name, err)
+	}
+	// Record the requested address, so the address is in use once again
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		recentService.Labels["implementation"] = "kube-vip"
+		recentService.Labels["ipam-address"] = address
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		recentService.Annotations[AllocationSourceAnnotation] = SourceStatic
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to record address [%s] of service [%s]: %w", address, service.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_staticConflictPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		wantErr     error
+		wantDynamic string
+		wantEvent   string
+	}{
+		{
+			name:        "protect dynamic",
+			policy:      StaticConflictProtectDynamic,
+			wantErr:     ErrAddressConflict,
+			wantDynamic: "192.168.0.201",
+			wantEvent:   ReasonAddressConflict,
+		},
+		{
+			name:        "yield dynamic",
+			policy:      StaticConflictYieldDynamic,
+			wantDynamic: "192.168.0.202",
+			wantEvent:   ReasonAddressYielded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			dynamic := newTestService("dev", "dynamic")
+			dynamic.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+			dynamic.Spec.LoadBalancerIP = "192.168.0.201"
+			static := newTestService("staging", "static")
+			static.Spec.LoadBalancerIP = "192.168.0.201"
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, dynamic, static)
+			k.staticConflictPolicy = tt.policy
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			_, err := k.syncLoadBalancer(context.TODO(), static)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("syncLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+
+			gotDynamic, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), dynamic.Name, metav1.GetOptions{})
+			gotStatic, _ := k.kubeClient.CoreV1().Services("staging").Get(context.TODO(), static.Name, metav1.GetOptions{})
+			if gotDynamic.Spec.LoadBalancerIP != tt.wantDynamic || gotDynamic.Labels["ipam-address"] != tt.wantDynamic {
+				t.Errorf("dynamic service address = %v (label %v), want %v", gotDynamic.Spec.LoadBalancerIP, gotDynamic.Labels["ipam-address"], tt.wantDynamic)
+			}
+			if gotStatic.Spec.LoadBalancerIP != "192.168.0.201" {
+				t.Errorf("static service address = %v, want 192.168.0.201", gotStatic.Spec.LoadBalancerIP)
+			}
+
+			// Every allocated address belongs to a single service
+			allocations, _ := listAllocations(context.TODO(), k.kubeClient)
+			seen := map[string]string{}
+			for _, a := range allocations {
+				if owner, ok := seen[a.Address]; ok {
+					t.Errorf("address [%s] is assigned to [%s] and [%s]", a.Address, owner, a.Name)
+				}
+				seen[a.Address] = a.Name
+			}
+			if tt.policy == StaticConflictProtectDynamic && gotStatic.Annotations[IPAMStatusAnnotation] != IPAMStatusAddressConflict {
+				t.Errorf("static service status = %v, want %v", gotStatic.Annotations[IPAMStatusAnnotation], IPAMStatusAddressConflict)
+			}
+			if tt.policy == StaticConflictYieldDynamic && gotStatic.Labels["ipam-address"] != "192.168.0.201" {
+				t.Errorf("static service label = %v, want 192.168.0.201", gotStatic.Labels["ipam-address"])
+			}
+
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			if !strings.Contains(strings.Join(events, "\n"), tt.wantEvent) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func Test_duplicateStaticIP(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("dev", "first")
+	first.CreationTimestamp = metav1.NewTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	first.Spec.LoadBalancerIP = "192.168.0.201"
+	second := newTestService("staging", "second")
+	second.CreationTimestamp = metav1.NewTime(time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC))
+	second.Spec.LoadBalancerIP = "192.168.0.201"
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, first, second)
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	// Whichever is synced first, the oldest service is given the address and the other is left pending
+	for _, svc := range []*v1.Service{second, first, second} {
+		_, err := k.syncLoadBalancer(context.TODO(), svc)
+		if svc == first && err != nil {
+			t.Fatalf("syncLoadBalancer(first) error = %v", err)
+		}
+		if svc == second && !errors.Is(err, ErrDuplicateStaticIP) {
+			t.Fatalf("syncLoadBalancer(second) error = %v, want %v", err, ErrDuplicateStaticIP)
+		}
+	}
+
+	gotFirst, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), first.Name, metav1.GetOptions{})
+	gotSecond, _ := k.kubeClient.CoreV1().Services("staging").Get(context.TODO(), second.Name, metav1.GetOptions{})
+	if gotFirst.Annotations[IPAMStatusAnnotation] != "" {
+		t.Errorf("first service status = %v, want none", gotFirst.Annotations[IPAMStatusAnnotation])
+	}
+	if gotSecond.Annotations[IPAMStatusAnnotation] != IPAMStatusDuplicateStaticIP {
+		t.Errorf("second service status = %v, want %v", gotSecond.Annotations[IPAMStatusAnnotation], IPAMStatusDuplicateStaticIP)
+	}
+	if got := k.allocations.list(); len(got) != 1 || got[0].Name != first.Name {
+		t.Errorf("allocations = %v, want only the first service", got)
+	}
+
+	// The event is only emitted once
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if got := strings.Count(strings.Join(events, "\n"), ReasonDuplicateStaticIP); got != 1 {
+		t.Errorf("events = %v, want a single %v", events, ReasonDuplicateStaticIP)
+	}
+
+	// A service that already has the address as its ingress holds it, however old the other service is
+	first.Status.LoadBalancer.Ingress = nil
+	second.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.0.201"}}
+	if !claimsFirst(second, first, "192.168.0.201") {
+		t.Errorf("claimsFirst() = false, want the service with the ingress to hold the address")
+	}
+}
+
+func Test_staticUnderPoolPressure(t *testing.T) {
+	tests := []struct {
+		name          string
+		reserveStatic bool
+		want          []string
+		wantErr       bool
+	}{
+		{
+			// The static request holds its address, so the second dynamic service waits for the pool
+			name:          "static reserved",
+			reserveStatic: true,
+			want:          []string{"192.168.0.10", "192.168.0.11", ""},
+			wantErr:       true,
+		},
+		{
+			// Without the reservation a dynamic service takes the requested address
+			name: "static not reserved",
+			want: []string{"192.168.0.10", "192.168.0.11", "192.168.0.12"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			// The static service is created, but not yet reconciled, when the pool is under pressure
+			static := newTestService("dev", "static")
+			static.Spec.LoadBalancerIP = "192.168.0.12"
+			first := newTestService("dev", "first")
+			second := newTestService("dev", "second")
+			third := newTestService("dev", "third")
+			k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.10-192.168.0.12"}, static, first, second, third)
+			k.reserveStatic = tt.reserveStatic
+
+			if _, err := k.syncLoadBalancer(context.TODO(), first); err != nil {
+				t.Fatalf("syncLoadBalancer(first) error = %v", err)
+			}
+			if _, err := k.syncLoadBalancer(context.TODO(), second); err != nil {
+				t.Fatalf("syncLoadBalancer(second) error = %v", err)
+			}
+			_, err := k.syncLoadBalancer(context.TODO(), third)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("syncLoadBalancer(third) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ipam.ErrNoAddressesAvailable) {
+				t.Errorf("syncLoadBalancer(third) error = %v, want %v", err, ipam.ErrNoAddressesAvailable)
+			}
+			for x, svc := range []*v1.Service{first, second, third} {
+				got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+				if got.Spec.LoadBalancerIP != tt.want[x] {
+					t.Errorf("service [%s] address = %q, want %q", svc.Name, got.Spec.LoadBalancerIP, tt.want[x])
+				}
+			}
+
+			// The static request is honoured, it is never blocked by the dynamic services
+			if !tt.reserveStatic {
+				return
+			}
+			if _, err := k.syncLoadBalancer(context.TODO(), static); err != nil {
+				t.Fatalf("syncLoadBalancer(static) error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), static.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != "192.168.0.12" || got.Annotations[IPAMStatusAnnotation] != "" {
+				t.Errorf("static service = %q with status %q, want 192.168.0.12", got.Spec.LoadBalancerIP, got.Annotations[IPAMStatusAnnotation])
+			}
+		})
+	}
+}
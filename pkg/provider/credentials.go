@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HookSecret is the secret (<namespace>/<name>, kube-system if there is no namespace) holding the credentials that
+// the allocate and release hooks are sent with, credentials don't belong in the config map with the pools
+var HookSecret string
+
+// ErrInvalidSecretReference is returned when a secret reference isn't <name> or <namespace>/<name>
+var ErrInvalidSecretReference = errors.New("invalid secret reference")
+
+const (
+	//HookSecretTokenKey is the secret key of the bearer token that the hooks are sent with
+	HookSecretTokenKey = "token"
+
+	//HookSecretHeaderPrefix is followed by the name of a header that the hooks are sent with, i.e. header-X-API-Key
+	HookSecretHeaderPrefix = "header-"
+)
+
+// parseSecretReference returns the namespace and name of the secret reference
+func parseSecretReference(reference string) (namespace, name string, err error) {
+	parts := strings.Split(reference, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return "kube-system", parts[0], nil
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("%w [%s], it must be <name> or <namespace>/<name>", ErrInvalidSecretReference, reference)
+}
+
+// secretHeaders returns a function reading the headers from the secret, it is read for every request so a rotated
+// credential is picked up. The provider needs get on the secret
+func secretHeaders(client kubernetes.Interface, reference string) (func(ctx context.Context) (map[string]string, error), error) {
+	namespace, name, err := parseSecretReference(reference)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) (map[string]string, error) {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read hook credentials from secret [%s/%s]: %w", namespace, name, err)
+		}
+		headers := make(map[string]string)
+		for key, value := range secret.Data {
+			switch {
+			case key == HookSecretTokenKey:
+				headers["Authorization"] = "Bearer " + strings.TrimSpace(string(value))
+			case strings.HasPrefix(key, HookSecretHeaderPrefix) && key != HookSecretHeaderPrefix:
+				headers[strings.TrimPrefix(key, HookSecretHeaderPrefix)] = strings.TrimSpace(string(value))
+			}
+		}
+		return headers, nil
+	}, nil
+}
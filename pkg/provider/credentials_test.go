@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func Test_parseSecretReference(t *testing.T) {
+	tests := []struct {
+		reference     string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{reference: "hook-credentials", wantNamespace: "kube-system", wantName: "hook-credentials"},
+		{reference: "automation/hook-credentials", wantNamespace: "automation", wantName: "hook-credentials"},
+		{reference: "automation/", wantErr: true},
+		{reference: "a/b/c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			namespace, name, err := parseSecretReference(tt.reference)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSecretReference) {
+					t.Errorf("parseSecretReference() error = %v, want %v", err, ErrInvalidSecretReference)
+				}
+				return
+			}
+			if err != nil || namespace != tt.wantNamespace || name != tt.wantName {
+				t.Errorf("parseSecretReference() = %v, %v, %v, want %v, %v", namespace, name, err, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_hooksSecretCredentials(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hook-credentials", Namespace: "kube-system"},
+		Data: map[string][]byte{
+			HookSecretTokenKey:                   []byte("s3cret\n"),
+			HookSecretHeaderPrefix + "X-API-Key": []byte("key-1"),
+			"unrelated":                          []byte("ignored"),
+		},
+	}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		wantErr bool
+	}{
+		{name: "secret", objects: []runtime.Object{secret}},
+		{name: "missing secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			var mu sync.Mutex
+			var received http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				received = r.Header.Clone()
+			}))
+			defer server.Close()
+
+			svc := newTestService("dev", "hooked")
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, append(tt.objects, svc)...)
+			headers, err := secretHeaders(k.kubeClient, "kube-system/hook-credentials")
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.hooks = &hooks{
+				allocateURL:   server.URL + "/allocate",
+				blocking:      true,
+				retries:       1,
+				retryInterval: time.Millisecond,
+				client:        server.Client(),
+				headers:       headers,
+			}
+
+			_, err = k.syncLoadBalancer(context.TODO(), svc)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("syncLoadBalancer() succeeded, the hook credentials couldn't be read")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := received.Get("Authorization"); got != "Bearer s3cret" {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer s3cret")
+			}
+			if got := received.Get("X-API-Key"); got != "key-1" {
+				t.Errorf("X-API-Key = %q, want %q", got, "key-1")
+			}
+			if got := received.Get("unrelated"); got != "" {
+				t.Errorf("unrelated = %q, want no header", got)
+			}
+		})
+	}
+}
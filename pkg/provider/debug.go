@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// DebugAddress is the address that the debug endpoint listens on, the endpoint is disabled if empty
+var DebugAddress string
+
+// debugHandler serves the allocation state observed by the load balancer manager
+func (k *kubevipLoadBalancerManager) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/allocations", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(k.allocations.list()); err != nil {
+			klog.Errorf("unable to write allocations: %v", err)
+		}
+	})
+	return mux
+}
+
+// serveDebug serves the handler on the address until stop is closed
+func serveDebug(address string, handler http.Handler, stop <-chan struct{}) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	klog.Infof("serving debug endpoint on [%s]", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("debug endpoint failed: %v", err)
+	}
+}
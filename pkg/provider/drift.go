@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// DriftPolicy is how a service whose spec.loadBalancerIP was changed away from its allocated address is handled
+var DriftPolicy = DriftRestore
+
+const (
+	//DriftRestore puts the allocated address back into spec.loadBalancerIP
+	DriftRestore = "restore"
+
+	//DriftAdopt allocates the new address to the service, if it is a valid static request, otherwise the allocated
+	//address is restored
+	DriftAdopt = "adopt"
+
+	//ReasonAddressDrift is the event reason when spec.loadBalancerIP no longer matches the allocated address
+	ReasonAddressDrift = "AddressDrift"
+)
+
+// drifted returns true if spec.loadBalancerIP of an allocated service no longer matches its ipam-address label
+func drifted(service *v1.Service) bool {
+	allocated := service.Labels["ipam-address"]
+	return allocated != "" && service.Spec.LoadBalancerIP != "" && ipam.NormalizeAddress(allocated) != ipam.NormalizeAddress(service.Spec.LoadBalancerIP)
+}
+
+// resolveDrift applies the drift policy to a service whose spec.loadBalancerIP was changed, the service is updated
+// in place so the reconcile carries on with the resolved address
+func (k *kubevipLoadBalancerManager) resolveDrift(ctx context.Context, service *v1.Service) error {
+	allocated := service.Labels["ipam-address"]
+	requested := service.Spec.LoadBalancerIP
+	address := allocated
+	if k.driftPolicy == DriftAdopt {
+		if err := k.validStaticRequest(ctx, service); err != nil {
+			klog.Warningf("not adopting address [%s] of service [%s]: %v", requested, service.Name, err)
+		} else {
+			address = requested
+		}
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		before := recentService.DeepCopy()
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		recentService.Labels["implementation"] = "kube-vip"
+		recentService.Labels["ipam-address"] = address
+		recentService.Spec.LoadBalancerIP = address
+		if address != allocated {
+			recentService.Annotations[AllocationSourceAnnotation] = SourceStatic
+		}
+		k.annotateAddress(recentService.Annotations, address)
+		k.stampOwner(recentService.Annotations)
+		// The fetched service was already resolved
+		if serviceUnchanged(before, recentService) {
+			*service = *recentService
+			return nil
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		if updateErr == nil {
+			*service = *recentService
+		}
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to resolve address drift of service [%s]: %w", service.Name, err)
+	}
+
+	if address == allocated {
+		klog.Infof("spec.loadBalancerIP [%s] of service [%s] doesn't match its address, restored [%s]", requested, service.Name, allocated)
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonAddressDrift, "spec.loadBalancerIP [%s] doesn't match the allocated address, restored [%s]", requested, allocated)
+		return nil
+	}
+	klog.Infof("spec.loadBalancerIP [%s] of service [%s] doesn't match its address, adopted it in place of [%s]", requested, service.Name, allocated)
+	k.recorder.Eventf(service, v1.EventTypeNormal, ReasonAddressDrift, "spec.loadBalancerIP [%s] doesn't match the allocated address, adopted it in place of [%s]", requested, allocated)
+	k.releaseWarm(allocated)
+	return nil
+}
+
+// validStaticRequest returns an error if the address in spec.loadBalancerIP couldn't be requested by the service
+func (k *kubevipLoadBalancerManager) validStaticRequest(ctx context.Context, service *v1.Service) error {
+	if err := k.checkRequestedAddress(ctx, service); err != nil {
+		return err
+	}
+	conflict, ok, err := k.conflictingAllocation(ctx, service)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("%w, [%s] is allocated to service [%s/%s]", ErrAddressConflict, service.Spec.LoadBalancerIP, conflict.Namespace, conflict.Name)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_syncLoadBalancerDrift(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		requested string
+		taken     bool
+		want      string
+	}{
+		{name: "restore", policy: DriftRestore, requested: "192.168.0.205", want: "192.168.0.201"},
+		{name: "adopt", policy: DriftAdopt, requested: "192.168.0.205", want: "192.168.0.205"},
+		{name: "adopt an allocated address", policy: DriftAdopt, requested: "192.168.0.205", taken: true, want: "192.168.0.201"},
+		{name: "adopt the network address", policy: DriftAdopt, requested: "192.168.0.200", want: "192.168.0.201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "drifted")
+			svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+			svc.Spec.LoadBalancerIP = tt.requested
+			objects := []runtime.Object{svc}
+			if tt.taken {
+				other := newTestService("staging", "other")
+				other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": tt.requested}
+				other.Spec.LoadBalancerIP = tt.requested
+				objects = append(objects, other)
+			}
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, objects...)
+			k.driftPolicy = tt.policy
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want || got.Labels["ipam-address"] != tt.want {
+				t.Errorf("address = %v (label %v), want %v", got.Spec.LoadBalancerIP, got.Labels["ipam-address"], tt.want)
+			}
+			if got.Annotations[LoadBalancerIPsAnnotation] != tt.want {
+				t.Errorf("[%s] = %v, want %v", LoadBalancerIPsAnnotation, got.Annotations[LoadBalancerIPsAnnotation], tt.want)
+			}
+			select {
+			case e := <-recorder.Events:
+				if !strings.Contains(e, ReasonAddressDrift) {
+					t.Errorf("event = %v, want %v", e, ReasonAddressDrift)
+				}
+			default:
+				t.Errorf("no %s event", ReasonAddressDrift)
+			}
+
+			// Once resolved the service is no longer drifted
+			if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			if drifted(got) {
+				t.Errorf("service is still drifted after it was resolved")
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerUnchanged(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "labeled")
+	svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc.Spec.LoadBalancerIP = "192.168.0.201"
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc)
+	k.instanceID = "provider-a"
+	svc.Annotations = map[string]string{LoadBalancerIPsAnnotation: "192.168.0.201", OwnedByAnnotation: "provider-a"}
+	if _, err := k.kubeClient.CoreV1().Services("dev").Update(context.TODO(), svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	client := k.kubeClient.(*fake.Clientset)
+	client.ClearActions()
+
+	// A stale copy still has the drifted address, the service itself is already correctly labeled
+	stale := svc.DeepCopy()
+	stale.Spec.LoadBalancerIP = "192.168.0.205"
+	if _, err := k.syncLoadBalancer(context.TODO(), stale); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("service was updated, it was already correctly labeled")
+		}
+	}
+	if stale.Spec.LoadBalancerIP != "192.168.0.201" {
+		t.Errorf("address = %v, want 192.168.0.201", stale.Spec.LoadBalancerIP)
+	}
+}
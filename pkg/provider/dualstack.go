@@ -0,0 +1,261 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	//IPFamilyPolicyAnnotation is the ipFamilyPolicy of the service, the v1.19 API has no such field
+	IPFamilyPolicyAnnotation = "kube-vip.io/ip-family-policy"
+
+	//IPFamilyPolicyPreferDualStack allocates an address of each family, or of a single family if only one has a
+	//free address in the pools of the service
+	IPFamilyPolicyPreferDualStack = "PreferDualStack"
+
+	//ReasonFamilyUnavailable is the event reason when a service preferring dual-stack is given a single family
+	ReasonFamilyUnavailable = "IPFamilyUnavailable"
+)
+
+// dualStackRequest returns true if the service pins several addresses with the loadbalancerIPs annotation,
+// i.e. 192.168.0.5,fd00::5
+func dualStackRequest(service *v1.Service) bool {
+	return strings.Contains(service.Annotations[LoadBalancerIPsAnnotation], ",")
+}
+
+// parseDualStack returns the IPv4 and the IPv6 address of the comma separated addresses, there must be exactly one
+// of each family
+func parseDualStack(value string) (ipv4, ipv6 string, err error) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return "", "", fmt.Errorf("%w, [%s] isn't an address", ErrInvalidAddress, entry)
+		}
+		address := ipam.NormalizeAddress(entry)
+		family := &ipv6
+		if ip.To4() != nil {
+			family = &ipv4
+		}
+		switch {
+		case *family == address:
+			return "", "", fmt.Errorf("%w, [%s] is requested more than once", ErrInvalidAddress, address)
+		case *family != "":
+			return "", "", fmt.Errorf("%w, [%s] and [%s] are of the same family, one IPv4 and one IPv6 address can be requested", ErrInvalidAddress, *family, address)
+		}
+		*family = address
+	}
+	if ipv4 == "" || ipv6 == "" {
+		return "", "", fmt.Errorf("%w, [%s] must be one IPv4 and one IPv6 address", ErrInvalidAddress, value)
+	}
+	return ipv4, ipv6, nil
+}
+
+// claimedAddresses returns the addresses allocated to, or requested by, every load balancer service other than the
+// service
+func (k *kubevipLoadBalancerManager) claimedAddresses(ctx context.Context, service *v1.Service) (map[string]string, error) {
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	claimed := make(map[string]string)
+	for x := range svcs.Items {
+		other := &svcs.Items[x]
+		if other.UID == service.UID || other.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		owner := other.Namespace + "/" + other.Name
+		addresses := []string{other.Labels["ipam-address"], other.Spec.LoadBalancerIP}
+		if dualStackRequest(other) {
+			addresses = append(addresses, strings.Split(other.Annotations[LoadBalancerIPsAnnotation], ",")...)
+		}
+		for _, address := range addresses {
+			if address = strings.TrimSpace(address); address != "" {
+				claimed[ipam.NormalizeAddress(address)] = owner
+			}
+		}
+	}
+	return claimed, nil
+}
+
+// reconcileDualStack assigns both pinned addresses to the service, each must be in a pool and not be claimed by
+// another service. The IPv4 address is recorded as the allocated address, both are tracked and set as the ingress
+func (k *kubevipLoadBalancerManager) reconcileDualStack(ctx context.Context, service *v1.Service) (*v1.LoadBalancerStatus, error) {
+	ipv4, ipv6, err := parseDualStack(service.Annotations[LoadBalancerIPsAnnotation])
+	if err != nil {
+		return nil, k.allocationFailed(ctx, service, fmt.Errorf("%w for service [%s]", err, service.Name))
+	}
+
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return nil, err
+	}
+	keys, bounds, _ := poolBounds(cm, k.keyPrefix)
+	// The claimed addresses must not change until the service records its addresses
+	unlock := k.allocationLock.lock()
+	defer unlock()
+	claimed, err := k.claimedAddresses(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	pools := make(map[string][]string)
+	for _, address := range []string{ipv4, ipv6} {
+		key, ok := poolContaining(keys, bounds, address)
+		if !ok {
+			return nil, k.allocationFailed(ctx, service, fmt.Errorf("%w, [%s] requested by service [%s] isn't in a pool of its family", ErrInvalidAddress, address, service.Name))
+		}
+		if owner, ok := claimed[address]; ok {
+			return nil, k.allocationFailed(ctx, service, fmt.Errorf("%w, [%s] requested by service [%s] is allocated to service [%s]", ErrAddressConflict, address, service.Name, owner))
+		}
+		pools[key] = append(pools[key], address)
+	}
+	// Both addresses may come from a pool of both families, which can limit the addresses of a service
+	if err := checkPoolPolicy(cm, k.keyPrefix, service.Name, pools); err != nil {
+		return nil, k.allocationFailed(ctx, service, err)
+	}
+
+	if service.Labels["ipam-address"] != ipv4 || service.Labels["implementation"] != "kube-vip" || service.Annotations[IPAMStatusAnnotation] != "" {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			before := recentService.DeepCopy()
+			if recentService.Labels == nil {
+				recentService.Labels = make(map[string]string)
+			}
+			recentService.Labels["implementation"] = "kube-vip"
+			recentService.Labels["ipam-address"] = ipv4
+			clearIPAMStatus(recentService.Annotations)
+			k.stampOwner(recentService.Annotations)
+			if serviceUnchanged(before, recentService) {
+				return nil
+			}
+			_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+			return updateErr
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error recording addresses [%s] [%s] of service [%s]: %w", ipv4, ipv6, service.Name, err)
+		}
+		klog.Infof("assigned addresses [%s] [%s] to service [%s]", ipv4, ipv6, service.Name)
+		requestedAddressesHistogram.Observe(2)
+	}
+	k.allocations.setAddresses(service, []string{ipv4, ipv6}, SourceStatic)
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: ipv4}, {IP: ipv6}}}, nil
+}
+
+// prefersDualStack returns true if the service prefers an address of each family and hasn't been given one yet
+func prefersDualStack(service *v1.Service) bool {
+	return service.Annotations[IPFamilyPolicyAnnotation] == IPFamilyPolicyPreferDualStack && !dualStackRequest(service) &&
+		service.Spec.LoadBalancerIP == "" && service.Labels["ipam-address"] == ""
+}
+
+// singleFamilyStatus returns the status of a service preferring dual-stack that was given a single family, it is set
+// as the only ingress so that the service reports the family it has. The status of other services is left as it is
+func singleFamilyStatus(status *v1.LoadBalancerStatus, service *v1.Service, address string) *v1.LoadBalancerStatus {
+	if service.Annotations[IPFamilyPolicyAnnotation] != IPFamilyPolicyPreferDualStack || len(status.Ingress) != 0 {
+		return status
+	}
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: address}}}
+}
+
+// addressFamily returns the family of the address
+func addressFamily(address string) string {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return ipam.FamilyIPv6
+	}
+	return ipam.FamilyIPv4
+}
+
+// withFamily returns a copy of the service with the ipFamily, it is only used to allocate and isn't updated
+func withFamily(service *v1.Service, family string) *v1.Service {
+	service = service.DeepCopy()
+	ipFamily := v1.IPFamily(family)
+	service.Spec.IPFamily = &ipFamily
+	return service
+}
+
+// preferDualStack returns the service to allocate to, if the pools of the service have a free address of each family
+// they are pinned with the loadbalancerIPs annotation and the updated service is returned. If only one family has a
+// free address, the service is returned with that ipFamily so that a single address of it is allocated, and neither
+// family returns the service as it is so that the allocation reports why
+func (k *kubevipLoadBalancerManager) preferDualStack(ctx context.Context, service *v1.Service) (*v1.Service, error) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return service, nil
+	}
+	environment, err := k.namespaceEnvironment(ctx, cm, service.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// The addresses must not be allocated to another service until they are pinned
+	unlock := k.allocationLock.lock()
+	defer unlock()
+	existing, err := k.existingAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string)
+	for _, family := range []string{ipam.FamilyIPv4, ipam.FamilyIPv6} {
+		discovered, err := discoverAddress(cm, withFamily(service, family), environment, k.cloudConfigMap, k.keyPrefix, existing)
+		if err != nil {
+			klog.V(2).Infof("no %s address is available for service [%s]: %v", family, service.Name, err)
+			continue
+		}
+		// A pool without addresses of the family allocates from any family, the address goes back to the warm pool
+		if addressFamily(discovered.address) != family {
+			klog.V(2).Infof("no %s address is available for service [%s], the pool has none", family, service.Name)
+			k.releaseWarm(discovered.address)
+			continue
+		}
+		addresses[family] = discovered.address
+		existing = append(existing, discovered.address)
+	}
+
+	// Only a pair is pinned, a single address is allocated again (and the addresses taken from a warm pool returned)
+	ipv4, ipv6 := addresses[ipam.FamilyIPv4], addresses[ipam.FamilyIPv6]
+	if ipv4 == "" || ipv6 == "" {
+		k.releaseWarm(ipv4)
+		k.releaseWarm(ipv6)
+	}
+	switch {
+	case ipv4 == "" && ipv6 == "":
+		return service, nil
+	case ipv4 == "":
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonFamilyUnavailable, "no %s address is available, allocating a single %s address", ipam.FamilyIPv4, ipam.FamilyIPv6)
+		return withFamily(service, ipam.FamilyIPv6), nil
+	case ipv6 == "":
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonFamilyUnavailable, "no %s address is available, allocating a single %s address", ipam.FamilyIPv6, ipam.FamilyIPv4)
+		return withFamily(service, ipam.FamilyIPv4), nil
+	}
+
+	var pinned *v1.Service
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		recentService.Annotations[LoadBalancerIPsAnnotation] = ipv4 + "," + ipv6
+		var updateErr error
+		pinned, updateErr = k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		k.releaseWarm(ipv4)
+		k.releaseWarm(ipv6)
+		return nil, fmt.Errorf("error pinning addresses [%s] [%s] of service [%s]: %w", ipv4, ipv6, service.Name, err)
+	}
+	return pinned, nil
+}
@@ -0,0 +1,203 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func Test_reconcileDualStack(t *testing.T) {
+	pools := map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126"}
+	tests := []struct {
+		name       string
+		data       map[string]string
+		requested  string
+		wantErr    error
+		wantStatus string
+	}{
+		{
+			name:      "both families",
+			data:      pools,
+			requested: "192.168.0.5, fd00::5",
+		},
+		{
+			name:       "IPv6 address without an IPv6 pool",
+			data:       map[string]string{"cidr-dev": "192.168.0.0/24"},
+			requested:  "192.168.0.5,fd00::5",
+			wantErr:    ErrInvalidAddress,
+			wantStatus: IPAMStatusInvalidAddress,
+		},
+		{
+			name:       "duplicate address",
+			data:       pools,
+			requested:  "192.168.0.5,192.168.0.5",
+			wantErr:    ErrInvalidAddress,
+			wantStatus: IPAMStatusInvalidAddress,
+		},
+		{
+			name:       "two addresses of the same family",
+			data:       pools,
+			requested:  "192.168.0.5,192.168.0.6",
+			wantErr:    ErrInvalidAddress,
+			wantStatus: IPAMStatusInvalidAddress,
+		},
+		{
+			name:       "address allocated to another service",
+			data:       pools,
+			requested:  "192.168.0.6,fd00::5",
+			wantErr:    ErrAddressConflict,
+			wantStatus: IPAMStatusAddressConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			other := newTestService("dev", "other")
+			other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.6"}
+			other.Spec.LoadBalancerIP = "192.168.0.6"
+			svc := newTestService("dev", "dual")
+			svc.Annotations = map[string]string{LoadBalancerIPsAnnotation: tt.requested}
+			k := newTestLoadBalancer(tt.data, other, svc)
+
+			status, err := k.syncLoadBalancer(context.TODO(), svc)
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("syncLoadBalancer() error = %v, want %v", err, tt.wantErr)
+				}
+				if got.Annotations[IPAMStatusAnnotation] != tt.wantStatus {
+					t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			if len(status.Ingress) != 2 || status.Ingress[0].IP != "192.168.0.5" || status.Ingress[1].IP != "fd00::5" {
+				t.Errorf("syncLoadBalancer() status = %+v, want ingress 192.168.0.5 and fd00::5", status)
+			}
+			if got.Labels["ipam-address"] != "192.168.0.5" {
+				t.Errorf("label ipam-address = %q, want 192.168.0.5", got.Labels["ipam-address"])
+			}
+			// Both addresses are tracked
+			if addresses := k.allocations.addresses[svc.UID]; !reflect.DeepEqual(addresses, []string{"192.168.0.5", "fd00::5"}) {
+				t.Errorf("tracked addresses = %v, want [192.168.0.5 fd00::5]", addresses)
+			}
+			if got, _ := testutil.GetGaugeMetricValue(serviceAddressesGauge.WithLabelValues("dev", "dual")); got != 2 {
+				t.Errorf("service addresses metric = %v, want 2", got)
+			}
+
+			// A dynamic service isn't given either of the pinned addresses, even without reserving static requests
+			k.reserveStatic = false
+			dynamic := newTestService("dev", "dynamic")
+			if _, err := k.kubeClient.CoreV1().Services("dev").Create(context.TODO(), dynamic, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := k.syncLoadBalancer(context.TODO(), dynamic); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), dynamic.Name, metav1.GetOptions{})
+			if allocated.Spec.LoadBalancerIP != "fd00::6" {
+				t.Errorf("dynamic service allocated %q, want fd00::6", allocated.Spec.LoadBalancerIP)
+			}
+		})
+	}
+}
+
+func Test_preferDualStack(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		wantIngress []string
+		wantEvent   bool
+		warm        bool
+	}{
+		{
+			name:        "both families",
+			data:        map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126"},
+			wantIngress: []string{"192.168.0.5", "fd00::5"},
+		},
+		{
+			name:        "IPv4 only",
+			data:        map[string]string{"cidr-dev": "192.168.0.4/30"},
+			wantIngress: []string{"192.168.0.5"},
+			wantEvent:   true,
+		},
+		{
+			name:        "IPv6 only",
+			data:        map[string]string{"cidr-dev": "fd00::4/126"},
+			wantIngress: []string{"fd00::5"},
+			wantEvent:   true,
+		},
+		{
+			// The addresses taken from the warm pool and not pinned are returned to it
+			name:        "IPv4 only, warm pools",
+			data:        map[string]string{"cidr-dev": "192.168.0.4/30"},
+			wantIngress: []string{"192.168.0.5"},
+			wantEvent:   true,
+			warm:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			defer ipam.ResetWarm()
+			svc := newTestService("dev", "prefer")
+			svc.Annotations = map[string]string{IPFamilyPolicyAnnotation: IPFamilyPolicyPreferDualStack}
+			k := newTestLoadBalancer(tt.data, svc)
+			if tt.warm {
+				k.warmPools = &warmPools{}
+				k.warmStartup(context.TODO())
+			}
+
+			status, err := k.syncLoadBalancer(context.TODO(), svc)
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			var ingress []string
+			for _, i := range status.Ingress {
+				ingress = append(ingress, i.IP)
+			}
+			if !reflect.DeepEqual(ingress, tt.wantIngress) {
+				t.Errorf("syncLoadBalancer() ingress = %v, want %v", ingress, tt.wantIngress)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Labels["ipam-address"] != tt.wantIngress[0] {
+				t.Errorf("label ipam-address = %q, want %q", got.Labels["ipam-address"], tt.wantIngress[0])
+			}
+
+			var events []string
+			for done := false; !done; {
+				select {
+				case event := <-k.recorder.(*record.FakeRecorder).Events:
+					events = append(events, event)
+				default:
+					done = true
+				}
+			}
+			var unavailable bool
+			for _, event := range events {
+				unavailable = unavailable || strings.Contains(event, ReasonFamilyUnavailable)
+			}
+			if unavailable != tt.wantEvent {
+				t.Errorf("events = %v, want a [%s] event %v", events, ReasonFamilyUnavailable, tt.wantEvent)
+			}
+
+			// The service isn't stuck, a later sync keeps its address
+			if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+				t.Errorf("syncLoadBalancer() error = %v", err)
+			}
+			again, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if again.Labels["ipam-address"] != tt.wantIngress[0] {
+				t.Errorf("label ipam-address = %q after a later sync, want %q", again.Labels["ipam-address"], tt.wantIngress[0])
+			}
+		})
+	}
+}
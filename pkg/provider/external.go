@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// ErrReservationsUnavailable is returned when the external reservations have never been fetched, an address isn't
+// allocated until they are as it may be reserved
+var ErrReservationsUnavailable = errors.New("external reservations unavailable")
+
+// ReservationsURL is an endpoint (i.e. of a corporate IPAM) returning the reserved addresses, cidrs and ranges that
+// mustn't be allocated
+var ReservationsURL string
+
+// ReservationsInterval is how often the external reservations are fetched
+var ReservationsInterval = time.Minute
+
+// reservationsResponse is the body returned by the reservations endpoint, i.e.
+// {"reservations": ["192.168.0.10-192.168.0.20", "192.168.1.0/28", "192.168.0.5"]}
+type reservationsResponse struct {
+	Reservations []string `json:"reservations"`
+}
+
+// externalReservations caches the addresses reserved by the reservations endpoint, the last fetched addresses are
+// kept while the endpoint is failing
+type externalReservations struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	addresses []string
+	fetched   bool
+}
+
+func newExternalReservations(url string) *externalReservations {
+	if url == "" {
+		return nil
+	}
+	return &externalReservations{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// fetch returns every address reserved by the endpoint
+func (r *externalReservations) fetch(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status [%s]", resp.Status)
+	}
+	var body reservationsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unable to decode the reservations: %v", err)
+	}
+	return ipam.ReservedAddresses(body.Reservations)
+}
+
+// refresh fetches the reservations, the cached addresses are kept if the fetch fails
+func (r *externalReservations) refresh(ctx context.Context) error {
+	addresses, err := r.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to fetch the reservations from [%s]: %w", r.url, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addresses, r.fetched = addresses, true
+	return nil
+}
+
+// reserved returns the cached addresses, they are fetched if they never have been
+func (r *externalReservations) reserved(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	fetched := r.fetched
+	r.mu.Unlock()
+	if !fetched {
+		if err := r.refresh(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrReservationsUnavailable, err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addresses, nil
+}
+
+// reservationsStartup fetches the external reservations every interval until stopped
+func (k *kubevipLoadBalancerManager) reservationsStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if err := k.reservations.refresh(context.Background()); err != nil {
+			klog.Warningf("%v, keeping the last reservations", err)
+		}
+	}, ReservationsInterval, stop)
+}
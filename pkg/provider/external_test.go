@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_externalReservations(t *testing.T) {
+	ipam.Manager = nil
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"reservations": ["192.168.0.1-192.168.0.2", "192.168.0.3/32"]}`))
+	}))
+	defer server.Close()
+
+	first := newTestService("dev", "first")
+	second := newTestService("dev", "second")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, first, second)
+	k.reservations = newExternalReservations(server.URL)
+
+	if _, err := k.syncLoadBalancer(context.TODO(), first); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), first.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.4" {
+		t.Errorf("syncLoadBalancer() allocated %q, want 192.168.0.4 after the reservations", got.Spec.LoadBalancerIP)
+	}
+
+	// A failing endpoint keeps the last reservations
+	atomic.StoreInt32(&failing, 1)
+	if err := k.reservations.refresh(context.TODO()); err == nil {
+		t.Errorf("refresh() error = nil, want the failure of the endpoint")
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), second); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), second.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.5" {
+		t.Errorf("syncLoadBalancer() allocated %q, want 192.168.0.5 with the cached reservations", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_externalReservationsUnavailable(t *testing.T) {
+	ipam.Manager = nil
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`not json`))
+	}))
+	defer server.Close()
+
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, svc)
+	k.reservations = newExternalReservations(server.URL)
+
+	// Nothing is allocated until the reservations have been fetched
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); !errors.Is(err, ErrReservationsUnavailable) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrReservationsUnavailable)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "" {
+		t.Errorf("syncLoadBalancer() allocated %q, want no address", got.Spec.LoadBalancerIP)
+	}
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// ErrPoolPolicy is returned when a service requests more addresses from a pool than the pool allows
+var ErrPoolPolicy = errors.New("pool policy violated")
+
+// ErrInvalidPoolPolicy is returned when a pool policy key can't be parsed
+var ErrInvalidPoolPolicy = errors.New("invalid pool policy")
+
+const (
+	//PoolMaxPerServiceKeyPrefix is followed by the pool, i.e. pool-max-per-service-<namespace>, the value is the most
+	//addresses a single service can hold from the pool
+	PoolMaxPerServiceKeyPrefix = "pool-max-per-service-"
+
+	//PoolAllowBlocksKeyPrefix is followed by the pool, i.e. pool-allow-blocks-<namespace>, "false" refuses a service
+	//requesting more than one address from the pool
+	PoolAllowBlocksKeyPrefix = "pool-allow-blocks-"
+
+	//IPAMStatusPoolPolicy is set when the service requests more addresses from a pool than the pool allows
+	IPAMStatusPoolPolicy = "pool-policy"
+
+	//ReasonPoolPolicy is the event reason when a service requests more addresses from a pool than the pool allows
+	ReasonPoolPolicy = "PoolPolicyViolated"
+)
+
+// poolPolicy is how many addresses a single service can hold from a pool
+type poolPolicy struct {
+	// maxPerService is the most addresses a service can hold from the pool, 0 is unlimited
+	maxPerService int
+	// allowBlocks is false if a service can only hold a single address from the pool
+	allowBlocks bool
+}
+
+// policyPool returns the pool of the config map key, i.e. dev for cidr-dev
+func policyPool(key, keyPrefix string) string {
+	return strings.TrimPrefix(key, keyPrefix+poolKind(key, keyPrefix)+"-")
+}
+
+// parseMaxPerService returns the value of a pool-max-per-service key
+func parseMaxPerService(value string) (int, error) {
+	max, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || max < 1 {
+		return 0, fmt.Errorf("%w, [%s] isn't a number of addresses of at least 1", ErrInvalidPoolPolicy, value)
+	}
+	return max, nil
+}
+
+// parseAllowBlocks returns the value of a pool-allow-blocks key
+func parseAllowBlocks(value string) (bool, error) {
+	allow, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return true, fmt.Errorf("%w, [%s] isn't true or false", ErrInvalidPoolPolicy, value)
+	}
+	return allow, nil
+}
+
+// parsePoolPolicy returns the policy of the pool, with an error for each key that can't be parsed (and is ignored)
+func parsePoolPolicy(cm *v1.ConfigMap, keyPrefix, pool string) (poolPolicy, []error) {
+	policy := poolPolicy{allowBlocks: true}
+	var errs []error
+	maxKey := keyPrefix + PoolMaxPerServiceKeyPrefix + pool
+	if value, ok := cm.Data[maxKey]; ok {
+		max, err := parseMaxPerService(value)
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: maxKey, Value: value, Err: err})
+		}
+		policy.maxPerService = max
+	}
+	blocksKey := keyPrefix + PoolAllowBlocksKeyPrefix + pool
+	if value, ok := cm.Data[blocksKey]; ok {
+		allow, err := parseAllowBlocks(value)
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: blocksKey, Value: value, Err: err})
+		}
+		policy.allowBlocks = allow
+	}
+	return policy, errs
+}
+
+// poolPolicyErrors returns an error for every pool policy key that can't be parsed
+func poolPolicyErrors(cm *v1.ConfigMap, keyPrefix string) []error {
+	var errs []error
+	for key, value := range cm.Data {
+		var err error
+		switch {
+		case strings.HasPrefix(key, keyPrefix+PoolMaxPerServiceKeyPrefix):
+			_, err = parseMaxPerService(value)
+		case strings.HasPrefix(key, keyPrefix+PoolAllowBlocksKeyPrefix):
+			_, err = parseAllowBlocks(value)
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: key, Value: value, Err: err})
+		}
+	}
+	return errs
+}
+
+// checkPoolPolicy returns an error if the service holding the addresses (by pool key) would break the policy of a
+// pool, a policy that can't be parsed is ignored
+func checkPoolPolicy(cm *v1.ConfigMap, keyPrefix, serviceName string, addresses map[string][]string) error {
+	for key, inPool := range addresses {
+		policy, errs := parsePoolPolicy(cm, keyPrefix, policyPool(key, keyPrefix))
+		for _, err := range errs {
+			klog.Warningf("ignoring %v", err)
+		}
+		if !policy.allowBlocks && len(inPool) > 1 {
+			return fmt.Errorf("%w, service [%s] requests %v from pool [%s], which only allows a single address per service", ErrPoolPolicy, serviceName, inPool, key)
+		}
+		if policy.maxPerService > 0 && len(inPool) > policy.maxPerService {
+			return fmt.Errorf("%w, service [%s] requests %v from pool [%s], which allows [%d] addresses per service", ErrPoolPolicy, serviceName, inPool, key, policy.maxPerService)
+		}
+	}
+	return nil
+}
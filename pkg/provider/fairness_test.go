@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_poolPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    map[string]string
+		requested string
+		wantErr   bool
+	}{
+		{name: "no policy", requested: "192.168.0.5,fd00::5"},
+		{name: "max per service respected", policy: map[string]string{PoolMaxPerServiceKeyPrefix + "dev": "2"}, requested: "192.168.0.5,fd00::5"},
+		{name: "max per service enforced", policy: map[string]string{PoolMaxPerServiceKeyPrefix + "dev": "1"}, requested: "192.168.0.5,fd00::5", wantErr: true},
+		{name: "max per service of another pool", policy: map[string]string{PoolMaxPerServiceKeyPrefix + "global": "1"}, requested: "192.168.0.5,fd00::5"},
+		{name: "blocks allowed", policy: map[string]string{PoolAllowBlocksKeyPrefix + "dev": "true"}, requested: "192.168.0.5,fd00::5"},
+		{name: "blocks refused", policy: map[string]string{PoolAllowBlocksKeyPrefix + "dev": "false"}, requested: "192.168.0.5,fd00::5", wantErr: true},
+		{name: "invalid policy is ignored", policy: map[string]string{PoolAllowBlocksKeyPrefix + "dev": "sometimes"}, requested: "192.168.0.5,fd00::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			data := map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126"}
+			for key, value := range tt.policy {
+				data[key] = value
+			}
+			svc := newTestService("dev", "dual")
+			svc.Annotations = map[string]string{LoadBalancerIPsAnnotation: tt.requested}
+			k := newTestLoadBalancer(data, svc)
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if tt.wantErr {
+				if !errors.Is(err, ErrPoolPolicy) {
+					t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrPoolPolicy)
+				}
+				if got.Annotations[IPAMStatusAnnotation] != IPAMStatusPoolPolicy {
+					t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], IPAMStatusPoolPolicy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			if got.Labels["ipam-address"] != "192.168.0.5" {
+				t.Errorf("label ipam-address = %q, want 192.168.0.5", got.Labels["ipam-address"])
+			}
+		})
+	}
+}
+
+func Test_poolPolicySingleAddress(t *testing.T) {
+	// A service is only ever allocated a single address, which every policy allows
+	ipam.Manager = nil
+	svc := newTestService("dev", "single")
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-dev":                         "192.168.0.4/30",
+		PoolMaxPerServiceKeyPrefix + "dev": "1",
+		PoolAllowBlocksKeyPrefix + "dev":   "false",
+	}, svc)
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP == "" {
+		t.Errorf("service wasn't allocated an address")
+	}
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	//ReuseFreedFirstKey when "true" allocates a recently released address before an address that was never used
+	ReuseFreedFirstKey = "reuse-freed-first"
+
+	//ReuseFreedTTLKey is how long (i.e. 1m) a released address is preferred for, the default is ReuseFreedTTL
+	ReuseFreedTTLKey = "reuse-freed-ttl"
+
+	//ReuseFreedTTL is how long a released address is preferred for unless the config map sets the TTL
+	ReuseFreedTTL = 10 * time.Minute
+)
+
+// freedAddress is an address released when its service was deleted
+type freedAddress struct {
+	address string
+	at      time.Time
+}
+
+// freedAddresses are the recently released addresses, oldest first
+type freedAddresses struct {
+	mu        sync.Mutex
+	addresses []freedAddress
+}
+
+// add records the address as released at the time
+func (f *freedAddresses) add(address string, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removeLocked(address)
+	f.addresses = append(f.addresses, freedAddress{address: ipam.NormalizeAddress(address), at: at})
+}
+
+// remove forgets the address, i.e. once it has been reused
+func (f *freedAddresses) remove(address string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removeLocked(address)
+}
+
+func (f *freedAddresses) removeLocked(address string) {
+	address = ipam.NormalizeAddress(address)
+	for x := range f.addresses {
+		if f.addresses[x].address == address {
+			f.addresses = append(f.addresses[:x], f.addresses[x+1:]...)
+			return
+		}
+	}
+}
+
+// recent returns the addresses released within the TTL, most recently released first, older addresses are forgotten
+func (f *freedAddresses) recent(now time.Time, ttl time.Duration) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var kept []freedAddress
+	for _, a := range f.addresses {
+		if now.Sub(a.at) < ttl {
+			kept = append(kept, a)
+		}
+	}
+	f.addresses = kept
+
+	recent := make([]string, 0, len(kept))
+	for x := len(kept) - 1; x >= 0; x-- {
+		recent = append(recent, kept[x].address)
+	}
+	return recent
+}
+
+// reuseFreedTTL returns how long a released address is preferred for
+func reuseFreedTTL(cm *v1.ConfigMap) time.Duration {
+	value, ok := cm.Data[ReuseFreedTTLKey]
+	if !ok {
+		return ReuseFreedTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		klog.Warningf("ignoring [%s] [%s], it isn't a positive duration", ReuseFreedTTLKey, value)
+		return ReuseFreedTTL
+	}
+	return ttl
+}
+
+// preferFreed returns the most recently released address that is free and in the same pool instead of the
+// discovered address, so that allocations stay dense
+func (k *kubevipLoadBalancerManager) preferFreed(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation, existingServiceIPS []string) *allocation {
+	if cm.Data[ReuseFreedFirstKey] != "true" {
+		return discovered
+	}
+	for _, address := range k.freed.recent(k.clock.Now(), reuseFreedTTL(cm)) {
+		if address == discovered.address {
+			k.freed.remove(address)
+			return discovered
+		}
+		preferred, ok := k.preferAddress(ctx, cm, service, discovered, existingServiceIPS, address)
+		if ok {
+			klog.Infof("reusing released address [%s] for service [%s]", address, service.Name)
+			k.freed.remove(address)
+			return preferred
+		}
+	}
+	return discovered
+}
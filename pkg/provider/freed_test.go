@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func Test_preferFreed(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		elapsed time.Duration
+		want    string
+	}{
+		{
+			name: "freed address is reused",
+			data: map[string]string{"cidr-dev": "192.168.0.0/29", ReuseFreedFirstKey: "true"},
+			want: "192.168.0.5",
+		},
+		{
+			name:    "freed address has expired",
+			data:    map[string]string{"cidr-dev": "192.168.0.0/29", ReuseFreedFirstKey: "true", ReuseFreedTTLKey: "1m"},
+			elapsed: time.Minute,
+			want:    "192.168.0.3",
+		},
+		{
+			name: "disabled",
+			data: map[string]string{"cidr-dev": "192.168.0.0/29"},
+			want: "192.168.0.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			// 192.168.0.3 and 192.168.0.4 have never been used, 192.168.0.5 is released when old is deleted
+			var objects []*v1.Service
+			for x, name := range []string{"a", "b", "old"} {
+				svc := newTestService("dev", name)
+				address := []string{"192.168.0.1", "192.168.0.2", "192.168.0.5"}[x]
+				svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": address}
+				svc.Spec.LoadBalancerIP = address
+				objects = append(objects, svc)
+			}
+			fresh := newTestService("dev", "fresh")
+			k := newTestLoadBalancer(tt.data, objects[0], objects[1], objects[2], fresh)
+			fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+			k.clock = fakeClock
+
+			if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), "old", metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := k.EnsureLoadBalancerDeleted(context.TODO(), "", objects[2]); err != nil {
+				t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+			}
+			fakeClock.Step(tt.elapsed)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), fresh); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), fresh.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+		})
+	}
+}
+
+func Test_freedAddressesRecent(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &freedAddresses{}
+	f.add("192.168.0.1", start)
+	f.add("192.168.0.2", start.Add(time.Minute))
+	f.add("192.168.0.3", start.Add(2*time.Minute))
+	// Releasing an address again moves it to the front
+	f.add("192.168.0.1", start.Add(3*time.Minute))
+	f.remove("192.168.0.3")
+
+	got := f.recent(start.Add(4*time.Minute), 3*time.Minute+time.Second)
+	want := []string{"192.168.0.1", "192.168.0.2"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("recent() = %v, want %v", got, want)
+	}
+	if got := f.recent(start.Add(10*time.Minute), time.Minute); len(got) != 0 {
+		t.Errorf("recent() = %v, want the expired addresses forgotten", got)
+	}
+}
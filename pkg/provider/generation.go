@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	//PoolGenerationKey is the config map key with the current generation of the pools
+	PoolGenerationKey = "pool-generation"
+
+	//PoolMigrationKey when "true" reallocates services from an older pool generation into the current pools
+	PoolMigrationKey = "pool-migration"
+
+	//PoolGenerationAnnotation records the pool generation that the address of a service was allocated from
+	PoolGenerationAnnotation = "kube-vip.io/pool-generation"
+)
+
+// poolGeneration returns the current pool generation, ok is false if it isn't configured
+func poolGeneration(cm *v1.ConfigMap) (generation int, ok bool) {
+	value, ok := cm.Data[PoolGenerationKey]
+	if !ok {
+		return 0, false
+	}
+	generation, err := strconv.Atoi(value)
+	if err != nil {
+		klog.Warningf("ignoring [%s] [%s], it isn't a number", PoolGenerationKey, value)
+		return 0, false
+	}
+	return generation, true
+}
+
+// migrating returns true if the service should be reallocated into the current pool generation, only services
+// stamped with an older generation are migrated and only while the migration is enabled
+func migrating(cm *v1.ConfigMap, service *v1.Service) bool {
+	if cm.Data[PoolMigrationKey] != "true" {
+		return false
+	}
+	current, ok := poolGeneration(cm)
+	if !ok {
+		return false
+	}
+	stamped, err := strconv.Atoi(service.Annotations[PoolGenerationAnnotation])
+	if err != nil {
+		return false
+	}
+	return stamped < current
+}
+
+// stampGeneration records the current pool generation in the annotations of an allocated service
+func stampGeneration(annotations map[string]string, cm *v1.ConfigMap) {
+	if generation, ok := poolGeneration(cm); ok {
+		annotations[PoolGenerationAnnotation] = strconv.Itoa(generation)
+		return
+	}
+	delete(annotations, PoolGenerationAnnotation)
+}
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// ErrInvalidGlobalServiceID is returned when the global service id of a service can't be used as a record key
+var ErrInvalidGlobalServiceID = errors.New("invalid global service id")
+
+const (
+	//GlobalServiceIDAnnotation is an id shared by services (in any namespace) that are given the same address, the
+	//first service allocated with the id defines the address
+	GlobalServiceIDAnnotation = "kube-vip.io/global-service-id"
+
+	//KubeVipGlobalServices is the config map (in kube-system) that records the address of each global service id
+	KubeVipGlobalServices = "kubevip-global-services"
+
+	//ReasonInvalidGlobalServiceID is the event reason when the global service id of a service isn't valid
+	ReasonInvalidGlobalServiceID = "InvalidGlobalServiceID"
+)
+
+// globalServiceID returns the global service id of the service, or an error if it can't be a config map key
+func globalServiceID(service *v1.Service) (string, error) {
+	id := service.Annotations[GlobalServiceIDAnnotation]
+	if id == "" {
+		return "", nil
+	}
+	if errs := validation.IsConfigMapKey(id); len(errs) != 0 {
+		return "", fmt.Errorf("%w [%s] of service [%s]: %s", ErrInvalidGlobalServiceID, id, service.Name, strings.Join(errs, ", "))
+	}
+	return id, nil
+}
+
+// reserveGlobal returns the address recorded for the id, recording the address if the id has none. Concurrent
+// reservations conflict on the config map, the loser re-reads it and converges on the recorded address
+func (k *kubevipLoadBalancerManager) reserveGlobal(ctx context.Context, id, address string) (recorded string, err error) {
+	configMaps := k.kubeClient.CoreV1().ConfigMaps("kube-system")
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, KubeVipGlobalServices, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: KubeVipGlobalServices, Namespace: "kube-system"}, Data: map[string]string{id: address}}
+			if _, err = configMaps.Create(ctx, cm, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+				// Another reservation created it first, retry against its record
+				return apierrors.NewConflict(v1.Resource("configmaps"), KubeVipGlobalServices, err)
+			}
+			recorded = address
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if existing, ok := cm.Data[id]; ok {
+			recorded = ipam.NormalizeAddress(existing)
+			return nil
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[id] = address
+		if _, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		recorded = address
+		return nil
+	})
+	return recorded, err
+}
+
+// globalHolders returns the other services that have the address, split into those with the same global service id
+// and the rest
+func (k *kubevipLoadBalancerManager) globalHolders(ctx context.Context, service *v1.Service, id, address string) (sharing, conflicting []*v1.Service, err error) {
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	for x := range svcs.Items {
+		other := &svcs.Items[x]
+		if other.UID == service.UID || other.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		if ipam.NormalizeAddress(other.Labels["ipam-address"]) != address && ipam.NormalizeAddress(other.Spec.LoadBalancerIP) != address {
+			continue
+		}
+		if other.Annotations[GlobalServiceIDAnnotation] == id {
+			sharing = append(sharing, other)
+		} else {
+			conflicting = append(conflicting, other)
+		}
+	}
+	return sharing, conflicting, nil
+}
+
+// preferGlobal returns the address recorded for the global service id of the service instead of the discovered
+// address. The first service with the id records the discovered address, the recorded address must be in a pool and
+// can't be allocated to a service without the id
+func (k *kubevipLoadBalancerManager) preferGlobal(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation) (*allocation, error) {
+	id, err := globalServiceID(service)
+	if err != nil {
+		k.ipamEvent(service, v1.EventTypeWarning, ReasonInvalidGlobalServiceID, err.Error())
+		return nil, err
+	}
+	if id == "" {
+		return discovered, nil
+	}
+	recorded, err := k.reserveGlobal(ctx, id, discovered.address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reserve address [%s] for global service id [%s]: %w", discovered.address, id, err)
+	}
+	if recorded == discovered.address {
+		return discovered, nil
+	}
+
+	keys, bounds, _ := poolBounds(cm, k.keyPrefix)
+	pool, ok := poolContaining(keys, bounds, recorded)
+	if !ok {
+		return nil, fmt.Errorf("%w, [%s] recorded for global service id [%s] of service [%s] isn't in a pool", ErrInvalidAddress, recorded, id, service.Name)
+	}
+	_, conflicting, err := k.globalHolders(ctx, service, id, recorded)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicting) != 0 {
+		return nil, fmt.Errorf("%w, [%s] recorded for global service id [%s] of service [%s] is allocated to service [%s/%s]", ErrAddressConflict, recorded, id, service.Name, conflicting[0].Namespace, conflicting[0].Name)
+	}
+
+	k.releaseWarm(discovered.address)
+	shared := &allocation{address: recorded, pool: pool, source: SourceReserved}
+	if allocator := allocatorFor(poolKind(pool, k.keyPrefix)); allocator != nil {
+		if prefix, err := allocator.Prefix(cm.Data[pool], recorded); err == nil {
+			shared.prefix = prefix
+		}
+	}
+	klog.Infof("allocating address [%s] of global service id [%s] to service [%s/%s]", recorded, id, service.Namespace, service.Name)
+	return shared, nil
+}
+
+// releaseGlobal returns true if the address of the deleted service is still shared by a service with its global
+// service id, otherwise the record of the id is removed and the address can be released
+func (k *kubevipLoadBalancerManager) releaseGlobal(ctx context.Context, service *v1.Service, address string) bool {
+	id := service.Annotations[GlobalServiceIDAnnotation]
+	if id == "" {
+		return false
+	}
+	address = ipam.NormalizeAddress(address)
+	sharing, _, err := k.globalHolders(ctx, service, id, address)
+	if err != nil {
+		klog.Warningf("unable to list the services of global service id [%s], releasing address [%s]: %v", id, address, err)
+		return false
+	}
+	if len(sharing) != 0 {
+		klog.Infof("address [%s] of global service id [%s] is still allocated to service [%s/%s], not releasing it", address, id, sharing[0].Namespace, sharing[0].Name)
+		return true
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipGlobalServices, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ipam.NormalizeAddress(cm.Data[id]) != address {
+			return nil
+		}
+		delete(cm.Data, id)
+		_, err = k.kubeClient.CoreV1().ConfigMaps("kube-system").Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Warningf("unable to remove the record of global service id [%s]: %v", id, err)
+	}
+	return false
+}
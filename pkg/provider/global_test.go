@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newGlobalService(ns, name, id string) *v1.Service {
+	svc := newTestService(ns, name)
+	svc.Annotations = map[string]string{GlobalServiceIDAnnotation: id}
+	return svc
+}
+
+func Test_preferGlobalConvergence(t *testing.T) {
+	ipam.Manager = nil
+	first := newGlobalService("dev", "myapp", "myapp")
+	second := newGlobalService("prod", "myapp", "myapp")
+	other := newTestService("prod", "other")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, first, second, other)
+
+	for _, svc := range []*v1.Service{first, second, other} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s/%s) error = %v", svc.Namespace, svc.Name, err)
+		}
+	}
+	addresses := make(map[string]string)
+	for _, svc := range []*v1.Service{first, second, other} {
+		got, _ := k.kubeClient.CoreV1().Services(svc.Namespace).Get(context.TODO(), svc.Name, metav1.GetOptions{})
+		addresses[svc.Namespace+"/"+svc.Name] = got.Labels["ipam-address"]
+	}
+	if addresses["dev/myapp"] == "" || addresses["dev/myapp"] != addresses["prod/myapp"] {
+		t.Errorf("services with the global service id allocated %q and %q, want the same address", addresses["dev/myapp"], addresses["prod/myapp"])
+	}
+	if addresses["prod/other"] == addresses["dev/myapp"] {
+		t.Errorf("service without the global service id allocated the shared address %q", addresses["prod/other"])
+	}
+	records, _ := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipGlobalServices, metav1.GetOptions{})
+	if records == nil || records.Data["myapp"] != addresses["dev/myapp"] {
+		t.Errorf("record of global service id = %v, want %q", records, addresses["dev/myapp"])
+	}
+
+	// The address is kept while another service has the id, the record is removed with the last of them
+	if err := k.deleteLoadBalancer(context.TODO(), first); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), first.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	records, _ = k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipGlobalServices, metav1.GetOptions{})
+	if _, ok := records.Data["myapp"]; !ok {
+		t.Errorf("record of global service id removed while service [prod/myapp] has the address")
+	}
+	remaining, _ := k.kubeClient.CoreV1().Services("prod").Get(context.TODO(), second.Name, metav1.GetOptions{})
+	if err := k.deleteLoadBalancer(context.TODO(), remaining); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	records, _ = k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipGlobalServices, metav1.GetOptions{})
+	if _, ok := records.Data["myapp"]; ok {
+		t.Errorf("record of global service id kept after its last service was deleted")
+	}
+}
+
+func Test_preferGlobalConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		recorded   string
+		wantErr    error
+		wantStatus string
+	}{
+		{
+			name:       "recorded address allocated to a service without the id",
+			id:         "myapp",
+			recorded:   "192.168.0.201",
+			wantErr:    ErrAddressConflict,
+			wantStatus: IPAMStatusAddressConflict,
+		},
+		{
+			name:       "recorded address outside of the pools",
+			id:         "myapp",
+			recorded:   "10.0.0.1",
+			wantErr:    ErrInvalidAddress,
+			wantStatus: IPAMStatusInvalidAddress,
+		},
+		{
+			name:    "invalid id",
+			id:      "my app",
+			wantErr: ErrInvalidGlobalServiceID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			holder := newTestService("dev", "holder")
+			holder.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+			holder.Spec.LoadBalancerIP = "192.168.0.201"
+			records := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: KubeVipGlobalServices, Namespace: "kube-system"},
+				Data:       map[string]string{"myapp": tt.recorded},
+			}
+			svc := newGlobalService("prod", "myapp", tt.id)
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, holder, records, svc)
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("syncLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("prod").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Labels["ipam-address"] != "" {
+				t.Errorf("service allocated %q, want no address", got.Labels["ipam-address"])
+			}
+			if got.Annotations[IPAMStatusAnnotation] != tt.wantStatus {
+				t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], tt.wantStatus)
+			}
+		})
+	}
+}
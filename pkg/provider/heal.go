@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+//ReasonAllocationHealed is the event reason when the managed state of a service with an allocated address is restored
+const ReasonAllocationHealed = "AllocationHealed"
+
+// partiallyManaged returns true if the service has an ipam-address label but not the rest of the managed state, i.e.
+// it was labelled by an earlier version without the implementation label or without the address in its spec. A
+// spec that differs from the label is a drift, not a partially managed service
+func partiallyManaged(service *v1.Service) bool {
+	if service.Labels["ipam-address"] == "" || drifted(service) {
+		return false
+	}
+	return service.Labels["implementation"] != "kube-vip" || service.Spec.LoadBalancerIP == ""
+}
+
+// heal restores the managed state of a partially managed service with the address of its label, if the address is
+// still in a pool and not claimed by another service. healed is false if the service should be allocated instead
+func (k *kubevipLoadBalancerManager) heal(ctx context.Context, cm *v1.ConfigMap, service *v1.Service) (status *v1.LoadBalancerStatus, healed bool, err error) {
+	address := ipam.NormalizeAddress(service.Labels["ipam-address"])
+
+	// The address isn't counted as in use until the service has the implementation label, so check and claim it as
+	// an allocation would
+	unlock := k.allocationLock.lock()
+	defer unlock()
+
+	keys, bounds, _ := poolBounds(cm, k.keyPrefix)
+	if _, ok := poolContaining(keys, bounds, address); !ok {
+		klog.Infof("address [%s] of partially managed service [%s] isn't in a pool, allocating a new address", address, service.Name)
+		return nil, false, nil
+	}
+	claimed, err := k.claimedAddresses(ctx, service)
+	if err != nil {
+		return nil, false, err
+	}
+	if owner, ok := claimed[address]; ok {
+		klog.Infof("address [%s] of partially managed service [%s] is claimed by service [%s], allocating a new address", address, service.Name, owner)
+		return nil, false, nil
+	}
+
+	var source string
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		before := recentService.DeepCopy()
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		// The source is recorded before the spec is set, otherwise a dynamic address would look static
+		source = allocationSource(recentService)
+		recentService.Labels["implementation"] = "kube-vip"
+		recentService.Labels["ipam-address"] = address
+		recentService.Spec.LoadBalancerIP = address
+		clearIPAMStatus(recentService.Annotations)
+		k.annotateAddress(recentService.Annotations, address)
+		k.stampOwner(recentService.Annotations)
+		recentService.Annotations[AllocationSourceAnnotation] = source
+		if serviceUnchanged(before, recentService) {
+			return nil
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error healing address [%s] of service [%s]: %w", address, service.Name, err)
+	}
+	klog.Infof("restored the managed state of service [%s/%s] with address [%s]", service.Namespace, service.Name, address)
+	k.recorder.Eventf(service, v1.EventTypeNormal, ReasonAllocationHealed, "restored the managed state of address [%s]", address)
+	k.allocations.set(service, address, source)
+	return ingressStatus(cm, service, address), true, nil
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_heal(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		spec       string
+		want       string
+		wantHealed bool
+	}{
+		{
+			name:       "without the implementation label or spec",
+			labels:     map[string]string{"ipam-address": "192.168.0.4"},
+			want:       "192.168.0.4",
+			wantHealed: true,
+		},
+		{
+			name:       "without the spec",
+			labels:     map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.4"},
+			want:       "192.168.0.4",
+			wantHealed: true,
+		},
+		{
+			name:       "without the implementation label",
+			labels:     map[string]string{"ipam-address": "192.168.0.4"},
+			spec:       "192.168.0.4",
+			want:       "192.168.0.4",
+			wantHealed: true,
+		},
+		{
+			name:   "address outside of the pools",
+			labels: map[string]string{"ipam-address": "10.0.0.4"},
+			want:   "192.168.0.1",
+		},
+		{
+			name:   "address claimed by another service",
+			labels: map[string]string{"ipam-address": "192.168.0.2"},
+			want:   "192.168.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			other := newTestService("prod", "other")
+			other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.2"}
+			other.Spec.LoadBalancerIP = "192.168.0.2"
+			svc := newTestService("dev", "web")
+			svc.Labels = tt.labels
+			svc.Spec.LoadBalancerIP = tt.spec
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.0/29"}, other, svc)
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Labels["implementation"] != "kube-vip" || got.Labels["ipam-address"] != tt.want || got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("service labels = %v, spec = %q, want the managed state of %s", got.Labels, got.Spec.LoadBalancerIP, tt.want)
+			}
+			if got.Annotations[LoadBalancerIPsAnnotation] != tt.want {
+				t.Errorf("annotation [%s] = %q, want %q", LoadBalancerIPsAnnotation, got.Annotations[LoadBalancerIPsAnnotation], tt.want)
+			}
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			if healed := strings.Contains(strings.Join(events, "\n"), ReasonAllocationHealed); healed != tt.wantHealed {
+				t.Errorf("events = %v, want healed %v", events, tt.wantHealed)
+			}
+		})
+	}
+}
+
+func Test_partiallyManaged(t *testing.T) {
+	svc := newTestService("dev", "web")
+	if partiallyManaged(svc) {
+		t.Errorf("partiallyManaged() = true for a service without an address")
+	}
+	svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.4"}
+	svc.Spec.LoadBalancerIP = "192.168.0.4"
+	if partiallyManaged(svc) {
+		t.Errorf("partiallyManaged() = true for a managed service")
+	}
+	// The spec was changed away from the label, which is a drift
+	svc.Spec.LoadBalancerIP = "192.168.0.5"
+	delete(svc.Labels, "implementation")
+	if partiallyManaged(svc) {
+		t.Errorf("partiallyManaged() = true for a drifted service")
+	}
+}
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// AllocationHistoryLength is the number of allocation events kept in the history annotation, zero disables the annotation
+var AllocationHistoryLength int
+
+// AllocationHistoryAnnotation records the most recent allocation events of a service
+const AllocationHistoryAnnotation = "kube-vip.io/allocation-history"
+
+// Allocation lifecycle event reasons, these are emitted as normal events so they can be filtered on
+const (
+	//ReasonAddressAllocated is the event reason when a service is given its first address
+	ReasonAddressAllocated = "AddressAllocated"
+
+	//ReasonAddressReallocated is the event reason when a service is given a different address
+	ReasonAddressReallocated = "AddressReallocated"
+
+	//ReasonAddressAdopted is the event reason when the ingress address from another controller is adopted
+	ReasonAddressAdopted = "AddressAdopted"
+
+	//ReasonAddressReleased is the event reason when the address of a service has been released
+	ReasonAddressReleased = "AddressReleased"
+)
+
+// historyEntry is a single allocation event stored in the history annotation
+type historyEntry struct {
+	Reason  string `json:"reason"`
+	Address string `json:"address"`
+	Time    string `json:"time"`
+}
+
+// appendHistory adds an entry to the history annotation, keeping the most recent length entries
+func appendHistory(annotations map[string]string, length int, reason, address string, now time.Time) {
+	if length <= 0 {
+		return
+	}
+
+	var history []historyEntry
+	if raw, ok := annotations[AllocationHistoryAnnotation]; ok {
+		if err := json.Unmarshal([]byte(raw), &history); err != nil {
+			klog.Warningf("discarding unreadable [%s] annotation: %v", AllocationHistoryAnnotation, err)
+			history = nil
+		}
+	}
+
+	history = append(history, historyEntry{
+		Reason:  reason,
+		Address: address,
+		Time:    now.UTC().Format(time.RFC3339),
+	})
+	if len(history) > length {
+		history = history[len(history)-length:]
+	}
+
+	b, _ := json.Marshal(history)
+	annotations[AllocationHistoryAnnotation] = string(b)
+}
+
+// allocationReason returns the lifecycle reason for moving a service from the previous address to the new one
+func allocationReason(previous, address string) string {
+	if previous != "" && previous != address {
+		return ReasonAddressReallocated
+	}
+	return ReasonAddressAllocated
+}
+
+// recordRelease emits the release event and (if enabled) records it in the history of the service, the
+// service is usually being deleted so failing to update the history isn't an error
+func (k *kubevipLoadBalancerManager) recordRelease(ctx context.Context, service *v1.Service, address string) {
+	k.recorder.Eventf(service, v1.EventTypeNormal, ReasonAddressReleased, "released address [%s]", address)
+	if k.historyLength <= 0 {
+		return
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		appendHistory(recentService.Annotations, k.historyLength, ReasonAddressReleased, address, time.Now())
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Warningf("unable to record release in [%s] on service [%s]: %v", AllocationHistoryAnnotation, service.Name, err)
+	}
+}
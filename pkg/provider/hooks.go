@@ -0,0 +1,194 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// OnAllocateURL is POSTed to after an address has been allocated to a service
+var OnAllocateURL string
+
+// OnReleaseURL is POSTed to after the address of a service has been released
+var OnReleaseURL string
+
+// HookBlocking makes a failed hook fail the reconcile, instead of only being logged
+var HookBlocking bool
+
+// HookRetries is the number of attempts made to deliver a hook
+var HookRetries = 3
+
+// AllocateHookPendingAnnotation is the address of an allocation whose blocking allocate hook hasn't been delivered yet,
+// the hook is delivered (and the annotation removed) by a later reconcile if it fails
+const AllocateHookPendingAnnotation = "kube-vip.io/allocate-hook-pending"
+
+const (
+	hookEventAllocate = "allocate"
+	hookEventRelease  = "release"
+)
+
+// hookPayload is the body sent to the allocate and release hooks
+type hookPayload struct {
+	Event     string `json:"event"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+	Address   string `json:"address"`
+}
+
+// hooks delivers allocation and release notifications to external automation (DNS, firewalls etc.)
+type hooks struct {
+	allocateURL string
+	releaseURL  string
+	blocking    bool
+
+	retries       int
+	retryInterval time.Duration
+	client        *http.Client
+
+	// headers returns the credentials every hook is sent with, nil if there are none
+	headers func(ctx context.Context) (map[string]string, error)
+}
+
+func newHooks() *hooks {
+	return &hooks{
+		allocateURL:   OnAllocateURL,
+		releaseURL:    OnReleaseURL,
+		blocking:      HookBlocking,
+		retries:       HookRetries,
+		retryInterval: time.Second,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// allocated notifies the allocate hook (if configured) that the service has been given an address
+func (h *hooks) allocated(ctx context.Context, service *v1.Service, address string) error {
+	return h.notify(ctx, h.allocateURL, newHookPayload(hookEventAllocate, service, address))
+}
+
+// pendingDelivery is true if the allocate hook must be delivered before an allocation is complete, a failed
+// non-blocking hook is only logged
+func (h *hooks) pendingDelivery() bool {
+	return h.allocateURL != "" && h.blocking
+}
+
+// released notifies the release hook (if configured) that the address of the service is free
+func (h *hooks) released(ctx context.Context, service *v1.Service, address string) error {
+	return h.notify(ctx, h.releaseURL, newHookPayload(hookEventRelease, service, address))
+}
+
+func newHookPayload(event string, service *v1.Service, address string) hookPayload {
+	return hookPayload{
+		Event:     event,
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		UID:       string(service.UID),
+		Address:   address,
+	}
+}
+
+// notify sends the payload, a non-blocking hook is delivered in the background and never returns an error
+func (h *hooks) notify(ctx context.Context, url string, payload hookPayload) error {
+	if url == "" {
+		return nil
+	}
+	if !h.blocking {
+		// The reconcile context may be cancelled before a background hook has been delivered
+		go func() {
+			if err := h.send(context.Background(), url, payload); err != nil {
+				klog.Errorf("%v", err)
+			}
+		}()
+		return nil
+	}
+	return h.send(ctx, url, payload)
+}
+
+// send POSTs the payload to the url, retrying until it succeeds or the retries are used up
+func (h *hooks) send(ctx context.Context, url string, payload hookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = h.post(ctx, url, b)
+		if err == nil {
+			return nil
+		}
+		klog.Warningf("%s hook for service [%s/%s] failed, attempt [%d/%d]: %v", payload.Event, payload.Namespace, payload.Name, attempt, h.retries, err)
+		if attempt >= h.retries {
+			return fmt.Errorf("%s hook for service [%s/%s] failed after [%d] attempts: %v", payload.Event, payload.Namespace, payload.Name, attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(h.retryInterval):
+		}
+	}
+}
+
+func (h *hooks) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.headers != nil {
+		headers, err := h.headers(ctx)
+		if err != nil {
+			return err
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status [%s] from [%s]", resp.Status, url)
+	}
+	return nil
+}
+
+// deliverAllocateHook notifies the allocate hook of the address of the service, once it has been delivered the
+// pending annotation is removed so that a later reconcile doesn't deliver it again
+func (k *kubevipLoadBalancerManager) deliverAllocateHook(ctx context.Context, service *v1.Service, address string) error {
+	if err := k.hooks.allocated(ctx, service, address); err != nil {
+		return err
+	}
+	if !k.hooks.pendingDelivery() && service.Annotations[AllocateHookPendingAnnotation] == "" {
+		return nil
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if _, ok := recentService.Annotations[AllocateHookPendingAnnotation]; !ok {
+			return nil
+		}
+		delete(recentService.Annotations, AllocateHookPendingAnnotation)
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to clear the pending allocate hook of service [%s]: %w", service.Name, err)
+	}
+	return nil
+}
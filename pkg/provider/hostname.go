@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	//HostnameTemplateKey is the config map key with the template of the ingress hostname of an allocated address
+	HostnameTemplateKey = "hostname-template"
+
+	//HostnameOnlyKey when "true" sets the ingress hostname instead of the address
+	HostnameOnlyKey = "hostname-only"
+)
+
+// ingressHostname renders the hostname template for the address of the service, the template may contain
+// {ip}, {ip-dashed} (i.e. 192-168-0-1), {name} and {namespace}
+func ingressHostname(template string, service *v1.Service, address string) string {
+	return strings.NewReplacer(
+		"{ip}", address,
+		"{ip-dashed}", strings.NewReplacer(".", "-", ":", "-").Replace(address),
+		"{name}", service.Name,
+		"{namespace}", service.Namespace,
+	).Replace(template)
+}
+
+// ingressStatus returns the load balancer status of the service with the allocated address, the status is
+// left untouched unless a hostname template is configured
+func ingressStatus(cm *v1.ConfigMap, service *v1.Service, address string) *v1.LoadBalancerStatus {
+	template := cm.Data[HostnameTemplateKey]
+	if template == "" || address == "" {
+		return &service.Status.LoadBalancer
+	}
+	ingress := v1.LoadBalancerIngress{Hostname: ingressHostname(template, service, address)}
+	if cm.Data[HostnameOnlyKey] != "true" {
+		ingress.IP = address
+	}
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{ingress}}
+}
@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+const (
+	//InfraNamespacesKey is the key in the ConfigMap with the comma separated namespaces whose allocations are
+	//infrastructure, i.e. of shared ingress controllers, and aren't counted against a quota
+	InfraNamespacesKey = "infra-namespaces"
+
+	//InfraSelectorKey is the key in the ConfigMap with a label selector of the services whose allocations are
+	//infrastructure, i.e. app.kubernetes.io/component=ingress-controller
+	InfraSelectorKey = "infra-selector"
+
+	//AllocationClassAnnotation marks the class of the allocation of a service, it is only set for infrastructure
+	AllocationClassAnnotation = "kube-vip.io/allocation-class"
+
+	//AllocationClassInfra is the class of an allocation that isn't counted against the quota of its namespace
+	AllocationClassInfra = "infra"
+)
+
+// infraAllocation returns true if the namespace of the service is an infra namespace, or the service matches the
+// infra selector
+func infraAllocation(cm *v1.ConfigMap, service *v1.Service) bool {
+	if cm == nil {
+		return false
+	}
+	for _, namespace := range strings.Split(cm.Data[InfraNamespacesKey], ",") {
+		if strings.TrimSpace(namespace) == service.Namespace {
+			return true
+		}
+	}
+	value, ok := cm.Data[InfraSelectorKey]
+	if !ok {
+		return false
+	}
+	selector, err := labels.Parse(value)
+	if err != nil {
+		klog.Warningf("ignoring [%s] [%s], it isn't a label selector: %v", InfraSelectorKey, value, err)
+		return false
+	}
+	return selector.Matches(labels.Set(service.Labels))
+}
+
+// classifyAllocation marks the allocation of the service as infrastructure, or removes the mark if it isn't
+func classifyAllocation(annotations map[string]string, cm *v1.ConfigMap, service *v1.Service) {
+	if infraAllocation(cm, service) {
+		annotations[AllocationClassAnnotation] = AllocationClassInfra
+		return
+	}
+	delete(annotations, AllocationClassAnnotation)
+}
@@ -2,12 +2,22 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	cloudprovider "k8s.io/cloud-provider"
 
@@ -16,29 +26,310 @@ import (
 
 //kubevipLoadBalancerManager -
 type kubevipLoadBalancerManager struct {
-	kubeClient     *kubernetes.Clientset
+	kubeClient     kubernetes.Interface
 	nameSpace      string
 	cloudConfigMap string
+	recorder       record.EventRecorder
+
+	// allocationLock serialises allocations from the same pools, in every namespace
+	allocationLock *allocationLock
+
+	// noPoolRetries limits how often services without a pool are re-evaluated
+	noPoolRetries *retryLimiter
+
+	// hooks notify external automation of allocations and releases
+	hooks *hooks
+
+	// reservations are the addresses reserved by an external IPAM, nil unless a reservations url is configured
+	reservations *externalReservations
+
+	// reconcileTimeout bounds the time a single sync can take, zero disables the timeout
+	reconcileTimeout time.Duration
+
+	// historyLength is the number of entries kept in the allocation history annotation
+	historyLength int
+
+	// watchedNamespaces limits the namespaces that are reconciled, all namespaces are reconciled if empty
+	watchedNamespaces map[string]bool
+
+	// requireManaged ignores services without the managed annotation
+	requireManaged bool
+
+	// staticConflictPolicy is how a service requesting an address allocated to another service is handled
+	staticConflictPolicy string
+
+	// driftPolicy is how a service whose spec.loadBalancerIP no longer matches its allocated address is handled
+	driftPolicy string
+
+	// nodeSubnetPolicy is how a static address that isn't in a subnet of the nodes is handled
+	nodeSubnetPolicy string
+	nodeSubnetPrefix int
+
+	// nodeAddressPolicy is how an allocated address that is the address of a node is handled
+	nodeAddressPolicy string
+
+	// compatAnnotation also records the address of a service for another load balancer convention, if set
+	compatAnnotation string
+
+	// allocations is the observed address of each service
+	allocations *allocationStore
+
+	// observeOnly stops the manager from allocating addresses or modifying services
+	observeOnly bool
+
+	// keyPrefix is prepended to the cidr and range keys of the config map
+	keyPrefix string
+
+	// verifyAllocation re-reads the service after an allocation, retrying if it didn't stick
+	verifyAllocation bool
+
+	// api is true when the allocation API is enabled, its allocations are also in use
+	api bool
+
+	// foreignIngressPolicy is how a service with an ingress address from another controller is handled
+	foreignIngressPolicy string
+
+	// avoidExternalIPs and avoidClusterIPs stop the external and cluster IPs of services being allocated
+	avoidExternalIPs bool
+	avoidClusterIPs  bool
+
+	// reserveStatic stops the addresses requested by services through spec.loadBalancerIP being allocated
+	reserveStatic bool
+
+	// warmPools caches the free addresses of the pools, nil if the pools are scanned for every allocation
+	warmPools *warmPools
+
+	// paused stops allocation and release, it can also be set in the config map
+	paused bool
+
+	// snapshot is the previous address of each service, nil unless snapshots are enabled
+	snapshot *snapshot
+	// snapshotMissing records since when each snapshot entry has had no allocated service, the entry is kept for
+	// the retention so services recreated after a restore can still be given their address
+	snapshotMissing   *snapshotMissing
+	snapshotRetention time.Duration
+
+	// clock is the time used for reservation TTLs
+	clock clock.Clock
+
+	// freed are the recently released addresses, they are allocated first when reuse-freed-first is set
+	freed *freedAddresses
+
+	// quotaNamespaces are the namespaces with quota metrics
+	quotaNamespaces *quotaNamespaces
+
+	// tracer records spans of the reconcile path, its spans aren't recorded if tracing is disabled
+	tracer trace.Tracer
+
+	// queue holds the services requeued by the provider, it is processed by Concurrency workers
+	queue *reconcileQueue
+
+	// audit records allocations as IPAllocation objects, nil if auditing is disabled
+	audit *allocationAudit
+	// auditChannels logs allocations and releases to the audit channel of their pool
+	auditChannels *auditChannels
+
+	// waitForAdvertisement holds back the ingress until kube-vip advertises the address, for at most the timeout
+	waitForAdvertisement bool
+	advertisementTimeout time.Duration
+	advertising          *advertisementWaits
+	// reserveIngress sets the ingress before it is advertised, with the advertisement status annotation
+	reserveIngress bool
+
+	// serviceCidr is the service network that the cidr-from-service-offset pool is derived from
+	serviceCidr string
+
+	// instanceID is stamped on the services this instance allocates, with enforceOwnership services stamped by
+	// another instance are left untouched
+	instanceID       string
+	enforceOwnership bool
+
+	// terminatingGracePeriod is how long a service can be terminating before its address is reclaimed, zero never
+	// reclaims it
+	terminatingGracePeriod time.Duration
+
+	// reconciled records when each service was last reconciled, the resync skips those reconciled within the interval
+	resyncInterval time.Duration
+	reconciled     *reconcileTimes
+
+	// synced records the address related fields of each service when it was last synced, an update that changes none
+	// of them is skipped
+	synced *syncedFields
+
+	// eventDeduplication only emits an IPAM event when its reason changes, or once the repeat interval has passed
+	eventDeduplication  bool
+	eventRepeatInterval time.Duration
+	events              *eventDedup
 }
 
-func newLoadBalancer(kubeClient *kubernetes.Clientset, ns, cm, serviceCidr string) cloudprovider.LoadBalancer {
+func newLoadBalancer(kubeClient kubernetes.Interface, recorder record.EventRecorder, ns, cm, serviceCidr string) cloudprovider.LoadBalancer {
 	k := &kubevipLoadBalancerManager{
 		kubeClient:     kubeClient,
+		recorder:       recorder,
 		nameSpace:      ns,
 		cloudConfigMap: cm,
+		serviceCidr:    serviceCidr,
+		allocationLock: &allocationLock{},
+		noPoolRetries:  newRetryLimiter(NoPoolRetryInterval),
+		hooks:          newHooks(),
+		auditChannels:  newAuditChannels(),
+		reservations:   newExternalReservations(ReservationsURL),
+
+		reconcileTimeout: ReconcileTimeout,
+		historyLength:    AllocationHistoryLength,
+
+		watchedNamespaces: make(map[string]bool),
+		requireManaged:    RequireManagedAnnotation,
+		compatAnnotation:  CompatAnnotation,
+
+		staticConflictPolicy: StaticConflictPolicy,
+		driftPolicy:          DriftPolicy,
+		nodeSubnetPolicy:     NodeSubnetPolicy,
+		nodeSubnetPrefix:     NodeSubnetPrefix,
+		nodeAddressPolicy:    NodeAddressPolicy,
+
+		allocations: newAllocationStore(),
+		observeOnly: ObserveOnly,
+
+		keyPrefix:        KeyPrefix,
+		verifyAllocation: VerifyAllocation,
+		api:              APIAddress != "",
+		paused:           Paused,
+		avoidExternalIPs: AvoidExternalIPs,
+		avoidClusterIPs:  AvoidClusterIPs,
+		reserveStatic:    ReserveStaticAddresses,
+
+		foreignIngressPolicy: ForeignIngressPolicy,
+		clock:                clock.RealClock{},
+		freed:                &freedAddresses{},
+		quotaNamespaces:      &quotaNamespaces{},
+		tracer:               newTracer(newTracerProviderFromEnv()),
+		queue:                newReconcileQueue(Concurrency),
+
+		waitForAdvertisement: WaitForAdvertisement,
+		advertisementTimeout: AdvertisementTimeout,
+		advertising:          newAdvertisementWaits(),
+		reserveIngress:       ReserveIngress,
+
+		terminatingGracePeriod: TerminatingGracePeriod,
+
+		snapshotMissing:   newSnapshotMissing(),
+		snapshotRetention: SnapshotRetention,
+
+		eventDeduplication:  EventDeduplication,
+		eventRepeatInterval: EventRepeatInterval,
+		events:              newEventDedup(),
+
+		instanceID:       instanceID(InstanceID),
+		enforceOwnership: EnforceOwnership,
+
+		resyncInterval: ResyncInterval,
+		reconciled:     newReconcileTimes(),
+		synced:         newSyncedFields(),
+	}
+	for _, ns := range WatchedNamespaces {
+		k.watchedNamespaces[ns] = true
+	}
+	if WarmPools {
+		k.warmPools = &warmPools{}
+	}
+	if HookSecret != "" {
+		headers, err := secretHeaders(kubeClient, HookSecret)
+		if err != nil {
+			klog.Warningf("hooks are sent without credentials: %v", err)
+		}
+		k.hooks.headers = headers
+	}
+	switch k.foreignIngressPolicy {
+	case ForeignIngressAllocate, ForeignIngressAdopt, ForeignIngressSkip:
+	default:
+		klog.Warningf("unknown foreign ingress policy [%s], using [%s]", k.foreignIngressPolicy, ForeignIngressAllocate)
+		k.foreignIngressPolicy = ForeignIngressAllocate
+	}
+	switch k.staticConflictPolicy {
+	case StaticConflictProtectDynamic, StaticConflictYieldDynamic:
+	default:
+		klog.Warningf("unknown static conflict policy [%s], using [%s]", k.staticConflictPolicy, StaticConflictProtectDynamic)
+		k.staticConflictPolicy = StaticConflictProtectDynamic
+	}
+	switch k.driftPolicy {
+	case DriftRestore, DriftAdopt:
+	default:
+		klog.Warningf("unknown drift policy [%s], using [%s]", k.driftPolicy, DriftRestore)
+		k.driftPolicy = DriftRestore
+	}
+	switch k.nodeSubnetPolicy {
+	case NodeSubnetIgnore, NodeSubnetWarn, NodeSubnetStrict:
+	default:
+		klog.Warningf("unknown node subnet policy [%s], using [%s]", k.nodeSubnetPolicy, NodeSubnetIgnore)
+		k.nodeSubnetPolicy = NodeSubnetIgnore
+	}
+	switch k.nodeAddressPolicy {
+	case NodeAddressIgnore, NodeAddressWarn, NodeAddressAvoid:
+	default:
+		klog.Warningf("unknown node address policy [%s], using [%s]", k.nodeAddressPolicy, NodeAddressIgnore)
+		k.nodeAddressPolicy = NodeAddressIgnore
+	}
+	if k.nodeSubnetPrefix < 0 || k.nodeSubnetPrefix > 32 {
+		klog.Warningf("invalid node subnet prefix [%d], using [24]", k.nodeSubnetPrefix)
+		k.nodeSubnetPrefix = 24
 	}
 	return k
 }
 
+// ignored returns true if the service has opted out of being managed with the ignore annotation
+func ignored(service *v1.Service) bool {
+	return service.Annotations[IgnoreAnnotation] == "true"
+}
+
+// watched returns true if services in the namespace should be reconciled
+func (k *kubevipLoadBalancerManager) watched(namespace string) bool {
+	return len(k.watchedNamespaces) == 0 || k.watchedNamespaces[namespace]
+}
+
+// managed returns true if the service should be reconciled, it must be in a watched namespace and have opted
+// in if the managed annotation is required
+func (k *kubevipLoadBalancerManager) managed(service *v1.Service) bool {
+	if !k.watched(service.Namespace) {
+		klog.V(4).Infof("namespace [%s] isn't watched, ignoring service [%s]", service.Namespace, service.Name)
+		return false
+	}
+	if k.requireManaged && service.Annotations[ManagedAnnotation] != "true" {
+		klog.V(4).Infof("service [%s] doesn't have [%s], ignoring", service.Name, ManagedAnnotation)
+		return false
+	}
+	return true
+}
+
 func (k *kubevipLoadBalancerManager) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (lbs *v1.LoadBalancerStatus, err error) {
+	if !k.managed(service) {
+		return &service.Status.LoadBalancer, nil
+	}
+	ctx, span := k.tracer.Start(ctx, "EnsureLoadBalancer", trace.WithAttributes(attribute.String("service", service.Namespace+"/"+service.Name)))
+	defer span.End()
 	return k.syncLoadBalancer(ctx, service)
 }
 func (k *kubevipLoadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (err error) {
+	if !k.managed(service) {
+		return nil
+	}
+	ctx, span := k.tracer.Start(ctx, "UpdateLoadBalancer", trace.WithAttributes(attribute.String("service", service.Namespace+"/"+service.Name)))
+	defer span.End()
+	// The service is also updated when only its nodes or unrelated fields change, which can't affect its address
+	if !k.synced.changed(service, k.compatAnnotation) {
+		klog.V(2).Infof("no address related field of service [%s] changed since it was synced, skipping", service.Name)
+		return nil
+	}
 	_, err = k.syncLoadBalancer(ctx, service)
 	return err
 }
 
 func (k *kubevipLoadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	// A service that was allocated before opting out still has its address released
+	allocated := k.watched(service.Namespace) && service.Labels["implementation"] == "kube-vip"
+	if !allocated && !k.managed(service) {
+		return nil
+	}
 	return k.deleteLoadBalancer(ctx, service)
 }
 
@@ -62,8 +353,52 @@ func getDefaultLoadBalancerName(service *v1.Service) string {
 }
 
 func (k *kubevipLoadBalancerManager) deleteLoadBalancer(ctx context.Context, service *v1.Service) error {
+	// An ignored service is hand-managed, its address isn't released
+	if ignored(service) {
+		klog.V(2).Infof("service [%s] has [%s], not releasing its address", service.Name, IgnoreAnnotation)
+		return nil
+	}
+	if k.foreignOwned(service) {
+		klog.V(2).Infof("service [%s] is owned by [%s], not releasing its address", service.Name, service.Annotations[OwnedByAnnotation])
+		return nil
+	}
 	klog.Infof("deleting service '%s' (%s)", service.Name, service.UID)
+	address := service.Labels["ipam-address"]
+	if address == "" {
+		address = service.Spec.LoadBalancerIP
+	}
+
+	// The address is released once unpaused
+	if address != "" && !k.observeOnly && k.releasePaused(ctx) {
+		k.ipamEvent(service, v1.EventTypeWarning, ReasonAllocationPaused, fmt.Sprintf("allocation is paused, address [%s] is released once unpaused", address))
+		return fmt.Errorf("%w, address [%s] of service [%s] is released once unpaused", ErrPaused, address, service.Name)
+	}
 
+	k.noPoolRetries.forget(service.UID)
+	k.advertising.forget(service.UID)
+	k.events.forget(service.UID)
+	k.reconciled.forget(service.UID)
+	k.synced.forget(service.UID)
+	k.allocations.remove(service.UID)
+
+	// Nothing was allocated, so there is nothing to release
+	if k.observeOnly {
+		return nil
+	}
+
+	// The address is kept while another service with the global service id has it
+	if address != "" && k.releaseGlobal(ctx, service, address) {
+		return nil
+	}
+	if address != "" {
+		k.recordRelease(ctx, service, address)
+		k.releaseWarm(address)
+		k.freed.add(address, k.clock.Now())
+		k.audit.released(ctx, service)
+		k.auditReleased(ctx, service, address)
+		k.quotaReleased(ctx, service.Namespace)
+		return k.hooks.released(ctx, service, address)
+	}
 	return nil
 }
 
@@ -74,23 +409,172 @@ func (k *kubevipLoadBalancerManager) deleteLoadBalancer(ctx context.Context, ser
 // 2b. Get the network configuration for this service (namespace) / (CIDR/Range)
 // 2c. Between the two find a free address
 
-func (k *kubevipLoadBalancerManager) syncLoadBalancer(ctx context.Context, service *v1.Service) (*v1.LoadBalancerStatus, error) {
+func (k *kubevipLoadBalancerManager) syncLoadBalancer(ctx context.Context, service *v1.Service) (status *v1.LoadBalancerStatus, err error) {
+	// An ignored service is hand-managed, it is left exactly as it is
+	if ignored(service) {
+		klog.V(2).Infof("service [%s] has [%s], skipping", service.Name, IgnoreAnnotation)
+		return &service.Status.LoadBalancer, nil
+	}
+	// Another instance of the provider owns the service, it is left to that instance
+	if k.foreignOwned(service) {
+		klog.V(2).Infof("service [%s] is owned by [%s], skipping", service.Name, service.Annotations[OwnedByAnnotation])
+		return &service.Status.LoadBalancer, nil
+	}
+	// The cloud provider only calls this for LoadBalancer services, anything else (i.e. ExternalName) has no
+	// address to allocate and is left as it is
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		klog.Infof("service [%s] is of type [%s] not [%s], skipping", service.Name, service.Spec.Type, v1.ServiceTypeLoadBalancer)
+		return &service.Status.LoadBalancer, nil
+	}
+	ctx, span := k.tracer.Start(ctx, "syncLoadBalancer")
+	defer span.End()
+	// A service that was reconciled is skipped by the resync until the interval has passed. Its fields are only
+	// recorded once it holds an address, a service left pending (i.e. in a disabled namespace, or with the ingress of
+	// another controller) is synced on its next update as the config map may have changed since
+	defer func() {
+		if err == nil {
+			k.reconciled.done(service.UID, k.clock.Now())
+			if observedAddress(service) != "" {
+				k.synced.record(service, k.compatAnnotation)
+			}
+		}
+	}()
+	if k.reconcileTimeout == 0 {
+		return k.advertisedStatus(ctx, service, k.reconcileLoadBalancer)
+	}
+
+	// All API calls made during the sync share the deadline
+	ctx, cancel := context.WithTimeout(ctx, k.reconcileTimeout)
+	defer cancel()
+
+	status, err = k.advertisedStatus(ctx, service, k.reconcileLoadBalancer)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// Returning an error requeues the service, so it will be retried
+		return nil, fmt.Errorf("%w after [%s] syncing service [%s]: %v", ErrReconcileTimeout, k.reconcileTimeout, service.Name, err)
+	}
+	return status, err
+}
+
+// advertisedStatus reconciles the service, holding back its ingress until the address is advertised if enabled
+func (k *kubevipLoadBalancerManager) advertisedStatus(ctx context.Context, service *v1.Service, reconcile func(context.Context, *v1.Service) (*v1.LoadBalancerStatus, error)) (*v1.LoadBalancerStatus, error) {
+	status, err := reconcile(ctx, service)
+	if err != nil || (!k.waitForAdvertisement && !k.reserveIngress) || k.observeOnly {
+		return status, err
+	}
+	return k.awaitAdvertisement(ctx, service, status)
+}
+
+// reconcileLoadBalancer reconciles the load balancer state, all API calls must use ctx
+func (k *kubevipLoadBalancerManager) reconcileLoadBalancer(ctx context.Context, service *v1.Service) (*v1.LoadBalancerStatus, error) {
 	// This function reconciles the load balancer state
-	klog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
+	klog.V(2).Infof("syncing service '%s' (%s)", service.Name, service.UID)
 
-	// The loadBalancer address has already been populated
-	if service.Spec.LoadBalancerIP != "" {
+	// Only record the address that the service already has
+	if k.observeOnly {
+		if address := observedAddress(service); address != "" {
+			k.allocations.set(service, address, allocationSource(service))
+		}
 		return &service.Status.LoadBalancer, nil
 	}
 
-	// Get all services in this namespace, that have the correct label
-	svcs, err := k.kubeClient.CoreV1().Services(service.Namespace).List(ctx, metav1.ListOptions{LabelSelector: "implementation=kube-vip"})
-	if err != nil {
-		return &service.Status.LoadBalancer, err
+	// Nothing is allocated or changed while paused, services with an address are left untouched and the rest are
+	// requeued until unpaused
+	if cm, paused := k.pausedConfigMap(ctx); paused {
+		if address := observedAddress(service); address != "" {
+			k.allocations.set(service, address, allocationSource(service))
+			return ingressStatus(cm, service, address), nil
+		}
+		message := fmt.Sprintf("allocation is paused, service [%s] is allocated once unpaused", service.Name)
+		if err := k.recordIPAMStatus(ctx, service, IPAMStatusPaused, ReasonAllocationPaused, message); err != nil {
+			klog.Errorf("%v", err)
+		}
+		return nil, fmt.Errorf("%w, service [%s] is allocated once unpaused", ErrPaused, service.Name)
+	}
+
+	// Labels of the namespace (i.e. for chargeback) are mirrored onto the service
+	k.propagateNamespaceLabels(ctx, service)
+
+	// A blocking allocate hook failed after the address was recorded, it must be delivered before the service is
+	// considered allocated
+	if address := service.Annotations[AllocateHookPendingAnnotation]; address != "" {
+		if err := k.deliverAllocateHook(ctx, service, address); err != nil {
+			return nil, err
+		}
+	}
+
+	// A service preferring dual-stack has an address of each family pinned, or is given a single family
+	if prefersDualStack(service) {
+		var err error
+		if service, err = k.preferDualStack(ctx, service); err != nil {
+			return nil, err
+		}
+	}
+
+	// Both families are pinned by the annotation, the addresses are assigned rather than allocated
+	if dualStackRequest(service) {
+		return k.reconcileDualStack(ctx, service)
+	}
+
+	// The address in the spec was changed away from the allocated address
+	if drifted(service) {
+		if err := k.resolveDrift(ctx, service); err != nil {
+			return nil, err
+		}
+	}
+
+	// The loadBalancer address has already been populated, a service with a pool generation may need migrating
+	if service.Spec.LoadBalancerIP != "" && service.Annotations[PoolGenerationAnnotation] == "" && !partiallyManaged(service) {
+		// An address that wasn't allocated by kube-vip was requested by the user
+		if service.Labels["ipam-address"] != service.Spec.LoadBalancerIP {
+			if err := k.checkRequestedAddress(ctx, service); err != nil {
+				return nil, k.allocationFailed(ctx, service, err)
+			}
+			if err := k.checkNodeSubnet(ctx, service); err != nil {
+				return nil, k.allocationFailed(ctx, service, err)
+			}
+			if err := k.duplicateStatic(ctx, service); err != nil {
+				return nil, err
+			}
+			if err := k.resolveConflict(ctx, service); err != nil {
+				return nil, err
+			}
+			expired, err := k.reservationExpired(ctx, service)
+			if err != nil {
+				return nil, err
+			}
+			// Returning an error requeues the service, without its address it is allocated from its pool
+			if expired {
+				return nil, fmt.Errorf("%w, service [%s] is requeued for allocation", ErrReservationExpired, service.Name)
+			}
+		}
+		k.allocations.set(service, service.Spec.LoadBalancerIP, allocationSource(service))
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// Another controller may have already given the service an address
+	if address := foreignIngressAddress(service); address != "" {
+		switch k.foreignIngressPolicy {
+		case ForeignIngressSkip:
+			klog.V(2).Infof("service [%s] has ingress [%s] from another controller, skipping", service.Name, address)
+			return &service.Status.LoadBalancer, nil
+		case ForeignIngressAdopt:
+			return k.adoptIngress(ctx, service, address)
+		}
+	}
+
+	// A service without a pool is only re-evaluated once the retry interval has passed
+	if k.noPoolRetries.limited(service.UID) {
+		return nil, fmt.Errorf("%w for service [%s], retrying in [%s]", ErrNoPoolConfigured, service.Name, NoPoolRetryInterval)
 	}
 
 	// Get the clound controller configuration map
+	_, cmSpan := k.tracer.Start(ctx, "GetConfigMap")
 	controllerCM, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	cmSpan.End()
+	// The config map exists, but can't be read until its variables are set
+	if errors.Is(err, ErrUndefinedVariable) {
+		return nil, err
+	}
 	if err != nil {
 		klog.Errorf("Unable to retrieve kube-vip ipam config from configMap [%s] in kube-system", KubeVipClientConfig)
 		// TODO - determine best course of action, create one if it doesn't exist
@@ -100,24 +584,152 @@ func (k *kubevipLoadBalancerManager) syncLoadBalancer(ctx context.Context, servi
 		}
 	}
 
-	var existingServiceIPS []string
-	for x := range svcs.Items {
-		existingServiceIPS = append(existingServiceIPS, svcs.Items[x].Labels["ipam-address"])
+	// A service labelled by an earlier version keeps its address, with the rest of the managed state restored
+	if partiallyManaged(service) {
+		status, healed, err := k.heal(ctx, controllerCM, service)
+		if err != nil || healed {
+			return status, err
+		}
+	}
+
+	if service.Spec.LoadBalancerIP != "" {
+		if !migrating(controllerCM, service) {
+			k.allocations.set(service, service.Spec.LoadBalancerIP, allocationSource(service))
+			return ingressStatus(controllerCM, service, service.Spec.LoadBalancerIP), nil
+		}
+		klog.Infof("migrating service [%s] from pool generation [%s] into [%s]", service.Name, service.Annotations[PoolGenerationAnnotation], controllerCM.Data[PoolGenerationKey])
+	}
+
+	// Services in a disabled namespace never receive an address
+	if namespaceDisabled(controllerCM, service.Namespace) {
+		klog.V(2).Infof("allocation is disabled in namespace [%s], skipping service [%s]", service.Namespace, service.Name)
+		message := fmt.Sprintf("allocation is disabled for namespace [%s] by [%s]", service.Namespace, DisabledNamespacesKey)
+		if err := k.recordIPAMStatus(ctx, service, IPAMStatusNamespaceDisabled, ReasonAllocationDisabled, message); err != nil {
+			return nil, err
+		}
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// Rebuild the warm pools if they have changed, a pool that can't be warmed is scanned instead
+	if err := k.warm(ctx, controllerCM); err != nil {
+		klog.Warningf("%v", err)
+	}
+
+	environment, err := k.namespaceEnvironment(ctx, controllerCM, service.Namespace)
+	if err != nil {
+		return nil, err
 	}
 
-  // If the LoadBalancer address is empty, then do a local IPAM lookup
-	loadBalancerIP, err := discoverAddress(controllerCM, service.Namespace, k.cloudConfigMap, existingServiceIPS)
+	// Reading the existing addresses and updating the service must not interleave with another allocation from the
+	// same pools, in any namespace, otherwise both could be given the same address
+	unlock := k.lockAllocation(controllerCM, service, environment)
+	defer unlock()
+
+	// Another sync (i.e. the resync racing the service controller) may have allocated the service while this one
+	// waited for the lock, the service is read again so it isn't given a second address. Only an address it didn't
+	// have before counts, a yielding service still carries the address it yields
+	current, err := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &service.Status.LoadBalancer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if address := current.Labels["ipam-address"]; address != "" && address != service.Labels["ipam-address"] && address == current.Spec.LoadBalancerIP &&
+		!migrating(controllerCM, current) {
+		klog.V(2).Infof("service [%s] was allocated [%s] by another sync, skipping", service.Name, address)
+		k.allocations.set(current, address, allocationSource(current))
+		return ingressStatus(controllerCM, current, address), nil
+	}
 
+	_, listSpan := k.tracer.Start(ctx, "existingAddresses")
+	existingServiceIPS, err := k.existingAddresses(ctx)
+	listSpan.SetAttributes(attribute.Int("addresses", len(existingServiceIPS)))
+	listSpan.End()
 	if err != nil {
+		return &service.Status.LoadBalancer, err
+	}
+
+	// The address of a node is skipped as if it was in use, or only warned about once allocated
+	var nodeAddresses map[string]string
+	if k.nodeAddressPolicy != NodeAddressIgnore {
+		if nodeAddresses, err = k.allNodeAddresses(ctx); err != nil {
+			klog.Warningf("unable to list the node addresses, not comparing them with the address of service [%s]: %v", service.Name, err)
+		}
+		if k.nodeAddressPolicy == NodeAddressAvoid {
+			for address := range nodeAddresses {
+				existingServiceIPS = append(existingServiceIPS, address)
+			}
+		}
+	}
+
+	// Don't start an allocation that can't be written back to the service
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	// If the LoadBalancer address is empty, then do a local IPAM lookup
+	_, discoverSpan := k.tracer.Start(ctx, "discoverAddress")
+	discovered, err := discoverAddress(controllerCM, service, environment, k.cloudConfigMap, k.keyPrefix, existingServiceIPS)
+	if discovered != nil {
+		discoverSpan.SetAttributes(attribute.String("pool", discovered.pool), attribute.String("address", discovered.address))
+	}
+	discoverSpan.End()
+	// Without a configured pool the address can come from a pool next to the service network, or the network of the nodes
+	if errors.Is(err, ErrNoPoolConfigured) && serviceOffsetEnabled(controllerCM) {
+		discovered, err = k.discoverServiceOffsetAddress(ctx, controllerCM, service.Namespace)
+	}
+	if errors.Is(err, ErrNoPoolConfigured) && nodeCidrEnabled(controllerCM) {
+		discovered, err = k.discoverNodeAddress(ctx, service.Namespace)
+	}
+
+	// The scan is resumed when the service is requeued, rather than holding the worker
+	if errors.Is(err, ipam.ErrScanTimeout) {
+		return nil, fmt.Errorf("%w for service [%s] after [%s], it is requeued", err, service.Name, ScanTimeout)
+	}
+	if err != nil {
+		return nil, k.allocationFailed(ctx, service, err)
+	}
+	for _, warning := range discovered.warnings {
+		k.recorder.Event(service, v1.EventTypeWarning, ReasonAllocationWarning, warning)
+	}
+	// A recently released address is reused before a fresh one, if it is still free
+	discovered = k.preferFreed(ctx, controllerCM, service, discovered, existingServiceIPS)
+	// A service following a sibling is given the next address if it is still free
+	discovered = k.preferAdjacent(ctx, controllerCM, service, discovered, existingServiceIPS)
+	// A service restored from a backup is given its previous address if it is still free
+	discovered = k.preferSnapshot(ctx, controllerCM, service, discovered, existingServiceIPS)
+	// A recreated service is given the address recorded for its name if it is still free
+	discovered = k.preferSticky(ctx, controllerCM, service, discovered, existingServiceIPS)
+	// Services sharing a global service id converge on the address of the first of them
+	shared, err := k.preferGlobal(ctx, controllerCM, service, discovered)
+	if err != nil {
+		k.releaseWarm(discovered.address)
+		return nil, k.allocationFailed(ctx, service, err)
+	}
+	discovered = shared
+	loadBalancerIP := discovered.address
+	source := SourceDynamic
+	if discovered.source != "" {
+		source = discovered.source
+	}
+
 	// Update the services with this new address
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+	var reason string
+	updateService := func() error {
+		// Stop retrying once the deadline has passed
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 		if getErr != nil {
 			return getErr
 		}
+		// Another sync allocated a different address since the service was read, it keeps that address
+		if address := recentService.Labels["ipam-address"]; address != "" && address != current.Labels["ipam-address"] && address != loadBalancerIP {
+			return fmt.Errorf("%w, service [%s] has address [%s]", ErrAlreadyAllocated, service.Name, address)
+		}
+		before := recentService.DeepCopy()
 
 		klog.Infof("Updating service [%s], with load balancer IPAM address [%s]", service.Name, loadBalancerIP)
 
@@ -125,70 +737,608 @@ func (k *kubevipLoadBalancerManager) syncLoadBalancer(ctx context.Context, servi
 			// Just because ..
 			recentService.Labels = make(map[string]string)
 		}
+		// Moving from a previous address is a reallocation
+		reason = allocationReason(recentService.Labels["ipam-address"], loadBalancerIP)
+
 		// Set Label for service lookups
 		recentService.Labels["implementation"] = "kube-vip"
 		recentService.Labels["ipam-address"] = loadBalancerIP
 
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		// Clear any previous allocation failure
+		clearIPAMStatus(recentService.Annotations)
+
+		// Record the network the address belongs to
+		if discovered.prefix != "" {
+			recentService.Annotations[AllocatedCidrAnnotation] = discovered.prefix
+		} else {
+			delete(recentService.Annotations, AllocatedCidrAnnotation)
+		}
+		k.annotateAddress(recentService.Annotations, loadBalancerIP)
+		k.stampOwner(recentService.Annotations)
+		recentService.Annotations[AllocationSourceAnnotation] = source
+		stampGeneration(recentService.Annotations, controllerCM)
+		classifyAllocation(recentService.Annotations, controllerCM, recentService)
+		// The allocation isn't complete until a blocking hook has been delivered, a failure is retried on requeue
+		if k.hooks.pendingDelivery() {
+			recentService.Annotations[AllocateHookPendingAnnotation] = loadBalancerIP
+		}
+
 		// Set IPAM address to Load Balancer Service
 		recentService.Spec.LoadBalancerIP = loadBalancerIP
 
+		// The service already has the address, i.e. it was applied by an earlier reconcile
+		if serviceUnchanged(before, recentService) {
+			klog.V(2).Infof("service [%s] already has address [%s], skipping the update", service.Name, loadBalancerIP)
+			return nil
+		}
+		appendHistory(recentService.Annotations, k.historyLength, reason, loadBalancerIP, time.Now())
+
 		// Update the actual service with teh address and the labels
 		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
 		return updateErr
-	})
-	if retryErr != nil {
-		return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
 	}
+	for attempt := 1; ; attempt++ {
+		_, updateSpan := k.tracer.Start(ctx, "updateService")
+		retryErr := retry.RetryOnConflict(retry.DefaultRetry, updateService)
+		updateSpan.End()
+		// The service was deleted during the sync, there is nothing left to allocate to
+		if apierrors.IsNotFound(retryErr) {
+			klog.Infof("service [%s/%s] was deleted before an address could be allocated", service.Namespace, service.Name)
+			k.releaseWarm(loadBalancerIP)
+			return &service.Status.LoadBalancer, nil
+		}
+		if errors.Is(retryErr, ErrAlreadyAllocated) {
+			k.releaseWarm(loadBalancerIP)
+			return nil, retryErr
+		}
+		if retryErr != nil {
+			k.releaseWarm(loadBalancerIP)
+			return nil, fmt.Errorf("error updating Service Spec [%s] : %w", service.Name, retryErr)
+		}
+		if !k.verifyAllocation {
+			break
+		}
 
+		// An update can succeed and still not stick, i.e. a mutating webhook removing the label
+		verifyErr := k.verifyAllocated(ctx, service, loadBalancerIP)
+		if verifyErr == nil {
+			break
+		}
+		if apierrors.IsNotFound(verifyErr) {
+			klog.Infof("service [%s/%s] was deleted before an address could be allocated", service.Namespace, service.Name)
+			k.releaseWarm(loadBalancerIP)
+			return &service.Status.LoadBalancer, nil
+		}
+		klog.Warningf("allocation to service [%s] not applied, attempt [%d/%d]: %v", service.Name, attempt, VerifyAllocationAttempts, verifyErr)
+		if attempt >= VerifyAllocationAttempts {
+			k.releaseWarm(loadBalancerIP)
+			return nil, fmt.Errorf("allocation of [%s] to service [%s] not applied after [%d] attempts: %w", loadBalancerIP, service.Name, attempt, verifyErr)
+		}
+	}
+	k.recorder.Eventf(service, v1.EventTypeNormal, reason, "allocated address [%s] from [%s]", loadBalancerIP, discovered.pool)
+	// Traffic to the address would be routed to the node rather than the service
+	if node, ok := nodeAddresses[loadBalancerIP]; ok && k.nodeAddressPolicy == NodeAddressWarn {
+		message := fmt.Sprintf("allocated address [%s] from [%s] is the address of node [%s], the pool overlaps the node network", loadBalancerIP, discovered.pool, node)
+		klog.Warningf("%s", message)
+		k.recorder.Event(service, v1.EventTypeWarning, ReasonNodeAddress, message)
+	}
+	// A later failure is a transition, so its event is emitted
+	k.events.forget(service.UID)
+	// A migrated service no longer uses its previous address
+	if service.Spec.LoadBalancerIP != "" && service.Spec.LoadBalancerIP != loadBalancerIP {
+		k.releaseWarm(service.Spec.LoadBalancerIP)
+	}
+	k.allocations.set(service, loadBalancerIP, source)
+	requestedAddressesHistogram.Observe(1)
+	k.audit.allocated(ctx, service, loadBalancerIP, discovered.pool)
+	k.auditAllocated(controllerCM, service, loadBalancerIP, discovered.pool, source)
+	k.quotaAllocated(ctx, controllerCM, service, service.Labels["ipam-address"] == "")
+	k.recordSticky(ctx, controllerCM, service, loadBalancerIP)
+	// The address is recorded, a slow hook mustn't hold up allocations in other namespaces
+	unlock()
+
+	if err = k.deliverAllocateHook(ctx, service, loadBalancerIP); err != nil {
+		return nil, err
+	}
+
+	return singleFamilyStatus(ingressStatus(controllerCM, service, loadBalancerIP), service, loadBalancerIP), nil
+}
+
+// checkRequestedAddress returns an error if the address requested by the service is the network or broadcast
+// address of a cidr pool, unless they are allowed by the config map
+func (k *kubevipLoadBalancerManager) checkRequestedAddress(ctx context.Context, service *v1.Service) error {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		klog.V(2).Infof("unable to check address [%s] of service [%s]: %v", service.Spec.LoadBalancerIP, service.Name, err)
+		return nil
+	}
+	if cm.Data[AllowNetworkAddressKey] == "true" {
+		return nil
+	}
+	for key, cidr := range cm.Data {
+		if poolKind(key, k.keyPrefix) == "cidr" && ipam.IsNetworkOrBroadcast(cidr, service.Spec.LoadBalancerIP) {
+			return fmt.Errorf("%w, [%s] requested by service [%s] is the network or broadcast address of [%s]", ErrInvalidAddress, service.Spec.LoadBalancerIP, service.Name, key)
+		}
+	}
+	return nil
+}
+
+// serviceUnchanged returns true if the labels, annotations and spec of the service are the same as before, so
+// updating it would only add load on the API server
+func serviceUnchanged(before, after *v1.Service) bool {
+	return equality.Semantic.DeepEqual(before.Labels, after.Labels) &&
+		equality.Semantic.DeepEqual(before.Annotations, after.Annotations) &&
+		equality.Semantic.DeepEqual(before.Spec, after.Spec)
+}
+
+// foreignIngressAddress returns the ingress address of a service that wasn't allocated by this provider
+func foreignIngressAddress(service *v1.Service) string {
+	if service.Spec.LoadBalancerIP != "" || service.Labels["ipam-address"] != "" {
+		return ""
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+	}
+	return ""
+}
+
+// adoptIngress records the ingress address from another controller as the allocated address of the service
+func (k *kubevipLoadBalancerManager) adoptIngress(ctx context.Context, service *v1.Service, address string) (*v1.LoadBalancerStatus, error) {
+	unlock := k.allocationLock.lock()
+	defer unlock()
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		before := recentService.DeepCopy()
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		recentService.Labels["implementation"] = "kube-vip"
+		recentService.Labels["ipam-address"] = address
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		k.annotateAddress(recentService.Annotations, address)
+		k.stampOwner(recentService.Annotations)
+		recentService.Annotations[AllocationSourceAnnotation] = SourceStatic
+		recentService.Spec.LoadBalancerIP = address
+		if serviceUnchanged(before, recentService) {
+			return nil
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if apierrors.IsNotFound(err) {
+		return &service.Status.LoadBalancer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error adopting ingress [%s] of service [%s] : %w", address, service.Name, err)
+	}
+	klog.Infof("adopted ingress [%s] of service [%s]", address, service.Name)
+	k.recorder.Eventf(service, v1.EventTypeNormal, ReasonAddressAdopted, "adopted address [%s] from the service ingress", address)
+	k.allocations.set(service, address, SourceStatic)
 	return &service.Status.LoadBalancer, nil
 }
 
-func discoverAddress(cm *v1.ConfigMap, namespace, configMapName string, existingServiceIPS []string) (vip string, err error) {
-	var cidr, ipRange string
-	var ok bool
+// existingAddresses returns the addresses in use by kube-vip services, by the allocation API and reserved by an
+// external IPAM. Every namespace is included, as the global and environment pools are shared by namespaces, so the
+// first service in a namespace isn't given an address that a service in another namespace already has
+func (k *kubevipLoadBalancerManager) existingAddresses(ctx context.Context) ([]string, error) {
+	// Get all services that have the correct label
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: "implementation=kube-vip"})
+	if err != nil {
+		return nil, err
+	}
 
-	// Find Cidr
-	cidrKey := fmt.Sprintf("cidr-%s", namespace)
-	// Lookup current namespace
-	if cidr, ok = cm.Data[cidrKey]; !ok {
-		klog.Info(fmt.Errorf("no cidr config for namespace [%s] exists in key [%s] configmap [%s]", namespace, cidrKey, configMapName))
-		// Lookup global cidr configmap data
-		if cidr, ok = cm.Data["cidr-global"]; !ok {
-			klog.Info(fmt.Errorf("no global cidr config exists [cidr-global]"))
-		} else {
-			klog.Infof("Taking address from [cidr-global] pool")
+	var existingServiceIPS []string
+	for x := range svcs.Items {
+		existingServiceIPS = append(existingServiceIPS, ipam.NormalizeAddress(svcs.Items[x].Labels["ipam-address"]))
+		// The label only holds the first address of a dual-stack service, the pair is in its annotation
+		if dualStackRequest(&svcs.Items[x]) {
+			if ipv4, ipv6, err := parseDualStack(svcs.Items[x].Annotations[LoadBalancerIPsAnnotation]); err == nil {
+				existingServiceIPS = append(existingServiceIPS, ipv4, ipv6)
+			}
 		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", cidrKey)
 	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromCidr(namespace, cidr, existingServiceIPS)
+
+	if k.api {
+		apiAddresses, err := k.apiAddresses(ctx, v1.NamespaceAll)
+		if err != nil {
+			return nil, err
+		}
+		existingServiceIPS = append(existingServiceIPS, apiAddresses...)
+	}
+
+	if k.avoidExternalIPs || k.avoidClusterIPs || k.reserveStatic {
+		serviceAddresses, err := k.serviceAddresses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		existingServiceIPS = append(existingServiceIPS, serviceAddresses...)
+	}
+
+	if k.reservations != nil {
+		reserved, err := k.reservations.reserved(ctx)
+		if err != nil {
+			return nil, err
+		}
+		existingServiceIPS = append(existingServiceIPS, reserved...)
+	}
+	return existingServiceIPS, nil
+}
+
+// serviceAddresses returns the external IPs, cluster IPs and/or requested load balancer IPs (as configured) of the
+// services in the managed namespaces, these aren't allocated by kube-vip but an allocated address mustn't collide
+// with them
+func (k *kubevipLoadBalancerManager) serviceAddresses(ctx context.Context) ([]string, error) {
+	namespaces := []string{v1.NamespaceAll}
+	if len(k.watchedNamespaces) != 0 {
+		namespaces = namespaces[:0]
+		for ns := range k.watchedNamespaces {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	var addresses []string
+	for _, ns := range namespaces {
+		svcs, err := k.kubeClient.CoreV1().Services(ns).List(ctx, metav1.ListOptions{})
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		for x := range svcs.Items {
+			if k.avoidExternalIPs {
+				addresses = append(addresses, ipam.NormalizeAddresses(svcs.Items[x].Spec.ExternalIPs)...)
+			}
+			if clusterIP := svcs.Items[x].Spec.ClusterIP; k.avoidClusterIPs && clusterIP != "" && clusterIP != v1.ClusterIPNone {
+				addresses = append(addresses, ipam.NormalizeAddress(clusterIP))
+			}
+			// A static request is honoured even if it hasn't been reconciled yet, so dynamic services can't take it
+			if requested := svcs.Items[x].Spec.LoadBalancerIP; k.reserveStatic && requested != "" && svcs.Items[x].Spec.Type == v1.ServiceTypeLoadBalancer {
+				addresses = append(addresses, ipam.NormalizeAddress(requested))
+			}
+			if k.reserveStatic && dualStackRequest(&svcs.Items[x]) {
+				if ipv4, ipv6, err := parseDualStack(svcs.Items[x].Annotations[LoadBalancerIPsAnnotation]); err == nil {
+					addresses = append(addresses, ipv4, ipv6)
+				}
+			}
 		}
-		return
 	}
+	return addresses, nil
+}
 
-	// Find Range
-	rangeKey := fmt.Sprintf("range-%s", namespace)
-	// Lookup current namespace
-	if ipRange, ok = cm.Data[rangeKey]; !ok {
-		klog.Info(fmt.Errorf("no range config for namespace [%s] exists in key [%s] configmap [%s]", namespace, rangeKey, configMapName))
-		// Lookup global range configmap data
-		if ipRange, ok = cm.Data["range-global"]; !ok {
-			klog.Info(fmt.Errorf("no global range config exists [range-global]"))
+// namespaceEnvironment returns the environment of the namespace, this is only looked up if the environment tier is used
+func (k *kubevipLoadBalancerManager) namespaceEnvironment(ctx context.Context, cm *v1.ConfigMap, namespace string) (string, error) {
+	// The environment tier is selected through a label on the services namespace
+	if !usesEnvironmentTier(cm) {
+		return "", nil
+	}
+	ns, err := k.kubeClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return ns.Labels[EnvironmentLabel], nil
+}
+
+// verifyAllocated re-reads the service and checks that the allocated address is in its spec and labels
+func (k *kubevipLoadBalancerManager) verifyAllocated(ctx context.Context, service *v1.Service, address string) error {
+	recentService, err := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if recentService.Spec.LoadBalancerIP != address {
+		return fmt.Errorf("spec has load balancer IP [%s]", recentService.Spec.LoadBalancerIP)
+	}
+	if recentService.Labels["ipam-address"] != address || recentService.Labels["implementation"] != "kube-vip" {
+		return fmt.Errorf("labels are [ipam-address=%s, implementation=%s]", recentService.Labels["ipam-address"], recentService.Labels["implementation"])
+	}
+	return nil
+}
+
+// namespaceDisabled returns true if the namespace is listed in the disabled-namespaces key
+func namespaceDisabled(cm *v1.ConfigMap, namespace string) bool {
+	for _, disabled := range configList(cm, DisabledNamespacesKey) {
+		if disabled == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// poolCordoned returns true if new addresses mustn't be allocated from the pool key, services already allocated
+// from it keep their address
+func poolCordoned(cm *v1.ConfigMap, key string) bool {
+	for _, cordoned := range configList(cm, CordonedPoolsKey) {
+		if cordoned == key {
+			klog.V(2).Infof("pool [%s] is cordoned, skipping", key)
+			return true
+		}
+	}
+	return false
+}
+
+// withGateways returns the existing addresses with the gateway of each cidr, if the gateways are reserved
+func withGateways(cm *v1.ConfigMap, cidr string, existingServiceIPS []string) []string {
+	if cm.Data[ReserveGatewayKey] != "true" {
+		return existingServiceIPS
+	}
+	gateways, err := ipam.GatewayAddresses(cidr)
+	if err != nil {
+		klog.Warningf("unable to reserve the gateways of [%s]: %v", cidr, err)
+		return existingServiceIPS
+	}
+	return append(append([]string{}, existingServiceIPS...), gateways...)
+}
+
+// reservedGateway returns true if the address is the gateway of one of the cidrs and the gateways are reserved
+func reservedGateway(cm *v1.ConfigMap, cidr, address string) bool {
+	if cm.Data[ReserveGatewayKey] != "true" {
+		return false
+	}
+	gateways, err := ipam.GatewayAddresses(cidr)
+	if err != nil {
+		return false
+	}
+	for _, gateway := range gateways {
+		if gateway == ipam.NormalizeAddress(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// roundRobin returns true if the addresses of a pool with several cidrs or ranges are spread over them, rather
+// than filling the first
+func roundRobin(cm *v1.ConfigMap) bool {
+	strategy, ok := cm.Data[MultiPoolKey]
+	if ok && strategy != MultiPoolRoundRobin {
+		klog.Warningf("ignoring [%s] [%s], the only strategy is [%s]", MultiPoolKey, strategy, MultiPoolRoundRobin)
+	}
+	return strategy == MultiPoolRoundRobin
+}
+
+// bestFit returns true if the config map selects the smallest cidr or range of a pool that has a free address
+func bestFit(cm *v1.ConfigMap) bool {
+	selection, ok := cm.Data[PoolSelectionKey]
+	if ok && selection != PoolSelectionBestFit && selection != PoolSelectionFirstFit {
+		klog.Warningf("ignoring [%s] [%s], it must be [%s] or [%s]", PoolSelectionKey, selection, PoolSelectionFirstFit, PoolSelectionBestFit)
+	}
+	return selection == PoolSelectionBestFit
+}
+
+// fallbackOrder returns the pool tiers that should be searched (in order) for an address, this is
+// configured through the fallback-order key and defaults to namespace,global
+func fallbackOrder(cm *v1.ConfigMap) []string {
+	tiers := configList(cm, FallbackOrderKey)
+	if len(tiers) == 0 {
+		return []string{TierNamespace, TierGlobal}
+	}
+	return tiers
+}
+
+// usesEnvironmentTier determines if the environment of a namespace is needed to find a pool
+func usesEnvironmentTier(cm *v1.ConfigMap) bool {
+	for _, tier := range fallbackOrder(cm) {
+		if tier == TierEnvironment {
+			return true
+		}
+	}
+	return false
+}
+
+// allocation describes an address discovered for a service and the pool it was taken from
+type allocation struct {
+	// address is the allocated IP address
+	address string
+	// pool is the configmap key of the pool, e.g. cidr-global
+	pool string
+	// prefix is the network the address belongs to, this is empty if it couldn't be determined
+	prefix string
+	// source is where the address came from, dynamic if empty
+	source string
+	// warnings are problems with the request of the service that didn't stop the allocation
+	warnings []string
+}
+
+func discoverAddress(cm *v1.ConfigMap, service *v1.Service, environment, configMapName, keyPrefix string, existingServiceIPS []string) (*allocation, error) {
+	namespace := service.Namespace
+	// Differently formatted addresses would otherwise look free
+	existingServiceIPS = ipam.NormalizeAddresses(existingServiceIPS)
+
+	// The service asks for the global pool, i.e. for an address reachable from every namespace
+	if service.Annotations[UseGlobalPoolAnnotation] == "true" {
+		a, found, err := discoverPoolAddress(cm, service, "global", configMapName, keyPrefix, existingServiceIPS)
+		if a != nil {
+			a.address = ipam.NormalizeAddress(a.address)
+		}
+		if found {
+			return a, err
+		}
+		return nil, fmt.Errorf("%w, service [%s] has [%s] but there is no global pool", ErrNoPoolConfigured, service.Name, UseGlobalPoolAnnotation)
+	}
+
+	// A pool selecting the labels of the service takes precedence over the fallback chain
+	for _, pool := range selectedPools(cm, service, keyPrefix) {
+		a, found, err := discoverPoolAddress(cm, service, pool, configMapName, keyPrefix, existingServiceIPS)
+		if a != nil {
+			a.address = ipam.NormalizeAddress(a.address)
+		}
+		if found {
+			return a, err
+		}
+		klog.V(2).Infof("pool [%s] selects service [%s] but has no cidr, range or list, trying the next pool", pool, service.Name)
+	}
+
+	// Walk the fallback chain, the first tier with a pool configured will provide the address
+	for _, tier := range fallbackOrder(cm) {
+		var pool string
+		switch tier {
+		case TierNamespace:
+			pool = namespace
+		case TierEnvironment:
+			if environment == "" {
+				klog.V(2).Infof("namespace [%s] has no [%s] label, skipping environment pool", namespace, EnvironmentLabel)
+				continue
+			}
+			pool = fmt.Sprintf("env-%s", environment)
+		case TierGlobal:
+			pool = "global"
+		default:
+			klog.Warningf("unknown tier [%s] in [%s] configmap [%s]", tier, FallbackOrderKey, configMapName)
+			continue
+		}
+
+		a, found, err := discoverPoolAddress(cm, service, pool, configMapName, keyPrefix, existingServiceIPS)
+		if a != nil {
+			a.address = ipam.NormalizeAddress(a.address)
+		}
+		if found {
+			return a, err
+		}
+		klog.V(2).Infof("no [%s] pool for namespace [%s], trying the next tier", tier, namespace)
+	}
+	return nil, fmt.Errorf("%w, no IP address ranges could be found for namespace [%s] in tiers [%s]", ErrNoPoolConfigured, namespace, strings.Join(fallbackOrder(cm), ","))
+}
+
+// hashedPool returns true if the addresses of the pool are derived from a hash of the service
+func hashedPool(cm *v1.ConfigMap, keyPrefix, pool string) bool {
+	strategyKey := fmt.Sprintf("%s%s%s", keyPrefix, CidrStrategyKeyPrefix, pool)
+	strategy, ok := cm.Data[strategyKey]
+	if ok && strategy != CidrStrategyHashed {
+		klog.Warningf("ignoring [%s] [%s], the only strategy is [%s]", strategyKey, strategy, CidrStrategyHashed)
+	}
+	return strategy == CidrStrategyHashed
+}
+
+// cidrOptions returns how addresses are chosen from the cidr of the pool for the service
+func cidrOptions(cm *v1.ConfigMap, keyPrefix, pool string, service *v1.Service) ipam.Options {
+	var options ipam.Options
+	if hashedPool(cm, keyPrefix, pool) {
+		options.HashKey = service.Namespace + "/" + service.Name
+	}
+	offsetKey := fmt.Sprintf("%s%s%s", keyPrefix, CidrStartOffsetKeyPrefix, pool)
+	if value, ok := cm.Data[offsetKey]; ok {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			klog.Warningf("ignoring [%s] [%s], it isn't a positive number", offsetKey, value)
 		} else {
-			klog.Infof("Taking address from [range-global] pool")
+			options.StartOffset = offset
 		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", rangeKey)
 	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromRange(namespace, ipRange, existingServiceIPS)
+	if ScanTimeout > 0 {
+		options.Deadline = time.Now().Add(ScanTimeout)
+	}
+	options.Parity = octetParity(cm)
+	options.Descending = descending(cm)
+	return options
+}
+
+// octetParity returns the parity that addresses are preferred with, empty if the config map doesn't set a valid one
+func octetParity(cm *v1.ConfigMap) string {
+	if cm == nil {
+		return ""
+	}
+	value, ok := cm.Data[OctetParityKey]
+	switch {
+	case !ok:
+		return ""
+	case value == ipam.ParityEven, value == ipam.ParityOdd:
+		return value
+	}
+	klog.Warningf("ignoring [%s] [%s], it must be %s or %s", OctetParityKey, value, ipam.ParityEven, ipam.ParityOdd)
+	return ""
+}
+
+// descending returns true if the config map allocates cidr and range pools from their highest address down
+func descending(cm *v1.ConfigMap) bool {
+	if cm == nil {
+		return false
+	}
+	direction, ok := cm.Data[RangeDirectionKey]
+	if ok && direction != RangeDirectionAscending && direction != RangeDirectionDescending {
+		klog.Warningf("ignoring [%s] [%s], it must be [%s] or [%s]", RangeDirectionKey, direction, RangeDirectionAscending, RangeDirectionDescending)
+	}
+	return direction == RangeDirectionDescending
+}
+
+// serviceFamily returns the family of the ipFamily of the service, or of the default-ip-family key if it has none.
+// An empty family allocates from every cidr, range or address of a pool
+func serviceFamily(cm *v1.ConfigMap, service *v1.Service) string {
+	if service.Spec.IPFamily != nil {
+		return string(*service.Spec.IPFamily)
+	}
+	if cm == nil {
+		return ""
+	}
+	value, ok := cm.Data[DefaultIPFamilyKey]
+	switch {
+	case !ok:
+		return ""
+	case value == ipam.FamilyIPv4, value == ipam.FamilyIPv6:
+		return value
+	}
+	klog.Warningf("ignoring [%s] [%s], it must be %s or %s", DefaultIPFamilyKey, value, ipam.FamilyIPv4, ipam.FamilyIPv6)
+	return ""
+}
+
+// discoverPoolAddress will ask the allocator of the first kind of pool that exists (a cidr, then a range, then a
+// list) for an address, found will be false if none exist
+func discoverPoolAddress(cm *v1.ConfigMap, service *v1.Service, pool, configMapName, keyPrefix string, existingServiceIPS []string) (a *allocation, found bool, err error) {
+	var warnings []string
+	var keys []string
+	for _, allocator := range allocators {
+		key := fmt.Sprintf("%s%s-%s", keyPrefix, allocator.Kind(), pool)
+		keys = append(keys, key)
+		definition, ok := cm.Data[key]
+		if ok && strings.TrimSpace(definition) == "" {
+			// An empty key (i.e. left over from a removed pool) isn't a pool, the next kind or tier is used instead
+			klog.Warningf("ignoring [%s] in configmap [%s], it is empty", key, configMapName)
+			ok = false
+		}
+		if !ok || poolCordoned(cm, key) {
+			// The preferred subnet only applies to cidr pools
+			if allocator.Kind() == "cidr" && service.Annotations[PreferredSubnetAnnotation] != "" {
+				warning := fmt.Sprintf("ignoring [%s] for service [%s], [%s] isn't a cidr pool", PreferredSubnetAnnotation, service.Name, key)
+				klog.Warning(warning)
+				warnings = append(warnings, warning)
+			}
+			continue
+		}
+		// A pool of both families only allocates addresses of the family of the service, a pool without the family
+		// is left as it is
+		if family := serviceFamily(cm, service); family != "" {
+			if filtered, ok := ipam.FilterFamily(definition, family); ok {
+				definition = filtered
+			} else {
+				klog.V(2).Infof("pool [%s] has no %s addresses for service [%s], allocating from any family", key, family, service.Name)
+			}
+		}
+		klog.V(2).Infof("Taking address from [%s] pool", key)
+		start := time.Now()
+		a, err := allocator.Allocate(&AllocationRequest{
+			ConfigMap:  cm,
+			Service:    service,
+			Pool:       pool,
+			Key:        key,
+			Definition: definition,
+			KeyPrefix:  keyPrefix,
+			Existing:   existingServiceIPS,
+		})
+		observeAllocationScan(allocator, definition, time.Since(start))
 		if err != nil {
-			return vip, err
+			return nil, true, exhaustedError(allocator, key, definition, existingServiceIPS, err)
 		}
-		return
+		a.warnings = append(warnings, a.warnings...)
+		return a, true, nil
 	}
-	return "", fmt.Errorf("no IP address ranges could be found either range-global or range-<namespace>")
+
+	klog.Info(fmt.Errorf("no pool config exists in keys [%s] configmap [%s]", strings.Join(keys, "] ["), configMapName))
+	return nil, false, nil
 }
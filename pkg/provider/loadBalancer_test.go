@@ -0,0 +1,2441 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// newTestLoadBalancer returns a load balancer manager backed by a fake client and event recorder,
+// populated with the kube-vip config map and any additional objects
+func newTestLoadBalancer(data map[string]string, objects ...runtime.Object) *kubevipLoadBalancerManager {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: "kube-system",
+		},
+		Data: data,
+	}
+	objects = append(objects, cm)
+	recorder := record.NewFakeRecorder(100)
+	return newLoadBalancer(fake.NewSimpleClientset(objects...), recorder, "default", KubeVipCloudConfig, "").(*kubevipLoadBalancerManager)
+}
+
+func newTestService(namespace, name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			UID:       types.UID("uid-" + name),
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+	}
+}
+
+func Test_discoverAddress(t *testing.T) {
+	type args struct {
+		data        map[string]string
+		namespace   string
+		environment string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default order, namespace pool",
+			args: args{
+				data: map[string]string{
+					"cidr-dev":    "192.168.0.200/30",
+					"cidr-global": "192.168.1.200/30",
+				},
+				namespace: "dev",
+			},
+			want: "192.168.0.201",
+		},
+		{
+			name: "default order, environment pool is ignored",
+			args: args{
+				data: map[string]string{
+					"cidr-env-prod": "192.168.2.200/30",
+					"range-global":  "192.168.1.10-192.168.1.11",
+				},
+				namespace:   "dev",
+				environment: "prod",
+			},
+			want: "192.168.1.10",
+		},
+		{
+			name: "full chain, namespace tier",
+			args: args{
+				data: map[string]string{
+					FallbackOrderKey: "namespace,env,global",
+					"range-dev":      "192.168.0.10-192.168.0.11",
+					"cidr-env-prod":  "192.168.2.200/30",
+					"cidr-global":    "192.168.1.200/30",
+				},
+				namespace:   "dev",
+				environment: "prod",
+			},
+			want: "192.168.0.10",
+		},
+		{
+			name: "full chain, environment tier",
+			args: args{
+				data: map[string]string{
+					FallbackOrderKey: "namespace, env, global",
+					"cidr-env-prod":  "192.168.2.200/30",
+					"cidr-global":    "192.168.1.200/30",
+				},
+				namespace:   "dev",
+				environment: "prod",
+			},
+			want: "192.168.2.201",
+		},
+		{
+			name: "full chain, global tier",
+			args: args{
+				data: map[string]string{
+					FallbackOrderKey: "namespace,env,global",
+					"cidr-env-prod":  "192.168.2.200/30",
+					"cidr-global":    "192.168.1.200/30",
+				},
+				namespace:   "dev",
+				environment: "staging",
+			},
+			want: "192.168.1.201",
+		},
+		{
+			name: "full chain, namespace without environment label",
+			args: args{
+				data: map[string]string{
+					FallbackOrderKey: "namespace,env,global",
+					"cidr-env-prod":  "192.168.2.200/30",
+					"range-global":   "192.168.1.10-192.168.1.11",
+				},
+				namespace: "dev",
+			},
+			want: "192.168.1.10",
+		},
+		{
+			name: "full chain, no pools",
+			args: args{
+				data: map[string]string{
+					FallbackOrderKey: "namespace,env,global",
+					"cidr-other":     "192.168.0.200/30",
+				},
+				namespace:   "dev",
+				environment: "prod",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			cm := &v1.ConfigMap{Data: tt.args.data}
+			got, err := discoverAddress(cm, newTestService(tt.args.namespace, "lb"), tt.args.environment, KubeVipClientConfig, "", []string{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("discoverAddress() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != nil && got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerConcurrent(t *testing.T) {
+	ipam.Manager = nil
+
+	var services []*v1.Service
+	var objects []runtime.Object
+	for _, namespace := range []string{"dev", "staging"} {
+		for x := 0; x < 10; x++ {
+			svc := newTestService(namespace, fmt.Sprintf("svc-%d", x))
+			services = append(services, svc)
+			objects = append(objects, svc)
+		}
+	}
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-dev":     "192.168.0.0/27",
+		"cidr-staging": "192.168.1.0/27",
+	}, objects...)
+
+	var wg sync.WaitGroup
+	for x := range services {
+		wg.Add(1)
+		go func(svc *v1.Service) {
+			defer wg.Done()
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Errorf("syncLoadBalancer() error = %v", err)
+			}
+		}(services[x])
+	}
+	wg.Wait()
+
+	for _, namespace := range []string{"dev", "staging"} {
+		svcs, err := k.kubeClient.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned := map[string]string{}
+		for _, svc := range svcs.Items {
+			ip := svc.Spec.LoadBalancerIP
+			if ip == "" {
+				t.Errorf("service [%s/%s] was not assigned an address", namespace, svc.Name)
+				continue
+			}
+			if other, ok := assigned[ip]; ok {
+				t.Errorf("address [%s] assigned to both [%s] and [%s] in [%s]", ip, other, svc.Name, namespace)
+			}
+			assigned[ip] = svc.Name
+		}
+	}
+}
+
+func Test_syncLoadBalancerNoPool(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "no-pool")
+	k := newTestLoadBalancer(map[string]string{"cidr-other": "192.168.0.200/30"}, svc)
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	// The first reconcile marks the service and emits a single event
+	_, err := k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ErrNoPoolConfigured) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrNoPoolConfigured)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Annotations[IPAMStatusAnnotation] != IPAMStatusNoPoolConfigured {
+		t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], IPAMStatusNoPoolConfigured)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("got %d events, want 1", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonNoPoolConfigured) {
+		t.Errorf("event = %q, want reason %s", event, ReasonNoPoolConfigured)
+	}
+
+	// A reconcile within the retry interval doesn't re-evaluate the service
+	_, err = k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ErrNoPoolConfigured) {
+		t.Errorf("syncLoadBalancer() error = %v, want %v", err, ErrNoPoolConfigured)
+	}
+
+	// Re-evaluating an unchanged state doesn't emit the event again
+	k.noPoolRetries.forget(svc.UID)
+	_, err = k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ErrNoPoolConfigured) {
+		t.Errorf("syncLoadBalancer() error = %v, want %v", err, ErrNoPoolConfigured)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("got %d events, want 0", len(recorder.Events))
+	}
+}
+
+func Test_syncLoadBalancerExhausted(t *testing.T) {
+	ipam.Manager = nil
+
+	used := newTestService("dev", "used")
+	used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc := newTestService("dev", "exhausted")
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.201-192.168.0.201"}, used, svc)
+
+	_, err := k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ipam.ErrNoAddressesAvailable) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ipam.ErrNoAddressesAvailable)
+	}
+	if errors.Is(err, ErrNoPoolConfigured) {
+		t.Errorf("syncLoadBalancer() error = %v, exhausted pool reported as not configured", err)
+	}
+	// The error and the event include the usage of the pool
+	usage := "pool [range-dev] (192.168.0.201-192.168.0.201) is exhausted: 1/1 used"
+	if !strings.Contains(err.Error(), usage) {
+		t.Errorf("syncLoadBalancer() error = %v, want it to contain %q", err, usage)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Annotations[IPAMStatusAnnotation] != IPAMStatusPoolExhausted {
+		t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], IPAMStatusPoolExhausted)
+	}
+	recorder := k.recorder.(*record.FakeRecorder)
+	if len(recorder.Events) == 0 {
+		t.Fatal("got no events, want a pool exhausted event")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonPoolExhausted) || !strings.Contains(event, usage) {
+		t.Errorf("event = %q, want %s with %q", event, ReasonPoolExhausted, usage)
+	}
+}
+
+func Test_exhaustedEventDeduplication(t *testing.T) {
+	ipam.Manager = nil
+	used := newTestService("dev", "used")
+	used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc := newTestService("dev", "exhausted")
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.201-192.168.0.201"}, used, svc)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	k.eventRepeatInterval = time.Hour
+	recorder := k.recorder.(*record.FakeRecorder)
+	events := func() (reasons []string) {
+		for len(recorder.Events) > 0 {
+			reasons = append(reasons, strings.Fields(<-recorder.Events)[1])
+		}
+		return reasons
+	}
+
+	// An unchanged exhausted state is only reported once
+	for i := 0; i < 3; i++ {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); !errors.Is(err, ipam.ErrNoAddressesAvailable) {
+			t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ipam.ErrNoAddressesAvailable)
+		}
+	}
+	if got := events(); len(got) != 1 || got[0] != ReasonPoolExhausted {
+		t.Errorf("events = %v, want a single %v", got, ReasonPoolExhausted)
+	}
+
+	// It is reported again once the repeat interval has passed
+	fakeClock.Step(time.Hour)
+	_, _ = k.syncLoadBalancer(context.TODO(), svc)
+	if got := events(); len(got) != 1 || got[0] != ReasonPoolExhausted {
+		t.Errorf("events = %v, want a single %v", got, ReasonPoolExhausted)
+	}
+
+	// The transition to allocated is reported, and so is becoming exhausted again
+	if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), used.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := events(); len(got) != 1 || got[0] != ReasonAddressAllocated {
+		t.Errorf("events = %v, want a single %v", got, ReasonAddressAllocated)
+	}
+	if !k.events.emit(svc.UID, ReasonPoolExhausted, fakeClock.Now(), 0) || k.events.emit(svc.UID, ReasonPoolExhausted, fakeClock.Now(), 0) {
+		t.Errorf("emit() didn't report only the first %v after a transition", ReasonPoolExhausted)
+	}
+	if !k.events.emit(svc.UID, ReasonNoPoolConfigured, fakeClock.Now(), 0) {
+		t.Errorf("emit() = false, want a changed reason emitted")
+	}
+}
+
+func Test_exhaustedEventDeduplicationDisabled(t *testing.T) {
+	ipam.Manager = nil
+	used := newTestService("dev", "used")
+	used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc := newTestService("dev", "exhausted")
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.201-192.168.0.201"}, used, svc)
+	k.eventDeduplication = false
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	for i := 0; i < 3; i++ {
+		_, _ = k.syncLoadBalancer(context.TODO(), svc)
+	}
+	if len(recorder.Events) != 3 {
+		t.Errorf("got %d events, want one for every sync", len(recorder.Events))
+	}
+}
+
+func Test_hooks(t *testing.T) {
+	ipam.Manager = nil
+
+	var mu sync.Mutex
+	var received []hookPayload
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Fail the first request to exercise the retry
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload hookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("unable to decode hook payload: %v", err)
+		}
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	svc := newTestService("dev", "hooked")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+	k.hooks = &hooks{
+		allocateURL:   server.URL + "/allocate",
+		releaseURL:    server.URL + "/release",
+		blocking:      true,
+		retries:       3,
+		retryInterval: time.Millisecond,
+		client:        server.Client(),
+	}
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err := k.deleteLoadBalancer(context.TODO(), allocated); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+
+	want := []hookPayload{
+		{Event: hookEventAllocate, Namespace: "dev", Name: "hooked", UID: "uid-hooked", Address: "192.168.0.201"},
+		{Event: hookEventRelease, Namespace: "dev", Name: "hooked", UID: "uid-hooked", Address: "192.168.0.201"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("hooks received %v, want %v", received, want)
+	}
+}
+
+func Test_hooksFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		blocking bool
+		wantErr  bool
+	}{
+		{
+			name:     "non-blocking failure doesn't fail the update",
+			blocking: false,
+		},
+		{
+			name:     "blocking failure fails the update",
+			blocking: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "hooked")
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+			k.hooks = &hooks{
+				allocateURL:   server.URL,
+				blocking:      tt.blocking,
+				retries:       2,
+				retryInterval: time.Millisecond,
+				client:        server.Client(),
+			}
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != "192.168.0.201" {
+				t.Errorf("service address = %q, the hook should run after the update", got.Spec.LoadBalancerIP)
+			}
+		})
+	}
+}
+
+func Test_hooksRedelivery(t *testing.T) {
+	ipam.Manager = nil
+	var mu sync.Mutex
+	failing := true
+	var received []hookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload hookPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	svc := newTestService("dev", "hooked")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+	k.hooks = &hooks{allocateURL: server.URL, blocking: true, retries: 1, client: server.Client()}
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err == nil {
+		t.Fatal("syncLoadBalancer() error = nil, want the hook failure")
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Annotations[AllocateHookPendingAnnotation] != "192.168.0.201" {
+		t.Fatalf("annotation [%s] = %q, want 192.168.0.201", AllocateHookPendingAnnotation, got.Annotations[AllocateHookPendingAnnotation])
+	}
+
+	// The requeued service already has its address, the hook is still delivered
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if _, ok := got.Annotations[AllocateHookPendingAnnotation]; ok {
+		t.Errorf("annotation [%s] = %q, want it removed", AllocateHookPendingAnnotation, got.Annotations[AllocateHookPendingAnnotation])
+	}
+	want := []hookPayload{{Event: hookEventAllocate, Namespace: "dev", Name: "hooked", UID: "uid-hooked", Address: "192.168.0.201"}}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("hooks received %v, want %v", received, want)
+	}
+}
+
+func Test_discoverAddressPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want allocation
+	}{
+		{
+			name: "cidr pool",
+			data: map[string]string{"cidr-dev": "192.168.0.0/24"},
+			want: allocation{address: "192.168.0.1", pool: "cidr-dev", prefix: "192.168.0.0/24"},
+		},
+		{
+			name: "multiple cidr pool",
+			data: map[string]string{"cidr-global": "192.168.0.200/32,192.168.1.0/24"},
+			want: allocation{address: "192.168.0.200", pool: "cidr-global", prefix: "192.168.0.200/32"},
+		},
+		{
+			name: "range pool",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20"},
+			want: allocation{address: "192.168.0.10", pool: "range-dev", prefix: "192.168.0.0/27"},
+		},
+		{
+			name: "range pool across octets",
+			data: map[string]string{"range-dev": "192.168.0.250-192.168.1.5"},
+			want: allocation{address: "192.168.0.250", pool: "range-dev", prefix: "192.168.0.0/23"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", []string{})
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("discoverAddress() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerAllocatedCidr(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "prefixed")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc)
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Annotations[AllocatedCidrAnnotation] != "192.168.0.200/29" {
+		t.Errorf("annotation [%s] = %q, want %q", AllocatedCidrAnnotation, got.Annotations[AllocatedCidrAnnotation], "192.168.0.200/29")
+	}
+}
+
+func Test_syncLoadBalancerDisabledNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespace  string
+		wantStatus string
+		wantEvents int
+	}{
+		{
+			name:       "disabled namespace is skipped",
+			namespace:  "kube-system",
+			wantStatus: IPAMStatusNamespaceDisabled,
+			wantEvents: 1,
+		},
+		{
+			name:       "other namespace is allocated",
+			namespace:  "dev",
+			wantEvents: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService(tt.namespace, "lb")
+			k := newTestLoadBalancer(map[string]string{
+				DisabledNamespacesKey: "kube-system, kube-public",
+				"cidr-global":         "192.168.0.200/30",
+			}, svc)
+
+			// Reconcile twice to show the event is only emitted once
+			got := svc
+			for x := 0; x < 2; x++ {
+				if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+					t.Fatalf("syncLoadBalancer() error = %v", err)
+				}
+				got, _ = k.kubeClient.CoreV1().Services(tt.namespace).Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			}
+
+			if got.Annotations[IPAMStatusAnnotation] != tt.wantStatus {
+				t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], tt.wantStatus)
+			}
+			if tt.wantStatus != "" && got.Spec.LoadBalancerIP != "" {
+				t.Errorf("service in disabled namespace was given address [%s]", got.Spec.LoadBalancerIP)
+			}
+			if tt.wantStatus == "" && got.Spec.LoadBalancerIP != "192.168.0.201" {
+				t.Errorf("service address = %q, want %q", got.Spec.LoadBalancerIP, "192.168.0.201")
+			}
+			if events := len(k.recorder.(*record.FakeRecorder).Events); events != tt.wantEvents {
+				t.Errorf("got %d events, want %d", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerTimeout(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "slow")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+	k.reconcileTimeout = 20 * time.Millisecond
+
+	// Inject a slow API server when listing services
+	client := k.kubeClient.(*fake.Clientset)
+	client.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(100 * time.Millisecond)
+		return false, nil, nil
+	})
+
+	start := time.Now()
+	_, err := k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ErrReconcileTimeout) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrReconcileTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("syncLoadBalancer() took %s, want a clean timeout", elapsed)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("service was updated after the reconcile timed out")
+		}
+	}
+}
+
+func Test_allocationHistory(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "history")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc)
+	k.historyLength = 2
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	// Allocate, then clear the address (as an external actor might) to force a reallocation
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	got.Spec.LoadBalancerIP = ""
+	got.Labels["ipam-address"] = "192.168.0.250"
+	got, _ = k.kubeClient.CoreV1().Services("dev").Update(context.TODO(), got, metav1.UpdateOptions{})
+	if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err := k.deleteLoadBalancer(context.TODO(), got); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+
+	wantEvents := []string{ReasonAddressAllocated, ReasonAddressReallocated, ReasonAddressReleased}
+	if len(recorder.Events) != len(wantEvents) {
+		t.Fatalf("got %d events, want %d", len(recorder.Events), len(wantEvents))
+	}
+	for _, reason := range wantEvents {
+		if event := <-recorder.Events; !strings.HasPrefix(event, v1.EventTypeNormal+" "+reason+" ") {
+			t.Errorf("event = %q, want reason %s", event, reason)
+		}
+	}
+
+	// The history only keeps the most recent entries
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	var history []historyEntry
+	if err := json.Unmarshal([]byte(got.Annotations[AllocationHistoryAnnotation]), &history); err != nil {
+		t.Fatalf("unable to read [%s]: %v", AllocationHistoryAnnotation, err)
+	}
+	if len(history) != 2 || history[0].Reason != ReasonAddressReallocated || history[1].Reason != ReasonAddressReleased {
+		t.Errorf("history = %+v, want %s then %s", history, ReasonAddressReallocated, ReasonAddressReleased)
+	}
+}
+
+func Test_watchedNamespaces(t *testing.T) {
+	ipam.Manager = nil
+
+	watched := newTestService("dev", "watched")
+	ignored := newTestService("production", "ignored")
+	ignored.Labels = map[string]string{"ipam-address": "192.168.0.210"}
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, watched, ignored)
+	k.watchedNamespaces = map[string]bool{"dev": true, "staging": true}
+	client := k.kubeClient.(*fake.Clientset)
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", ignored, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if err := k.UpdateLoadBalancer(context.TODO(), "cluster", ignored, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if err := k.EnsureLoadBalancerDeleted(context.TODO(), "cluster", ignored); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("service outside the watched namespaces caused API calls %v", actions)
+	}
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", watched, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), watched.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP == "" {
+		t.Errorf("service in a watched namespace wasn't allocated an address")
+	}
+}
+
+func Test_syncLoadBalancerWithoutNodePorts(t *testing.T) {
+	ipam.Manager = nil
+
+	// The v1.19 API has no allocateLoadBalancerNodePorts, a service with it set to false has ports without a
+	// node port, the address is allocated regardless of the ports
+	svc := newTestService("dev", "no-node-ports")
+	svc.Spec.Ports = []v1.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}}
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc)
+
+	status, err := k.EnsureLoadBalancer(context.TODO(), "cluster", svc, nil)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	address := got.Spec.LoadBalancerIP
+	if address == "" || got.Labels["ipam-address"] != address {
+		t.Fatalf("address = %v (label %v), want an allocated address", address, got.Labels["ipam-address"])
+	}
+
+	// The controller records the status, later syncs keep the address
+	got.Status.LoadBalancer = *status
+	if err := k.UpdateLoadBalancer(context.TODO(), "cluster", got, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", got, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != address || got.Labels["ipam-address"] != address {
+		t.Errorf("address = %v (label %v), want %v", got.Spec.LoadBalancerIP, got.Labels["ipam-address"], address)
+	}
+	for _, port := range got.Spec.Ports {
+		if port.NodePort != 0 {
+			t.Errorf("port [%s] node port = %v, want none", port.Name, port.NodePort)
+		}
+	}
+}
+
+func Test_requireManagedAnnotation(t *testing.T) {
+	ipam.Manager = nil
+
+	optedIn := newTestService("dev", "opted-in")
+	optedIn.Annotations = map[string]string{ManagedAnnotation: "true"}
+	ignored := newTestService("dev", "ignored")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, optedIn, ignored)
+	k.requireManaged = true
+	client := k.kubeClient.(*fake.Clientset)
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", ignored, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if err := k.UpdateLoadBalancer(context.TODO(), "cluster", ignored, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if err := k.EnsureLoadBalancerDeleted(context.TODO(), "cluster", ignored); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("service without [%s] caused API calls %v", ManagedAnnotation, actions)
+	}
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", optedIn, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), optedIn.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP == "" {
+		t.Fatalf("service with [%s] wasn't allocated an address", ManagedAnnotation)
+	}
+
+	// Opting out doesn't stop the address being released
+	delete(got.Annotations, ManagedAnnotation)
+	if err := k.EnsureLoadBalancerDeleted(context.TODO(), "cluster", got); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if allocations := k.allocations.list(); len(allocations) != 0 {
+		t.Errorf("address of an opted out service wasn't released, allocations %v", allocations)
+	}
+}
+
+func Test_observeOnly(t *testing.T) {
+	ipam.Manager = nil
+
+	existing := newTestService("dev", "existing")
+	existing.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	existing.Spec.LoadBalancerIP = "192.168.0.201"
+	pending := newTestService("dev", "pending")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, existing, pending)
+	k.observeOnly = true
+	k.hooks = &hooks{allocateURL: "http://127.0.0.1:0", releaseURL: "http://127.0.0.1:0", blocking: true}
+	client := k.kubeClient.(*fake.Clientset)
+
+	for _, svc := range []*v1.Service{existing, pending} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+	}
+	want := []serviceAllocation{{Namespace: "dev", Name: "existing", Address: "192.168.0.201"}}
+	if got := k.allocations.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("observed allocations = %+v, want %+v", got, want)
+	}
+	if got, _ := testutil.GetGaugeMetricValue(allocationsGauge.WithLabelValues("dev", SourceDynamic)); got != 1 {
+		t.Errorf("allocated addresses metric = %v, want 1", got)
+	}
+
+	// The debug endpoint serves the observed state
+	rec := httptest.NewRecorder()
+	k.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/allocations", nil))
+	var served []serviceAllocation
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || !reflect.DeepEqual(served, want) {
+		t.Errorf("debug endpoint = %s, want %+v", rec.Body.String(), want)
+	}
+
+	if err := k.deleteLoadBalancer(context.TODO(), existing); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	for _, action := range client.Actions() {
+		switch action.GetVerb() {
+		case "create", "update", "patch", "delete":
+			t.Errorf("observe mode made a mutating call %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if len(k.recorder.(*record.FakeRecorder).Events) != 0 {
+		t.Errorf("observe mode emitted events")
+	}
+}
+
+func Test_discoverAddressPreferredSubnet(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         map[string]string
+		preferred    string
+		existing     []string
+		want         string
+		wantWarnings int
+	}{
+		{
+			name:      "preferred subnet is tried first",
+			data:      map[string]string{"cidr-dev": "192.168.0.0/30,192.168.1.0/30"},
+			preferred: "192.168.1.0/30",
+			want:      "192.168.1.1",
+		},
+		{
+			name:      "full preferred subnet falls back to the pool",
+			data:      map[string]string{"cidr-dev": "192.168.0.0/30,192.168.1.0/30"},
+			preferred: "192.168.1.0/30",
+			existing:  []string{"192.168.1.1", "192.168.1.2"},
+			want:      "192.168.0.1",
+		},
+		{
+			name:         "preferred subnet not in the pool is ignored",
+			data:         map[string]string{"cidr-dev": "192.168.0.0/30,192.168.1.0/30"},
+			preferred:    "10.0.0.0/24",
+			want:         "192.168.0.1",
+			wantWarnings: 1,
+		},
+		{
+			name:         "preferred subnet on a range pool is ignored",
+			data:         map[string]string{"range-dev": "192.168.0.10-192.168.0.20"},
+			preferred:    "192.168.0.0/24",
+			want:         "192.168.0.10",
+			wantWarnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Annotations = map[string]string{PreferredSubnetAnnotation: tt.preferred}
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, svc, "", KubeVipClientConfig, "", tt.existing)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+			if len(got.warnings) != tt.wantWarnings {
+				t.Errorf("discoverAddress() warnings = %v, want %d", got.warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressKeyPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		keyPrefix string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "prefixed namespace cidr",
+			data:      map[string]string{"kv-cidr-dev": "192.168.0.200/29", "cidr-dev": "10.0.0.0/29"},
+			keyPrefix: "kv-",
+			want:      "192.168.0.201",
+		},
+		{
+			name:      "prefixed global range",
+			data:      map[string]string{"kv-range-global": "192.168.0.10-192.168.0.20", "range-dev": "10.0.0.10-10.0.0.20"},
+			keyPrefix: "kv-",
+			want:      "192.168.0.10",
+		},
+		{
+			name:      "unprefixed keys are ignored",
+			data:      map[string]string{"cidr-dev": "10.0.0.0/29"},
+			keyPrefix: "kv-",
+			wantErr:   true,
+		},
+		{
+			name: "no prefix",
+			data: map[string]string{"kv-cidr-dev": "192.168.0.200/29", "cidr-dev": "10.0.0.0/29"},
+			want: "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, tt.keyPrefix, []string{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_allocationAudit(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "audited")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	k.audit = newAllocationAudit(dyn)
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	ipAllocation, err := dyn.Resource(ipAllocationResource).Namespace("dev").Get(context.TODO(), "audited", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("IPAllocation not recorded: %v", err)
+	}
+	for field, want := range map[string]string{"address": "192.168.0.201", "pool": "cidr-dev", "actor": auditActor} {
+		if got := ipAllocation.Object["spec"].(map[string]interface{})[field]; got != want {
+			t.Errorf("IPAllocation spec.%s = %v, want %v", field, got, want)
+		}
+	}
+	if owners := ipAllocation.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != svc.UID {
+		t.Errorf("IPAllocation owners = %v, want service [%s]", owners, svc.UID)
+	}
+
+	allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err := k.deleteLoadBalancer(context.TODO(), allocated); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if _, err := dyn.Resource(ipAllocationResource).Namespace("dev").Get(context.TODO(), "audited", metav1.GetOptions{}); err == nil {
+		t.Errorf("IPAllocation not deleted on release")
+	}
+}
+
+func Test_syncLoadBalancerDeleted(t *testing.T) {
+	ipam.Manager = nil
+
+	svc := newTestService("dev", "deleted")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+	recorder := k.recorder.(*record.FakeRecorder)
+	// The service is deleted after the allocation has been discovered
+	client := k.kubeClient.(*fake.Clientset)
+	client.PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(v1.Resource("services"), action.(k8stesting.GetAction).GetName())
+	})
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v, want nil for a deleted service", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("syncLoadBalancer() emitted %d events for a deleted service, want 0", len(recorder.Events))
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("syncLoadBalancer() updated [%s] for a deleted service", action.GetResource().Resource)
+		}
+	}
+}
+
+func Test_discoverAddressNormalizesExisting(t *testing.T) {
+	ipam.Manager = nil
+
+	// Differently formatted addresses are still in use
+	existing := []string{" 192.168.0.201", "::ffff:192.168.0.202"}
+	got, err := discoverAddress(&v1.ConfigMap{Data: map[string]string{"cidr-dev": "192.168.0.200/29"}}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", existing)
+	if err != nil {
+		t.Fatalf("discoverAddress() error = %v", err)
+	}
+	if got.address != "192.168.0.203" {
+		t.Errorf("discoverAddress() = %v, want 192.168.0.203", got.address)
+	}
+}
+
+func Test_verifyAllocation(t *testing.T) {
+	tests := []struct {
+		name        string
+		strips      int
+		wantUpdates int
+		wantErr     bool
+	}{
+		{
+			name:        "allocation applied",
+			wantUpdates: 1,
+		},
+		{
+			name:        "label stripped once is retried",
+			strips:      1,
+			wantUpdates: 2,
+		},
+		{
+			name:        "label always stripped",
+			strips:      VerifyAllocationAttempts,
+			wantUpdates: VerifyAllocationAttempts,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+
+			svc := newTestService("dev", "verified")
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+			k.verifyAllocation = true
+			// Behave like a mutating webhook that removes the ipam-address label
+			client := k.kubeClient.(*fake.Clientset)
+			strips, updates := tt.strips, 0
+			client.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				updates++
+				if strips > 0 {
+					strips--
+					delete(action.(k8stesting.UpdateAction).GetObject().(*v1.Service).Labels, "ipam-address")
+				}
+				return false, nil, nil
+			})
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncLoadBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if updates != tt.wantUpdates {
+				t.Errorf("syncLoadBalancer() made %d updates, want %d", updates, tt.wantUpdates)
+			}
+		})
+	}
+}
+
+func newTestNode(name string, addresses ...v1.NodeAddress) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     v1.NodeStatus{Addresses: addresses},
+	}
+}
+
+func Test_syncLoadBalancerNodeCidr(t *testing.T) {
+	nodes := []runtime.Object{
+		newTestNode("node-1",
+			v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"},
+			v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.10"}),
+		newTestNode("node-2", v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.6"}),
+	}
+	// A service in another namespace is using an address from the same network
+	other := newTestService("other", "lb")
+	other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.2"}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "node and service addresses are excluded",
+			data: map[string]string{NodeCidrKey: "true"},
+			want: "192.168.0.3",
+		},
+		{
+			name: "configured pools take precedence",
+			data: map[string]string{NodeCidrKey: "true", "cidr-dev": "10.0.0.0/30"},
+			want: "10.0.0.1",
+		},
+		{
+			name:    "disabled",
+			data:    map[string]string{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			k := newTestLoadBalancer(tt.data, append([]runtime.Object{svc, other}, nodes...)...)
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncLoadBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() allocated %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerServiceOffset(t *testing.T) {
+	// A service in another namespace is using an address from the derived pool
+	other := newTestService("other", "lb")
+	other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "10.112.0.1"}
+
+	tests := []struct {
+		name        string
+		serviceCidr string
+		data        map[string]string
+		want        string
+		wantErr     error
+	}{
+		{
+			name:        "derived pool",
+			serviceCidr: "10.96.0.0/12",
+			data:        map[string]string{ServiceOffsetCidrKey: "/29@0"},
+			want:        "10.112.0.2",
+		},
+		{
+			name:        "configured pools take precedence",
+			serviceCidr: "10.96.0.0/12",
+			data:        map[string]string{ServiceOffsetCidrKey: "/29@0", "cidr-dev": "10.0.0.0/30"},
+			want:        "10.0.0.1",
+		},
+		{
+			name:        "derived pool overlaps the service network",
+			serviceCidr: "10.96.0.0/12",
+			data:        map[string]string{ServiceOffsetCidrKey: "/24@0.0.100.0"},
+			wantErr:     ipam.ErrInvalidOffsetCidr,
+		},
+		{
+			name:    "no service network",
+			data:    map[string]string{ServiceOffsetCidrKey: "/29@0"},
+			wantErr: ErrNoServiceCidr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			k := newTestLoadBalancer(tt.data, svc, other)
+			k.serviceCidr = tt.serviceCidr
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("syncLoadBalancer() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() allocated %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+		})
+	}
+}
+
+func Test_poolGenerationMigration(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		address        string
+		generation     string
+		want           string
+		wantGeneration string
+	}{
+		{
+			name:           "new allocation is stamped",
+			data:           map[string]string{"cidr-dev": "192.168.0.200/30", PoolGenerationKey: "2"},
+			want:           "192.168.0.201",
+			wantGeneration: "2",
+		},
+		{
+			name:           "older generation is migrated",
+			data:           map[string]string{"cidr-dev": "192.168.0.200/30", PoolGenerationKey: "2", PoolMigrationKey: "true"},
+			address:        "10.0.0.1",
+			generation:     "1",
+			want:           "192.168.0.201",
+			wantGeneration: "2",
+		},
+		{
+			name:           "older generation is kept outside of a migration",
+			data:           map[string]string{"cidr-dev": "192.168.0.200/30", PoolGenerationKey: "2"},
+			address:        "10.0.0.1",
+			generation:     "1",
+			want:           "10.0.0.1",
+			wantGeneration: "1",
+		},
+		{
+			name:           "current generation is kept",
+			data:           map[string]string{"cidr-dev": "192.168.0.200/30", PoolGenerationKey: "2", PoolMigrationKey: "true"},
+			address:        "10.0.0.1",
+			generation:     "2",
+			want:           "10.0.0.1",
+			wantGeneration: "2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			if tt.address != "" {
+				svc.Spec.LoadBalancerIP = tt.address
+				svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": tt.address}
+				svc.Annotations = map[string]string{PoolGenerationAnnotation: tt.generation}
+			}
+			k := newTestLoadBalancer(tt.data, svc)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+			if got.Annotations[PoolGenerationAnnotation] != tt.wantGeneration {
+				t.Errorf("syncLoadBalancer() generation = %v, want %v", got.Annotations[PoolGenerationAnnotation], tt.wantGeneration)
+			}
+		})
+	}
+}
+
+func Test_foreignIngressPolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		want      string
+		wantLabel string
+	}{
+		{policy: ForeignIngressAllocate, want: "192.168.0.201", wantLabel: "192.168.0.201"},
+		{policy: ForeignIngressAdopt, want: "10.0.0.10", wantLabel: "10.0.0.10"},
+		{policy: ForeignIngressSkip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.10"}}
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30"}, svc)
+			k.foreignIngressPolicy = tt.policy
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+			if got.Labels["ipam-address"] != tt.wantLabel {
+				t.Errorf("syncLoadBalancer() ipam-address label = %v, want %v", got.Labels["ipam-address"], tt.wantLabel)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressStartOffset(t *testing.T) {
+	ipam.Manager = nil
+	data := map[string]string{"cidr-dev": "192.168.0.0/24", "cidr-start-offset-dev": "50"}
+
+	got, err := discoverAddress(&v1.ConfigMap{Data: data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", []string{"192.168.0.51"})
+	if err != nil {
+		t.Fatalf("discoverAddress() error = %v", err)
+	}
+	if got.address != "192.168.0.52" {
+		t.Errorf("discoverAddress() = %v, want 192.168.0.52", got.address)
+	}
+}
+
+func Test_discoverAddressCordoned(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "cordoned range falls back to the global pool",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20", "cidr-global": "192.168.1.200/29", CordonedPoolsKey: "range-dev"},
+			want: "192.168.1.201",
+		},
+		{
+			name: "cordoned cidr falls back to the range",
+			data: map[string]string{"cidr-dev": "192.168.0.200/29", "range-dev": "192.168.0.10-192.168.0.20", CordonedPoolsKey: "cidr-dev"},
+			want: "192.168.0.10",
+		},
+		{
+			name:    "every pool cordoned",
+			data:    map[string]string{"range-dev": "192.168.0.10-192.168.0.20", "cidr-global": "192.168.1.200/29", CordonedPoolsKey: "range-dev, cidr-global"},
+			wantErr: ErrNoPoolConfigured,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("discoverAddress() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressPoolSelector(t *testing.T) {
+	data := map[string]string{
+		PoolSelectorKeyPrefix + "prod":    "tier in (frontend)",
+		PoolSelectorKeyPrefix + "edge":    "tier=frontend,edge",
+		PoolSelectorKeyPrefix + "empty":   "tier=batch",
+		PoolSelectorKeyPrefix + "invalid": "tier in (",
+		"cidr-prod":                       "192.168.1.200/29",
+		"cidr-edge":                       "192.168.2.200/29",
+		"cidr-global":                     "192.168.0.200/29",
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "matching", labels: map[string]string{"tier": "frontend"}, want: "192.168.1.201"},
+		{name: "several matching, by pool name", labels: map[string]string{"tier": "frontend", "edge": "true"}, want: "192.168.2.201"},
+		{name: "not matching", labels: map[string]string{"tier": "backend"}, want: "192.168.0.201"},
+		{name: "without labels", want: "192.168.0.201"},
+		{name: "matching pool without a cidr or range", labels: map[string]string{"tier": "batch"}, want: "192.168.0.201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Labels = tt.labels
+			got, err := discoverAddress(&v1.ConfigMap{Data: data}, svc, "", KubeVipClientConfig, "", nil)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressUseGlobalPool(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]string
+		annotation string
+		labels     map[string]string
+		want       string
+		wantErr    error
+	}{
+		{
+			name: "namespace pool",
+			data: map[string]string{"cidr-dev": "192.168.1.0/29", "cidr-global": "192.168.0.200/29"},
+			want: "192.168.1.1",
+		},
+		{
+			name:       "global cidr over a namespace pool with free addresses",
+			data:       map[string]string{"cidr-dev": "192.168.1.0/29", "cidr-global": "192.168.0.200/29"},
+			annotation: "true",
+			want:       "192.168.0.201",
+		},
+		{
+			name:       "global range over a namespace pool with free addresses",
+			data:       map[string]string{"range-dev": "192.168.1.10-192.168.1.20", "range-global": "192.168.0.10-192.168.0.20"},
+			annotation: "true",
+			want:       "192.168.0.10",
+		},
+		{
+			name:       "global pool over a selecting pool",
+			data:       map[string]string{PoolSelectorKeyPrefix + "prod": "tier=frontend", "cidr-prod": "192.168.2.0/29", "cidr-global": "192.168.0.200/29"},
+			annotation: "true",
+			labels:     map[string]string{"tier": "frontend"},
+			want:       "192.168.0.201",
+		},
+		{
+			name:       "not true",
+			data:       map[string]string{"cidr-dev": "192.168.1.0/29", "cidr-global": "192.168.0.200/29"},
+			annotation: "yes",
+			want:       "192.168.1.1",
+		},
+		{
+			name:       "no global pool",
+			data:       map[string]string{"cidr-dev": "192.168.1.0/29"},
+			annotation: "true",
+			wantErr:    ErrNoPoolConfigured,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Labels = tt.labels
+			if tt.annotation != "" {
+				svc.Annotations = map[string]string{UseGlobalPoolAnnotation: tt.annotation}
+			}
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, svc, "", KubeVipClientConfig, "", nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("discoverAddress() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressOctetParity(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		existing []string
+		want     string
+	}{
+		{
+			name: "even cidr",
+			data: map[string]string{"cidr-dev": "192.168.0.0/29", OctetParityKey: "even"},
+			want: "192.168.0.2",
+		},
+		{
+			name: "odd range",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20", OctetParityKey: "odd"},
+			want: "192.168.0.11",
+		},
+		{
+			name:     "no free even address",
+			data:     map[string]string{"range-dev": "192.168.0.10-192.168.0.12", OctetParityKey: "even"},
+			existing: []string{"192.168.0.10", "192.168.0.12"},
+			want:     "192.168.0.11",
+		},
+		{
+			name: "invalid parity",
+			data: map[string]string{"cidr-dev": "192.168.0.0/29", OctetParityKey: "second"},
+			want: "192.168.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", tt.existing)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressRangeDirection(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		existing []string
+		want     string
+	}{
+		{
+			name: "descending range",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20", RangeDirectionKey: RangeDirectionDescending},
+			want: "192.168.0.20",
+		},
+		{
+			name:     "descending cidr",
+			data:     map[string]string{"cidr-dev": "192.168.0.0/29", RangeDirectionKey: RangeDirectionDescending},
+			existing: []string{"192.168.0.6"},
+			want:     "192.168.0.5",
+		},
+		{
+			name: "ascending",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20", RangeDirectionKey: RangeDirectionAscending},
+			want: "192.168.0.10",
+		},
+		{
+			name: "invalid direction",
+			data: map[string]string{"range-dev": "192.168.0.10-192.168.0.20", RangeDirectionKey: "downwards"},
+			want: "192.168.0.10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", tt.existing)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressDefaultIPFamily(t *testing.T) {
+	ipv6 := v1.IPv6Protocol
+	tests := []struct {
+		name   string
+		data   map[string]string
+		family *v1.IPFamily
+		want   string
+	}{
+		{
+			name: "no default",
+			data: map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126"},
+			want: "192.168.0.5",
+		},
+		{
+			name: "IPv4 default",
+			data: map[string]string{"cidr-dev": "fd00::4/126,192.168.0.4/30", DefaultIPFamilyKey: "IPv4"},
+			want: "192.168.0.5",
+		},
+		{
+			name: "IPv6 default",
+			data: map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126", DefaultIPFamilyKey: "IPv6"},
+			want: "fd00::5",
+		},
+		{
+			name: "IPv4 default range",
+			data: map[string]string{"range-dev": "fd00::10-fd00::20,192.168.0.10-192.168.0.20", DefaultIPFamilyKey: "IPv4"},
+			want: "192.168.0.10",
+		},
+		{
+			name: "IPv6 default without an IPv6 pool",
+			data: map[string]string{"cidr-dev": "192.168.0.4/30", DefaultIPFamilyKey: "IPv6"},
+			want: "192.168.0.5",
+		},
+		{
+			name: "invalid default",
+			data: map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126", DefaultIPFamilyKey: "v6"},
+			want: "192.168.0.5",
+		},
+		{
+			name:   "family of the service",
+			data:   map[string]string{"cidr-dev": "192.168.0.4/30,fd00::4/126", DefaultIPFamilyKey: "IPv4"},
+			family: &ipv6,
+			want:   "fd00::5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Spec.IPFamily = tt.family
+			got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, svc, "", KubeVipClientConfig, "", nil)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressEmptyPool(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"empty", "", "192.168.1.1"},
+		{"whitespace only", "  \n", "192.168.1.1"},
+		{"valid", "192.168.0.0/29", "192.168.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			data := map[string]string{"cidr-dev": tt.value, "cidr-global": "192.168.1.0/29"}
+			got, err := discoverAddress(&v1.ConfigMap{Data: data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", nil)
+			if err != nil {
+				t.Fatalf("discoverAddress() error = %v", err)
+			}
+			if got.address != tt.want {
+				t.Errorf("discoverAddress() = %v, want %v", got.address, tt.want)
+			}
+		})
+	}
+
+	// An empty pool without a fallback isn't configured
+	ipam.Manager = nil
+	_, err := discoverAddress(&v1.ConfigMap{Data: map[string]string{"range-dev": " "}}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", nil)
+	if !errors.Is(err, ErrNoPoolConfigured) {
+		t.Errorf("discoverAddress() error = %v, want %v", err, ErrNoPoolConfigured)
+	}
+}
+
+func Test_discoverAddressReserveGateway(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		gateways []string
+		want     int
+	}{
+		{name: "/30", cidr: "192.168.0.0/30", gateways: []string{"192.168.0.1"}, want: 1},
+		{name: "/29", cidr: "192.168.0.8/29", gateways: []string{"192.168.0.9"}, want: 5},
+		{name: "/24", cidr: "192.168.1.0/24", gateways: []string{"192.168.1.1"}, want: 253},
+		{name: "several cidrs", cidr: "192.168.2.0/29,192.168.3.0/28", gateways: []string{"192.168.2.1", "192.168.3.1"}, want: 18},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			cm := &v1.ConfigMap{Data: map[string]string{"cidr-global": tt.cidr, ReserveGatewayKey: "true"}}
+			var existing []string
+			for {
+				got, err := discoverAddress(cm, newTestService("dev", "lb"), "", KubeVipClientConfig, "", existing)
+				if errors.Is(err, ipam.ErrNoAddressesAvailable) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("discoverAddress() error = %v", err)
+				}
+				for _, gateway := range tt.gateways {
+					if got.address == gateway {
+						t.Fatalf("discoverAddress() allocated the gateway [%s]", gateway)
+					}
+				}
+				existing = append(existing, got.address)
+			}
+			if len(existing) != tt.want {
+				t.Errorf("allocated addresses = %d, want %d", len(existing), tt.want)
+			}
+		})
+	}
+
+	// Without the key the gateway is allocated as normal
+	ipam.Manager = nil
+	got, err := discoverAddress(&v1.ConfigMap{Data: map[string]string{"cidr-global": "192.168.0.0/29"}}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", nil)
+	if err != nil || got.address != "192.168.0.1" {
+		t.Errorf("discoverAddress() = %v, %v, want 192.168.0.1", got, err)
+	}
+}
+
+func Test_discoverAddressRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		prefixA string
+		prefixB string
+	}{
+		{
+			name:    "cidrs",
+			data:    map[string]string{"cidr-dev": "192.168.0.0/28,192.168.1.0/28", MultiPoolKey: MultiPoolRoundRobin},
+			prefixA: "192.168.0.",
+			prefixB: "192.168.1.",
+		},
+		{
+			name:    "ranges",
+			data:    map[string]string{"range-dev": "192.168.0.10-192.168.0.20,192.168.1.10-192.168.1.20", MultiPoolKey: MultiPoolRoundRobin},
+			prefixA: "192.168.0.",
+			prefixB: "192.168.1.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			var existing []string
+			counts := map[string]int{}
+			for x := 0; x < 8; x++ {
+				got, err := discoverAddress(&v1.ConfigMap{Data: tt.data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", existing)
+				if err != nil {
+					t.Fatalf("discoverAddress() error = %v", err)
+				}
+				existing = append(existing, got.address)
+				switch {
+				case strings.HasPrefix(got.address, tt.prefixA):
+					counts[tt.prefixA]++
+				case strings.HasPrefix(got.address, tt.prefixB):
+					counts[tt.prefixB]++
+				}
+				// The pools never differ by more than one address
+				if diff := counts[tt.prefixA] - counts[tt.prefixB]; diff > 1 || diff < -1 {
+					t.Fatalf("allocation [%d] distribution = %v, want even", x+1, counts)
+				}
+			}
+			if counts[tt.prefixA] != 4 || counts[tt.prefixB] != 4 {
+				t.Errorf("distribution = %v, want 4 from each pool", counts)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerCordonedKeepsAddress(t *testing.T) {
+	ipam.Manager = nil
+	existing := newTestService("dev", "existing")
+	existing.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.10"}
+	existing.Spec.LoadBalancerIP = "192.168.0.10"
+	k := newTestLoadBalancer(map[string]string{"range-dev": "192.168.0.10-192.168.0.20", CordonedPoolsKey: "range-dev"}, existing)
+
+	if _, err := k.syncLoadBalancer(context.TODO(), existing); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), existing.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.10" {
+		t.Errorf("service from a cordoned pool changed address to %v", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_discoverAddressBestFit(t *testing.T) {
+	tests := []struct {
+		name      string
+		pool      map[string]string
+		selection string
+		want      []string
+	}{
+		{
+			name:      "first-fit cidrs",
+			pool:      map[string]string{"cidr-dev": "192.168.0.0/28,192.168.1.0/30,192.168.2.0/29"},
+			selection: PoolSelectionFirstFit,
+			want:      []string{"192.168.0.1", "192.168.0.2", "192.168.0.3", "192.168.0.4"},
+		},
+		{
+			name:      "best-fit cidrs",
+			pool:      map[string]string{"cidr-dev": "192.168.0.0/28,192.168.1.0/30,192.168.2.0/29"},
+			selection: PoolSelectionBestFit,
+			want:      []string{"192.168.1.1", "192.168.1.2", "192.168.2.1", "192.168.2.2"},
+		},
+		{
+			name: "without a selection",
+			pool: map[string]string{"range-dev": "192.168.0.10-192.168.0.20,192.168.1.10-192.168.1.11"},
+			want: []string{"192.168.0.10", "192.168.0.11", "192.168.0.12"},
+		},
+		{
+			name:      "best-fit ranges",
+			pool:      map[string]string{"range-dev": "192.168.0.10-192.168.0.20,192.168.1.10-192.168.1.11"},
+			selection: PoolSelectionBestFit,
+			want:      []string{"192.168.1.10", "192.168.1.11", "192.168.0.10"},
+		},
+		{
+			name:      "best-fit over round-robin",
+			pool:      map[string]string{"cidr-dev": "192.168.0.0/28,192.168.1.0/30", MultiPoolKey: MultiPoolRoundRobin},
+			selection: PoolSelectionBestFit,
+			want:      []string{"192.168.1.1", "192.168.1.2", "192.168.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			data := map[string]string{}
+			for key, value := range tt.pool {
+				data[key] = value
+			}
+			if tt.selection != "" {
+				data[PoolSelectionKey] = tt.selection
+			}
+			var existing []string
+			for _, want := range tt.want {
+				got, err := discoverAddress(&v1.ConfigMap{Data: data}, newTestService("dev", "lb"), "", KubeVipClientConfig, "", existing)
+				if err != nil {
+					t.Fatalf("discoverAddress() error = %v", err)
+				}
+				if got.address != want {
+					t.Fatalf("discoverAddress() = %v after %v, want %v", got.address, existing, want)
+				}
+				existing = append(existing, got.address)
+			}
+		})
+	}
+}
+
+func Test_discoverAddressHashed(t *testing.T) {
+	ipam.Manager = nil
+	cm := &v1.ConfigMap{Data: map[string]string{"cidr-dev": "fd00:1::/64", "cidr-strategy-dev": CidrStrategyHashed}}
+
+	first, err := discoverAddress(cm, newTestService("dev", "web"), "", KubeVipClientConfig, "", nil)
+	if err != nil {
+		t.Fatalf("discoverAddress() error = %v", err)
+	}
+	// A service keeps its address when it is recreated
+	again, err := discoverAddress(cm, newTestService("dev", "web"), "", KubeVipClientConfig, "", []string{"fd00:1::1"})
+	if err != nil {
+		t.Fatalf("discoverAddress() error = %v", err)
+	}
+	if again.address != first.address {
+		t.Errorf("discoverAddress() = %v, want %v", again.address, first.address)
+	}
+	if first.prefix != "fd00:1::/64" {
+		t.Errorf("discoverAddress() prefix = %v, want fd00:1::/64", first.prefix)
+	}
+	other, err := discoverAddress(cm, newTestService("dev", "api"), "", KubeVipClientConfig, "", []string{first.address})
+	if err != nil {
+		t.Fatalf("discoverAddress() error = %v", err)
+	}
+	if other.address == first.address {
+		t.Errorf("discoverAddress() gave two services the same address %v", other.address)
+	}
+}
+
+func Test_updateLoadBalancerPortChange(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+	}{
+		{
+			name: "plain pool",
+			data: map[string]string{"cidr-dev": "192.168.0.200/29"},
+		},
+		{
+			name: "pool generation",
+			data: map[string]string{"cidr-dev": "192.168.0.200/29", PoolGenerationKey: "1", PoolMigrationKey: "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			svc.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80}}
+			k := newTestLoadBalancer(tt.data, svc)
+			client := k.kubeClient.(*fake.Clientset)
+
+			if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", svc, nil); err != nil {
+				t.Fatalf("EnsureLoadBalancer() error = %v", err)
+			}
+			allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			client.ClearActions()
+
+			// Only the ports of the service change
+			allocated.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}}
+			if err := k.UpdateLoadBalancer(context.TODO(), "cluster", allocated, nil); err != nil {
+				t.Fatalf("UpdateLoadBalancer() error = %v", err)
+			}
+
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != allocated.Spec.LoadBalancerIP || got.Labels["ipam-address"] != allocated.Labels["ipam-address"] {
+				t.Errorf("UpdateLoadBalancer() moved the service from [%s] to [%s]", allocated.Spec.LoadBalancerIP, got.Spec.LoadBalancerIP)
+			}
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "update" {
+					t.Errorf("UpdateLoadBalancer() updated [%s] for a port change", action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
+
+func Test_paused(t *testing.T) {
+	ipam.Manager = nil
+
+	pending := newTestService("dev", "pending")
+	allocated := newTestService("dev", "allocated")
+	allocated.Spec.LoadBalancerIP = "192.168.0.202"
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.202"}
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29", PausedKey: "true"}, pending, allocated)
+	client := k.kubeClient.(*fake.Clientset)
+
+	// Pending services are requeued, allocated services are untouched
+	if _, err := k.syncLoadBalancer(context.TODO(), pending); !errors.Is(err, ErrPaused) {
+		t.Errorf("syncLoadBalancer() paused error = %v, want %v", err, ErrPaused)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), pending.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "" || got.Annotations[IPAMStatusAnnotation] != IPAMStatusPaused {
+		t.Errorf("paused service address = [%s] status = [%s], want no address and [%s]", got.Spec.LoadBalancerIP, got.Annotations[IPAMStatusAnnotation], IPAMStatusPaused)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), allocated); err != nil {
+		t.Errorf("syncLoadBalancer() allocated service error = %v", err)
+	}
+	// Nor are addresses pinned for a service preferring dual-stack
+	prefer := newTestService("dev", "prefer")
+	prefer.Annotations = map[string]string{IPFamilyPolicyAnnotation: IPFamilyPolicyPreferDualStack}
+	if _, err := k.kubeClient.CoreV1().Services("dev").Create(context.TODO(), prefer, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), prefer); !errors.Is(err, ErrPaused) {
+		t.Errorf("syncLoadBalancer() paused dual-stack error = %v, want %v", err, ErrPaused)
+	}
+	if got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), prefer.Name, metav1.GetOptions{}); got.Annotations[LoadBalancerIPsAnnotation] != "" {
+		t.Errorf("paused service pinned [%s]", got.Annotations[LoadBalancerIPsAnnotation])
+	}
+	if err := k.deleteLoadBalancer(context.TODO(), allocated); !errors.Is(err, ErrPaused) {
+		t.Errorf("deleteLoadBalancer() paused error = %v, want %v", err, ErrPaused)
+	}
+	if got, _ := testutil.GetGaugeMetricValue(pausedGauge); got != 1 {
+		t.Errorf("paused metric = %v, want 1", got)
+	}
+
+	// Unpause
+	cm, _ := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipClientConfig, metav1.GetOptions{})
+	delete(cm.Data, PausedKey)
+	if _, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to unpause: %v", err)
+	}
+	client.ClearActions()
+
+	if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+		t.Fatalf("syncLoadBalancer() unpaused error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), pending.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.201" {
+		t.Errorf("unpaused service address = [%s], want 192.168.0.201", got.Spec.LoadBalancerIP)
+	}
+	if _, ok := got.Annotations[IPAMStatusAnnotation]; ok {
+		t.Errorf("unpaused service still has [%s]", IPAMStatusAnnotation)
+	}
+	if err := k.deleteLoadBalancer(context.TODO(), allocated); err != nil {
+		t.Errorf("deleteLoadBalancer() unpaused error = %v", err)
+	}
+	if got, _ := testutil.GetGaugeMetricValue(pausedGauge); got != 0 {
+		t.Errorf("paused metric = %v, want 0", got)
+	}
+}
+
+func Test_avoidServiceAddresses(t *testing.T) {
+	tests := []struct {
+		name             string
+		avoidExternalIPs bool
+		avoidClusterIPs  bool
+		want             string
+	}{
+		{
+			name: "not avoided",
+			want: "192.168.0.201",
+		},
+		{
+			name:             "external IPs avoided",
+			avoidExternalIPs: true,
+			want:             "192.168.0.203",
+		},
+		{
+			name:            "cluster IPs avoided",
+			avoidClusterIPs: true,
+			want:            "192.168.0.202",
+		},
+		{
+			name:             "both avoided",
+			avoidExternalIPs: true,
+			avoidClusterIPs:  true,
+			want:             "192.168.0.203",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			// Services that aren't managed by kube-vip, in other namespaces
+			external := newTestService("other", "external")
+			external.Spec.Type = v1.ServiceTypeClusterIP
+			external.Spec.ExternalIPs = []string{"192.168.0.201", "192.168.0.202"}
+			clusterIP := newTestService("other", "cluster-ip")
+			clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+			clusterIP.Spec.ClusterIP = "192.168.0.201"
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc, external, clusterIP)
+			k.avoidExternalIPs = tt.avoidExternalIPs
+			k.avoidClusterIPs = tt.avoidClusterIPs
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+		})
+	}
+}
+
+func Test_warmPools(t *testing.T) {
+	ipam.Manager = nil
+	defer ipam.ResetWarm()
+
+	// A service in another namespace shares the global pool
+	other := newTestService("other", "lb")
+	other.Spec.LoadBalancerIP = "192.168.0.201"
+	other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc, other)
+	k.warmPools = &warmPools{}
+	k.warmStartup(context.TODO())
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if allocated.Spec.LoadBalancerIP != "192.168.0.202" {
+		t.Errorf("syncLoadBalancer() address = %v, want 192.168.0.202", allocated.Spec.LoadBalancerIP)
+	}
+
+	// The released address is allocated again
+	if err := k.deleteLoadBalancer(context.TODO(), allocated); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), svc.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	next := newTestService("dev", "next")
+	if _, err := k.kubeClient.CoreV1().Services("dev").Create(context.TODO(), next, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), next); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), next.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.202" {
+		t.Errorf("syncLoadBalancer() after release = %v, want 192.168.0.202", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_ingressHostname(t *testing.T) {
+	svc := newTestService("dev", "web")
+	tests := []struct {
+		name     string
+		template string
+		address  string
+		want     string
+	}{
+		{"dashed", "{ip-dashed}.lb.example.com", "192.168.0.10", "192-168-0-10.lb.example.com"},
+		{"dashed ipv6", "{ip-dashed}.lb.example.com", "fd00::10", "fd00--10.lb.example.com"},
+		{"service", "{name}.{namespace}.lb.example.com", "192.168.0.10", "web.dev.lb.example.com"},
+		{"no placeholders", "lb.example.com", "192.168.0.10", "lb.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ingressHostname(tt.template, svc, tt.address); got != tt.want {
+				t.Errorf("ingressHostname() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want []v1.LoadBalancerIngress
+	}{
+		{
+			name: "no template",
+			data: map[string]string{"cidr-global": "192.168.0.200/29"},
+		},
+		{
+			name: "hostname and address",
+			data: map[string]string{"cidr-global": "192.168.0.200/29", HostnameTemplateKey: "{ip-dashed}.lb.example.com"},
+			want: []v1.LoadBalancerIngress{{IP: "192.168.0.201", Hostname: "192-168-0-201.lb.example.com"}},
+		},
+		{
+			name: "hostname only",
+			data: map[string]string{"cidr-global": "192.168.0.200/29", HostnameTemplateKey: "{ip-dashed}.lb.example.com", HostnameOnlyKey: "true"},
+			want: []v1.LoadBalancerIngress{{Hostname: "192-168-0-201.lb.example.com"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			k := newTestLoadBalancer(tt.data, svc)
+
+			status, err := k.syncLoadBalancer(context.TODO(), svc)
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			if !reflect.DeepEqual(status.Ingress, tt.want) {
+				t.Errorf("syncLoadBalancer() ingress = %v, want %v", status.Ingress, tt.want)
+			}
+
+			// The hostname is kept once the service controller has written the status
+			allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			allocated.Status.LoadBalancer = *status
+			status, err = k.syncLoadBalancer(context.TODO(), allocated)
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			if !reflect.DeepEqual(status.Ingress, tt.want) {
+				t.Errorf("syncLoadBalancer() allocated ingress = %v, want %v", status.Ingress, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerRequestedAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		data    map[string]string
+		wantErr bool
+	}{
+		{"network address", "192.168.0.0", map[string]string{"cidr-dev": "192.168.0.0/24"}, true},
+		{"broadcast address", "192.168.0.255", map[string]string{"cidr-dev": "192.168.0.0/24"}, true},
+		{"valid host", "192.168.0.10", map[string]string{"cidr-dev": "192.168.0.0/24"}, false},
+		{"network address allowed", "192.168.0.0", map[string]string{"cidr-dev": "192.168.0.0/24", AllowNetworkAddressKey: "true"}, false},
+		{"outside the pools", "10.0.0.0", map[string]string{"cidr-dev": "192.168.0.0/24"}, false},
+		{"point to point", "192.168.0.0", map[string]string{"cidr-dev": "192.168.0.0/31"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService("dev", "static")
+			svc.Spec.LoadBalancerIP = tt.address
+			k := newTestLoadBalancer(tt.data, svc)
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("syncLoadBalancer() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidAddress) {
+				t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrInvalidAddress)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Annotations[IPAMStatusAnnotation] != IPAMStatusInvalidAddress {
+				t.Errorf("service status = %v, want %v", got.Annotations[IPAMStatusAnnotation], IPAMStatusInvalidAddress)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, ReasonInvalidAddress) {
+					t.Errorf("event = %v, want %v", event, ReasonInvalidAddress)
+				}
+			default:
+				t.Errorf("no event explaining the rejected address")
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerCompatAnnotation(t *testing.T) {
+	for _, compat := range []string{"", "metallb.universe.tf/loadBalancerIPs"} {
+		t.Run(compat, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", "lb")
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc)
+			k.compatAnnotation = compat
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Annotations[LoadBalancerIPsAnnotation] != "192.168.0.201" {
+				t.Errorf("annotation [%s] = %v, want 192.168.0.201", LoadBalancerIPsAnnotation, got.Annotations[LoadBalancerIPsAnnotation])
+			}
+			if compat == "" {
+				if _, ok := got.Annotations["metallb.universe.tf/loadBalancerIPs"]; ok {
+					t.Errorf("compatibility annotation set while disabled, annotations = %v", got.Annotations)
+				}
+				return
+			}
+			if got.Annotations[compat] != "192.168.0.201" {
+				t.Errorf("annotation [%s] = %v, want 192.168.0.201", compat, got.Annotations[compat])
+			}
+		})
+	}
+}
+
+func Test_reservationTTL(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "static")
+	svc.Annotations = map[string]string{ReservationTTLAnnotation: "10m"}
+	svc.Spec.LoadBalancerIP = "192.168.1.10"
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	sync := func() (*v1.Service, error) {
+		current, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+		_, err := k.syncLoadBalancer(context.TODO(), current)
+		got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+		return got, err
+	}
+
+	// The pending reservation is stamped, and kept until the TTL has passed
+	got, err := sync()
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got.Annotations[ReservedAtAnnotation] != "2021-01-01T00:00:00Z" {
+		t.Errorf("annotation [%s] = %v, want 2021-01-01T00:00:00Z", ReservedAtAnnotation, got.Annotations[ReservedAtAnnotation])
+	}
+	fakeClock.Step(9 * time.Minute)
+	if got, err = sync(); err != nil || got.Spec.LoadBalancerIP != "192.168.1.10" {
+		t.Fatalf("syncLoadBalancer() before the TTL = %v, %v, want the reservation kept", got.Spec.LoadBalancerIP, err)
+	}
+
+	// Crossing the TTL releases the address and requeues the service
+	fakeClock.Step(2 * time.Minute)
+	got, err = sync()
+	if !errors.Is(err, ErrReservationExpired) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrReservationExpired)
+	}
+	if got.Spec.LoadBalancerIP != "" {
+		t.Errorf("syncLoadBalancer() address = %v, want the reservation released", got.Spec.LoadBalancerIP)
+	}
+	if got, err = sync(); err != nil || got.Spec.LoadBalancerIP != "192.168.0.201" {
+		t.Errorf("syncLoadBalancer() after requeue = %v, %v, want 192.168.0.201", got.Spec.LoadBalancerIP, err)
+	}
+}
+
+func Test_reservationTTLNotPending(t *testing.T) {
+	svc := newTestService("dev", "static")
+	svc.Annotations = map[string]string{ReservationTTLAnnotation: "10m", ReservedAtAnnotation: "2021-01-01T00:00:00Z"}
+	svc.Spec.LoadBalancerIP = "192.168.1.10"
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+	k := newTestLoadBalancer(nil, svc)
+	k.clock = clock.NewFakeClock(time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC))
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.1.10" {
+		t.Errorf("address of a service with an ingress was released")
+	}
+	if _, ok := got.Annotations[ReservedAtAnnotation]; ok {
+		t.Errorf("annotation [%s] wasn't removed once the service had an ingress", ReservedAtAnnotation)
+	}
+}
+
+func Test_ignoreAnnotation(t *testing.T) {
+	ipam.Manager = nil
+	pending := newTestService("dev", "pending")
+	pending.Annotations = map[string]string{IgnoreAnnotation: "true"}
+	allocated := newTestService("dev", "allocated")
+	allocated.Annotations = map[string]string{IgnoreAnnotation: "true"}
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.1"}
+	allocated.Spec.LoadBalancerIP = "192.168.0.2"
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, pending, allocated)
+	client := k.kubeClient.(*fake.Clientset)
+	recorder := k.recorder.(*record.FakeRecorder)
+	client.ClearActions()
+
+	// Neither the pending nor the drifted service is touched, and no address is released on deletion
+	for _, svc := range []*v1.Service{pending, allocated} {
+		if _, err := k.EnsureLoadBalancer(context.TODO(), "", svc, nil); err != nil {
+			t.Fatalf("EnsureLoadBalancer() error = %v", err)
+		}
+		if err := k.UpdateLoadBalancer(context.TODO(), "", svc, nil); err != nil {
+			t.Fatalf("UpdateLoadBalancer() error = %v", err)
+		}
+		if err := k.EnsureLoadBalancerDeleted(context.TODO(), "", svc); err != nil {
+			t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+		}
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("ignored services made API calls %v, want none", actions)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("ignored services emitted [%d] events, want none", len(recorder.Events))
+	}
+	if got := k.allocations.list(); len(got) != 0 {
+		t.Errorf("allocations = %v, want none", got)
+	}
+	if got := k.freed.recent(time.Now(), time.Hour); len(got) != 0 {
+		t.Errorf("released addresses = %v, want none", got)
+	}
+}
+
+func Test_ownership(t *testing.T) {
+	ipam.Manager = nil
+	fresh := newTestService("dev", "fresh")
+	foreign := newTestService("dev", "foreign")
+	foreign.Annotations = map[string]string{OwnedByAnnotation: "provider-b"}
+	foreign.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.2"}
+	foreign.Spec.LoadBalancerIP = "192.168.0.2"
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, fresh, foreign)
+	k.instanceID = "provider-a"
+	k.enforceOwnership = true
+	client := k.kubeClient.(*fake.Clientset)
+
+	// A service allocated by this instance is stamped with it
+	if _, err := k.syncLoadBalancer(context.TODO(), fresh); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), fresh.Name, metav1.GetOptions{})
+	if got.Annotations[OwnedByAnnotation] != "provider-a" {
+		t.Errorf("annotation [%s] = %q, want provider-a", OwnedByAnnotation, got.Annotations[OwnedByAnnotation])
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), got); err != nil {
+		t.Fatalf("syncLoadBalancer() of an owned service error = %v", err)
+	}
+
+	// A service owned by another instance isn't touched, and its address isn't released
+	client.ClearActions()
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "", foreign, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if err := k.EnsureLoadBalancerDeleted(context.TODO(), "", foreign); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("foreign-owned service made API calls %v, want none", actions)
+	}
+	if got := k.freed.recent(time.Now(), time.Hour); len(got) != 0 {
+		t.Errorf("released addresses = %v, want none", got)
+	}
+
+	if got := len(k.allocations.list()); got != 1 {
+		t.Errorf("allocations = %d, want only the owned service", got)
+	}
+
+	// Without enforcement the service is reconciled
+	k.enforceOwnership = false
+	if _, err := k.syncLoadBalancer(context.TODO(), foreign); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := len(k.allocations.list()); got != 2 {
+		t.Errorf("allocations = %d, want both services", got)
+	}
+}
+
+func Test_syncLoadBalancerNotLoadBalancer(t *testing.T) {
+	ipam.Manager = nil
+	externalName := newTestService("dev", "external")
+	externalName.Spec.Type = v1.ServiceTypeExternalName
+	externalName.Spec.ExternalName = "db.example.com"
+	headless := newTestService("dev", "headless")
+	headless.Spec.Type = v1.ServiceTypeClusterIP
+	headless.Spec.ClusterIP = v1.ClusterIPNone
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, externalName, headless)
+	client := k.kubeClient.(*fake.Clientset)
+	recorder := k.recorder.(*record.FakeRecorder)
+	client.ClearActions()
+
+	for _, svc := range []*v1.Service{externalName, headless} {
+		status, err := k.EnsureLoadBalancer(context.TODO(), "", svc, nil)
+		if err != nil {
+			t.Fatalf("EnsureLoadBalancer(%s) error = %v", svc.Name, err)
+		}
+		if len(status.Ingress) != 0 {
+			t.Errorf("EnsureLoadBalancer(%s) status = %+v, want no ingress", svc.Name, status)
+		}
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("services that aren't load balancers made API calls %v, want none", actions)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("services that aren't load balancers emitted [%d] events, want none", len(recorder.Events))
+	}
+	if got := k.allocations.list(); len(got) != 0 {
+		t.Errorf("allocations = %v, want none", got)
+	}
+}
+
+func Test_syncLoadBalancerFirstInNamespace(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("dev", "first")
+	first.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	first.Spec.LoadBalancerIP = "192.168.0.201"
+	second := newTestService("staging", "second")
+	second.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.202"}
+	second.Spec.LoadBalancerIP = "192.168.0.202"
+	svc := newTestService("prod", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, first, second, svc)
+	// Only the labels of the services in other namespaces show the addresses are in use
+	k.reserveStatic = false
+
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("prod").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.203" {
+		t.Errorf("first service in namespace [prod] allocated %q from the global pool, want 192.168.0.203", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_syncLoadBalancerScanTimeout(t *testing.T) {
+	ipam.Manager = nil
+	defer func(timeout time.Duration) { ScanTimeout = timeout }(ScanTimeout)
+	ScanTimeout = time.Nanosecond
+
+	// The first 1100 hosts of the pool are in use, so the scan checks its deadline before finding one
+	var objects []runtime.Object
+	for x := 0; x < 1100; x++ {
+		address := fmt.Sprintf("10.0.%d.%d", (x+1)/256, (x+1)%256)
+		svc := newTestService("dev", fmt.Sprintf("svc-%d", x))
+		svc.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": address}
+		svc.Spec.LoadBalancerIP = address
+		objects = append(objects, svc)
+	}
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "10.0.0.0/20"}, append(objects, svc)...)
+
+	_, err := k.syncLoadBalancer(context.TODO(), svc)
+	if !errors.Is(err, ipam.ErrScanTimeout) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ipam.ErrScanTimeout)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if status, ok := got.Annotations[IPAMStatusAnnotation]; ok {
+		t.Errorf("annotation [%s] = %q, a timed out scan is retried rather than failed", IPAMStatusAnnotation, status)
+	}
+
+	// Without the timeout the requeued service is allocated the first free host
+	ScanTimeout = 0
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "10.0.4.77" {
+		t.Errorf("address = %v, want 10.0.4.77", got.Spec.LoadBalancerIP)
+	}
+}
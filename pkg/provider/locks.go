@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// allocationLock serialises allocations from the same pools. The addresses in use are read across the cluster and the
+// global and environment pools are shared by namespaces, so allocations from a pool in different namespaces could
+// otherwise be given the same address. Allocations from unrelated pools proceed concurrently
+type allocationLock struct {
+	// all is held for reading with the pool locks, and for writing by changes that aren't confined to known pools
+	all sync.RWMutex
+
+	mu    sync.Mutex
+	pools map[string]*sync.Mutex
+}
+
+// lock will block until no other allocation is in progress, for changes whose pools aren't known up front. The
+// returned function releases it and can be called more than once, i.e. to release the lock early with a deferred
+// release as well
+func (a *allocationLock) lock() func() {
+	a.all.Lock()
+	var once sync.Once
+	return func() { once.Do(a.all.Unlock) }
+}
+
+// lockPools will block until no other allocation from the pools is in progress, the pools are locked in order so
+// allocations sharing some of them can't deadlock. The returned function releases them and can be called more than once
+func (a *allocationLock) lockPools(pools []string) func() {
+	sorted := append([]string(nil), pools...)
+	sort.Strings(sorted)
+	var held []*sync.Mutex
+	a.all.RLock()
+	for x, pool := range sorted {
+		if x > 0 && pool == sorted[x-1] {
+			continue
+		}
+		l := a.pool(pool)
+		l.Lock()
+		held = append(held, l)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for x := len(held) - 1; x >= 0; x-- {
+				held[x].Unlock()
+			}
+			a.all.RUnlock()
+		})
+	}
+}
+
+// pool returns the lock of the pool, creating it the first time
+func (a *allocationLock) pool(pool string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pools == nil {
+		a.pools = make(map[string]*sync.Mutex)
+	}
+	l, ok := a.pools[pool]
+	if !ok {
+		l = &sync.Mutex{}
+		a.pools[pool] = l
+	}
+	return l
+}
+
+// lockAllocation locks the pools the service can be allocated from, or every pool if they aren't known up front
+func (k *kubevipLoadBalancerManager) lockAllocation(cm *v1.ConfigMap, service *v1.Service, environment string) func() {
+	pools, ok := poolLocks(cm, service, environment, k.keyPrefix)
+	if !ok {
+		return k.allocationLock.lock()
+	}
+	return k.allocationLock.lockPools(pools)
+}
+
+// poolLocks returns the locks of every configured pool that discoverAddress could allocate the service an address from, pools
+// whose addresses overlap share the lock of the first of them. ok is false if the node network is a fallback, its
+// addresses aren't known until the nodes are listed
+func poolLocks(cm *v1.ConfigMap, service *v1.Service, environment, keyPrefix string) (locks []string, ok bool) {
+	if nodeCidrEnabled(cm) {
+		return nil, false
+	}
+
+	var pools []string
+	if service.Annotations[UseGlobalPoolAnnotation] == "true" {
+		pools = append(pools, "global")
+	} else {
+		// The selectors are warned about when the address is discovered
+		selectorPools, selectors, _ := poolSelectors(cm, keyPrefix)
+		for _, pool := range selectorPools {
+			if selectors[pool].Matches(labels.Set(service.Labels)) {
+				pools = append(pools, pool)
+			}
+		}
+		for _, tier := range fallbackOrder(cm) {
+			switch tier {
+			case TierNamespace:
+				pools = append(pools, service.Namespace)
+			case TierEnvironment:
+				if environment != "" {
+					pools = append(pools, "env-"+environment)
+				}
+			case TierGlobal:
+				pools = append(pools, "global")
+			}
+		}
+	}
+
+	// A pool without a key can't be allocated from, every namespace falls back to the global pool whether it is
+	// configured or not
+	var keys []string
+	for _, pool := range pools {
+		for _, allocator := range allocators {
+			if key := keyPrefix + allocator.Kind() + "-" + pool; cm.Data[key] != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if serviceOffsetEnabled(cm) {
+		keys = append(keys, ServiceOffsetCidrKey)
+	}
+	groups := overlapGroups(poolBounds(cm, keyPrefix))
+	for _, key := range keys {
+		if group, ok := groups[key]; ok {
+			key = group
+		}
+		locks = append(locks, key)
+	}
+	return locks, true
+}
+
+// overlapGroups returns the first key (in order) of the group of overlapping pools that each pool belongs to
+func overlapGroups(keys []string, bounds map[string][]ipam.Bounds, _ []error) map[string]string {
+	groups := make(map[string]string, len(keys))
+	for _, key := range keys {
+		groups[key] = key
+	}
+	// A pool overlapping two groups joins them, the later group is moved into the earlier one
+	for x := range keys {
+		for _, other := range keys[x+1:] {
+			if _, ok := overlapping(bounds[keys[x]], bounds[other]); !ok || groups[keys[x]] == groups[other] {
+				continue
+			}
+			from, into := groups[other], groups[keys[x]]
+			if from < into {
+				from, into = into, from
+			}
+			for key, group := range groups {
+				if group == from {
+					groups[key] = into
+				}
+			}
+		}
+	}
+	return groups
+}
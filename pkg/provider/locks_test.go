@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// blocks reports whether lock waits for the held lock, the lock is released once it is taken
+func blocks(lock func() func()) bool {
+	locked := make(chan func())
+	go func() { locked <- lock() }()
+	select {
+	case unlock := <-locked:
+		unlock()
+		return false
+	case <-time.After(50 * time.Millisecond):
+		// The lock is taken once the held lock is released
+		go func() { (<-locked)() }()
+		return true
+	}
+}
+
+// slowList is a client whose service lists return late. A reactor of the fake client can't delay them, the reactors
+// of every request are run under a single lock
+type slowList struct{ kubernetes.Interface }
+
+func (c slowList) CoreV1() corev1.CoreV1Interface { return slowListCore{c.Interface.CoreV1()} }
+
+type slowListCore struct{ corev1.CoreV1Interface }
+
+func (c slowListCore) Services(namespace string) corev1.ServiceInterface {
+	return slowListServices{c.CoreV1Interface.Services(namespace)}
+}
+
+type slowListServices struct{ corev1.ServiceInterface }
+
+func (s slowListServices) List(ctx context.Context, opts metav1.ListOptions) (*v1.ServiceList, error) {
+	list, err := s.ServiceInterface.List(ctx, opts)
+	time.Sleep(5 * time.Millisecond)
+	return list, err
+}
+
+func Test_allocationLock(t *testing.T) {
+	a := &allocationLock{}
+
+	unlock := a.lockPools([]string{"cidr-dev", "cidr-global"})
+	if blocks(func() func() { return a.lockPools([]string{"cidr-staging"}) }) {
+		t.Errorf("lockPools() blocked on an unrelated pool")
+	}
+	if !blocks(func() func() { return a.lockPools([]string{"cidr-staging", "cidr-global"}) }) {
+		t.Errorf("lockPools() didn't block on a shared pool")
+	}
+	if !blocks(a.lock) {
+		t.Errorf("lock() didn't block while a pool was held")
+	}
+	unlock()
+	unlock()
+
+	unlock = a.lock()
+	if !blocks(func() func() { return a.lockPools([]string{"cidr-staging"}) }) {
+		t.Errorf("lockPools() didn't block while every pool was held")
+	}
+	unlock()
+
+	// A pool listed twice is only locked once
+	a.lockPools([]string{"cidr-dev", "cidr-dev"})()
+}
+
+func Test_poolLocks(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		annotations map[string]string
+		environment string
+		want        []string
+		wantOK      bool
+	}{
+		{
+			name:   "namespace and global",
+			data:   map[string]string{"cidr-dev": "192.168.0.0/29", "cidr-global": "192.168.1.0/29"},
+			want:   []string{"cidr-dev", "cidr-global"},
+			wantOK: true,
+		},
+		{
+			name:        "environment",
+			data:        map[string]string{"cidr-dev": "192.168.0.0/29", "range-env-prod": "192.168.1.1-192.168.1.5", FallbackOrderKey: "namespace,env,global"},
+			environment: "prod",
+			want:        []string{"cidr-dev", "range-env-prod"},
+			wantOK:      true,
+		},
+		{
+			name:        "global pool annotation",
+			data:        map[string]string{"cidr-dev": "192.168.0.0/29", "list-global": "192.168.1.1,192.168.1.2"},
+			annotations: map[string]string{UseGlobalPoolAnnotation: "true"},
+			want:        []string{"list-global"},
+			wantOK:      true,
+		},
+		{
+			name:   "overlapping pools share a lock",
+			data:   map[string]string{"cidr-dev": "192.168.0.0/28", "range-global": "192.168.0.8-192.168.0.20"},
+			want:   []string{"cidr-dev", "cidr-dev"},
+			wantOK: true,
+		},
+		{
+			name: "node network",
+			data: map[string]string{"cidr-dev": "192.168.0.0/29", NodeCidrKey: "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &v1.ConfigMap{Data: tt.data}
+			svc := newTestService("dev", "web")
+			svc.Annotations = tt.annotations
+			got, ok := poolLocks(cm, svc, tt.environment, "")
+			if ok != tt.wantOK {
+				t.Fatalf("poolLocks() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("poolLocks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerConcurrentOverlap(t *testing.T) {
+	ipam.Manager = nil
+
+	var services []*v1.Service
+	var objects []runtime.Object
+	for _, namespace := range []string{"dev", "staging"} {
+		for x := 0; x < 6; x++ {
+			svc := newTestService(namespace, fmt.Sprintf("svc-%d", x))
+			services = append(services, svc)
+			objects = append(objects, svc)
+		}
+	}
+	// The pools of the namespaces share their addresses
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-dev":      "192.168.0.0/28",
+		"range-staging": "192.168.0.1-192.168.0.14",
+	}, objects...)
+	// Listing the addresses in use is slowed down, so allocations that aren't serialised read the same addresses
+	k.kubeClient = slowList{k.kubeClient}
+
+	var wg sync.WaitGroup
+	for x := range services {
+		wg.Add(1)
+		go func(svc *v1.Service) {
+			defer wg.Done()
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Errorf("syncLoadBalancer() error = %v", err)
+			}
+		}(services[x])
+	}
+	wg.Wait()
+
+	assigned := map[string]string{}
+	for _, namespace := range []string{"dev", "staging"} {
+		svcs, err := k.kubeClient.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, svc := range svcs.Items {
+			ip := svc.Spec.LoadBalancerIP
+			if ip == "" {
+				t.Errorf("service [%s/%s] was not assigned an address", namespace, svc.Name)
+				continue
+			}
+			if other, ok := assigned[ip]; ok {
+				t.Errorf("address [%s] assigned to both [%s] and [%s/%s]", ip, other, namespace, svc.Name)
+			}
+			assigned[ip] = namespace + "/" + svc.Name
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	metricsNamespace = "kube_vip"
+	metricsSubsystem = "cloud_provider"
+)
+
+var (
+	// allocationsGauge is the number of services with an address in each namespace, by where the address came from
+	allocationsGauge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "allocated_addresses",
+		Help:           "Number of services with a load balancer address, by namespace and source (static, dynamic or reserved)",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace", "source"})
+
+	// allocationsCounter is the number of addresses observed or allocated, by where the address came from
+	allocationsCounter = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "allocations_total",
+		Help:           "Number of load balancer addresses given to services, by source (static, dynamic or reserved)",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"source"})
+
+	// serviceAddressesGauge is the number of addresses each service holds, two for a dual-stack service
+	serviceAddressesGauge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "service_addresses",
+		Help:           "Number of load balancer addresses held by a service, by namespace and service",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace", "service"})
+
+	// quotaGauge is the configured max-allocations of each namespace with a quota
+	quotaGauge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "namespace_quota",
+		Help:           "Maximum number of load balancer addresses of the namespace, by namespace",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace"})
+
+	// quotaUsedGauge is the number of addresses used by each namespace with a quota
+	quotaUsedGauge = metrics.NewGaugeVec(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "namespace_quota_used",
+		Help:           "Number of load balancer addresses used by a namespace with a quota, by namespace",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace"})
+
+	// scannedHistogram is the number of addresses examined by each scan of a pool, by whether a free one was found
+	scannedHistogram = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "scanned_addresses",
+		Help:           "Number of addresses examined to find a free one, by result (found or exhausted)",
+		Buckets:        metrics.ExponentialBuckets(1, 4, 9),
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"result"})
+
+	// allocationScanHistogram is the time taken to allocate an address from a pool, by the size bucket of the pool
+	allocationScanHistogram = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "allocation_scan_duration_seconds",
+		Help:           "Time taken to allocate an address from a pool, by pool size (<=/24, /23-/20 or >/20 addresses)",
+		Buckets:        metrics.ExponentialBuckets(0.0001, 4, 9),
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"pool_size"})
+
+	// requestedAddressesHistogram is the number of addresses requested by each allocation, two for a dual-stack request
+	requestedAddressesHistogram = metrics.NewHistogram(&metrics.HistogramOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "requested_addresses",
+		Help:           "Number of load balancer addresses requested by an allocation, one or one of each family",
+		Buckets:        metrics.LinearBuckets(1, 1, 4),
+		StabilityLevel: metrics.ALPHA,
+	})
+
+	// pausedGauge is 1 while allocation is paused
+	pausedGauge = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Subsystem:      metricsSubsystem,
+		Name:           "paused",
+		Help:           "Whether allocation and release are paused (1) or not (0)",
+		StabilityLevel: metrics.ALPHA,
+	})
+)
+
+func init() {
+	// The cloud-controller-manager serves the legacy registry on /metrics
+	legacyregistry.MustRegister(allocationsGauge)
+	legacyregistry.MustRegister(allocationsCounter)
+	legacyregistry.MustRegister(serviceAddressesGauge)
+	legacyregistry.MustRegister(requestedAddressesHistogram)
+	legacyregistry.MustRegister(pausedGauge)
+	legacyregistry.MustRegister(quotaGauge)
+	legacyregistry.MustRegister(quotaUsedGauge)
+	legacyregistry.MustRegister(scannedHistogram)
+	legacyregistry.MustRegister(allocationScanHistogram)
+
+	ipam.ScanObserver = observeScan
+}
+
+// observeScan records the number of addresses examined by a scan of a pool
+func observeScan(scanned int, found bool) {
+	result := "found"
+	if !found {
+		result = "exhausted"
+	}
+	scannedHistogram.WithLabelValues(result).Observe(float64(scanned))
+}
+
+// Pool size buckets, by the number of addresses of an IPv4 prefix
+const (
+	poolSizeSmall  = "<=/24"
+	poolSizeMedium = "/23-/20"
+	poolSizeLarge  = ">/20"
+)
+
+// poolSizeBucket returns the size bucket of the pool, a pool of several cidrs or ranges is bucketed by the total of
+// their addresses
+func poolSizeBucket(bounds []ipam.Bounds) string {
+	size := new(big.Int)
+	for _, b := range bounds {
+		size.Add(size, b.Size())
+	}
+	switch {
+	case size.Cmp(big.NewInt(1<<8)) <= 0:
+		return poolSizeSmall
+	case size.Cmp(big.NewInt(1<<12)) <= 0:
+		return poolSizeMedium
+	}
+	return poolSizeLarge
+}
+
+// observeAllocationScan records the time taken to allocate an address from the pool definition, a definition that
+// can't be parsed isn't recorded
+func observeAllocationScan(allocator Allocator, definition string, took time.Duration) {
+	bounds, err := allocator.Bounds(definition)
+	if err != nil {
+		return
+	}
+	allocationScanHistogram.WithLabelValues(poolSizeBucket(bounds)).Observe(took.Seconds())
+}
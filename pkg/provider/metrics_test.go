@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func Test_poolSizeBucket(t *testing.T) {
+	tests := []struct {
+		kind       string
+		definition string
+		want       string
+	}{
+		{"cidr", "192.168.0.0/24", poolSizeSmall},
+		{"range", "192.168.0.10-192.168.0.20", poolSizeSmall},
+		{"list", "192.168.0.10,192.168.0.20", poolSizeSmall},
+		{"cidr", "192.168.0.0/23", poolSizeMedium},
+		{"cidr", "192.168.0.0/24,192.168.1.0/24", poolSizeMedium},
+		{"cidr", "10.0.0.0/20", poolSizeMedium},
+		{"range", "10.0.0.0-10.0.16.0", poolSizeLarge},
+		{"cidr", "10.0.0.0/19", poolSizeLarge},
+		{"cidr", "fd00::/64", poolSizeLarge},
+	}
+	for _, tt := range tests {
+		bounds, err := allocatorFor(tt.kind).Bounds(tt.definition)
+		if err != nil {
+			t.Fatalf("Bounds(%s) error = %v", tt.definition, err)
+		}
+		if got := poolSizeBucket(bounds); got != tt.want {
+			t.Errorf("poolSizeBucket(%s) = %s, want %s", tt.definition, got, tt.want)
+		}
+	}
+}
+
+func Test_observeAllocationScan(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/22"}, svc)
+
+	before := make(map[string]float64)
+	for _, bucket := range []string{poolSizeSmall, poolSizeMedium, poolSizeLarge} {
+		before[bucket], _ = testutil.GetHistogramMetricValue(allocationScanHistogram.WithLabelValues(bucket))
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	// The scan of the /22 is recorded in the /23-/20 bucket only
+	for bucket, sum := range before {
+		after, _ := testutil.GetHistogramMetricValue(allocationScanHistogram.WithLabelValues(bucket))
+		if recorded := after > sum; recorded != (bucket == poolSizeMedium) {
+			t.Errorf("bucket [%s] recorded = %v, want %v", bucket, recorded, bucket == poolSizeMedium)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+//LoadBalancerIPsAnnotation records the address of a service, replacing the deprecated spec.loadBalancerIP
+const LoadBalancerIPsAnnotation = "kube-vip.io/loadbalancerIPs"
+
+// CompatAnnotation is an annotation of another load balancer (i.e. metallb.universe.tf/loadBalancerIPs) that also
+// records the address of a service, for tools that expect that convention. It is disabled if empty
+var CompatAnnotation string
+
+// annotateAddress records the allocated address in the annotations of a service
+func (k *kubevipLoadBalancerManager) annotateAddress(annotations map[string]string, address string) {
+	annotations[LoadBalancerIPsAnnotation] = address
+	if k.compatAnnotation != "" {
+		annotations[k.compatAnnotation] = address
+	}
+}
+
+// Migration - is a service whose spec.loadBalancerIP is copied into the annotation
+type Migration struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+}
+
+// needsMigration returns true if the spec.loadBalancerIP of the service isn't recorded in the annotation and label
+func needsMigration(service *v1.Service) bool {
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || service.Spec.LoadBalancerIP == "" {
+		return false
+	}
+	return service.Annotations[LoadBalancerIPsAnnotation] != service.Spec.LoadBalancerIP ||
+		service.Labels["implementation"] != "kube-vip" ||
+		service.Labels["ipam-address"] != service.Spec.LoadBalancerIP
+}
+
+// MigrateLoadBalancerIPs - copies the spec.loadBalancerIP of every load balancer service in the cluster into the
+// annotation and the ipam-address label, the address of the service is unchanged. Services are migrated in namespace
+// and name order, with dryRun the services that
+// would be migrated are returned without being updated
+func MigrateLoadBalancerIPs(ctx context.Context, client kubernetes.Interface, dryRun bool) ([]Migration, error) {
+	svcs, err := client.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(svcs.Items, func(i, j int) bool {
+		if svcs.Items[i].Namespace != svcs.Items[j].Namespace {
+			return svcs.Items[i].Namespace < svcs.Items[j].Namespace
+		}
+		return svcs.Items[i].Name < svcs.Items[j].Name
+	})
+
+	var migrations []Migration
+	for x := range svcs.Items {
+		service := &svcs.Items[x]
+		if !needsMigration(service) {
+			continue
+		}
+		m := Migration{Namespace: service.Namespace, Name: service.Name, Address: service.Spec.LoadBalancerIP}
+		if !dryRun {
+			if err := migrateService(ctx, client, service.Namespace, service.Name); err != nil {
+				return migrations, fmt.Errorf("unable to migrate service [%s/%s]: %v", service.Namespace, service.Name, err)
+			}
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// migrateService records the spec.loadBalancerIP of the service in the annotation and labels
+func migrateService(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		// The address may have been removed since the services were listed
+		if !needsMigration(recentService) {
+			return nil
+		}
+		address := recentService.Spec.LoadBalancerIP
+
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		recentService.Annotations[LoadBalancerIPsAnnotation] = address
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		recentService.Labels["implementation"] = "kube-vip"
+		recentService.Labels["ipam-address"] = address
+
+		_, updateErr := client.CoreV1().Services(namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
+
+// WriteMigrations - writes the migrated services as a table, or as JSON
+func WriteMigrations(w io.Writer, migrations []Migration, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(migrations)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tADDRESS")
+	for _, m := range migrations {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.Namespace, m.Name, m.Address)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMigrateLoadBalancerIPs(t *testing.T) {
+	legacy := newTestService("dev", "legacy")
+	legacy.Spec.LoadBalancerIP = "192.168.0.201"
+	allocated := newTestService("staging", "allocated")
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.202"}
+	allocated.Spec.LoadBalancerIP = "192.168.0.202"
+	migrated := newTestService("dev", "migrated")
+	migrated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.203"}
+	migrated.Annotations = map[string]string{LoadBalancerIPsAnnotation: "192.168.0.203"}
+	migrated.Spec.LoadBalancerIP = "192.168.0.203"
+	pending := newTestService("dev", "pending")
+	clusterIP := newTestService("dev", "cluster-ip")
+	clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+	clusterIP.Spec.LoadBalancerIP = "192.168.0.204"
+	k := newTestLoadBalancer(nil, legacy, allocated, migrated, pending, clusterIP)
+
+	want := []Migration{
+		{Namespace: "dev", Name: "legacy", Address: "192.168.0.201"},
+		{Namespace: "staging", Name: "allocated", Address: "192.168.0.202"},
+	}
+
+	// A dry run doesn't change the services
+	got, err := MigrateLoadBalancerIPs(context.TODO(), k.kubeClient, true)
+	if err != nil {
+		t.Fatalf("MigrateLoadBalancerIPs() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateLoadBalancerIPs() dry run = %v, want %v", got, want)
+	}
+	svc, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), "legacy", metav1.GetOptions{})
+	if _, ok := svc.Annotations[LoadBalancerIPsAnnotation]; ok {
+		t.Errorf("dry run migrated service [%s]", svc.Name)
+	}
+
+	got, err = MigrateLoadBalancerIPs(context.TODO(), k.kubeClient, false)
+	if err != nil {
+		t.Fatalf("MigrateLoadBalancerIPs() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateLoadBalancerIPs() = %v, want %v", got, want)
+	}
+	for _, m := range want {
+		svc, _ := k.kubeClient.CoreV1().Services(m.Namespace).Get(context.TODO(), m.Name, metav1.GetOptions{})
+		if svc.Annotations[LoadBalancerIPsAnnotation] != m.Address {
+			t.Errorf("service [%s] annotation = %v, want %v", m.Name, svc.Annotations[LoadBalancerIPsAnnotation], m.Address)
+		}
+		if svc.Labels["ipam-address"] != m.Address || svc.Labels["implementation"] != "kube-vip" {
+			t.Errorf("service [%s] labels = %v, want ipam-address %v", m.Name, svc.Labels, m.Address)
+		}
+		if svc.Spec.LoadBalancerIP != m.Address {
+			t.Errorf("service [%s] address changed to %v, want %v", m.Name, svc.Spec.LoadBalancerIP, m.Address)
+		}
+	}
+
+	// Migrating again has nothing to do
+	if got, err = MigrateLoadBalancerIPs(context.TODO(), k.kubeClient, false); err != nil || len(got) != 0 {
+		t.Errorf("MigrateLoadBalancerIPs() second run = %v, %v, want nothing migrated", got, err)
+	}
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// poolLabelsChanged returns true if a namespace label that selects a pool has changed
+func poolLabelsChanged(previous, current *v1.Namespace) bool {
+	return previous.Labels[EnvironmentLabel] != current.Labels[EnvironmentLabel]
+}
+
+// pendingAllocation returns true if the service is waiting for an address
+func pendingAllocation(service *v1.Service) bool {
+	return service.Spec.Type == v1.ServiceTypeLoadBalancer && service.Spec.LoadBalancerIP == "" && service.Labels["ipam-address"] == ""
+}
+
+// watchNamespaces re-evaluates the pending services of a namespace when its pool labels change
+func (k *kubevipLoadBalancerManager) watchNamespaces(ctx context.Context, factory informers.SharedInformerFactory) {
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			previous, ok := oldObj.(*v1.Namespace)
+			if !ok {
+				return
+			}
+			current, ok := newObj.(*v1.Namespace)
+			if !ok {
+				return
+			}
+			k.namespaceUpdated(ctx, previous, current)
+		},
+	})
+}
+
+// namespaceUpdated requeues the pending services of the namespace if it may now select a different pool
+func (k *kubevipLoadBalancerManager) namespaceUpdated(ctx context.Context, previous, current *v1.Namespace) {
+	if !poolLabelsChanged(previous, current) || !k.watched(current.Name) {
+		return
+	}
+	klog.Infof("pool labels of namespace [%s] changed, re-evaluating its pending services", current.Name)
+	k.requeuePending(ctx, current.Name)
+}
+
+// requeuePending queues the services of the namespace that are waiting for an address, services that already have
+// an address are left untouched
+func (k *kubevipLoadBalancerManager) requeuePending(ctx context.Context, namespace string) {
+	svcs, err := k.kubeClient.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("unable to list the services of namespace [%s]: %v", namespace, err)
+		return
+	}
+	for x := range svcs.Items {
+		if pendingAllocation(&svcs.Items[x]) {
+			k.queue.add(svcs.Items[x].Namespace, svcs.Items[x].Name)
+		}
+	}
+}
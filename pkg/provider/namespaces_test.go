@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+)
+
+func Test_namespaceJoinsPool(t *testing.T) {
+	ipam.Manager = nil
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev"}}
+	pending := newTestService("dev", "pending")
+	allocated := newTestService("dev", "allocated")
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.10"}
+	allocated.Spec.LoadBalancerIP = "192.168.0.10"
+	clusterIP := newTestService("dev", "cluster-ip")
+	clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+	k := newTestLoadBalancer(map[string]string{
+		FallbackOrderKey: TierEnvironment,
+		"cidr-env-prod":  "192.168.1.200/29",
+	}, ns, pending, allocated, clusterIP)
+
+	// Without the label the namespace has no pool
+	if _, err := k.syncLoadBalancer(context.TODO(), pending); !errors.Is(err, ErrNoPoolConfigured) {
+		t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrNoPoolConfigured)
+	}
+
+	factory := informers.NewSharedInformerFactory(k.kubeClient, 0)
+	k.watchNamespaces(context.TODO(), factory)
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	k.runQueue(stop)
+
+	// The namespace joins the prod pool, its pending service is re-evaluated straight away
+	labelled := ns.DeepCopy()
+	labelled.Labels = map[string]string{EnvironmentLabel: "prod"}
+	if _, err := k.kubeClient.CoreV1().Namespaces().Update(context.TODO(), labelled, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		got, err := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), pending.Name, metav1.GetOptions{})
+		return err == nil && got.Spec.LoadBalancerIP != "", err
+	})
+	if err != nil {
+		t.Fatalf("pending service wasn't allocated an address: %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), pending.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.1.201" {
+		t.Errorf("pending service address = %v, want 192.168.1.201", got.Spec.LoadBalancerIP)
+	}
+
+	// Services that aren't pending are left untouched
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), allocated.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.10" {
+		t.Errorf("allocated service address = %v, want 192.168.0.10", got.Spec.LoadBalancerIP)
+	}
+	got, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), clusterIP.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "" {
+		t.Errorf("cluster IP service address = %v, want none", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_poolLabelsChanged(t *testing.T) {
+	previous := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"team": "a"}}}
+	unrelated := previous.DeepCopy()
+	unrelated.Labels["team"] = "b"
+	if poolLabelsChanged(previous, unrelated) {
+		t.Errorf("poolLabelsChanged() = true for an unrelated label")
+	}
+	joined := previous.DeepCopy()
+	joined.Labels[EnvironmentLabel] = "prod"
+	if !poolLabelsChanged(previous, joined) || !poolLabelsChanged(joined, previous) {
+		t.Errorf("poolLabelsChanged() = false when joining or leaving a pool")
+	}
+}
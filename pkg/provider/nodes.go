@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// NodeAddressPolicy is how an allocated address that is the address of a node is handled
+var NodeAddressPolicy = NodeAddressIgnore
+
+const (
+	//NodeAddressIgnore doesn't compare allocated addresses with the node addresses
+	NodeAddressIgnore = "ignore"
+
+	//NodeAddressWarn emits a warning event when a service is allocated the address of a node
+	NodeAddressWarn = "warn"
+
+	//NodeAddressAvoid never allocates the address of a node
+	NodeAddressAvoid = "avoid"
+
+	//ReasonNodeAddress is the event reason when a service is allocated the address of a node
+	ReasonNodeAddress = "NodeAddressAllocated"
+)
+
+// nodeCidrEnabled returns true if the config map derives a pool from the node addresses
+func nodeCidrEnabled(cm *v1.ConfigMap) bool {
+	return cm.Data[NodeCidrKey] == "true"
+}
+
+// nodeAddresses returns the (IPv4) internal addresses of every node
+func (k *kubevipLoadBalancerManager) nodeAddresses(ctx context.Context) ([]string, error) {
+	nodes, err := k.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for x := range nodes.Items {
+		for _, address := range nodes.Items[x].Status.Addresses {
+			if address.Type != v1.NodeInternalIP {
+				continue
+			}
+			if ip := net.ParseIP(address.Address); ip != nil && ip.To4() != nil {
+				addresses = append(addresses, ipam.NormalizeAddress(address.Address))
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// discoverNodeAddress allocates from the smallest cidr that encloses the node addresses, the node addresses and
+// the addresses of kube-vip services in every namespace are excluded as the nodes are shared by all namespaces
+func (k *kubevipLoadBalancerManager) discoverNodeAddress(ctx context.Context, namespace string) (*allocation, error) {
+	nodeAddresses, err := k.nodeAddresses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes for [%s]: %v", NodeCidrKey, err)
+	}
+	if len(nodeAddresses) == 0 {
+		return nil, fmt.Errorf("%w, [%s] is set but no node has an internal IPv4 address", ErrNoPoolConfigured, NodeCidrKey)
+	}
+	cidr, err := ipam.EnclosingCidr(nodeAddresses)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	inUse := append(ipam.NormalizeAddresses(allocatedAddresses(allocations)), nodeAddresses...)
+
+	klog.V(2).Infof("Taking address from [%s] pool [%s]", NodeCidrKey, cidr)
+	vip, err := ipam.FindAvailableHostFromCidr(namespace, cidr, inUse)
+	if err != nil {
+		return nil, err
+	}
+	return &allocation{address: vip, pool: NodeCidrKey, prefix: cidr}, nil
+}
+
+// allNodeAddresses returns the internal and external addresses (of both families) of every node, mapped to the node
+func (k *kubevipLoadBalancerManager) allNodeAddresses(ctx context.Context) (map[string]string, error) {
+	nodes, err := k.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string)
+	for x := range nodes.Items {
+		for _, address := range nodes.Items[x].Status.Addresses {
+			if address.Type != v1.NodeInternalIP && address.Type != v1.NodeExternalIP {
+				continue
+			}
+			if net.ParseIP(address.Address) != nil {
+				addresses[ipam.NormalizeAddress(address.Address)] = nodes.Items[x].Name
+			}
+		}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_syncLoadBalancerNodeAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		want      string
+		wantEvent bool
+	}{
+		{name: "ignore", policy: NodeAddressIgnore, want: "192.168.0.201"},
+		{name: "warn", policy: NodeAddressWarn, want: "192.168.0.201", wantEvent: true},
+		{name: "avoid", policy: NodeAddressAvoid, want: "192.168.0.203"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			node := newTestNode("node-1",
+				v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.201"},
+				v1.NodeAddress{Type: v1.NodeExternalIP, Address: "192.168.0.202"},
+				v1.NodeAddress{Type: v1.NodeHostName, Address: "node-1"},
+			)
+			svc := newTestService("dev", "lb")
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, node, svc)
+			k.nodeAddressPolicy = tt.policy
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+			var nodeEvent bool
+			for len(recorder.Events) > 0 {
+				if e := <-recorder.Events; strings.Contains(e, ReasonNodeAddress) {
+					nodeEvent = true
+				}
+			}
+			if nodeEvent != tt.wantEvent {
+				t.Errorf("%s event = %v, want %v", ReasonNodeAddress, nodeEvent, tt.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// InstanceID identifies this provider in the owner annotation of the services it allocates, the hostname if empty
+var InstanceID string
+
+// EnforceOwnership leaves services owned by another instance untouched, rather than reconciling them
+var EnforceOwnership bool
+
+const (
+	//OwnedByAnnotation is the instance of the provider that allocated the address of the service
+	OwnedByAnnotation = "kube-vip.io/owned-by"
+)
+
+// instanceID returns the configured instance ID, or the hostname
+func instanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Warningf("unable to determine the instance ID from the hostname, services aren't stamped with [%s]: %v", OwnedByAnnotation, err)
+		return ""
+	}
+	return hostname
+}
+
+// stampOwner records this instance as the owner of the service
+func (k *kubevipLoadBalancerManager) stampOwner(annotations map[string]string) {
+	if k.instanceID != "" {
+		annotations[OwnedByAnnotation] = k.instanceID
+	}
+}
+
+// foreignOwned returns true if ownership is enforced and the service is owned by another instance
+func (k *kubevipLoadBalancerManager) foreignOwned(service *v1.Service) bool {
+	owner := service.Annotations[OwnedByAnnotation]
+	return k.enforceOwnership && owner != "" && owner != k.instanceID
+}
@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"context"
+	"errors"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Paused stops all allocation and release, services that already have an address are left untouched
+var Paused bool
+
+//PausedKey when "true" in the config map pauses allocation and release, as the Paused flag does
+const PausedKey = "paused"
+
+// ErrPaused is returned for services that are waiting for an allocation or release while paused, so they are requeued
+var ErrPaused = errors.New("allocation is paused")
+
+// isPaused returns true if allocation is paused by the flag or the config map, cm may be nil
+func (k *kubevipLoadBalancerManager) isPaused(cm *v1.ConfigMap) bool {
+	paused := k.paused || (cm != nil && cm.Data[PausedKey] == "true")
+	if paused {
+		pausedGauge.Set(1)
+	} else {
+		pausedGauge.Set(0)
+	}
+	return paused
+}
+
+// releasePaused returns true if releasing is paused, the config map is only read when the flag isn't set
+func (k *kubevipLoadBalancerManager) releasePaused(ctx context.Context) bool {
+	if k.paused {
+		return k.isPaused(nil)
+	}
+	_, paused := k.pausedConfigMap(ctx)
+	return paused
+}
+
+// pausedConfigMap returns the config map and true if allocation is paused, the config map is empty if it can't be read
+func (k *kubevipLoadBalancerManager) pausedConfigMap(ctx context.Context) (*v1.ConfigMap, bool) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		cm = &v1.ConfigMap{}
+	}
+	return cm, k.isPaused(cm)
+}
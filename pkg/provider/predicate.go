@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ipamFields are the fields of a service that affect its address, the v1.19 API has no loadBalancerClass or
+// ipFamilies so the single ipFamily is compared
+type ipamFields struct {
+	serviceType    v1.ServiceType
+	loadBalancerIP string
+	ipFamily       string
+	address        string
+	annotations    map[string]string
+}
+
+// relevantFields returns the fields of the service that affect its address, only the kube-vip.io annotations (and
+// the compatibility annotation) are relevant
+func relevantFields(service *v1.Service, compatAnnotation string) ipamFields {
+	fields := ipamFields{
+		serviceType:    service.Spec.Type,
+		loadBalancerIP: service.Spec.LoadBalancerIP,
+		address:        service.Labels["ipam-address"],
+		annotations:    make(map[string]string),
+	}
+	if service.Spec.IPFamily != nil {
+		fields.ipFamily = string(*service.Spec.IPFamily)
+	}
+	for key, value := range service.Annotations {
+		if strings.HasPrefix(key, "kube-vip.io/") || (compatAnnotation != "" && key == compatAnnotation) {
+			fields.annotations[key] = value
+		}
+	}
+	return fields
+}
+
+// syncedFields records the relevant fields of each service when it was last synced successfully
+type syncedFields struct {
+	mu     sync.Mutex
+	fields map[types.UID]ipamFields
+}
+
+func newSyncedFields() *syncedFields {
+	return &syncedFields{fields: make(map[types.UID]ipamFields)}
+}
+
+// record stores the relevant fields of the synced service
+func (s *syncedFields) record(service *v1.Service, compatAnnotation string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fields[service.UID] = relevantFields(service, compatAnnotation)
+}
+
+// changed returns true if a relevant field of the service has changed since it was synced, or it was never synced
+func (s *syncedFields) changed(service *v1.Service, compatAnnotation string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields, ok := s.fields[service.UID]
+	return !ok || !reflect.DeepEqual(fields, relevantFields(service, compatAnnotation))
+}
+
+// forget removes the service, its next update is synced
+func (s *syncedFields) forget(uid types.UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.fields, uid)
+}
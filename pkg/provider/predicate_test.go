@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_syncedFieldsChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*v1.Service)
+		want   bool
+	}{
+		{
+			name:   "unchanged",
+			change: func(*v1.Service) {},
+		},
+		{
+			name:   "unrelated label",
+			change: func(s *v1.Service) { s.Labels["app"] = "web" },
+		},
+		{
+			name:   "unrelated annotation",
+			change: func(s *v1.Service) { s.Annotations["example.com/owner"] = "team" },
+		},
+		{
+			name:   "ports",
+			change: func(s *v1.Service) { s.Spec.Ports = []v1.ServicePort{{Port: 443}} },
+		},
+		{
+			name:   "kube-vip annotation",
+			change: func(s *v1.Service) { s.Annotations[LoadBalancerIPsAnnotation] = "192.168.0.5" },
+			want:   true,
+		},
+		{
+			name:   "compatibility annotation",
+			change: func(s *v1.Service) { s.Annotations["metallb.universe.tf/loadBalancerIPs"] = "192.168.0.5" },
+			want:   true,
+		},
+		{
+			name:   "type",
+			change: func(s *v1.Service) { s.Spec.Type = v1.ServiceTypeNodePort },
+			want:   true,
+		},
+		{
+			name:   "loadBalancerIP",
+			change: func(s *v1.Service) { s.Spec.LoadBalancerIP = "192.168.0.5" },
+			want:   true,
+		},
+		{
+			name: "ipFamily",
+			change: func(s *v1.Service) {
+				family := v1.IPv6Protocol
+				s.Spec.IPFamily = &family
+			},
+			want: true,
+		},
+		{
+			name:   "allocated address",
+			change: func(s *v1.Service) { s.Labels["ipam-address"] = "192.168.0.6" },
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService("dev", "web")
+			svc.Labels = map[string]string{"ipam-address": "192.168.0.4"}
+			svc.Annotations = map[string]string{}
+			s := newSyncedFields()
+			s.record(svc, "metallb.universe.tf/loadBalancerIPs")
+
+			updated := svc.DeepCopy()
+			tt.change(updated)
+			if got := s.changed(updated, "metallb.universe.tf/loadBalancerIPs"); got != tt.want {
+				t.Errorf("changed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	s := newSyncedFields()
+	svc := newTestService("dev", "web")
+	if !s.changed(svc, "") {
+		t.Errorf("changed() = false for a service that was never synced")
+	}
+	s.record(svc, "")
+	s.forget(svc.UID)
+	if !s.changed(svc, "") {
+		t.Errorf("changed() = false for a forgotten service")
+	}
+}
+
+func Test_UpdateLoadBalancerRelevantFields(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, svc)
+	client := k.kubeClient.(*fake.Clientset)
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "", svc, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	// The first update carries the allocated address, which the service passed to EnsureLoadBalancer didn't have
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err := k.UpdateLoadBalancer(context.TODO(), "", got, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+
+	client.ClearActions()
+	unrelated := got.DeepCopy()
+	unrelated.Labels["app"] = "web"
+	unrelated.Spec.Ports = []v1.ServicePort{{Port: 443}}
+	if err := k.UpdateLoadBalancer(context.TODO(), "", unrelated, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("UpdateLoadBalancer() made %d requests for an unrelated change, want 0", len(actions))
+	}
+
+	relevant := unrelated.DeepCopy()
+	if relevant.Annotations == nil {
+		relevant.Annotations = map[string]string{}
+	}
+	relevant.Annotations[LoadBalancerIPsAnnotation] = "192.168.0.5"
+	if err := k.UpdateLoadBalancer(context.TODO(), "", relevant, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) == 0 {
+		t.Errorf("UpdateLoadBalancer() didn't reconcile a change of a kube-vip annotation")
+	}
+}
+
+func Test_UpdateLoadBalancerPending(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29", DisabledNamespacesKey: "dev"}, svc)
+
+	// The service is left without an address, its next update is synced once the namespace is enabled
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "", svc, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	// The update carrying its status annotation is synced while the namespace is still disabled
+	pending, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err := k.UpdateLoadBalancer(context.TODO(), "", pending, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	cm, _ := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipClientConfig, metav1.GetOptions{})
+	delete(cm.Data, DisabledNamespacesKey)
+	if _, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := pending.DeepCopy()
+	unrelated.Labels = map[string]string{"app": "web"}
+	if err := k.UpdateLoadBalancer(context.TODO(), "", unrelated, nil); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP == "" {
+		t.Errorf("UpdateLoadBalancer() didn't allocate the pending service once its namespace was enabled")
+	}
+}
@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// propagatedLabels returns the listed labels of the namespace that the service doesn't already have, a label the
+// namespace doesn't have isn't propagated
+func propagatedLabels(keys []string, namespace *v1.Namespace, service *v1.Service) map[string]string {
+	labels := make(map[string]string)
+	for _, key := range keys {
+		value, ok := namespace.Labels[key]
+		if !ok {
+			continue
+		}
+		if current, ok := service.Labels[key]; !ok || current != value {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// propagateNamespaceLabels copies the labels listed in the config map from the namespace onto the service, the
+// other labels of the service are left as they are. A failure is logged, it doesn't stop the reconcile
+func (k *kubevipLoadBalancerManager) propagateNamespaceLabels(ctx context.Context, service *v1.Service) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return
+	}
+	keys := configList(cm, PropagateNamespaceLabelsKey)
+	if len(keys) == 0 {
+		return
+	}
+	namespace, err := k.kubeClient.CoreV1().Namespaces().Get(ctx, service.Namespace, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("unable to propagate the labels of namespace [%s] to service [%s]: %v", service.Namespace, service.Name, err)
+		return
+	}
+	if len(propagatedLabels(keys, namespace, service)) == 0 {
+		return
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		labels := propagatedLabels(keys, namespace, recentService)
+		if len(labels) == 0 {
+			return nil
+		}
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		for key, value := range labels {
+			recentService.Labels[key] = value
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		klog.Warningf("unable to propagate the labels of namespace [%s] to service [%s]: %v", service.Namespace, service.Name, err)
+		return
+	}
+	klog.V(2).Infof("propagated labels [%v] of namespace [%s] to service [%s]", keys, service.Namespace, service.Name)
+}
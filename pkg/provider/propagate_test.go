@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_propagateNamespaceLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		propagate  string
+		wantLabels map[string]string
+		absent     []string
+	}{
+		{
+			name:       "listed labels",
+			propagate:  "cost-center, team",
+			wantLabels: map[string]string{"cost-center": "cc-100", "app": "web"},
+			absent:     []string{"team", "owner"},
+		},
+		{
+			name:       "not configured",
+			wantLabels: map[string]string{"app": "web"},
+			absent:     []string{"cost-center", "team", "owner"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "dev",
+				Labels: map[string]string{"cost-center": "cc-100", "owner": "platform"},
+			}}
+			svc := newTestService("dev", "lb")
+			svc.Labels = map[string]string{"app": "web"}
+			data := map[string]string{"cidr-global": "192.168.0.200/29"}
+			if tt.propagate != "" {
+				data[PropagateNamespaceLabelsKey] = tt.propagate
+			}
+			k := newTestLoadBalancer(data, ns, svc)
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			for key, value := range tt.wantLabels {
+				if got.Labels[key] != value {
+					t.Errorf("label [%s] = %q, want %q", key, got.Labels[key], value)
+				}
+			}
+			for _, key := range tt.absent {
+				if value, ok := got.Labels[key]; ok {
+					t.Errorf("label [%s] = %q, want it absent", key, value)
+				}
+			}
+			// The allocation is unaffected by the propagated labels
+			if got.Labels["ipam-address"] == "" || got.Spec.LoadBalancerIP == "" {
+				t.Errorf("service wasn't allocated an address")
+			}
+		})
+	}
+}
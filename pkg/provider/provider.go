@@ -1,23 +1,75 @@
 package provider
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"path/filepath"
 
 	"os"
+	"time"
 
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	cloudprovider "k8s.io/cloud-provider"
 )
 
+// Log levels, changes to services and addresses are always logged. Allocation decisions (the pool or tier an
+// address comes from, services that are skipped) are logged at V(2), and anything on the hot path (per service
+// checks, building pools and scanning candidates in the ipam package) at V(4).
+
 // OutSideCluster allows the controller to be started using a local kubeConfig for testing
 var OutSideCluster bool
 
+// ObserveOnly reports the addresses of services without allocating or modifying them
+var ObserveOnly bool
+
+// WatchedNamespaces limits the namespaces whose services are reconciled, all namespaces are reconciled if empty
+var WatchedNamespaces []string
+
+// RequireManagedAnnotation ignores services that haven't opted in with the managed annotation
+var RequireManagedAnnotation bool
+
+// ReconcileTimeout is the maximum time a single service sync can take, zero disables the timeout
+var ReconcileTimeout = 30 * time.Second
+
+// ScanTimeout is how long the scan of a cidr pool for a free address can take, the service is requeued and the scan
+// resumed once it has passed. Zero disables the timeout
+var ScanTimeout time.Duration
+
+// VerifyAllocation re-reads a service after an allocation and retries if the allocation wasn't applied
+var VerifyAllocation bool
+
+// VerifyAllocationAttempts is the number of times an allocation is applied before it is given up on
+var VerifyAllocationAttempts = 3
+
+// ForeignIngressPolicy is how a service that already has an ingress address from another controller is handled
+var ForeignIngressPolicy = ForeignIngressAllocate
+
+// AvoidExternalIPs stops the external IPs of services in the managed namespaces being allocated
+var AvoidExternalIPs bool
+
+// AvoidClusterIPs stops the cluster IPs of services in the managed namespaces being allocated
+var AvoidClusterIPs bool
+
+// ReserveStaticAddresses stops the spec.loadBalancerIP requested by a service being allocated to another service,
+// even before the request has been reconciled, so a static request is never blocked by a dynamic allocation
+var ReserveStaticAddresses = true
+
+// ServiceCidr is the service network of the cluster, the cidr-from-service-offset pool is derived from it
+var ServiceCidr string
+
+// KeyPrefix is prepended to the cidr and range keys of the config map, i.e. kv- for kv-cidr-<namespace>
+var KeyPrefix string
+
 const (
 	//ProviderName is the name of the cloud provider
 	ProviderName = "kubevip"
@@ -30,6 +82,120 @@ const (
 
 	//KubeVipServicesKey is the key in the ConfigMap that has the services configuration
 	KubeVipServicesKey = "kubevip-services"
+
+	//FallbackOrderKey is the key in the ConfigMap that defines the order pool tiers are searched
+	FallbackOrderKey = "fallback-order"
+
+	//DisabledNamespacesKey is the key in the ConfigMap listing namespaces that never receive an address
+	DisabledNamespacesKey = "disabled-namespaces"
+
+	//PropagateNamespaceLabelsKey is the key in the ConfigMap listing the namespace labels (i.e. cost-center) that are
+	//copied onto the services of the namespace
+	PropagateNamespaceLabelsKey = "propagate-namespace-labels"
+
+	//ManagedAnnotation opts a service in to being managed when the managed annotation is required
+	ManagedAnnotation = "kube-vip.io/managed"
+
+	//IgnoreAnnotation when "true" leaves the service untouched, it isn't allocated, relabelled or released
+	IgnoreAnnotation = "kube-vip.io/ignore"
+
+	//AllowNetworkAddressKey when "true" lets a service request the network or broadcast address of a cidr pool
+	AllowNetworkAddressKey = "allow-network-address"
+
+	//CordonedPoolsKey is the key in the ConfigMap listing pools (i.e. range-old) that new addresses aren't allocated from
+	CordonedPoolsKey = "cordoned-pools"
+
+	//ReserveGatewayKey when "true" stops the conventional gateway (the first host, i.e. .1) of each cidr being allocated
+	ReserveGatewayKey = "reserve-gateway"
+
+	//PoolSelectionKey is the key in the ConfigMap with how the cidr or range of a pool of several is chosen
+	PoolSelectionKey = "pool-selection"
+
+	//PoolSelectionFirstFit takes addresses from the cidrs or ranges of a pool in their configured order
+	PoolSelectionFirstFit = "first-fit"
+
+	//PoolSelectionBestFit takes addresses from the smallest cidr or range of a pool with a free address, keeping the
+	//larger ones free, it takes precedence over round-robin
+	PoolSelectionBestFit = "best-fit"
+
+	//OctetParityKey is the key in the ConfigMap (even or odd) that makes cidr and range pools prefer addresses whose
+	//last octet has the parity, i.e. to pair VIPs for VRRP
+	OctetParityKey = "octet-parity"
+
+	//RangeDirectionKey is the key in the ConfigMap with the direction cidr and range pools are allocated in, i.e.
+	//descending to fill dynamic addresses from the top and keep the low end for static addresses
+	RangeDirectionKey = "range-direction"
+
+	//RangeDirectionAscending allocates the lowest free address first
+	RangeDirectionAscending = "ascending"
+
+	//RangeDirectionDescending allocates the highest free address first
+	RangeDirectionDescending = "descending"
+
+	//DefaultIPFamilyKey is the key in the ConfigMap (IPv4 or IPv6) with the family allocated to a service that
+	//doesn't set ipFamily, i.e. IPv6 for an IPv6 primary cluster
+	DefaultIPFamilyKey = "default-ip-family"
+
+	//MultiPoolKey is the key in the ConfigMap with the strategy for a pool of several cidrs or ranges
+	MultiPoolKey = "multi-pool"
+
+	//MultiPoolRoundRobin spreads services over the cidrs or ranges of a pool, taking from the least utilized
+	MultiPoolRoundRobin = "round-robin"
+
+	//AllocatedCidrAnnotation is the service annotation recording the network of the allocated address
+	AllocatedCidrAnnotation = "kube-vip.io/allocated-cidr"
+
+	//NodeCidrKey when "true" allocates addresses from the network of the nodes if no pool is configured
+	NodeCidrKey = "cidr-from-nodes"
+
+	//ServiceOffsetCidrKey is a pool relative to the service network, /<bits>@<offset>, that addresses are allocated
+	//from if no pool is configured
+	ServiceOffsetCidrKey = "cidr-from-service-offset"
+
+	//CidrStartOffsetKeyPrefix is followed by the pool, i.e. cidr-start-offset-<namespace>, the value is the index of
+	//the first address tried in the cidr of the pool
+	CidrStartOffsetKeyPrefix = "cidr-start-offset-"
+
+	//CidrStrategyKeyPrefix is followed by the pool, i.e. cidr-strategy-<namespace>, the value is how addresses are
+	//chosen from the cidr of the pool
+	CidrStrategyKeyPrefix = "cidr-strategy-"
+
+	//CidrStrategyHashed derives the address of a service from a hash of its namespace and name, for IPv6 cidrs
+	CidrStrategyHashed = "hashed"
+
+	//PreferredSubnetAnnotation is the service annotation selecting the cidr in a pool that is tried first
+	PreferredSubnetAnnotation = "kube-vip.io/preferred-subnet"
+
+	//UseGlobalPoolAnnotation when "true" allocates the service from the global pool, even if a pool of its namespace
+	//(or a pool selecting it) exists
+	UseGlobalPoolAnnotation = "kube-vip.io/use-global-pool"
+
+	//EnvironmentLabel is the namespace label that selects the cidr-env-<env>/range-env-<env> pool
+	EnvironmentLabel = "kube-vip.io/environment"
+)
+
+// Policies for a service that already has an ingress address from another controller
+const (
+	//ForeignIngressAllocate allocates an address, ignoring the ingress address from another controller
+	ForeignIngressAllocate = "allocate"
+
+	//ForeignIngressAdopt records the ingress address from another controller as the allocated address
+	ForeignIngressAdopt = "adopt"
+
+	//ForeignIngressSkip leaves a service with an ingress address from another controller unmanaged
+	ForeignIngressSkip = "skip"
+)
+
+// Pool tiers that can be used in the fallback-order
+const (
+	//TierNamespace uses the cidr-<namespace>/range-<namespace> pool
+	TierNamespace = "namespace"
+
+	//TierEnvironment uses the cidr-env-<env>/range-env-<env> pool
+	TierEnvironment = "env"
+
+	//TierGlobal uses the cidr-global/range-global pool
+	TierGlobal = "global"
 )
 
 func init() {
@@ -55,46 +221,132 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 		ns = "default"
 	}
 
-	var cl *kubernetes.Clientset
-	if !OutSideCluster {
-		// This will attempt to load the configuration when running within a POD
-		cfg, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
-		}
-		cl, err = kubernetes.NewForConfig(cfg)
-
-		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
-		}
+	var kubeconfig string
+	if OutSideCluster {
 		// use the current context in kubeconfig
-	} else {
-		config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+		kubeconfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+	cl, err := NewKubeClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "kube-vip-cloud-provider"})
+
+	lb := newLoadBalancer(cl, recorder, ns, cm, ServiceCidr)
+	if AllocationAudit {
+		cfg, err := restConfig(kubeconfig)
 		if err != nil {
-			panic(err.Error())
+			return nil, err
 		}
-		cl, err = kubernetes.NewForConfig(config)
-
+		dyn, err := dynamic.NewForConfig(cfg)
 		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			return nil, fmt.Errorf("error creating kubernetes dynamic client: %s", err.Error())
 		}
+		lb.(*kubevipLoadBalancerManager).audit = newAllocationAudit(dyn)
 	}
+
 	return &KubeVipCloudProvider{
-		lb: newLoadBalancer(cl, ns, cm),
+		lb: lb,
 	}, nil
 }
 
+// NewKubeClient - creates a kubernetes client from the kubeconfig, or the POD configuration if kubeconfig is empty
+func NewKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
+	cfg, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+	}
+	return cl, nil
+}
+
+// restConfig - loads the client configuration from the kubeconfig, or the POD configuration if kubeconfig is empty
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	var cfg *rest.Config
+	var err error
+	if kubeconfig == "" {
+		// This will attempt to load the configuration when running within a POD
+		cfg, err = rest.InClusterConfig()
+	} else {
+		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+	}
+	return cfg, nil
+}
+
 // Initialize - starts the clound-provider controller
 func (p *KubeVipCloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	clientset := clientBuilder.ClientOrDie("do-shared-informers")
-	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
+
+	// Only watch the allowed namespaces, an informer factory is scoped to a single namespace
+	var sharedInformers []informers.SharedInformerFactory
+	if len(WatchedNamespaces) == 0 {
+		sharedInformers = append(sharedInformers, informers.NewSharedInformerFactory(clientset, 0))
+	}
+	for _, ns := range WatchedNamespaces {
+		sharedInformers = append(sharedInformers, informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(ns)))
+	}
 
 	//res := NewResourcesController(c.resources, sharedInformer.Core().V1().Services(), clientset)
 
-	sharedInformer.Start(nil)
-	sharedInformer.WaitForCacheSync(nil)
+	// Namespaces are cluster scoped, so pool label changes are watched across the cluster
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok {
+		namespaceInformer := informers.NewSharedInformerFactory(clientset, 0)
+		lb.watchNamespaces(context.Background(), namespaceInformer)
+		sharedInformers = append(sharedInformers, namespaceInformer)
+	}
+
+	for _, sharedInformer := range sharedInformers {
+		sharedInformer.Start(nil)
+		sharedInformer.WaitForCacheSync(nil)
+	}
 	//go res.Run(stop)
-	//go c.serveDebug(stop)
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok {
+		lb.validateStartup(context.Background())
+		lb.runQueue(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && lb.warmPools != nil {
+		lb.warmStartup(context.Background())
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && SnapshotInterval > 0 {
+		lb.snapshotStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok {
+		lb.stickyStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && ResyncInterval > 0 {
+		lb.resyncStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && TerminatingGracePeriod > 0 {
+		lb.reclaimStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && TextfilePath != "" {
+		lb.textfileStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && lb.reservations != nil {
+		lb.reservationsStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && SummaryInterval > 0 {
+		lb.summaryStartup(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && DebugAddress != "" {
+		go serveDebug(DebugAddress, lb.debugHandler(), stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && APIAddress != "" {
+		go lb.serveAPI(stop)
+	}
+	if lb, ok := p.lb.(*kubevipLoadBalancerManager); ok && WebhookAddress != "" {
+		go lb.serveWebhook(stop)
+	}
 }
 
 // LoadBalancer returns a loadbalancer interface. Also returns true if the interface is supported, false otherwise.
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// Concurrency is the number of services that are reconciled at once, by the service controller and by the
+// provider when it requeues services itself
+var Concurrency = 1
+
+// QueueRetries is how often a requeued service that fails to sync is retried
+var QueueRetries = 5
+
+// reconcileQueue holds the services (as namespace/name keys) the provider requeues itself, i.e. the pending services
+// of a namespace whose pool labels changed. Allocations are still serialised by the allocation lock
+type reconcileQueue struct {
+	queue   workqueue.RateLimitingInterface
+	workers int
+}
+
+func newReconcileQueue(workers int) *reconcileQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &reconcileQueue{
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "kube-vip-reconcile"),
+		workers: workers,
+	}
+}
+
+// add queues the service, a service that is already queued is only synced once
+func (q *reconcileQueue) add(namespace, name string) {
+	q.queue.Add(namespace + "/" + name)
+}
+
+// runQueue starts the workers, they stop (and the queue is shut down) once stop is closed
+func (k *kubevipLoadBalancerManager) runQueue(stop <-chan struct{}) {
+	for x := 0; x < k.queue.workers; x++ {
+		go wait.Until(func() {
+			for k.processNext(context.Background()) {
+			}
+		}, time.Second, stop)
+	}
+	go func() {
+		<-stop
+		k.queue.queue.ShutDown()
+	}()
+}
+
+// processNext syncs the next queued service, it returns false once the queue has been shut down
+func (k *kubevipLoadBalancerManager) processNext(ctx context.Context) bool {
+	item, quit := k.queue.queue.Get()
+	if quit {
+		return false
+	}
+	defer k.queue.queue.Done(item)
+
+	key := item.(string)
+	if err := k.syncKey(ctx, key); err != nil {
+		if k.queue.queue.NumRequeues(key) < QueueRetries {
+			klog.Warningf("unable to sync service [%s], retrying: %v", key, err)
+			k.queue.queue.AddRateLimited(key)
+			return true
+		}
+		klog.Errorf("unable to sync service [%s] after [%d] attempts: %v", key, QueueRetries, err)
+	}
+	k.queue.queue.Forget(key)
+	return true
+}
+
+// syncKey syncs the service if it is still waiting for an address
+func (k *kubevipLoadBalancerManager) syncKey(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	service, err := k.kubeClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !pendingAllocation(service) || !k.managed(service) {
+		return nil
+	}
+	// The service may be waiting out the retry interval for a pool
+	k.noPoolRetries.forget(service.UID)
+	// The service controller can allocate the service after it was read, the sync reads it again under the
+	// allocation lock rather than allocating it a second address
+	_, err = k.syncLoadBalancer(ctx, service)
+	return err
+}
@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_reconcileQueueConcurrency(t *testing.T) {
+	ipam.Manager = nil
+
+	// The allocate hook is slow, so reconciles overlap while workers are free. Every namespace shares the global pool,
+	// so overlapping allocations must still not be given the same address
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	data := map[string]string{"cidr-global": "192.168.0.0/26"}
+	var objects []runtime.Object
+	var services []*v1.Service
+	for n := 0; n < 4; n++ {
+		namespace := fmt.Sprintf("ns%d", n)
+		for x := 0; x < 8; x++ {
+			svc := newTestService(namespace, fmt.Sprintf("svc-%d", x))
+			svc.UID = types.UID("uid-" + namespace + "-" + svc.Name)
+			objects = append(objects, svc)
+			services = append(services, svc)
+		}
+	}
+	k := newTestLoadBalancer(data, objects...)
+	k.hooks = &hooks{allocateURL: server.URL, blocking: true, retries: 1, client: server.Client()}
+	k.queue = newReconcileQueue(4)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, svc := range services {
+		k.queue.add(svc.Namespace, svc.Name)
+	}
+	k.runQueue(stop)
+
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		allocations, err := listAllocations(context.TODO(), k.kubeClient)
+		return len(allocations) == len(services), err
+	})
+	if err != nil {
+		t.Fatalf("queued services weren't allocated: %v", err)
+	}
+
+	allocations, _ := listAllocations(context.TODO(), k.kubeClient)
+	seen := map[string]string{}
+	for _, a := range allocations {
+		if owner, ok := seen[a.Address]; ok {
+			t.Errorf("address [%s] is assigned to [%s] and [%s/%s]", a.Address, owner, a.Namespace, a.Name)
+		}
+		seen[a.Address] = a.Namespace + "/" + a.Name
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight < 2 {
+		t.Errorf("services were reconciled one at a time, want concurrently")
+	}
+	if maxInFlight > 4 {
+		t.Errorf("[%d] services were reconciled at once, want at most 4", maxInFlight)
+	}
+}
+
+func Test_reconcileQueueSkipsAllocated(t *testing.T) {
+	ipam.Manager = nil
+	allocated := newTestService("dev", "allocated")
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.210"}
+	allocated.Spec.LoadBalancerIP = "192.168.0.210"
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, allocated)
+
+	if err := k.syncKey(context.TODO(), "dev/allocated"); err != nil {
+		t.Fatalf("syncKey() error = %v", err)
+	}
+	if err := k.syncKey(context.TODO(), "dev/deleted"); err != nil {
+		t.Fatalf("syncKey() error = %v for a deleted service", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), allocated.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.210" {
+		t.Errorf("allocated service address = %v, want 192.168.0.210", got.Spec.LoadBalancerIP)
+	}
+}
+
+func Test_reconcileQueueAllocatedDuringSync(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/29"}, svc)
+	client := k.kubeClient.(*fake.Clientset)
+
+	// The service controller allocates the service after the queue read it, the queue only has the pending copy
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	var once sync.Once
+	client.PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled := false
+		once.Do(func() { handled = true })
+		return handled, svc.DeepCopy(), nil
+	})
+
+	if err := k.syncKey(context.TODO(), "dev/lb"); err != nil {
+		t.Fatalf("syncKey() error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.201" {
+		t.Errorf("service address = %v, want 192.168.0.201 kept", got.Spec.LoadBalancerIP)
+	}
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// QuotaWatermark is the fraction of its quota that a namespace can use before a warning event is emitted
+var QuotaWatermark = 0.8
+
+const (
+	//QuotaKeyPrefix is followed by the namespace, i.e. max-allocations-<namespace>, the value is the number of
+	//addresses the namespace is expected to use
+	QuotaKeyPrefix = "max-allocations-"
+
+	//ReasonQuotaWatermark is the event reason when a namespace reaches the watermark of its quota
+	ReasonQuotaWatermark = "QuotaWatermark"
+
+	//ReasonQuotaReached is the event reason when a namespace has used all of its quota
+	ReasonQuotaReached = "QuotaReached"
+)
+
+// quotaNamespaces are the namespaces with a quota gauge, so their usage is updated when an address is released
+type quotaNamespaces struct {
+	mu         sync.Mutex
+	namespaces map[string]bool
+}
+
+func (q *quotaNamespaces) add(namespace string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.namespaces == nil {
+		q.namespaces = make(map[string]bool)
+	}
+	q.namespaces[namespace] = true
+}
+
+func (q *quotaNamespaces) has(namespace string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.namespaces[namespace]
+}
+
+// namespaceQuota returns the quota of the namespace, ok is false if it doesn't have one
+func namespaceQuota(cm *v1.ConfigMap, namespace string) (quota int, ok bool) {
+	value, ok := cm.Data[QuotaKeyPrefix+namespace]
+	if !ok {
+		return 0, false
+	}
+	quota, err := strconv.Atoi(value)
+	if err != nil || quota <= 0 {
+		klog.Warningf("ignoring [%s%s] [%s], it isn't a positive number", QuotaKeyPrefix, namespace, value)
+		return 0, false
+	}
+	return quota, true
+}
+
+// namespaceUsage returns the number of kube-vip services with an address, and addresses allocated through the API, in
+// the namespace, infrastructure allocations aren't counted
+func (k *kubevipLoadBalancerManager) namespaceUsage(ctx context.Context, cm *v1.ConfigMap, namespace string) (int, error) {
+	svcs, err := k.kubeClient.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{LabelSelector: "implementation=kube-vip"})
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for x := range svcs.Items {
+		if svcs.Items[x].Labels["ipam-address"] != "" && !infraAllocation(cm, &svcs.Items[x]) {
+			used++
+		}
+	}
+	if k.api && !infraAllocation(cm, apiService(namespace, "")) {
+		apiAddresses, err := k.apiAddresses(ctx, namespace)
+		if err != nil {
+			return 0, err
+		}
+		used += len(apiAddresses)
+	}
+	return used, nil
+}
+
+// quotaAllocated updates the quota metrics after an address is allocated to the service, a warning event is emitted
+// when a new allocation takes the namespace to the watermark or to its quota
+func (k *kubevipLoadBalancerManager) quotaAllocated(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, newAllocation bool) {
+	quota, ok := namespaceQuota(cm, service.Namespace)
+	if !ok {
+		return
+	}
+	used, err := k.namespaceUsage(ctx, cm, service.Namespace)
+	if err != nil {
+		klog.Warningf("unable to determine the quota usage of namespace [%s]: %v", service.Namespace, err)
+		return
+	}
+	k.quotaNamespaces.add(service.Namespace)
+	quotaGauge.WithLabelValues(service.Namespace).Set(float64(quota))
+	quotaUsedGauge.WithLabelValues(service.Namespace).Set(float64(used))
+
+	// Only the allocation that crosses a threshold emits an event, a migrated service was already counted and an
+	// infrastructure allocation isn't counted
+	if !newAllocation || infraAllocation(cm, service) {
+		return
+	}
+	watermark := QuotaWatermark * float64(quota)
+	previous := used - 1
+	switch {
+	case used >= quota && previous < quota:
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonQuotaReached, "namespace [%s] has used [%d/%d] of its allocation quota", service.Namespace, used, quota)
+	case float64(used) >= watermark && float64(previous) < watermark:
+		k.recorder.Eventf(service, v1.EventTypeWarning, ReasonQuotaWatermark, "namespace [%s] has used [%d/%d] of its allocation quota", service.Namespace, used, quota)
+	}
+}
+
+// quotaReleased updates the quota usage of the namespace after an address is released
+func (k *kubevipLoadBalancerManager) quotaReleased(ctx context.Context, namespace string) {
+	if !k.quotaNamespaces.has(namespace) {
+		return
+	}
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		klog.Warningf("unable to determine the quota usage of namespace [%s]: %v", namespace, err)
+		return
+	}
+	used, err := k.namespaceUsage(ctx, cm, namespace)
+	if err != nil {
+		klog.Warningf("unable to determine the quota usage of namespace [%s]: %v", namespace, err)
+		return
+	}
+	quotaUsedGauge.WithLabelValues(namespace).Set(float64(used))
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// quotaEvents drains the recorder and returns the quota events
+func quotaEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			if strings.Contains(e, ReasonQuotaWatermark) || strings.Contains(e, ReasonQuotaReached) {
+				events = append(events, e)
+			}
+		default:
+			return events
+		}
+	}
+}
+
+func Test_namespaceQuota(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		QuotaKeyPrefix + "dev":     "5",
+		QuotaKeyPrefix + "staging": "none",
+		QuotaKeyPrefix + "prod":    "0",
+	}}
+	tests := []struct {
+		namespace string
+		want      int
+		wantOk    bool
+	}{
+		{namespace: "dev", want: 5, wantOk: true},
+		{namespace: "staging"},
+		{namespace: "prod"},
+		{namespace: "test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			got, ok := namespaceQuota(cm, tt.namespace)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("namespaceQuota() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_quotaWatermark(t *testing.T) {
+	ipam.Manager = nil
+	var services []*v1.Service
+	for x := 0; x < 6; x++ {
+		services = append(services, newTestService("quota", fmt.Sprintf("svc-%d", x)))
+	}
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-quota":             "192.168.10.0/28",
+		QuotaKeyPrefix + "quota": "5",
+	}, services[0], services[1], services[2], services[3], services[4], services[5])
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	// The watermark of 80% is reached with the fourth allocation, the quota with the fifth
+	want := []string{"", "", "", ReasonQuotaWatermark, ReasonQuotaReached, ""}
+	for x, svc := range services {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s) error = %v", svc.Name, err)
+		}
+		events := quotaEvents(recorder)
+		switch {
+		case want[x] == "" && len(events) != 0:
+			t.Errorf("allocation [%d] events = %v, want none", x+1, events)
+		case want[x] != "" && (len(events) != 1 || !strings.Contains(events[0], want[x])):
+			t.Errorf("allocation [%d] events = %v, want %v", x+1, events, want[x])
+		}
+		if got, _ := testutil.GetGaugeMetricValue(quotaUsedGauge.WithLabelValues("quota")); got != float64(x+1) {
+			t.Errorf("allocation [%d] quota used = %v, want %v", x+1, got, x+1)
+		}
+	}
+	if got, _ := testutil.GetGaugeMetricValue(quotaGauge.WithLabelValues("quota")); got != 5 {
+		t.Errorf("quota = %v, want 5", got)
+	}
+}
+
+func Test_quotaReleased(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("released", "first")
+	second := newTestService("released", "second")
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-released":             "192.168.11.0/28",
+		QuotaKeyPrefix + "released": "2",
+	}, first, second)
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	for _, svc := range []*v1.Service{first, second} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s) error = %v", svc.Name, err)
+		}
+	}
+	if events := quotaEvents(recorder); len(events) != 1 || !strings.Contains(events[0], ReasonQuotaReached) {
+		t.Errorf("events = %v, want %v", events, ReasonQuotaReached)
+	}
+
+	// Deleting the service releases its address, the controller then removes it
+	deleted := first.DeepCopy()
+	deleted.Labels = map[string]string{"ipam-address": "192.168.11.1"}
+	if err := k.kubeClient.CoreV1().Services("released").Delete(context.TODO(), first.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.deleteLoadBalancer(context.TODO(), deleted); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if got, _ := testutil.GetGaugeMetricValue(quotaUsedGauge.WithLabelValues("released")); got != 1 {
+		t.Errorf("quota used = %v, want 1", got)
+	}
+}
+
+func Test_quotaInfra(t *testing.T) {
+	ipam.Manager = nil
+	ingress := newTestService("shared", "ingress")
+	ingress.Labels = map[string]string{"app.kubernetes.io/component": "ingress-controller"}
+	first := newTestService("shared", "first")
+	second := newTestService("shared", "second")
+	controller := newTestService("ingress-nginx", "controller")
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-global":                    "192.168.12.0/28",
+		QuotaKeyPrefix + "shared":        "2",
+		QuotaKeyPrefix + "ingress-nginx": "1",
+		InfraSelectorKey:                 "app.kubernetes.io/component=ingress-controller",
+		InfraNamespacesKey:               "kube-system, ingress-nginx",
+	}, ingress, first, second, controller)
+	recorder := k.recorder.(*record.FakeRecorder)
+
+	// The tagged allocation isn't counted, so the quota is only reached by the second untagged allocation
+	tests := []struct {
+		svc       *v1.Service
+		wantClass string
+		wantUsed  float64
+		wantEvent string
+	}{
+		{svc: ingress, wantClass: AllocationClassInfra, wantUsed: 0},
+		{svc: first, wantUsed: 1},
+		{svc: second, wantUsed: 2, wantEvent: ReasonQuotaReached},
+		{svc: controller, wantClass: AllocationClassInfra, wantUsed: 0},
+	}
+	for _, tt := range tests {
+		if _, err := k.syncLoadBalancer(context.TODO(), tt.svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s) error = %v", tt.svc.Name, err)
+		}
+		got, _ := k.kubeClient.CoreV1().Services(tt.svc.Namespace).Get(context.TODO(), tt.svc.Name, metav1.GetOptions{})
+		if got.Annotations[AllocationClassAnnotation] != tt.wantClass {
+			t.Errorf("service [%s] annotation [%s] = %q, want %q", tt.svc.Name, AllocationClassAnnotation, got.Annotations[AllocationClassAnnotation], tt.wantClass)
+		}
+		if used, _ := testutil.GetGaugeMetricValue(quotaUsedGauge.WithLabelValues(tt.svc.Namespace)); used != tt.wantUsed {
+			t.Errorf("service [%s] quota used = %v, want %v", tt.svc.Name, used, tt.wantUsed)
+		}
+		events := quotaEvents(recorder)
+		switch {
+		case tt.wantEvent == "" && len(events) != 0:
+			t.Errorf("service [%s] events = %v, want none", tt.svc.Name, events)
+		case tt.wantEvent != "" && (len(events) != 1 || !strings.Contains(events[0], tt.wantEvent)):
+			t.Errorf("service [%s] events = %v, want %v", tt.svc.Name, events, tt.wantEvent)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// ErrReservationExpired is returned when the requested address of a pending service is released, the service is
+// requeued and allocated an address from its pool
+var ErrReservationExpired = errors.New("reservation expired")
+
+const (
+	//ReservationTTLAnnotation is how long (i.e. 10m) the requested address of a service is held while it is pending
+	ReservationTTLAnnotation = "kube-vip.io/reservation-ttl"
+
+	//ReservedAtAnnotation records when a pending service with a reservation TTL was first seen
+	ReservedAtAnnotation = "kube-vip.io/reserved-at"
+
+	//ReasonReservationExpired is the event reason when the requested address of a pending service is released
+	ReasonReservationExpired = "ReservationExpired"
+)
+
+// reservationExpired releases the requested address of a service that has been pending (with no ingress) for longer
+// than its reservation TTL, expired is true if the address was released
+func (k *kubevipLoadBalancerManager) reservationExpired(ctx context.Context, service *v1.Service) (expired bool, err error) {
+	value := service.Annotations[ReservationTTLAnnotation]
+	if value == "" {
+		return false, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		klog.Warningf("ignoring [%s] [%s] on service [%s], it isn't a positive duration", ReservationTTLAnnotation, value, service.Name)
+		return false, nil
+	}
+
+	reservedAt, reservedErr := time.Parse(time.RFC3339, service.Annotations[ReservedAtAnnotation])
+	pending := len(service.Status.LoadBalancer.Ingress) == 0
+	switch {
+	case !pending && service.Annotations[ReservedAtAnnotation] == "":
+		return false, nil
+	case !pending:
+		// The service is no longer pending, so the reservation is kept
+		return false, k.updateReservation(ctx, service, func(s *v1.Service) {
+			delete(s.Annotations, ReservedAtAnnotation)
+		})
+	case reservedErr != nil:
+		return false, k.updateReservation(ctx, service, func(s *v1.Service) {
+			s.Annotations[ReservedAtAnnotation] = k.clock.Now().UTC().Format(time.RFC3339)
+		})
+	case k.clock.Since(reservedAt) < ttl:
+		return false, nil
+	}
+
+	address := service.Spec.LoadBalancerIP
+	err = k.updateReservation(ctx, service, func(s *v1.Service) {
+		delete(s.Annotations, ReservedAtAnnotation)
+		s.Spec.LoadBalancerIP = ""
+	})
+	if err != nil {
+		return false, err
+	}
+	klog.Infof("released address [%s] of service [%s], it was pending for longer than [%s]", address, service.Name, ttl)
+	k.recorder.Eventf(service, v1.EventTypeWarning, ReasonReservationExpired, "released address [%s], the service was pending for longer than [%s]", address, ttl)
+	k.allocations.remove(service.UID)
+	k.releaseWarm(address)
+	return true, nil
+}
+
+// updateReservation applies the change to the latest version of the service
+func (k *kubevipLoadBalancerManager) updateReservation(ctx context.Context, service *v1.Service, change func(*v1.Service)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		change(recentService)
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		if updateErr != nil {
+			return fmt.Errorf("unable to update the reservation of service [%s]: %w", service.Name, updateErr)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// ResyncInterval is how often the provider reconciles every service itself, 0 disables the resync
+var ResyncInterval time.Duration
+
+// reconcileTimes records when each service was last reconciled successfully
+type reconcileTimes struct {
+	mu   sync.Mutex
+	last map[types.UID]time.Time
+}
+
+func newReconcileTimes() *reconcileTimes {
+	return &reconcileTimes{last: make(map[types.UID]time.Time)}
+}
+
+// done records that the service was reconciled
+func (r *reconcileTimes) done(uid types.UID, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last[uid] = now
+}
+
+// recent returns true if the service was reconciled within the interval
+func (r *reconcileTimes) recent(uid types.UID, now time.Time, interval time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.last[uid]
+	return ok && now.Sub(last) < interval
+}
+
+// forget removes the service, it is reconciled by the next resync
+func (r *reconcileTimes) forget(uid types.UID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.last, uid)
+}
+
+// resync reconciles every managed load balancer service that hasn't been reconciled within the interval, returning
+// the number of services reconciled. A service that fails is logged and retried by the next resync
+func (k *kubevipLoadBalancerManager) resync(ctx context.Context) (synced int, err error) {
+	namespaces := []string{v1.NamespaceAll}
+	if len(k.watchedNamespaces) != 0 {
+		namespaces = namespaces[:0]
+		for ns := range k.watchedNamespaces {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	var skipped int
+	for _, ns := range namespaces {
+		svcs, err := k.kubeClient.CoreV1().Services(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return synced, err
+		}
+		for x := range svcs.Items {
+			service := &svcs.Items[x]
+			if service.Spec.Type != v1.ServiceTypeLoadBalancer || !k.managed(service) {
+				continue
+			}
+			if k.reconciled.recent(service.UID, k.clock.Now(), k.resyncInterval) {
+				skipped++
+				continue
+			}
+			if _, err := k.syncLoadBalancer(ctx, service); err != nil {
+				klog.Warningf("unable to resync service [%s/%s]: %v", service.Namespace, service.Name, err)
+				continue
+			}
+			synced++
+		}
+	}
+	klog.V(2).Infof("resynced [%d] services, skipped [%d] reconciled within [%s]", synced, skipped, k.resyncInterval)
+	return synced, nil
+}
+
+// resyncStartup reconciles the services every interval until stopped
+func (k *kubevipLoadBalancerManager) resyncStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if _, err := k.resync(context.Background()); err != nil {
+			klog.Warningf("unable to resync services: %v", err)
+		}
+	}, k.resyncInterval, stop)
+}
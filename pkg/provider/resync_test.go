@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_resync(t *testing.T) {
+	ipam.Manager = nil
+	old := newTestService("dev", "old")
+	recent := newTestService("dev", "recent")
+	fresh := newTestService("dev", "fresh")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, old, recent, fresh)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	k.resyncInterval = 5 * time.Minute
+
+	if _, err := k.syncLoadBalancer(context.TODO(), old); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	fakeClock.Step(10 * time.Minute)
+	if _, err := k.syncLoadBalancer(context.TODO(), recent); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	fakeClock.Step(2 * time.Minute)
+
+	// The service reconciled two minutes ago is skipped, the others are reconciled
+	synced, err := k.resync(context.TODO())
+	if err != nil {
+		t.Fatalf("resync() error = %v", err)
+	}
+	if synced != 2 {
+		t.Errorf("resync() synced %d services, want 2", synced)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), fresh.Name, metav1.GetOptions{})
+	if got.Labels["ipam-address"] == "" {
+		t.Errorf("resync() didn't allocate the service that was never reconciled")
+	}
+
+	// Every service was just reconciled
+	if synced, _ := k.resync(context.TODO()); synced != 0 {
+		t.Errorf("resync() synced %d services, want 0", synced)
+	}
+	fakeClock.Step(5 * time.Minute)
+	if synced, _ := k.resync(context.TODO()); synced != 3 {
+		t.Errorf("resync() synced %d services, want 3", synced)
+	}
+}
+
+func Test_resyncStaleCopy(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, svc)
+	stale := svc.DeepCopy()
+
+	// The service controller allocates the service after the resync listed it
+	if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), stale); err != nil {
+		t.Fatalf("syncLoadBalancer() stale copy error = %v", err)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if got.Spec.LoadBalancerIP != "192.168.0.1" {
+		t.Errorf("service address = %v after syncing a stale copy, want 192.168.0.1", got.Spec.LoadBalancerIP)
+	}
+	recorder := k.recorder.(*record.FakeRecorder)
+	var allocations int
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, "allocated address") {
+			allocations++
+		}
+	}
+	if allocations != 1 {
+		t.Errorf("got %d allocation events, want 1", allocations)
+	}
+}
+
+func Test_reconcileTimes(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newReconcileTimes()
+	if r.recent("uid-a", start, time.Minute) {
+		t.Errorf("recent() = true for a service that was never reconciled")
+	}
+	r.done("uid-a", start)
+	if !r.recent("uid-a", start.Add(59*time.Second), time.Minute) {
+		t.Errorf("recent() = false within the interval")
+	}
+	if r.recent("uid-a", start.Add(time.Minute), time.Minute) {
+		t.Errorf("recent() = true once the interval has passed")
+	}
+	r.forget("uid-a")
+	if r.recent("uid-a", start, time.Minute) {
+		t.Errorf("recent() = true for a forgotten service")
+	}
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// NodeSubnetPolicy is how a static address that isn't in a subnet of the nodes is handled
+var NodeSubnetPolicy = NodeSubnetIgnore
+
+// NodeSubnetPrefix is the prefix length of the subnet inferred from each IPv4 node address, IPv6 subnets are /64
+var NodeSubnetPrefix = 24
+
+const (
+	//NodeSubnetIgnore doesn't check that static addresses are in a subnet of the nodes
+	NodeSubnetIgnore = "ignore"
+
+	//NodeSubnetWarn emits a warning event for a static address that isn't in a subnet of the nodes
+	NodeSubnetWarn = "warn"
+
+	//NodeSubnetStrict refuses a static address that isn't in a subnet of the nodes
+	NodeSubnetStrict = "strict"
+
+	//ReasonAddressOffSubnet is the event reason when a static address isn't in a subnet of the nodes
+	ReasonAddressOffSubnet = "AddressOffSubnet"
+)
+
+// nodeSubnets returns the subnet of every internal node address, the mask isn't known so the subnet of an IPv4
+// address is inferred from the prefix and an IPv6 address is in its /64
+func (k *kubevipLoadBalancerManager) nodeSubnets(ctx context.Context) ([]*net.IPNet, error) {
+	nodes, err := k.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var subnets []*net.IPNet
+	for x := range nodes.Items {
+		for _, address := range nodes.Items[x].Status.Addresses {
+			if address.Type != v1.NodeInternalIP {
+				continue
+			}
+			ip := net.ParseIP(address.Address)
+			if ip == nil {
+				continue
+			}
+			mask := net.CIDRMask(64, 128)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				mask = net.CIDRMask(k.nodeSubnetPrefix, 32)
+			}
+			subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+			if !seen[subnet.String()] {
+				seen[subnet.String()] = true
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+	return subnets, nil
+}
+
+// checkNodeSubnet applies the node subnet policy to the static address of the service, an address outside every
+// node subnet is only refused when the policy is strict
+func (k *kubevipLoadBalancerManager) checkNodeSubnet(ctx context.Context, service *v1.Service) error {
+	if k.nodeSubnetPolicy == NodeSubnetIgnore {
+		return nil
+	}
+	address := service.Spec.LoadBalancerIP
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	subnets, err := k.nodeSubnets(ctx)
+	if err != nil {
+		klog.V(2).Infof("unable to check address [%s] of service [%s] against the node subnets: %v", address, service.Name, err)
+		return nil
+	}
+	if len(subnets) == 0 {
+		klog.V(2).Infof("no node has an internal address, not checking address [%s] of service [%s]", address, service.Name)
+		return nil
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return nil
+		}
+	}
+
+	message := fmt.Sprintf("[%s] requested by service [%s] isn't in a subnet of the nodes %v", address, service.Name, subnets)
+	if k.nodeSubnetPolicy == NodeSubnetStrict {
+		return fmt.Errorf("%w, %s", ErrInvalidAddress, message)
+	}
+	klog.Warningf("%s", message)
+	k.recorder.Event(service, v1.EventTypeWarning, ReasonAddressOffSubnet, message)
+	return nil
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_syncLoadBalancerNodeSubnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		requested string
+		wantErr   bool
+		wantEvent bool
+	}{
+		{name: "on subnet", policy: NodeSubnetWarn, requested: "192.168.0.200"},
+		{name: "on an IPv6 subnet", policy: NodeSubnetWarn, requested: "fd00::200"},
+		{name: "off subnet", policy: NodeSubnetWarn, requested: "10.0.0.200", wantEvent: true},
+		{name: "off subnet, strict", policy: NodeSubnetStrict, requested: "10.0.0.200", wantErr: true},
+		{name: "off subnet, ignored", policy: NodeSubnetIgnore, requested: "10.0.0.200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			node := newTestNode("node-1",
+				v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.10"},
+				v1.NodeAddress{Type: v1.NodeInternalIP, Address: "fd00::10"},
+				v1.NodeAddress{Type: v1.NodeExternalIP, Address: "10.0.0.10"},
+			)
+			svc := newTestService("dev", "static")
+			svc.Spec.LoadBalancerIP = tt.requested
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.1.0/24"}, node, svc)
+			k.nodeSubnetPolicy = tt.policy
+			recorder := k.recorder.(*record.FakeRecorder)
+
+			_, err := k.syncLoadBalancer(context.TODO(), svc)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAddress) {
+					t.Fatalf("syncLoadBalancer() error = %v, want %v", err, ErrInvalidAddress)
+				}
+				got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+				if got.Annotations[IPAMStatusAnnotation] != IPAMStatusInvalidAddress {
+					t.Errorf("annotation [%s] = %q, want %q", IPAMStatusAnnotation, got.Annotations[IPAMStatusAnnotation], IPAMStatusInvalidAddress)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			var offSubnet bool
+			for len(recorder.Events) > 0 {
+				if e := <-recorder.Events; strings.Contains(e, ReasonAddressOffSubnet) {
+					offSubnet = true
+				}
+			}
+			if offSubnet != tt.wantEvent {
+				t.Errorf("%s event = %v, want %v", ReasonAddressOffSubnet, offSubnet, tt.wantEvent)
+			}
+		})
+	}
+}
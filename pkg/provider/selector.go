@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// ErrInvalidSelector is returned when a pool selector can't be parsed
+var ErrInvalidSelector = errors.New("invalid pool selector")
+
+//PoolSelectorKeyPrefix is followed by the pool, i.e. pool-selector-prod: tier in (frontend), a service with labels
+//matching the selector takes its address from the cidr-prod/range-prod pool
+const PoolSelectorKeyPrefix = "pool-selector-"
+
+// poolSelectors returns the pools and their selectors (with the key prefix) in the config map, sorted by pool
+func poolSelectors(cm *v1.ConfigMap, keyPrefix string) (pools []string, selectors map[string]labels.Selector, errs []error) {
+	selectors = make(map[string]labels.Selector)
+	for key, value := range cm.Data {
+		if !strings.HasPrefix(key, keyPrefix+PoolSelectorKeyPrefix) {
+			continue
+		}
+		selector, err := labels.Parse(value)
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: key, Value: value, Err: fmt.Errorf("%w: %v", ErrInvalidSelector, err)})
+			continue
+		}
+		pool := strings.TrimPrefix(key, keyPrefix+PoolSelectorKeyPrefix)
+		pools = append(pools, pool)
+		selectors[pool] = selector
+	}
+	sort.Strings(pools)
+	return pools, selectors, errs
+}
+
+// selectedPools returns the pools whose selector matches the labels of the service, in order of the pool name
+func selectedPools(cm *v1.ConfigMap, service *v1.Service, keyPrefix string) []string {
+	pools, selectors, errs := poolSelectors(cm, keyPrefix)
+	for _, err := range errs {
+		klog.Warningf("ignoring %v", err)
+	}
+	var selected []string
+	for _, pool := range pools {
+		if selectors[pool].Matches(labels.Set(service.Labels)) {
+			selected = append(selected, pool)
+		}
+	}
+	return selected
+}
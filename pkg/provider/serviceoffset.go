@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// ErrNoServiceCidr is returned when a pool is relative to the service network, but the service network isn't known
+var ErrNoServiceCidr = errors.New("no service cidr")
+
+// serviceOffsetEnabled returns true if the config map derives a pool from the service network
+func serviceOffsetEnabled(cm *v1.ConfigMap) bool {
+	_, ok := cm.Data[ServiceOffsetCidrKey]
+	return ok
+}
+
+// serviceOffsetCidr returns the cidr of the pool relative to the service network
+func serviceOffsetCidr(cm *v1.ConfigMap, serviceCidr string) (string, error) {
+	if serviceCidr == "" {
+		return "", fmt.Errorf("%w, [%s] needs the service network (--service-cidr)", ErrNoServiceCidr, ServiceOffsetCidrKey)
+	}
+	return ipam.OffsetCidr(serviceCidr, cm.Data[ServiceOffsetCidrKey])
+}
+
+// discoverServiceOffsetAddress allocates from the pool relative to the service network, the addresses of kube-vip
+// services in every namespace are excluded as the pool is shared by all namespaces
+func (k *kubevipLoadBalancerManager) discoverServiceOffsetAddress(ctx context.Context, cm *v1.ConfigMap, namespace string) (*allocation, error) {
+	cidr, err := serviceOffsetCidr(cm, k.serviceCidr)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(2).Infof("Taking address from [%s] pool [%s]", ServiceOffsetCidrKey, cidr)
+	vip, err := ipam.FindAvailableHostFromCidr(namespace, cidr, ipam.NormalizeAddresses(allocatedAddresses(allocations)))
+	if err != nil {
+		return nil, err
+	}
+	return &allocation{address: vip, pool: ServiceOffsetCidrKey, prefix: cidr}, nil
+}
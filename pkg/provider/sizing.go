@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serviceAllocation is an address that has been allocated to a kube-vip service
+type serviceAllocation struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+}
+
+// listAllocations returns the addresses allocated to kube-vip services in all namespaces
+func listAllocations(ctx context.Context, client kubernetes.Interface) ([]serviceAllocation, error) {
+	svcs, err := client.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: "implementation=kube-vip"})
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []serviceAllocation
+	for x := range svcs.Items {
+		address := svcs.Items[x].Labels["ipam-address"]
+		if address == "" {
+			continue
+		}
+		allocations = append(allocations, serviceAllocation{
+			Namespace: svcs.Items[x].Namespace,
+			Name:      svcs.Items[x].Name,
+			Address:   address,
+		})
+	}
+	return allocations, nil
+}
+
+// allocatedAddresses returns just the addresses of the allocations
+func allocatedAddresses(allocations []serviceAllocation) []string {
+	addresses := make([]string, 0, len(allocations))
+	for x := range allocations {
+		addresses = append(addresses, allocations[x].Address)
+	}
+	return addresses
+}
+
+// poolKind returns the kind of allocator of the config map key (i.e. "cidr"), or empty if it isn't a pool
+func poolKind(key, keyPrefix string) string {
+	if key == NodeCidrKey || key == ServiceOffsetCidrKey || strings.HasPrefix(key, keyPrefix+CidrStartOffsetKeyPrefix) || strings.HasPrefix(key, keyPrefix+CidrStrategyKeyPrefix) {
+		return ""
+	}
+	for _, allocator := range allocators {
+		if strings.HasPrefix(key, keyPrefix+allocator.Kind()+"-") {
+			return allocator.Kind()
+		}
+	}
+	return ""
+}
+
+// poolStats returns the usage of every pool (with the key prefix) in the config map, sorted by pool key
+func poolStats(cm *v1.ConfigMap, keyPrefix string, inUse []string) ([]ipam.PoolStats, error) {
+	var stats []ipam.PoolStats
+	for key, definition := range cm.Data {
+		allocator := allocatorFor(poolKind(key, keyPrefix))
+		if allocator == nil {
+			continue
+		}
+		s, err := allocator.Stats(key, definition, inUse)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse pool [%s]: %v", key, err)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Pool < stats[j].Pool })
+	return stats, nil
+}
+
+// PoolSizing - describes whether a pool can hold a target number of services
+type PoolSizing struct {
+	ipam.PoolStats
+
+	// Target is the projected number of services allocated from the pool
+	Target int `json:"target"`
+	// Sufficient is true when the pool can hold the target
+	Sufficient bool `json:"sufficient"`
+	// Grow is the number of addresses that would need adding to the pool to hold the target
+	Grow int `json:"grow"`
+}
+
+// suggestPoolSizing reports for every pool whether it could hold the target number of services
+func suggestPoolSizing(stats []ipam.PoolStats, target int) []PoolSizing {
+	sizing := make([]PoolSizing, 0, len(stats))
+	for x := range stats {
+		s := PoolSizing{
+			PoolStats:  stats[x],
+			Target:     target,
+			Sufficient: stats[x].Size >= target,
+		}
+		if !s.Sufficient {
+			s.Grow = target - stats[x].Size
+		}
+		sizing = append(sizing, s)
+	}
+	return sizing
+}
+
+// PoolSizingReport - compares the pools in the config map against a target number of services per pool
+func PoolSizingReport(ctx context.Context, client kubernetes.Interface, namespace, configMap, keyPrefix string, target int) ([]PoolSizing, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, configMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if cm, err = expandConfigMap(cm); err != nil {
+		return nil, err
+	}
+	allocations, err := listAllocations(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := poolStats(cm, keyPrefix, allocatedAddresses(allocations))
+	if err != nil {
+		return nil, err
+	}
+	return suggestPoolSizing(stats, target), nil
+}
+
+// WritePoolSizing - writes the sizing report as a table, or as JSON
+func WritePoolSizing(w io.Writer, sizing []PoolSizing, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sizing)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tDEFINITION\tSIZE\tUSED\tFREE\tTARGET\tSUFFICIENT\tGROW")
+	for _, s := range sizing {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%t\t%d\n", s.Pool, s.Definition, s.Size, s.Used, s.Free, s.Target, s.Sufficient, s.Grow)
+	}
+	return tw.Flush()
+}
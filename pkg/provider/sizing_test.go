@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func Test_suggestPoolSizing(t *testing.T) {
+	stats := []ipam.PoolStats{
+		{Pool: "cidr-dev", Definition: "192.168.0.200/29", Size: 6, Used: 4, Free: 2},
+		{Pool: "range-global", Definition: "192.168.1.10-192.168.1.29", Size: 20, Used: 5, Free: 15},
+	}
+	tests := []struct {
+		name   string
+		target int
+		want   []PoolSizing
+	}{
+		{
+			name:   "under-provisioned pool",
+			target: 10,
+			want: []PoolSizing{
+				{PoolStats: stats[0], Target: 10, Sufficient: false, Grow: 4},
+				{PoolStats: stats[1], Target: 10, Sufficient: true},
+			},
+		},
+		{
+			name:   "over-provisioned pools",
+			target: 6,
+			want: []PoolSizing{
+				{PoolStats: stats[0], Target: 6, Sufficient: true},
+				{PoolStats: stats[1], Target: 6, Sufficient: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suggestPoolSizing(stats, tt.target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("suggestPoolSizing() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolSizingReport(t *testing.T) {
+	used := newTestService("dev", "used")
+	used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	other := newTestService("staging", "other")
+	other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.1.10"}
+	k := newTestLoadBalancer(map[string]string{
+		"cidr-dev":       "192.168.0.200/30",
+		"range-global":   "192.168.1.10-192.168.1.13",
+		FallbackOrderKey: "namespace,global",
+	}, used, other)
+
+	sizing, err := PoolSizingReport(context.TODO(), k.kubeClient, "kube-system", KubeVipClientConfig, "", 3)
+	if err != nil {
+		t.Fatalf("PoolSizingReport() error = %v", err)
+	}
+	want := []PoolSizing{
+		{PoolStats: ipam.PoolStats{Pool: "cidr-dev", Definition: "192.168.0.200/30", Size: 2, Used: 1, Free: 1}, Target: 3, Grow: 1},
+		{PoolStats: ipam.PoolStats{Pool: "range-global", Definition: "192.168.1.10-192.168.1.13", Size: 4, Used: 1, Free: 3}, Target: 3, Sufficient: true},
+	}
+	if !reflect.DeepEqual(sizing, want) {
+		t.Errorf("PoolSizingReport() = %+v, want %+v", sizing, want)
+	}
+
+	var b bytes.Buffer
+	if err := WritePoolSizing(&b, sizing, false); err != nil {
+		t.Fatalf("WritePoolSizing() error = %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(b.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "cidr-dev") {
+		t.Errorf("WritePoolSizing() = %q, want a header and a row per pool", b.String())
+	}
+}
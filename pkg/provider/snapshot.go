@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// SnapshotInterval is how often the allocations are written to the snapshot config map, zero disables snapshots
+var SnapshotInterval time.Duration
+
+// SnapshotRetention is how long the entry of a service without an address is kept in the snapshot, so that services
+// recreated after a restore are still given their previous address
+var SnapshotRetention = 24 * time.Hour
+
+// KubeVipAllocationSnapshot is the config map (in kube-system) that the allocations are snapshotted into, keys are
+// <namespace>.<service> as namespaces can't contain a "."
+const KubeVipAllocationSnapshot = "kubevip-allocation-snapshot"
+
+// snapshot is the previous address of each service, services are given their previous address when it is free
+type snapshot struct {
+	mu        sync.Mutex
+	addresses map[string]string
+}
+
+func snapshotKey(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// previous returns the address of the service in the snapshot
+func (s *snapshot) previous(service *v1.Service) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addresses[snapshotKey(service.Namespace, service.Name)]
+}
+
+// snapshotMissing records since when each snapshot entry has had no allocated service
+type snapshotMissing struct {
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+func newSnapshotMissing() *snapshotMissing {
+	return &snapshotMissing{since: make(map[string]time.Time)}
+}
+
+// retained returns true if the entry has been missing for less than the retention, it is missing from now on
+func (m *snapshotMissing) retained(key string, now time.Time, retention time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since, ok := m.since[key]
+	if !ok {
+		m.since[key] = now
+		return true
+	}
+	if now.Sub(since) < retention {
+		return true
+	}
+	delete(m.since, key)
+	return false
+}
+
+// found records that the entry has an allocated service again
+func (m *snapshotMissing) found(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.since, key)
+}
+
+// writeSnapshot records the address of every kube-vip service in the snapshot config map. The entries of services
+// without an address (i.e. not recreated yet after a restore) are kept until they have been missing for the retention
+func (k *kubevipLoadBalancerManager) writeSnapshot(ctx context.Context) error {
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return err
+	}
+	allocated := make(map[string]string, len(allocations))
+	for _, a := range allocations {
+		allocated[snapshotKey(a.Namespace, a.Name)] = a.Address
+	}
+
+	configMaps := k.kubeClient.CoreV1().ConfigMaps("kube-system")
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, KubeVipAllocationSnapshot, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: KubeVipAllocationSnapshot, Namespace: "kube-system"}, Data: allocated}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string, len(allocated))
+		}
+		for key := range cm.Data {
+			if _, ok := allocated[key]; !ok && !k.snapshotMissing.retained(key, k.clock.Now(), k.snapshotRetention) {
+				klog.V(2).Infof("removing [%s] from snapshot [%s], it has had no address for [%s]", key, KubeVipAllocationSnapshot, k.snapshotRetention)
+				delete(cm.Data, key)
+			}
+		}
+		for key, address := range allocated {
+			k.snapshotMissing.found(key)
+			cm.Data[key] = address
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// loadSnapshot reads the snapshot config map so that services are given their previous addresses, i.e. when a
+// cluster is restored from a backup
+func (k *kubevipLoadBalancerManager) loadSnapshot(ctx context.Context) error {
+	cm, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipAllocationSnapshot, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	k.snapshot = &snapshot{addresses: make(map[string]string, len(cm.Data))}
+	for key, address := range cm.Data {
+		k.snapshot.addresses[key] = ipam.NormalizeAddress(address)
+	}
+	klog.Infof("loaded [%d] addresses from snapshot [%s]", len(cm.Data), KubeVipAllocationSnapshot)
+	return nil
+}
+
+// snapshotStartup loads the snapshot and then writes it every interval until stopped
+func (k *kubevipLoadBalancerManager) snapshotStartup(stop <-chan struct{}) {
+	if err := k.loadSnapshot(context.Background()); err != nil {
+		klog.Warningf("unable to load snapshot [%s]: %v", KubeVipAllocationSnapshot, err)
+	}
+	go wait.Until(func() {
+		if err := k.writeSnapshot(context.Background()); err != nil {
+			klog.Warningf("unable to write snapshot [%s]: %v", KubeVipAllocationSnapshot, err)
+		}
+	}, SnapshotInterval, stop)
+}
+
+// preferSnapshot returns the previous address of the service instead of the discovered address, if the previous
+// address is free and in the same pool
+func (k *kubevipLoadBalancerManager) preferSnapshot(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation, existingServiceIPS []string) *allocation {
+	previous := k.snapshot.previous(service)
+	if previous == "" || previous == discovered.address {
+		return discovered
+	}
+	preferred, ok := k.preferAddress(ctx, cm, service, discovered, existingServiceIPS, previous)
+	if ok {
+		klog.Infof("restoring previous address [%s] of service [%s] from the snapshot", previous, service.Name)
+		preferred.source = SourceReserved
+	}
+	return preferred
+}
+
+// preferAddress returns the allocation with the address instead of the discovered one, ok is false (and the
+// discovered allocation is returned) if the address is in use or isn't in the discovered pool
+func (k *kubevipLoadBalancerManager) preferAddress(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation, existingServiceIPS []string, address string) (a *allocation, ok bool) {
+	// The address may be in use in another namespace sharing the pool
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		klog.Warningf("unable to use address [%s] for service [%s]: %v", address, service.Name, err)
+		return discovered, false
+	}
+	for _, inUse := range append(existingServiceIPS, allocatedAddresses(allocations)...) {
+		if ipam.NormalizeAddress(inUse) == address {
+			klog.V(2).Infof("address [%s] for service [%s] is in use", address, service.Name)
+			return discovered, false
+		}
+	}
+
+	kind := poolKind(discovered.pool, k.keyPrefix)
+	allocator := allocatorFor(kind)
+	if allocator == nil {
+		return discovered, false
+	}
+	// The network and broadcast addresses (and reserved gateways) are never allocated from a cidr
+	if kind == "cidr" && (ipam.IsNetworkOrBroadcast(cm.Data[discovered.pool], address) || reservedGateway(cm, cm.Data[discovered.pool], address)) {
+		return discovered, false
+	}
+	bounds, err := allocator.Bounds(cm.Data[discovered.pool])
+	if err != nil {
+		return discovered, false
+	}
+	ip := net.ParseIP(address)
+	for _, b := range bounds {
+		if ip != nil && b.Contains(ip) {
+			k.releaseWarm(discovered.address)
+			preferred := *discovered
+			preferred.address = address
+			if prefix, err := allocator.Prefix(cm.Data[discovered.pool], address); err == nil {
+				preferred.prefix = prefix
+			}
+			return &preferred, true
+		}
+	}
+	klog.V(2).Infof("address [%s] for service [%s] isn't in pool [%s]", address, service.Name, discovered.pool)
+	return discovered, false
+}
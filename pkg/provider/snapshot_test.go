@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func Test_writeSnapshot(t *testing.T) {
+	dev := newTestService("dev", "web")
+	dev.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.201"}
+	staging := newTestService("staging", "api")
+	staging.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.202"}
+	pending := newTestService("dev", "pending")
+	k := newTestLoadBalancer(nil, dev, staging, pending)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+	k.snapshotRetention = time.Hour
+
+	snapshot := func() map[string]string {
+		if err := k.writeSnapshot(context.TODO()); err != nil {
+			t.Fatalf("writeSnapshot() error = %v", err)
+		}
+		cm, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipAllocationSnapshot, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("snapshot wasn't written: %v", err)
+		}
+		return cm.Data
+	}
+
+	if got, want := snapshot(), map[string]string{"dev.web": "192.168.0.201", "staging.api": "192.168.0.202"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot = %v, want %v", got, want)
+	}
+	// The entry of a service without an address is kept for the retention, i.e. until it is recreated after a restore
+	if err := k.kubeClient.CoreV1().Services("staging").Delete(context.TODO(), staging.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snapshot(), map[string]string{"dev.web": "192.168.0.201", "staging.api": "192.168.0.202"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot = %v, want %v", got, want)
+	}
+	fakeClock.Step(time.Hour)
+	if got, want := snapshot(), map[string]string{"dev.web": "192.168.0.201"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot after the retention = %v, want %v", got, want)
+	}
+}
+
+func Test_writeSnapshotAtStartup(t *testing.T) {
+	// The cluster was restored from a backup, the services haven't been recreated yet
+	snapshotCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipAllocationSnapshot, Namespace: "kube-system"},
+		Data:       map[string]string{"dev.web": "192.168.0.201", "dev.api": "192.168.0.202"},
+	}
+	web := newTestService("dev", "web")
+	web.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.203"}
+	k := newTestLoadBalancer(nil, web, snapshotCM)
+
+	if err := k.loadSnapshot(context.TODO()); err != nil {
+		t.Fatalf("loadSnapshot() error = %v", err)
+	}
+	if err := k.writeSnapshot(context.TODO()); err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+	cm, _ := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipAllocationSnapshot, metav1.GetOptions{})
+	if want := map[string]string{"dev.web": "192.168.0.203", "dev.api": "192.168.0.202"}; !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("snapshot = %v, want %v", cm.Data, want)
+	}
+}
+
+func Test_restoreSnapshot(t *testing.T) {
+	snapshotCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipAllocationSnapshot, Namespace: "kube-system"},
+		Data: map[string]string{
+			"dev.restored": "192.168.0.204",
+			"dev.taken":    "192.168.0.205",
+			"dev.moved":    "192.168.1.10",
+		},
+	}
+	// The previous address of "taken" now belongs to a service in another namespace
+	other := newTestService("staging", "other")
+	other.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.205"}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "restored", want: "192.168.0.204"},
+		{name: "taken", want: "192.168.0.201"},
+		{name: "moved", want: "192.168.0.201"},
+		{name: "new", want: "192.168.0.201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			svc := newTestService("dev", tt.name)
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc, other, snapshotCM)
+			if err := k.loadSnapshot(context.TODO()); err != nil {
+				t.Fatalf("loadSnapshot() error = %v", err)
+			}
+
+			if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if got.Spec.LoadBalancerIP != tt.want {
+				t.Errorf("syncLoadBalancer() address = %v, want %v", got.Spec.LoadBalancerIP, tt.want)
+			}
+			if got.Annotations[AllocatedCidrAnnotation] != "192.168.0.200/29" {
+				t.Errorf("annotation [%s] = %v, want 192.168.0.200/29", AllocatedCidrAnnotation, got.Annotations[AllocatedCidrAnnotation])
+			}
+		})
+	}
+}
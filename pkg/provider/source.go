@@ -0,0 +1,32 @@
+package provider
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	//AllocationSourceAnnotation records where the address of a service came from
+	AllocationSourceAnnotation = "kube-vip.io/allocation-source"
+
+	//SourceStatic is an address requested by the user, through spec.loadBalancerIP or an existing ingress
+	SourceStatic = "static"
+
+	//SourceDynamic is an address discovered from a pool
+	SourceDynamic = "dynamic"
+
+	//SourceReserved is an address restored from the allocation snapshot
+	SourceReserved = "reserved"
+)
+
+// allocationSource returns where the address of the service came from, a service allocated before the source was
+// recorded is dynamic if kube-vip labelled it with its address
+func allocationSource(service *v1.Service) string {
+	switch source := service.Annotations[AllocationSourceAnnotation]; source {
+	case SourceStatic, SourceDynamic, SourceReserved:
+		return source
+	}
+	if service.Spec.LoadBalancerIP != "" && service.Labels["ipam-address"] != service.Spec.LoadBalancerIP {
+		return SourceStatic
+	}
+	return SourceDynamic
+}
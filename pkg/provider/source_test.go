@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func Test_allocationSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		address    string
+		label      string
+		annotation string
+		want       string
+	}{
+		{name: "requested", address: "192.168.0.10", want: SourceStatic},
+		{name: "allocated", address: "192.168.0.10", label: "192.168.0.10", want: SourceDynamic},
+		{name: "pending", want: SourceDynamic},
+		{name: "recorded", address: "192.168.0.10", label: "192.168.0.10", annotation: SourceReserved, want: SourceReserved},
+		{name: "unknown recorded source", address: "192.168.0.10", annotation: "other", want: SourceStatic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService("dev", "lb")
+			svc.Spec.LoadBalancerIP = tt.address
+			svc.Labels = map[string]string{"ipam-address": tt.label}
+			svc.Annotations = map[string]string{AllocationSourceAnnotation: tt.annotation}
+			if got := allocationSource(svc); got != tt.want {
+				t.Errorf("allocationSource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerAllocationSource(t *testing.T) {
+	snapshotCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipAllocationSnapshot, Namespace: "kube-system"},
+		Data:       map[string]string{"dev.restored": "192.168.0.204"},
+	}
+	static := newTestService("dev", "static")
+	static.Spec.LoadBalancerIP = "192.168.0.203"
+	dynamic := newTestService("dev", "dynamic")
+	restored := newTestService("dev", "restored")
+
+	tests := []struct {
+		service *v1.Service
+		want    string
+	}{
+		{service: static, want: SourceStatic},
+		{service: dynamic, want: SourceDynamic},
+		{service: restored, want: SourceReserved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service.Name, func(t *testing.T) {
+			ipam.Manager = nil
+			k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, tt.service, snapshotCM)
+			if err := k.loadSnapshot(context.TODO()); err != nil {
+				t.Fatalf("loadSnapshot() error = %v", err)
+			}
+			counts := map[string]float64{}
+			for _, source := range []string{SourceStatic, SourceDynamic, SourceReserved} {
+				counts[source], _ = testutil.GetCounterMetricValue(allocationsCounter.WithLabelValues(source))
+			}
+
+			// Syncing the service again isn't another allocation
+			svc := tt.service
+			for x := 0; x < 2; x++ {
+				if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+					t.Fatalf("syncLoadBalancer() error = %v", err)
+				}
+				svc, _ = k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			}
+			for source, before := range counts {
+				want := before
+				if source == tt.want {
+					want++
+				}
+				if got, _ := testutil.GetCounterMetricValue(allocationsCounter.WithLabelValues(source)); got != want {
+					t.Errorf("[%s] allocations = %v, want %v", source, got, want)
+				}
+			}
+			if got, _ := testutil.GetGaugeMetricValue(allocationsGauge.WithLabelValues("dev", tt.want)); got != 1 {
+				t.Errorf("[%s] allocated addresses = %v, want 1", tt.want, got)
+			}
+			if tt.want != SourceStatic && svc.Annotations[AllocationSourceAnnotation] != tt.want {
+				t.Errorf("source annotation = %v, want %v", svc.Annotations[AllocationSourceAnnotation], tt.want)
+			}
+		})
+	}
+}
+
+func Test_serviceAddressesMetric(t *testing.T) {
+	ipam.Manager = nil
+	allocated := newTestService("dev", "allocated")
+	static := newTestService("dev", "static")
+	static.Spec.LoadBalancerIP = "192.168.0.205"
+	dual := newTestService("dev", "dual")
+	dual.Annotations = map[string]string{LoadBalancerIPsAnnotation: "192.168.0.202,fd00::5"}
+	pending := newTestService("dev", "pending")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.200/30,fd00::4/126"}, allocated, static, dual, pending)
+
+	requestedBefore, _ := testutil.GetHistogramMetricValue(requestedAddressesHistogram.ObserverMetric)
+	for _, svc := range []*v1.Service{allocated, static, dual} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer(%s) error = %v", svc.Name, err)
+		}
+	}
+	for name, want := range map[string]float64{"allocated": 1, "static": 1, "dual": 2, "pending": 0} {
+		if got, _ := testutil.GetGaugeMetricValue(serviceAddressesGauge.WithLabelValues("dev", name)); got != want {
+			t.Errorf("[%s] addresses = %v, want %v", name, got, want)
+		}
+	}
+
+	// The allocated service requested one address and the dual-stack service two, the static address isn't allocated
+	if requested, _ := testutil.GetHistogramMetricValue(requestedAddressesHistogram.ObserverMetric); requested-requestedBefore != 3 {
+		t.Errorf("requested addresses = %v, want 3", requested-requestedBefore)
+	}
+
+	// A released service no longer holds an address
+	k.allocations.remove(allocated.UID)
+	if got, _ := testutil.GetGaugeMetricValue(serviceAddressesGauge.WithLabelValues("dev", "allocated")); got != 0 {
+		t.Errorf("released service addresses = %v, want 0", got)
+	}
+}
@@ -0,0 +1,247 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// ErrNoPoolConfigured is returned when no tier in the fallback chain has a pool for a service
+var ErrNoPoolConfigured = errors.New("no pool configured")
+
+// ErrReconcileTimeout is returned when a sync doesn't complete within the reconcile timeout
+var ErrReconcileTimeout = errors.New("reconcile timed out")
+
+// ErrInvalidAddress is returned when a service requests an address that isn't a valid host
+var ErrInvalidAddress = errors.New("invalid address")
+
+// ErrAlreadyAllocated is returned when another sync allocated a different address to the service during this one
+var ErrAlreadyAllocated = errors.New("already allocated")
+
+// NoPoolRetryInterval is the minimum time between re-evaluating a service that has no pool configured
+var NoPoolRetryInterval = time.Minute
+
+// EventDeduplication only emits an IPAM event for a service when its reason changes, rather than on every reconcile
+var EventDeduplication = true
+
+// EventRepeatInterval is how long until an unchanged IPAM event is emitted again, 0 never repeats it
+var EventRepeatInterval time.Duration
+
+const (
+	//IPAMStatusAnnotation records why an address could not be allocated to a service
+	IPAMStatusAnnotation = "kube-vip.io/ipam-status"
+
+	//IPAMStatusNoPoolConfigured is set when there is no pool that the service can allocate from
+	IPAMStatusNoPoolConfigured = "no-pool-configured"
+
+	//IPAMStatusPoolExhausted is set when the pool for the service has no free addresses
+	IPAMStatusPoolExhausted = "pool-exhausted"
+
+	//IPAMStatusNamespaceDisabled is set when allocation is disabled for the namespace of the service
+	IPAMStatusNamespaceDisabled = "namespace-disabled"
+
+	//IPAMStatusInvalidAddress is set when the service requests an address that isn't a valid host
+	IPAMStatusInvalidAddress = "invalid-address"
+
+	//IPAMStatusPaused is set when the service is waiting for allocation to be unpaused
+	IPAMStatusPaused = "paused"
+
+	//IPAMStatusInvalidPool is set when the pool of the service can't be parsed, i.e. a range that is reversed
+	IPAMStatusInvalidPool = "invalid-pool"
+)
+
+// Event reasons
+const (
+	//ReasonNoPoolConfigured is the event reason when no pool is configured for a service
+	ReasonNoPoolConfigured = "NoPoolConfigured"
+
+	//ReasonPoolExhausted is the event reason when the pool for a service has no free addresses
+	ReasonPoolExhausted = "PoolExhausted"
+
+	//ReasonAllocationDisabled is the event reason when allocation is disabled for the namespace of a service
+	ReasonAllocationDisabled = "AllocationDisabled"
+
+	//ReasonInvalidAddress is the event reason when a service requests an address that isn't a valid host
+	ReasonInvalidAddress = "InvalidAddress"
+
+	//ReasonAllocationPaused is the event reason when a service is waiting for allocation to be unpaused
+	ReasonAllocationPaused = "AllocationPaused"
+
+	//ReasonInvalidPool is the event reason when the pool of a service can't be parsed
+	ReasonInvalidPool = "InvalidPool"
+
+	//ReasonAllocationWarning is the event reason when part of the request of a service was ignored
+	ReasonAllocationWarning = "AllocationWarning"
+)
+
+// ipamStatusForError maps an allocation error to the status annotation and event reason, errors that
+// aren't a terminal allocation state return an empty status
+func ipamStatusForError(err error) (status, reason string) {
+	switch {
+	case errors.Is(err, ErrNoPoolConfigured):
+		return IPAMStatusNoPoolConfigured, ReasonNoPoolConfigured
+	case errors.Is(err, ipam.ErrNoAddressesAvailable):
+		return IPAMStatusPoolExhausted, ReasonPoolExhausted
+	case errors.Is(err, ErrInvalidAddress):
+		return IPAMStatusInvalidAddress, ReasonInvalidAddress
+	case errors.Is(err, ErrAddressConflict):
+		return IPAMStatusAddressConflict, ReasonAddressConflict
+	case errors.Is(err, ErrDuplicateStaticIP):
+		return IPAMStatusDuplicateStaticIP, ReasonDuplicateStaticIP
+	case errors.Is(err, ErrPoolPolicy):
+		return IPAMStatusPoolPolicy, ReasonPoolPolicy
+	case errors.Is(err, ipam.ErrInvalidRange):
+		return IPAMStatusInvalidPool, ReasonInvalidPool
+	}
+	return "", ""
+}
+
+// allocationFailed records a failed allocation on the service
+func (k *kubevipLoadBalancerManager) allocationFailed(ctx context.Context, service *v1.Service, err error) error {
+	status, reason := ipamStatusForError(err)
+	if status == "" {
+		return err
+	}
+
+	if errors.Is(err, ErrNoPoolConfigured) {
+		k.noPoolRetries.delay(service.UID)
+	}
+
+	if updateErr := k.recordIPAMStatus(ctx, service, status, reason, err.Error()); updateErr != nil {
+		klog.Errorf("%v", updateErr)
+	}
+	return err
+}
+
+// recordIPAMStatus sets the status annotation on the service and emits a warning event, the event is deduplicated
+// so that repeated reconciles don't spam the service with the same event
+func (k *kubevipLoadBalancerManager) recordIPAMStatus(ctx context.Context, service *v1.Service, status, reason, message string) error {
+	if _, err := k.setIPAMStatus(ctx, service, status, reason, message); err != nil {
+		return fmt.Errorf("unable to set [%s] on service [%s]: %v", IPAMStatusAnnotation, service.Name, err)
+	}
+	k.ipamEvent(service, v1.EventTypeWarning, reason, message)
+	return nil
+}
+
+// ipamEvent emits the event unless it has the reason of the last event emitted for the service (and the repeat
+// interval hasn't passed)
+func (k *kubevipLoadBalancerManager) ipamEvent(service *v1.Service, eventType, reason, message string) {
+	if k.eventDeduplication && !k.events.emit(service.UID, reason, k.clock.Now(), k.eventRepeatInterval) {
+		klog.V(4).Infof("service [%s] already has a [%s] event, not emitting it again", service.Name, reason)
+		return
+	}
+	k.recorder.Event(service, eventType, reason, message)
+}
+
+// setIPAMStatus sets the status annotation and condition on the service, changed is false if both were already set
+func (k *kubevipLoadBalancerManager) setIPAMStatus(ctx context.Context, service *v1.Service, status, reason, message string) (changed bool, err error) {
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		conditionChanged := setIPAMCondition(recentService.Annotations, reason, message, metav1.NewTime(k.clock.Now()))
+		if recentService.Annotations[IPAMStatusAnnotation] == status && !conditionChanged {
+			changed = false
+			return nil
+		}
+		recentService.Annotations[IPAMStatusAnnotation] = status
+
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		changed = updateErr == nil
+		return updateErr
+	})
+	return changed, err
+}
+
+// retryLimiter tracks services that shouldn't be re-evaluated until an interval has passed
+type retryLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[types.UID]time.Time
+}
+
+func newRetryLimiter(interval time.Duration) *retryLimiter {
+	return &retryLimiter{
+		interval: interval,
+		next:     make(map[types.UID]time.Time),
+	}
+}
+
+// delay stops the service being re-evaluated until the interval has passed
+func (r *retryLimiter) delay(uid types.UID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next[uid] = time.Now().Add(r.interval)
+}
+
+// limited returns true if the service shouldn't be re-evaluated yet
+func (r *retryLimiter) limited(uid types.UID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, ok := r.next[uid]
+	if !ok {
+		return false
+	}
+	if time.Now().After(next) {
+		delete(r.next, uid)
+		return false
+	}
+	return true
+}
+
+// forget removes the service, it will be evaluated on the next reconcile
+func (r *retryLimiter) forget(uid types.UID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.next, uid)
+}
+
+// emittedEvent is the last IPAM event emitted for a service
+type emittedEvent struct {
+	reason string
+	at     time.Time
+}
+
+// eventDedup tracks the last IPAM event emitted for each service
+type eventDedup struct {
+	mu   sync.Mutex
+	last map[types.UID]emittedEvent
+}
+
+func newEventDedup() *eventDedup {
+	return &eventDedup{last: make(map[types.UID]emittedEvent)}
+}
+
+// emit returns true if the event should be emitted, because its reason differs from the last event of the service
+// or the last event is older than the repeat interval, and records it as the last event
+func (e *eventDedup) emit(uid types.UID, reason string, now time.Time, repeat time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last, ok := e.last[uid]
+	if ok && last.reason == reason && (repeat == 0 || now.Sub(last.at) < repeat) {
+		return false
+	}
+	e.last[uid] = emittedEvent{reason: reason, at: now}
+	return true
+}
+
+// forget removes the last event of the service, so that the next event is a transition
+func (e *eventDedup) forget(uid types.UID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.last, uid)
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	//StickyByNameKey when "true" records the address of every service by namespace and name, a recreated service
+	//(with a new UID) is given its recorded address if it is still free
+	StickyByNameKey = "sticky-by-name"
+
+	//StickyGraceKey is how long (i.e. 1h) the record of a deleted service is kept, the default is StickyGrace
+	StickyGraceKey = "sticky-by-name-grace"
+
+	//StickyGrace is how long the record of a deleted service is kept unless the config map sets the grace
+	StickyGrace = 24 * time.Hour
+
+	//KubeVipStickyAddresses is the config map (in kube-system) that the sticky records are kept in, keys are
+	//<namespace>.<service> as with the allocation snapshot
+	KubeVipStickyAddresses = "kubevip-sticky-addresses"
+)
+
+// StickyGCInterval is how often the records of deleted services are collected
+var StickyGCInterval = time.Minute
+
+// stickyRecord is the address recorded for a service name, missingSince is set once the service no longer exists
+type stickyRecord struct {
+	Address      string `json:"address"`
+	MissingSince string `json:"missingSince,omitempty"`
+}
+
+// stickyEnabled returns true if the config map enables sticky allocation by name
+func stickyEnabled(cm *v1.ConfigMap) bool {
+	return cm != nil && cm.Data[StickyByNameKey] == "true"
+}
+
+// stickyGrace returns how long the record of a deleted service is kept
+func stickyGrace(cm *v1.ConfigMap) time.Duration {
+	value, ok := cm.Data[StickyGraceKey]
+	if !ok {
+		return StickyGrace
+	}
+	grace, err := time.ParseDuration(value)
+	if err != nil || grace < 0 {
+		klog.Warningf("ignoring [%s] [%s], it isn't a duration", StickyGraceKey, value)
+		return StickyGrace
+	}
+	return grace
+}
+
+// readStickyRecords returns the sticky records config map (nil if it doesn't exist yet) and its records
+func (k *kubevipLoadBalancerManager) readStickyRecords(ctx context.Context) (*v1.ConfigMap, map[string]stickyRecord, error) {
+	cm, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, KubeVipStickyAddresses, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, map[string]stickyRecord{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make(map[string]stickyRecord, len(cm.Data))
+	for key, value := range cm.Data {
+		var record stickyRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			klog.Warningf("ignoring sticky record [%s] [%s]: %v", key, value, err)
+			continue
+		}
+		records[key] = record
+	}
+	return cm, records, nil
+}
+
+// writeStickyRecords replaces the records in the sticky records config map, creating it if cm is nil
+func (k *kubevipLoadBalancerManager) writeStickyRecords(ctx context.Context, cm *v1.ConfigMap, records map[string]stickyRecord) error {
+	data := make(map[string]string, len(records))
+	for key, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data[key] = string(value)
+	}
+
+	configMaps := k.kubeClient.CoreV1().ConfigMaps("kube-system")
+	if cm == nil {
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: KubeVipStickyAddresses, Namespace: "kube-system"}, Data: data}
+		_, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	cm.Data = data
+	_, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// recordSticky records the address allocated to the service by its namespace and name
+func (k *kubevipLoadBalancerManager) recordSticky(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, address string) {
+	if !stickyEnabled(cm) {
+		return
+	}
+	key := snapshotKey(service.Namespace, service.Name)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		stickyCM, records, err := k.readStickyRecords(ctx)
+		if err != nil {
+			return err
+		}
+		if record, ok := records[key]; ok && record.Address == address && record.MissingSince == "" {
+			return nil
+		}
+		records[key] = stickyRecord{Address: address}
+		return k.writeStickyRecords(ctx, stickyCM, records)
+	})
+	if err != nil {
+		klog.Warningf("unable to record sticky address [%s] of service [%s]: %v", address, service.Name, err)
+	}
+}
+
+// preferSticky returns the recorded address of the service name instead of the discovered address, if the recorded
+// address is free and in the same pool
+func (k *kubevipLoadBalancerManager) preferSticky(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, discovered *allocation, existingServiceIPS []string) *allocation {
+	if !stickyEnabled(cm) {
+		return discovered
+	}
+	_, records, err := k.readStickyRecords(ctx)
+	if err != nil {
+		klog.Warningf("unable to read sticky records [%s]: %v", KubeVipStickyAddresses, err)
+		return discovered
+	}
+	record, ok := records[snapshotKey(service.Namespace, service.Name)]
+	if !ok {
+		return discovered
+	}
+	recorded := ipam.NormalizeAddress(record.Address)
+	if recorded == discovered.address {
+		return discovered
+	}
+	preferred, ok := k.preferAddress(ctx, cm, service, discovered, existingServiceIPS, recorded)
+	if ok {
+		klog.Infof("re-pinning recorded address [%s] of service [%s/%s]", recorded, service.Namespace, service.Name)
+		preferred.source = SourceReserved
+	}
+	return preferred
+}
+
+// collectSticky removes the records of services that have not existed for the grace period
+func (k *kubevipLoadBalancerManager) collectSticky(ctx context.Context) error {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil || !stickyEnabled(cm) {
+		return nil
+	}
+	grace := stickyGrace(cm)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		stickyCM, records, err := k.readStickyRecords(ctx)
+		if err != nil || stickyCM == nil {
+			return err
+		}
+		svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(svcs.Items))
+		for x := range svcs.Items {
+			exists[snapshotKey(svcs.Items[x].Namespace, svcs.Items[x].Name)] = true
+		}
+
+		changed := false
+		for key, record := range records {
+			missingSince, missingErr := time.Parse(time.RFC3339, record.MissingSince)
+			switch {
+			case exists[key] && record.MissingSince == "":
+				continue
+			case exists[key]:
+				// The service was recreated within the grace period
+				record.MissingSince = ""
+				records[key] = record
+			case missingErr != nil:
+				record.MissingSince = k.clock.Now().UTC().Format(time.RFC3339)
+				records[key] = record
+			case k.clock.Since(missingSince) >= grace:
+				klog.Infof("removing sticky address [%s] of [%s], the service has not existed for [%s]", record.Address, key, grace)
+				delete(records, key)
+			default:
+				continue
+			}
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return k.writeStickyRecords(ctx, stickyCM, records)
+	})
+}
+
+// stickyStartup collects the records of deleted services every interval until stopped
+func (k *kubevipLoadBalancerManager) stickyStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if err := k.collectSticky(context.Background()); err != nil {
+			klog.Warningf("unable to collect sticky records [%s]: %v", KubeVipStickyAddresses, err)
+		}
+	}, StickyGCInterval, stop)
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func Test_stickyRecreate(t *testing.T) {
+	ipam.Manager = nil
+	web := newTestService("dev", "web")
+	api := newTestService("dev", "api")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29", StickyByNameKey: "true"}, web, api)
+
+	sync := func(svc *v1.Service) string {
+		t.Helper()
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+		got, err := k.kubeClient.CoreV1().Services(svc.Namespace).Get(context.TODO(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Labels["ipam-address"]
+	}
+	if got := sync(web); got != "192.168.0.1" {
+		t.Fatalf("web address = %v, want 192.168.0.1", got)
+	}
+	if got := sync(api); got != "192.168.0.2" {
+		t.Fatalf("api address = %v, want 192.168.0.2", got)
+	}
+
+	// Both are deleted, api is recreated first with a new UID and keeps its address rather than taking the first
+	for _, name := range []string{"web", "api"} {
+		if err := k.kubeClient.CoreV1().Services("dev").Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recreated := newTestService("dev", "api")
+	recreated.UID = types.UID("uid-api-recreated")
+	if _, err := k.kubeClient.CoreV1().Services("dev").Create(context.TODO(), recreated, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := sync(recreated); got != "192.168.0.2" {
+		t.Errorf("recreated api address = %v, want 192.168.0.2", got)
+	}
+	got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), "api", metav1.GetOptions{})
+	if got.Annotations[AllocationSourceAnnotation] != SourceReserved {
+		t.Errorf("annotation [%s] = %v, want %v", AllocationSourceAnnotation, got.Annotations[AllocationSourceAnnotation], SourceReserved)
+	}
+}
+
+func Test_stickyDisabled(t *testing.T) {
+	ipam.Manager = nil
+	web := newTestService("dev", "web")
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29"}, web)
+	if _, err := k.syncLoadBalancer(context.TODO(), web); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if _, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), KubeVipStickyAddresses, metav1.GetOptions{}); err == nil {
+		t.Errorf("config map [%s] was written with sticky allocation disabled", KubeVipStickyAddresses)
+	}
+}
+
+func Test_collectSticky(t *testing.T) {
+	web := newTestService("dev", "web")
+	stickyCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipStickyAddresses, Namespace: "kube-system"},
+		Data: map[string]string{
+			"dev.web":  `{"address":"192.168.0.1"}`,
+			"dev.gone": `{"address":"192.168.0.2"}`,
+		},
+	}
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/29", StickyByNameKey: "true", StickyGraceKey: "1h"}, web, stickyCM)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	k.clock = fakeClock
+
+	records := func() map[string]stickyRecord {
+		t.Helper()
+		if err := k.collectSticky(context.TODO()); err != nil {
+			t.Fatalf("collectSticky() error = %v", err)
+		}
+		_, records, err := k.readStickyRecords(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	// The record of a missing service is kept for the grace period
+	got := records()
+	if got["dev.gone"].MissingSince != "2021-01-01T00:00:00Z" {
+		t.Errorf("dev.gone missing since = %v, want 2021-01-01T00:00:00Z", got["dev.gone"].MissingSince)
+	}
+	if got["dev.web"].MissingSince != "" {
+		t.Errorf("dev.web missing since = %v, want it unset", got["dev.web"].MissingSince)
+	}
+	fakeClock.Step(59 * time.Minute)
+	if _, ok := records()["dev.gone"]; !ok {
+		t.Errorf("dev.gone was removed within the grace period")
+	}
+
+	fakeClock.Step(time.Minute)
+	got = records()
+	if _, ok := got["dev.gone"]; ok {
+		t.Errorf("dev.gone was kept after the grace period")
+	}
+	if got["dev.web"].Address != "192.168.0.1" {
+		t.Errorf("dev.web = %v, want 192.168.0.1", got["dev.web"])
+	}
+}
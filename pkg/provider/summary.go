@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// SummaryInterval is how often a summary of the allocations is logged, 0 disables the summary
+var SummaryInterval time.Duration
+
+// allocationSummary is the state of the allocations at the time of a summary
+type allocationSummary struct {
+	allocated int
+	// pending are the managed load balancer services without an address, exhausted those of them whose pool is
+	// exhausted
+	pending   int
+	exhausted int
+	pools     []ipam.PoolStats
+}
+
+func (s allocationSummary) String() string {
+	pools := make([]string, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, fmt.Sprintf("%s %d/%d free", pool.Pool, pool.Free, pool.Size))
+	}
+	return fmt.Sprintf("allocation summary: allocated [%d] pending [%d] exhausted [%d] pools [%s]", s.allocated, s.pending, s.exhausted, strings.Join(pools, ", "))
+}
+
+// summarize returns the allocations recorded by the provider, the free capacity of every pool and the services
+// that are waiting for an address
+func (k *kubevipLoadBalancerManager) summarize(ctx context.Context) (allocationSummary, error) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return allocationSummary{}, err
+	}
+	allocations := k.allocations.list()
+	stats, err := poolStats(cm, k.keyPrefix, allocatedAddresses(allocations))
+	if err != nil {
+		return allocationSummary{}, err
+	}
+	summary := allocationSummary{allocated: len(allocations), pools: stats}
+
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return allocationSummary{}, err
+	}
+	for x := range svcs.Items {
+		service := &svcs.Items[x]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer || !k.managed(service) || ignored(service) {
+			continue
+		}
+		if service.Labels["ipam-address"] != "" || service.Spec.LoadBalancerIP != "" {
+			continue
+		}
+		summary.pending++
+		if service.Annotations[IPAMStatusAnnotation] == IPAMStatusPoolExhausted {
+			summary.exhausted++
+		}
+	}
+	return summary, nil
+}
+
+// summaryStartup logs a summary of the allocations every interval until stopped
+func (k *kubevipLoadBalancerManager) summaryStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		summary, err := k.summarize(context.Background())
+		if err != nil {
+			klog.Warningf("unable to summarize the allocations: %v", err)
+			return
+		}
+		klog.Infof("%s", summary)
+	}, SummaryInterval, stop)
+}
@@ -0,0 +1,41 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+)
+
+func Test_summarize(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("dev", "first")
+	second := newTestService("dev", "second")
+	exhausted := newTestService("dev", "exhausted")
+	// Never reconciled, it is still pending
+	waiting := newTestService("prod", "waiting")
+	ignoredSvc := newTestService("prod", "ignored")
+	ignoredSvc.Annotations = map[string]string{IgnoreAnnotation: "true"}
+	clusterIP := newTestService("prod", "cluster-ip")
+	clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+	k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/30", "range-global": "192.168.1.10-192.168.1.12"}, first, second, exhausted, waiting, ignoredSvc, clusterIP)
+
+	for _, svc := range []*v1.Service{first, second} {
+		if _, err := k.syncLoadBalancer(context.TODO(), svc); err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+	}
+	if _, err := k.syncLoadBalancer(context.TODO(), exhausted); err == nil {
+		t.Fatalf("syncLoadBalancer() allocated from an exhausted pool")
+	}
+
+	summary, err := k.summarize(context.TODO())
+	if err != nil {
+		t.Fatalf("summarize() error = %v", err)
+	}
+	want := "allocation summary: allocated [2] pending [2] exhausted [1] pools [cidr-dev 0/2 free, range-global 3/3 free]"
+	if got := summary.String(); got != want {
+		t.Errorf("summarize() = %q, want %q", got, want)
+	}
+}
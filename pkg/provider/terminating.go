@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// TerminatingGracePeriod is how long a service can be terminating (i.e. a finalizer of another controller is
+// never removed) before its address is reclaimed, 0 never reclaims it
+var TerminatingGracePeriod time.Duration
+
+// ReclaimInterval is how often the services terminating for longer than the grace period are looked for
+var ReclaimInterval = time.Minute
+
+const (
+	//ReclaimedAddressAnnotation records the address reclaimed from a service that was terminating for too long
+	ReclaimedAddressAnnotation = "kube-vip.io/reclaimed-address"
+
+	//ReasonAddressReclaimed is the event reason when the address of a service that was terminating for too long is
+	//reclaimed
+	ReasonAddressReclaimed = "AddressReclaimed"
+)
+
+// stuckTerminating returns true if the service has been terminating for longer than the grace period
+func stuckTerminating(service *v1.Service, now time.Time, grace time.Duration) bool {
+	if grace <= 0 || service.DeletionTimestamp == nil {
+		return false
+	}
+	return now.Sub(service.DeletionTimestamp.Time) >= grace
+}
+
+// reclaimStuck reclaims the addresses of the kube-vip services terminating for longer than the grace period, rather
+// than starving the pool, returning the number reclaimed. Ignored services, services owned by another instance and
+// everything while paused are left as they are
+func (k *kubevipLoadBalancerManager) reclaimStuck(ctx context.Context) (reclaimed int, err error) {
+	if k.terminatingGracePeriod <= 0 || k.releasePaused(ctx) {
+		return 0, nil
+	}
+	svcs, err := k.kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: "implementation=kube-vip"})
+	if err != nil {
+		return 0, err
+	}
+	for x := range svcs.Items {
+		service := &svcs.Items[x]
+		if !stuckTerminating(service, k.clock.Now(), k.terminatingGracePeriod) || ignored(service) || k.foreignOwned(service) {
+			continue
+		}
+		// The address is released while no allocation is choosing from the addresses in use
+		unlock := k.allocationLock.lock()
+		ok, err := k.reclaimTerminating(ctx, service)
+		unlock()
+		if err != nil {
+			klog.Warningf("%v", err)
+			continue
+		}
+		if ok {
+			reclaimed++
+		}
+	}
+	return reclaimed, nil
+}
+
+// reclaimStartup reclaims the addresses of services stuck terminating every interval until stopped
+func (k *kubevipLoadBalancerManager) reclaimStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if _, err := k.reclaimStuck(context.Background()); err != nil {
+			klog.Warningf("unable to reclaim the addresses of terminating services: %v", err)
+		}
+	}, ReclaimInterval, stop)
+}
+
+// reclaimTerminating removes the address from a service that has been terminating for longer than the grace period,
+// so that it can be allocated again, returning false if there was nothing to reclaim. The address is kept in use if
+// the service can't be updated
+func (k *kubevipLoadBalancerManager) reclaimTerminating(ctx context.Context, service *v1.Service) (bool, error) {
+	address := service.Labels["ipam-address"]
+	var skipped bool
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		// The service may have been removed, or given back its address, since it was listed
+		if !stuckTerminating(recentService, k.clock.Now(), k.terminatingGracePeriod) || recentService.Labels["ipam-address"] != address ||
+			ignored(recentService) || k.foreignOwned(recentService) {
+			skipped = true
+			return nil
+		}
+		delete(recentService.Labels, "implementation")
+		delete(recentService.Labels, "ipam-address")
+		recentService.Spec.LoadBalancerIP = ""
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		recentService.Annotations[ReclaimedAddressAnnotation] = address
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if errors.IsNotFound(err) || (err == nil && skipped) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to reclaim address [%s] of terminating service [%s/%s]: %w", address, service.Namespace, service.Name, err)
+	}
+
+	age := k.clock.Now().Sub(service.DeletionTimestamp.Time).Round(time.Second)
+	klog.Warningf("reclaimed address [%s] of service [%s/%s], it has been terminating for [%s] (longer than [%s]) and can be allocated again", address, service.Namespace, service.Name, age, k.terminatingGracePeriod)
+	k.recorder.Eventf(service, v1.EventTypeWarning, ReasonAddressReclaimed, "reclaimed address [%s], the service has been terminating for [%s]", address, age)
+	k.allocations.remove(service.UID)
+	k.releaseWarm(address)
+	k.audit.released(ctx, service)
+	k.auditReleased(ctx, service, address)
+	k.quotaReleased(ctx, service.Namespace)
+	if err := k.hooks.released(ctx, service, address); err != nil {
+		klog.Errorf("%v", err)
+	}
+	return true, nil
+}
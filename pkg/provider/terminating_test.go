@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_reclaimTerminating(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		grace       time.Duration
+		terminating time.Duration
+		annotations map[string]string
+		paused      bool
+		wantReclaim bool
+	}{
+		{name: "past the grace period", grace: time.Hour, terminating: 2 * time.Hour, wantReclaim: true},
+		{name: "within the grace period", grace: time.Hour, terminating: 30 * time.Minute},
+		{name: "disabled", terminating: 24 * time.Hour},
+		{name: "ignored", grace: time.Hour, terminating: 2 * time.Hour, annotations: map[string]string{IgnoreAnnotation: "true"}},
+		{name: "owned by another instance", grace: time.Hour, terminating: 2 * time.Hour, annotations: map[string]string{OwnedByAnnotation: "other"}},
+		{name: "paused", grace: time.Hour, terminating: 2 * time.Hour, paused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.Manager = nil
+			stuck := newTestService("dev", "stuck")
+			stuck.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.1"}
+			stuck.Spec.LoadBalancerIP = "192.168.0.1"
+			deleted := metav1.NewTime(now.Add(-tt.terminating))
+			stuck.DeletionTimestamp = &deleted
+			stuck.Finalizers = []string{"example.com/held"}
+			stuck.Annotations = tt.annotations
+			used := newTestService("dev", "used")
+			used.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.2"}
+			svc := newTestService("dev", "new")
+			k := newTestLoadBalancer(map[string]string{"cidr-dev": "192.168.0.0/30"}, stuck, used, svc)
+			k.clock = clock.NewFakeClock(now)
+			k.terminatingGracePeriod = tt.grace
+			k.enforceOwnership = true
+			k.instanceID = "this"
+
+			// The address is reclaimed by the reclaim loop, listing the addresses in use leaves the service alone
+			if _, err := k.existingAddresses(context.TODO()); err != nil {
+				t.Fatalf("existingAddresses() error = %v", err)
+			}
+			if got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), stuck.Name, metav1.GetOptions{}); got.Labels["ipam-address"] != "192.168.0.1" {
+				t.Fatalf("existingAddresses() removed label ipam-address %q", got.Labels["ipam-address"])
+			}
+			k.paused = tt.paused
+			count, err := k.reclaimStuck(context.TODO())
+			if err != nil {
+				t.Fatalf("reclaimStuck() error = %v", err)
+			}
+			if tt.wantReclaim != (count == 1) {
+				t.Errorf("reclaimStuck() = %d, want a reclaim %v", count, tt.wantReclaim)
+			}
+			k.paused = false
+
+			_, err = k.syncLoadBalancer(context.TODO(), svc)
+			got, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), stuck.Name, metav1.GetOptions{})
+			if !tt.wantReclaim {
+				if !errors.Is(err, ipam.ErrNoAddressesAvailable) {
+					t.Errorf("syncLoadBalancer() error = %v, want %v", err, ipam.ErrNoAddressesAvailable)
+				}
+				if got.Labels["ipam-address"] != "192.168.0.1" {
+					t.Errorf("terminating service label ipam-address = %q, want it kept", got.Labels["ipam-address"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncLoadBalancer() error = %v", err)
+			}
+			allocated, _ := k.kubeClient.CoreV1().Services("dev").Get(context.TODO(), svc.Name, metav1.GetOptions{})
+			if allocated.Spec.LoadBalancerIP != "192.168.0.1" {
+				t.Errorf("syncLoadBalancer() allocated %q, want the reclaimed 192.168.0.1", allocated.Spec.LoadBalancerIP)
+			}
+			if got.Labels["ipam-address"] != "" || got.Labels["implementation"] != "" || got.Spec.LoadBalancerIP != "" {
+				t.Errorf("terminating service = %v %q, want its address removed", got.Labels, got.Spec.LoadBalancerIP)
+			}
+			if got.Annotations[ReclaimedAddressAnnotation] != "192.168.0.1" {
+				t.Errorf("annotation [%s] = %q, want 192.168.0.1", ReclaimedAddressAnnotation, got.Annotations[ReclaimedAddressAnnotation])
+			}
+			recorder := k.recorder.(*record.FakeRecorder)
+			var reclaimed bool
+			for len(recorder.Events) > 0 {
+				if strings.Contains(<-recorder.Events, ReasonAddressReclaimed) {
+					reclaimed = true
+				}
+			}
+			if !reclaimed {
+				t.Errorf("got no %s event", ReasonAddressReclaimed)
+			}
+
+			// Once the finalizer is removed the deletion has nothing to release
+			if err := k.deleteLoadBalancer(context.TODO(), got); err != nil {
+				t.Fatalf("deleteLoadBalancer() error = %v", err)
+			}
+			for len(recorder.Events) > 0 {
+				if event := <-recorder.Events; strings.Contains(event, ReasonAddressReleased) {
+					t.Errorf("event = %v, want the reclaimed address not to be released again", event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// TextfilePath is the file the pool usage and allocations are written to for the node-exporter textfile
+// collector, the textfile is disabled if empty
+var TextfilePath string
+
+// TextfileInterval is how often the textfile is written
+var TextfileInterval = time.Minute
+
+// textfileMetric is the name of a metric in the textfile, the same namespace as the served metrics
+func textfileMetric(name string) string {
+	return metricsNamespace + "_" + metricsSubsystem + "_" + name
+}
+
+// writeTextfileMetrics writes the usage of every pool, and the allocations per namespace and source, in the
+// Prometheus text format
+func writeTextfileMetrics(w io.Writer, stats []ipam.PoolStats, counts []sourceCount) error {
+	gauges := []struct {
+		name  string
+		help  string
+		value func(ipam.PoolStats) int
+	}{
+		{"pool_size", "Number of addresses in the pool, by pool", func(s ipam.PoolStats) int { return s.Size }},
+		{"pool_used", "Number of addresses of the pool allocated to services, by pool", func(s ipam.PoolStats) int { return s.Used }},
+		{"pool_free", "Number of addresses of the pool that can be allocated, by pool", func(s ipam.PoolStats) int { return s.Free }},
+	}
+	for _, gauge := range gauges {
+		name := textfileMetric(gauge.name)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, gauge.help, name); err != nil {
+			return err
+		}
+		for _, s := range stats {
+			if _, err := fmt.Fprintf(w, "%s{pool=%q} %d\n", name, s.Pool, gauge.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := textfileMetric("allocated_addresses")
+	if _, err := fmt.Fprintf(w, "# HELP %s Number of services with a load balancer address, by namespace and source (static, dynamic or reserved)\n# TYPE %s gauge\n", name, name); err != nil {
+		return err
+	}
+	for _, c := range counts {
+		if _, err := fmt.Fprintf(w, "%s{namespace=%q,source=%q} %d\n", name, c.namespace, c.source, c.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTextfile writes the textfile to the path, through a temporary file so the collector never reads a partial file
+func (k *kubevipLoadBalancerManager) writeTextfile(ctx context.Context, path string) error {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		return err
+	}
+	stats, err := poolStats(cm, k.keyPrefix, allocatedAddresses(k.allocations.list()))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeTextfileMetrics(tmp, stats, k.allocations.counts()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The collector only reads files that are readable by node-exporter
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// textfileStartup writes the textfile every interval until stopped
+func (k *kubevipLoadBalancerManager) textfileStartup(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if err := k.writeTextfile(context.Background(), TextfilePath); err != nil {
+			klog.Warningf("unable to write textfile [%s]: %v", TextfilePath, err)
+		}
+	}, TextfileInterval, stop)
+}
@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func Test_writeTextfileMetrics(t *testing.T) {
+	stats := []ipam.PoolStats{{Pool: "cidr-global", Definition: "192.168.0.200/29", Size: 6, Used: 2, Free: 4}}
+	counts := []sourceCount{{namespace: "dev", source: SourceDynamic, count: 2}}
+	var b bytes.Buffer
+	if err := writeTextfileMetrics(&b, stats, counts); err != nil {
+		t.Fatalf("writeTextfileMetrics() error = %v", err)
+	}
+	want := `# HELP kube_vip_cloud_provider_pool_size Number of addresses in the pool, by pool
+# TYPE kube_vip_cloud_provider_pool_size gauge
+kube_vip_cloud_provider_pool_size{pool="cidr-global"} 6
+# HELP kube_vip_cloud_provider_pool_used Number of addresses of the pool allocated to services, by pool
+# TYPE kube_vip_cloud_provider_pool_used gauge
+kube_vip_cloud_provider_pool_used{pool="cidr-global"} 2
+# HELP kube_vip_cloud_provider_pool_free Number of addresses of the pool that can be allocated, by pool
+# TYPE kube_vip_cloud_provider_pool_free gauge
+kube_vip_cloud_provider_pool_free{pool="cidr-global"} 4
+# HELP kube_vip_cloud_provider_allocated_addresses Number of services with a load balancer address, by namespace and source (static, dynamic or reserved)
+# TYPE kube_vip_cloud_provider_allocated_addresses gauge
+kube_vip_cloud_provider_allocated_addresses{namespace="dev",source="dynamic"} 2
+`
+	if b.String() != want {
+		t.Errorf("writeTextfileMetrics() = \n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func Test_writeTextfile(t *testing.T) {
+	ipam.Manager = nil
+	first := newTestService("dev", "first")
+	second := newTestService("dev", "second")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, first, second)
+	for _, svc := range []string{"first", "second"} {
+		if _, err := k.syncLoadBalancer(context.TODO(), newTestService("dev", svc)); err != nil {
+			t.Fatalf("syncLoadBalancer() error = %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "kube-vip.prom")
+	if err := k.writeTextfile(context.TODO(), path); err != nil {
+		t.Fatalf("writeTextfile() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`kube_vip_cloud_provider_pool_size{pool="cidr-global"} 6`,
+		`kube_vip_cloud_provider_pool_used{pool="cidr-global"} 2`,
+		`kube_vip_cloud_provider_pool_free{pool="cidr-global"} 4`,
+		`kube_vip_cloud_provider_allocated_addresses{namespace="dev",source="dynamic"} 2`,
+	} {
+		if !bytes.Contains(b, []byte(line+"\n")) {
+			t.Errorf("textfile doesn't contain %q:\n%s", line, b)
+		}
+	}
+	// Only the textfile is left in the directory
+	if entries, _ := ioutil.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("directory has %d files, want only the textfile", len(entries))
+	}
+}
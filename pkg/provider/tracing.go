@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog"
+)
+
+const (
+	//TracesExporterEnv is the environment variable that selects the span exporter, tracing is disabled if unset
+	TracesExporterEnv = "OTEL_TRACES_EXPORTER"
+
+	//TracesExporterNone disables tracing
+	TracesExporterNone = "none"
+
+	//TracesExporterConsole writes every finished span to stdout
+	TracesExporterConsole = "console"
+
+	// tracerName is the instrumentation name of the spans of the reconcile path
+	tracerName = "github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+)
+
+// newTracerProviderFromEnv returns the tracer provider for the exporter in the environment, nil if tracing is
+// disabled. The OTLP exporters need a newer gRPC than the Kubernetes client of this release builds with, so console
+// is the only exporter
+func newTracerProviderFromEnv() *sdktrace.TracerProvider {
+	switch exporter := os.Getenv(TracesExporterEnv); exporter {
+	case "", TracesExporterNone:
+		return nil
+	case TracesExporterConsole:
+		console, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			klog.Warningf("unable to create the [%s] span exporter, tracing is disabled: %v", exporter, err)
+			return nil
+		}
+		// Spans are exported as they end, so a trace isn't lost when the cloud-provider exits
+		return sdktrace.NewTracerProvider(sdktrace.WithSyncer(console))
+	default:
+		klog.Warningf("ignoring [%s] [%s], the only exporter is [%s]", TracesExporterEnv, exporter, TracesExporterConsole)
+		return nil
+	}
+}
+
+// newTracer returns the tracer of the reconcile path, its spans aren't recorded without a provider
+func newTracer(provider *sdktrace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	return provider.Tracer(tracerName)
+}
@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// childSpans returns the exported spans that are children of the span, in the order they were started
+func childSpans(spans tracetest.SpanStubs, parent tracetest.SpanStub) []tracetest.SpanStub {
+	var children []tracetest.SpanStub
+	for _, s := range spans {
+		if s.Parent.SpanID() == parent.SpanContext.SpanID() {
+			children = append(children, s)
+		}
+	}
+	sort.Slice(children, func(x, y int) bool { return children[x].StartTime.Before(children[y].StartTime) })
+	return children
+}
+
+func spanNames(spans []tracetest.SpanStub) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// spanAttributes returns the attributes of the span as strings
+func spanAttributes(s tracetest.SpanStub) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range s.Attributes {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attributes
+}
+
+func Test_tracingHierarchy(t *testing.T) {
+	ipam.Manager = nil
+	svc := newTestService("dev", "lb")
+	k := newTestLoadBalancer(map[string]string{"cidr-global": "192.168.0.200/29"}, svc)
+	exporter := tracetest.NewInMemoryExporter()
+	k.tracer = newTracer(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	if _, err := k.EnsureLoadBalancer(context.TODO(), "cluster", svc, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	spans := exporter.GetSpans()
+	var roots []tracetest.SpanStub
+	for _, s := range spans {
+		if !s.Parent.IsValid() {
+			roots = append(roots, s)
+		}
+	}
+	if len(roots) != 1 {
+		t.Fatalf("exported traces = %d, want 1", len(roots))
+	}
+	root := roots[0]
+	if root.Name != "EnsureLoadBalancer" || !reflect.DeepEqual(root.Attributes, []attribute.KeyValue{attribute.String("service", "dev/lb")}) {
+		t.Errorf("root span = %s %v, want EnsureLoadBalancer service=dev/lb", root.Name, root.Attributes)
+	}
+	children := childSpans(spans, root)
+	if got := spanNames(children); !reflect.DeepEqual(got, []string{"syncLoadBalancer"}) {
+		t.Fatalf("root children = %v, want [syncLoadBalancer]", got)
+	}
+	// Spans are only exported once they have ended
+	sync := childSpans(spans, children[0])
+	want := []string{"GetConfigMap", "existingAddresses", "discoverAddress", "updateService"}
+	if got := spanNames(sync); !reflect.DeepEqual(got, want) {
+		t.Errorf("syncLoadBalancer children = %v, want %v", got, want)
+	}
+	for _, child := range sync {
+		if child.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("span [%s] isn't in the trace of the root span", child.Name)
+		}
+		attributes := spanAttributes(child)
+		if child.Name == "discoverAddress" && (attributes["pool"] != "cidr-global" || attributes["address"] != "192.168.0.201") {
+			t.Errorf("discoverAddress attributes = %v, want pool=cidr-global address=192.168.0.201", attributes)
+		}
+	}
+}
+
+func Test_newTracerProviderFromEnv(t *testing.T) {
+	defer os.Unsetenv(TracesExporterEnv)
+	tests := []struct {
+		exporter string
+		want     bool
+	}{
+		{exporter: "", want: false},
+		{exporter: TracesExporterNone, want: false},
+		{exporter: TracesExporterConsole, want: true},
+		{exporter: "otlp", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.exporter, func(t *testing.T) {
+			os.Setenv(TracesExporterEnv, tt.exporter)
+			if got := newTracerProviderFromEnv(); (got != nil) != tt.want {
+				t.Errorf("newTracerProviderFromEnv() = %v, want enabled %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// ErrPoolOverlap is returned when the addresses of two pools overlap
+var ErrPoolOverlap = errors.New("pools overlap")
+
+// ErrNotHashable is returned for a pool with the hashed strategy whose cidrs aren't all IPv6 (without a window), it
+// is scanned instead
+var ErrNotHashable = errors.New("the hashed strategy only applies to IPv6 cidrs without a window, the pool is scanned")
+
+// ConfigError - is a problem with a single key of the config map
+type ConfigError struct {
+	// Key is the config map key, i.e. cidr-global
+	Key string
+	// Value is the value of the key
+	Value string
+	// Err is the problem, i.e. ipam.ErrInvalidCidr
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config map key [%s] [%s]: %v", e.Key, e.Value, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateConfig - parses every pool (with the configured KeyPrefix) in the config map, returning a ConfigError for
+// each key with an invalid cidr, range, pool selector or pool policy, a pool larger than the size limit or a hashed pool
+// that is scanned, and for each pair of keys whose addresses overlap
+func ValidateConfig(cm *v1.ConfigMap) []error {
+	keys, bounds, errs := poolBounds(cm, KeyPrefix)
+	_, _, selectorErrs := poolSelectors(cm, KeyPrefix)
+	errs = append(errs, selectorErrs...)
+	errs = append(errs, poolPolicyErrors(cm, KeyPrefix)...)
+
+	// Every address of a pool may be scanned, so pools larger than the limit are refused. A hashed pool isn't scanned
+	for _, key := range keys {
+		if poolKind(key, KeyPrefix) == "cidr" && hashedPool(cm, KeyPrefix, strings.TrimPrefix(key, KeyPrefix+"cidr-")) {
+			if ipam.Hashable(cm.Data[key]) {
+				continue
+			}
+			errs = append(errs, &ConfigError{Key: key, Value: cm.Data[key], Err: ErrNotHashable})
+		}
+		if b, ok := bounds[key]; ok {
+			if err := ipam.CheckPoolSize(b); err != nil {
+				errs = append(errs, &ConfigError{Key: key, Value: cm.Data[key], Err: err})
+			}
+		}
+	}
+
+	// The cidrs or ranges within a key may overlap, only different keys are compared
+	for x := range keys {
+		for _, other := range keys[x+1:] {
+			if overlap, ok := overlapping(bounds[keys[x]], bounds[other]); ok {
+				errs = append(errs, &ConfigError{Key: keys[x], Value: cm.Data[keys[x]], Err: fmt.Errorf("%w, [%s] is also in [%s]", ErrPoolOverlap, overlap, other)})
+			}
+		}
+	}
+	return errs
+}
+
+// poolBounds returns the sorted pool keys and the bounds of every pool that could be parsed, with an error for
+// each pool that couldn't
+func poolBounds(cm *v1.ConfigMap, keyPrefix string) ([]string, map[string][]ipam.Bounds, []error) {
+	var keys []string
+	for key := range cm.Data {
+		if poolKind(key, keyPrefix) != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	bounds := make(map[string][]ipam.Bounds, len(keys))
+	for _, key := range keys {
+		b, err := allocatorFor(poolKind(key, keyPrefix)).Bounds(cm.Data[key])
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: key, Value: cm.Data[key], Err: err})
+			continue
+		}
+		bounds[key] = b
+	}
+
+	// The pool relative to the service network is compared with the other pools once it is derived
+	if serviceOffsetEnabled(cm) {
+		cidr, err := serviceOffsetCidr(cm, ServiceCidr)
+		if err == nil {
+			var b []ipam.Bounds
+			if b, err = ipam.CidrBounds(cidr); err == nil {
+				keys = append(keys, ServiceOffsetCidrKey)
+				bounds[ServiceOffsetCidrKey] = b
+			}
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{Key: ServiceOffsetCidrKey, Value: cm.Data[ServiceOffsetCidrKey], Err: err})
+		}
+	}
+	return keys, bounds, errs
+}
+
+// poolContaining returns the key of the first pool that contains the address, ok is false if no pool does
+func poolContaining(keys []string, bounds map[string][]ipam.Bounds, address string) (key string, ok bool) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", false
+	}
+	for _, key := range keys {
+		for _, b := range bounds[key] {
+			if b.Contains(ip) {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// overlapping returns the first bounds of a that overlaps with b
+func overlapping(a, b []ipam.Bounds) (ipam.Bounds, bool) {
+	for x := range a {
+		for y := range b {
+			if a[x].Overlaps(b[y]) {
+				return a[x], true
+			}
+		}
+	}
+	return ipam.Bounds{}, false
+}
+
+// validateStartup logs the problems with the config map before any service is synced
+func (k *kubevipLoadBalancerManager) validateStartup(ctx context.Context) {
+	raw, err := k.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, k.cloudConfigMap, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("unable to validate configmap [%s]: %v", k.cloudConfigMap, err)
+		return
+	}
+	cm, err := expandConfigMap(raw)
+	if err != nil {
+		klog.Warningf("unable to validate configmap [%s]: %v", k.cloudConfigMap, err)
+		return
+	}
+	for _, err := range unexpandedErrors(ValidateConfig(cm), raw) {
+		klog.Warningf("%v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		wantKey string
+		wantErr error
+	}{
+		{
+			name: "valid pools",
+			data: map[string]string{
+				"cidr-dev":                 "192.168.0.200/29,192.168.0.200/30",
+				"cidr-staging":             "10.0.0.0/8[10.1.0.10-10.1.0.20]",
+				"range-global":             "192.168.1.10-192.168.1.20",
+				"cidr-v6":                  "fd00::/64",
+				"cidr-strategy-v6":         CidrStrategyHashed,
+				FallbackOrderKey:           "namespace,global",
+				NodeCidrKey:                "true",
+				"cidr-start-offset-dev":    "2",
+				"pool-selector-dev":        "tier in (frontend)",
+				"list-edge":                "192.168.2.10,192.168.2.20",
+				"pool-max-per-service-dev": "2",
+				"pool-allow-blocks-edge":   "false",
+			},
+		},
+		{
+			name: "messy pools",
+			data: map[string]string{
+				"cidr-dev":     " 192.168.0.200/29 ,, 192.168.0.200/29,",
+				"range-global": "192.168.1.10 - 192.168.1.20 , 192.168.1.30-192.168.1.40",
+			},
+		},
+		{
+			name:    "invalid cidr",
+			data:    map[string]string{"cidr-dev": "192.168.0.300/29"},
+			wantKey: "cidr-dev",
+			wantErr: ipam.ErrInvalidCidr,
+		},
+		{
+			name:    "window outside the cidr",
+			data:    map[string]string{"cidr-dev": "192.168.0.0/24[192.168.0.50-192.168.1.10]"},
+			wantKey: "cidr-dev",
+			wantErr: ipam.ErrInvalidCidr,
+		},
+		{
+			name:    "hashed pool that isn't IPv6",
+			data:    map[string]string{"cidr-dev": "192.168.0.0/24", "cidr-strategy-dev": CidrStrategyHashed},
+			wantKey: "cidr-dev",
+			wantErr: ErrNotHashable,
+		},
+		{
+			name:    "invalid range",
+			data:    map[string]string{"range-dev": "192.168.0.10"},
+			wantKey: "range-dev",
+			wantErr: ipam.ErrInvalidRange,
+		},
+		{
+			name:    "invalid range address",
+			data:    map[string]string{"range-dev": "192.168.0.10-192.168.0"},
+			wantKey: "range-dev",
+			wantErr: ipam.ErrInvalidRange,
+		},
+		{
+			name:    "range start after end",
+			data:    map[string]string{"range-dev": "192.168.0.20-192.168.0.10"},
+			wantKey: "range-dev",
+			wantErr: ipam.ErrRangeReversed,
+		},
+		{
+			name:    "invalid list",
+			data:    map[string]string{"list-dev": "192.168.0.10,192.168.0.0/24"},
+			wantKey: "list-dev",
+			wantErr: ipam.ErrInvalidList,
+		},
+		{
+			name:    "list overlapping a range",
+			data:    map[string]string{"list-dev": "192.168.0.15", "range-global": "192.168.0.10-192.168.0.20"},
+			wantKey: "list-dev",
+			wantErr: ErrPoolOverlap,
+		},
+		{
+			name:    "invalid pool selector",
+			data:    map[string]string{PoolSelectorKeyPrefix + "prod": "tier in (", "cidr-prod": "192.168.0.0/24"},
+			wantKey: PoolSelectorKeyPrefix + "prod",
+			wantErr: ErrInvalidSelector,
+		},
+		{
+			name:    "invalid pool max per service",
+			data:    map[string]string{PoolMaxPerServiceKeyPrefix + "dev": "0", "cidr-dev": "192.168.0.0/24"},
+			wantKey: PoolMaxPerServiceKeyPrefix + "dev",
+			wantErr: ErrInvalidPoolPolicy,
+		},
+		{
+			name:    "invalid pool allow blocks",
+			data:    map[string]string{PoolAllowBlocksKeyPrefix + "dev": "sometimes", "cidr-dev": "192.168.0.0/24"},
+			wantKey: PoolAllowBlocksKeyPrefix + "dev",
+			wantErr: ErrInvalidPoolPolicy,
+		},
+		{
+			name:    "pool larger than the limit",
+			data:    map[string]string{"cidr-dev": "10.0.0.0/8"},
+			wantKey: "cidr-dev",
+			wantErr: ipam.ErrPoolTooLarge,
+		},
+		{
+			name: "service offset pool",
+			data: map[string]string{ServiceOffsetCidrKey: "/24@0", "cidr-dev": "192.168.0.0/24"},
+		},
+		{
+			name:    "invalid service offset pool",
+			data:    map[string]string{ServiceOffsetCidrKey: "/24@0.0.100.0"},
+			wantKey: ServiceOffsetCidrKey,
+			wantErr: ipam.ErrInvalidOffsetCidr,
+		},
+		{
+			name:    "service offset pool overlapping a cidr",
+			data:    map[string]string{ServiceOffsetCidrKey: "/24@0", "cidr-dev": "10.112.0.0/28"},
+			wantKey: "cidr-dev",
+			wantErr: ErrPoolOverlap,
+		},
+		{
+			name:    "overlapping keys",
+			data:    map[string]string{"cidr-dev": "192.168.0.0/24", "range-global": "192.168.0.250-192.168.1.10"},
+			wantKey: "cidr-dev",
+			wantErr: ErrPoolOverlap,
+		},
+	}
+	defer func(cidr string) { ServiceCidr = cidr }(ServiceCidr)
+	ServiceCidr = "10.96.0.0/12"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateConfig(&v1.ConfigMap{Data: tt.data})
+			if tt.wantErr == nil {
+				if len(errs) != 0 {
+					t.Errorf("ValidateConfig() = %v, want no errors", errs)
+				}
+				return
+			}
+			if len(errs) != 1 {
+				t.Fatalf("ValidateConfig() = %v, want a single error", errs)
+			}
+			var configErr *ConfigError
+			if !errors.As(errs[0], &configErr) {
+				t.Fatalf("ValidateConfig() error %v isn't a ConfigError", errs[0])
+			}
+			if configErr.Key != tt.wantKey {
+				t.Errorf("ValidateConfig() key = %v, want %v", configErr.Key, tt.wantKey)
+			}
+			if !errors.Is(errs[0], tt.wantErr) {
+				t.Errorf("ValidateConfig() error = %v, want %v", errs[0], tt.wantErr)
+			}
+		})
+	}
+}
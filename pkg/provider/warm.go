@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// WarmPools caches the free addresses of every pool at startup, allocations then take from the cache
+var WarmPools bool
+
+// warmPools tracks the config map that the warm pools were built from, so they are rebuilt when it changes
+type warmPools struct {
+	mu      sync.Mutex
+	warmed  bool
+	version string
+}
+
+// warm rebuilds the warm pools if the config map has changed since they were built, the warm pools are shared by
+// every namespace so the addresses of kube-vip services in all namespaces are in use
+func (k *kubevipLoadBalancerManager) warm(ctx context.Context, cm *v1.ConfigMap) error {
+	if k.warmPools == nil {
+		return nil
+	}
+	k.warmPools.mu.Lock()
+	defer k.warmPools.mu.Unlock()
+	if k.warmPools.warmed && k.warmPools.version == cm.ResourceVersion {
+		return nil
+	}
+
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return err
+	}
+	inUse := ipam.NormalizeAddresses(allocatedAddresses(allocations))
+	if k.api {
+		apiAddresses, err := k.apiAddresses(ctx, v1.NamespaceAll)
+		if err != nil {
+			return err
+		}
+		inUse = append(inUse, apiAddresses...)
+	}
+
+	ipam.ResetWarm()
+	for key, definition := range cm.Data {
+		switch poolKind(key, k.keyPrefix) {
+		case "cidr":
+			// A hashed pool is never scanned, and is too large to warm
+			if hashedPool(cm, k.keyPrefix, strings.TrimPrefix(key, k.keyPrefix+"cidr-")) {
+				continue
+			}
+			err = ipam.WarmCidr(definition, inUse)
+		case "range":
+			err = ipam.WarmRange(definition, inUse)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to warm pool [%s]: %v", key, err)
+		}
+	}
+	klog.V(2).Infof("warmed pools from configmap [%s] version [%s]", cm.Name, cm.ResourceVersion)
+	k.warmPools.warmed = true
+	k.warmPools.version = cm.ResourceVersion
+	return nil
+}
+
+// warmStartup builds the warm pools before any service is synced
+func (k *kubevipLoadBalancerManager) warmStartup(ctx context.Context) {
+	cm, err := k.GetConfigMap(ctx, KubeVipClientConfig, "kube-system")
+	if err != nil {
+		klog.Warningf("unable to warm pools: %v", err)
+		return
+	}
+	if err := k.warm(ctx, cm); err != nil {
+		klog.Warningf("%v", err)
+	}
+}
+
+// releaseWarm returns an address that is no longer used to the warm pools
+func (k *kubevipLoadBalancerManager) releaseWarm(address string) {
+	if k.warmPools != nil && address != "" {
+		ipam.ReleaseWarm(ipam.NormalizeAddress(address))
+	}
+}
@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// WebhookAddress is the address that the validating webhook is served on, it is disabled if empty
+var WebhookAddress string
+
+// WebhookTLSCert and WebhookTLSKey are the certificate that the webhook is served with, the API server requires TLS
+var WebhookTLSCert, WebhookTLSKey string
+
+// admitConfigMap validates an update to the kubevip config map, it is denied if a pool is invalid or an address that
+// is allocated from the current pools would no longer be in any of the proposed pools
+func (k *kubevipLoadBalancerManager) admitConfigMap(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Namespace != "kube-system" || req.Name != k.cloudConfigMap || req.Operation == admissionv1.Delete {
+		return response
+	}
+	deny := func(message string) *admissionv1.AdmissionResponse {
+		klog.Warningf("denying change to configmap [%s]: %s", req.Name, message)
+		response.Allowed = false
+		response.Result = &metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonInvalid, Message: message}
+		return response
+	}
+
+	var proposed, current v1.ConfigMap
+	if err := json.Unmarshal(req.Object.Raw, &proposed); err != nil {
+		return deny(fmt.Sprintf("unable to decode configmap: %v", err))
+	}
+	if len(req.OldObject.Raw) != 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, &current); err != nil {
+			return deny(fmt.Sprintf("unable to decode configmap: %v", err))
+		}
+	}
+
+	// Variables are expanded from the environment of the provider, as they are when the config map is read, the
+	// problems are reported with the values as written
+	raw := proposed
+	expandedProposed, err := expandConfigMap(&proposed)
+	if err != nil {
+		return deny(err.Error())
+	}
+	proposed = *expandedProposed
+	if expandedCurrent, err := expandConfigMap(&current); err == nil {
+		current = *expandedCurrent
+	}
+
+	// Overlapping pools are allowed, the provider never allocates the same address twice, and a hashed pool that isn't
+	// hashable is still scanned
+	var invalid []string
+	for _, err := range unexpandedErrors(ValidateConfig(&proposed), &raw) {
+		if errors.Is(err, ErrPoolOverlap) || errors.Is(err, ErrNotHashable) {
+			response.Warnings = append(response.Warnings, err.Error())
+			continue
+		}
+		invalid = append(invalid, err.Error())
+	}
+	if len(invalid) != 0 {
+		return deny(strings.Join(invalid, ", "))
+	}
+
+	// Only addresses from the current pools are checked, i.e. an address from the node network was never in a pool
+	allocations, err := listAllocations(ctx, k.kubeClient)
+	if err != nil {
+		return deny(fmt.Sprintf("unable to list the allocated addresses: %v", err))
+	}
+	inUse := allocatedAddresses(allocations)
+	if k.api {
+		apiAddresses, err := k.apiAddresses(ctx, v1.NamespaceAll)
+		if err != nil {
+			return deny(fmt.Sprintf("unable to list the allocation API addresses: %v", err))
+		}
+		inUse = append(inUse, apiAddresses...)
+	}
+	currentKeys, currentBounds, _ := poolBounds(&current, k.keyPrefix)
+	proposedKeys, proposedBounds, _ := poolBounds(&proposed, k.keyPrefix)
+	var orphaned []string
+	for _, address := range inUse {
+		key, ok := poolContaining(currentKeys, currentBounds, address)
+		if !ok {
+			continue
+		}
+		if _, ok := poolContaining(proposedKeys, proposedBounds, address); !ok {
+			orphaned = append(orphaned, fmt.Sprintf("%s (from [%s])", address, key))
+		}
+	}
+	if len(orphaned) != 0 {
+		return deny(fmt.Sprintf("allocated addresses would no longer be in a pool: %s", strings.Join(orphaned, ", ")))
+	}
+	return response
+}
+
+// webhookHandler serves the AdmissionReview requests of the validating webhook
+func (k *kubevipLoadBalancerManager) webhookHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var review admissionv1.AdmissionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+			http.Error(w, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+		review.Response = k.admitConfigMap(r.Context(), review.Request)
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			klog.Errorf("unable to write admission review: %v", err)
+		}
+	})
+	return mux
+}
+
+// serveWebhook serves the validating webhook until stopped
+func (k *kubevipLoadBalancerManager) serveWebhook(stop <-chan struct{}) {
+	if WebhookTLSCert == "" || WebhookTLSKey == "" {
+		klog.Errorf("not serving the webhook on [%s], --webhook-tls-cert and --webhook-tls-key are required", WebhookAddress)
+		return
+	}
+	server := &http.Server{
+		Addr:              WebhookAddress,
+		Handler:           k.webhookHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	klog.Infof("serving validating webhook on [%s]", WebhookAddress)
+	if err := server.ListenAndServeTLS(WebhookTLSCert, WebhookTLSKey); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("validating webhook failed: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func admissionReview(t *testing.T, name string, current, proposed map[string]string) []byte {
+	raw := func(data map[string]string) runtime.RawExtension {
+		if data == nil {
+			return runtime.RawExtension{}
+		}
+		b, err := json.Marshal(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kube-system"}, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: b}
+	}
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "review",
+			Name:      name,
+			Namespace: "kube-system",
+			Operation: admissionv1.Update,
+			Object:    raw(proposed),
+			OldObject: raw(current),
+		},
+	}
+	b, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_webhookHandler(t *testing.T) {
+	allocated := newTestService("dev", "allocated")
+	allocated.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "192.168.0.205"}
+	// An address from the node network was never in a pool
+	node := newTestService("dev", "node")
+	node.Labels = map[string]string{"implementation": "kube-vip", "ipam-address": "10.0.0.10"}
+	current := map[string]string{"cidr-dev": "192.168.0.200/29"}
+	k := newTestLoadBalancer(current, allocated, node)
+	handler := k.webhookHandler()
+	os.Setenv("KUBEVIP_TEST_CIDR", "192.168.0.200/28")
+	os.Setenv("KUBEVIP_TEST_RANGE", "192.168.1.20-192.168.1.10")
+	defer os.Unsetenv("KUBEVIP_TEST_CIDR")
+	defer os.Unsetenv("KUBEVIP_TEST_RANGE")
+
+	tests := []struct {
+		name        string
+		configMap   string
+		proposed    map[string]string
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "pool grown",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "192.168.0.200/28"},
+			wantAllowed: true,
+		},
+		{
+			name:        "address moved to another pool",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"range-global": "192.168.0.204-192.168.0.206"},
+			wantAllowed: true,
+		},
+		{
+			name:        "pool shrunk",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "192.168.0.200/30"},
+			wantMessage: "192.168.0.205 (from [cidr-dev])",
+		},
+		{
+			name:        "pool removed",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-global": "192.168.1.0/24"},
+			wantMessage: "192.168.0.205 (from [cidr-dev])",
+		},
+		{
+			name:        "invalid pool",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "192.168.0.200/29", "range-global": "192.168.1.20-192.168.1.10"},
+			wantMessage: "range-global",
+		},
+		{
+			name:        "pool from a variable",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "${KUBEVIP_TEST_CIDR}"},
+			wantAllowed: true,
+		},
+		{
+			name:        "undefined variable",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "${KUBEVIP_TEST_UNDEFINED}"},
+			wantMessage: "KUBEVIP_TEST_UNDEFINED",
+		},
+		{
+			name:        "invalid pool from a variable",
+			configMap:   KubeVipCloudConfig,
+			proposed:    map[string]string{"cidr-dev": "192.168.0.200/29", "range-global": "${KUBEVIP_TEST_RANGE}"},
+			wantMessage: "config map key [range-global] [${KUBEVIP_TEST_RANGE}]",
+		},
+		{
+			name:        "other configmap",
+			configMap:   "other",
+			proposed:    map[string]string{"cidr-dev": "not a cidr"},
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(admissionReview(t, tt.configMap, current, tt.proposed)))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("webhook status = %d, body %s", rec.Code, rec.Body.String())
+			}
+			var review admissionv1.AdmissionReview
+			if err := json.NewDecoder(rec.Body).Decode(&review); err != nil {
+				t.Fatal(err)
+			}
+			if review.Response == nil || review.Response.UID != "review" {
+				t.Fatalf("webhook response = %+v, want the request UID", review.Response)
+			}
+			if review.Response.Allowed != tt.wantAllowed {
+				t.Errorf("webhook allowed = %v, want %v (%+v)", review.Response.Allowed, tt.wantAllowed, review.Response.Result)
+			}
+			if tt.wantMessage != "" && (review.Response.Result == nil || !strings.Contains(review.Response.Result.Message, tt.wantMessage)) {
+				t.Errorf("webhook result = %+v, want a message containing %q", review.Response.Result, tt.wantMessage)
+			}
+		})
+	}
+}